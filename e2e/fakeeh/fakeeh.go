@@ -0,0 +1,384 @@
+// Package fakeeh is an in-process stand-in for e-hentai.org used by tests.
+//
+// It serves the three upstream surfaces the server and node talk to:
+//
+//   - /api.php      gdata metadata lookups (server pricing, node metadata)
+//   - /archiver.php archive cost page and archive generation (node)
+//   - /             homepage with gallery links (node status gallery)
+//
+// Galleries, account funds and injected failures are configured through
+// the Server methods; everything is safe for concurrent use.
+package fakeeh
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ArchiveMode selects what archiver.php does for a gallery.
+type ArchiveMode int
+
+const (
+	ArchiveOK          ArchiveMode = iota // cost page + download link
+	ArchiveUnavailable                    // error page, no cost info
+)
+
+// Gallery is a fake gallery.
+type Gallery struct {
+	GID      int
+	Token    string
+	Title    string
+	Posted   time.Time
+	Filesize int64 // bytes
+	CostGP   int   // archive cost; 0 renders "Free!"
+	Archive  ArchiveMode
+}
+
+// Stats counts requests per endpoint.
+type Stats struct {
+	APICalls      int // api.php requests (including injected failures)
+	APIGalleries  int // gids requested through api.php
+	ArchivePages  int // archiver.php GETs (counted on arrival, even if blocked)
+	ArchiveGrants int // archives successfully generated
+}
+
+// Server is a running fake. Close it when done.
+type Server struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	galleries   map[int]*Gallery
+	gp          int
+	credits     int
+	apiFailures int // remaining api.php calls to fail
+	apiStatus   int // status code used for injected failures
+	gates       map[int]chan struct{}
+	blocked     map[int]int // requests currently waiting on a gate
+	stats       Stats
+}
+
+// New starts a fake with an empty catalogue and no funds.
+func New() *Server {
+	s := &Server{
+		galleries: make(map[int]*Gallery),
+		gates:     make(map[int]chan struct{}),
+		blocked:   make(map[int]int),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api.php", s.handleAPI)
+	mux.HandleFunc("/archiver.php", s.handleArchiver)
+	mux.HandleFunc("/archive/", s.handleDownload)
+	mux.HandleFunc("/", s.handleHome)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// APIURL returns the api.php endpoint.
+func (s *Server) APIURL() string {
+	return s.URL + "/api.php"
+}
+
+// AddGallery adds or replaces a gallery.
+func (s *Server) AddGallery(g Gallery) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.galleries[g.GID] = &g
+}
+
+// SetFunds sets the account balance shown on archiver pages.
+func (s *Server) SetFunds(gp, credits int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gp = gp
+	s.credits = credits
+}
+
+// Funds returns the current account balance.
+func (s *Server) Funds() (gp, credits int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gp, s.credits
+}
+
+// FailAPI makes the next n api.php calls answer with status.
+func (s *Server) FailAPI(n, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiFailures = n
+	s.apiStatus = status
+}
+
+// Block makes archiver.php requests for gid hang until Release (or Close)
+// is called, simulating a node stuck mid-task.
+func (s *Server) Block(gid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.gates[gid]; !ok {
+		s.gates[gid] = make(chan struct{})
+	}
+}
+
+// Release unblocks archiver.php requests for gid.
+func (s *Server) Release(gid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if gate, ok := s.gates[gid]; ok {
+		close(gate)
+		delete(s.gates, gid)
+	}
+}
+
+// Blocked returns how many archiver.php requests for gid are waiting.
+func (s *Server) Blocked(gid int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.blocked[gid]
+}
+
+// Close releases blocked requests and shuts the server down.
+func (s *Server) Close() {
+	s.mu.Lock()
+	for gid, gate := range s.gates {
+		close(gate)
+		delete(s.gates, gid)
+	}
+	s.mu.Unlock()
+	s.Server.Close()
+}
+
+// Stats returns a snapshot of the request counters.
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// ─────────────────────────────────────────────
+// api.php
+// ─────────────────────────────────────────────
+
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.stats.APICalls++
+	if s.apiFailures > 0 {
+		s.apiFailures--
+		status := s.apiStatus
+		s.mu.Unlock()
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	s.mu.Unlock()
+
+	var req struct {
+		Method  string  `json:"method"`
+		Gidlist [][]any `json:"gidlist"`
+	}
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil || req.Method != "gdata" {
+		writeJSON(w, map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.APIGalleries += len(req.Gidlist)
+
+	out := make([]map[string]any, 0, len(req.Gidlist))
+	for _, pair := range req.Gidlist {
+		if len(pair) != 2 {
+			continue
+		}
+		gid := toInt(pair[0])
+		token, _ := pair[1].(string)
+
+		g, ok := s.galleries[gid]
+		if !ok || g.Token != token {
+			out = append(out, map[string]any{"gid": gid, "error": "Key missing, or incorrect key provided."})
+			continue
+		}
+		out = append(out, map[string]any{
+			"gid":      g.GID,
+			"token":    g.Token,
+			"title":    g.Title,
+			"posted":   strconv.FormatInt(g.Posted.Unix(), 10),
+			"filesize": g.Filesize,
+		})
+	}
+	writeJSON(w, map[string]any{"gmetadata": out})
+}
+
+// ─────────────────────────────────────────────
+// archiver.php
+// ─────────────────────────────────────────────
+
+func (s *Server) handleArchiver(w http.ResponseWriter, r *http.Request) {
+	gid, _ := strconv.Atoi(r.URL.Query().Get("gid"))
+	token := r.URL.Query().Get("token")
+
+	s.mu.Lock()
+	if r.Method == http.MethodGet {
+		s.stats.ArchivePages++
+	}
+	gate := s.gates[gid]
+	if gate != nil {
+		s.blocked[gid]++
+	}
+	s.mu.Unlock()
+	if gate != nil {
+		select {
+		case <-gate:
+		case <-r.Context().Done():
+		}
+		s.mu.Lock()
+		s.blocked[gid]--
+		s.mu.Unlock()
+		if r.Context().Err() != nil {
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g, ok := s.galleries[gid]
+	if !ok || g.Token != token {
+		writeHTML(w, "<p>Invalid archiver key.</p>")
+		return
+	}
+	if g.Archive == ArchiveUnavailable {
+		writeHTML(w, "<p>This gallery is currently unavailable.</p>")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		writeHTML(w, s.costPage(g))
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.PostForm.Get("invalidate_sessions") != "" {
+		writeHTML(w, "<p>Sessions invalidated.</p>")
+		return
+	}
+	if r.PostForm.Get("dltype") == "" {
+		writeHTML(w, s.costPage(g))
+		return
+	}
+
+	if !s.chargeLocked(g.CostGP) {
+		writeHTML(w, "<p>Insufficient funds.</p>")
+		return
+	}
+	s.stats.ArchiveGrants++
+	link := fmt.Sprintf("%s/archive/%d/%s/org?autostart=1", s.URL, g.GID, g.Token)
+	writeHTML(w, fmt.Sprintf(`<script type="text/javascript">document.location = "%s";</script>`, link))
+}
+
+// costPage mirrors the parts of the real page the node scrapes: the first
+// <strong> is the cost, "Estimated Size" follows, and funds are on one line.
+func (s *Server) costPage(g *Gallery) string {
+	cost := "Free!"
+	if g.CostGP > 0 {
+		cost = fmt.Sprintf("%s GP", commas(g.CostGP))
+	}
+	return fmt.Sprintf(`<div id="db">
+<p>Download Cost: &nbsp; <strong>%s</strong></p>
+<p>Estimated Size: &nbsp; <strong>%.2f MiB</strong></p>
+<form method="post"><input type="hidden" name="dltype" value="org" /><input type="submit" name="dlcheck" value="Download Original Archive" /></form>
+<p>%s GP &nbsp; [?] &nbsp; %s Credits</p>
+</div>`, cost, float64(g.Filesize)/(1<<20), commas(s.gp), commas(s.credits))
+}
+
+// chargeLocked pays cost from GP first, then credits. Must hold s.mu.
+func (s *Server) chargeLocked(cost int) bool {
+	if cost == 0 {
+		return true
+	}
+	if s.gp >= cost {
+		s.gp -= cost
+		return true
+	}
+	// Credits convert at the node's CreditsToGPRatio (3.4 GP per credit).
+	need := cost - s.gp
+	creditsNeeded := (need*10 + 33) / 34
+	if creditsNeeded > s.credits {
+		return false
+	}
+	s.gp = 0
+	s.credits -= creditsNeeded
+	return true
+}
+
+func (s *Server) handleDownload(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/zip")
+	_, _ = w.Write([]byte("PK\x05\x06" + string(make([]byte, 18))))
+}
+
+// ─────────────────────────────────────────────
+// Homepage
+// ─────────────────────────────────────────────
+
+func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	gids := make([]int, 0, len(s.galleries))
+	for gid := range s.galleries {
+		gids = append(gids, gid)
+	}
+	slices.Sort(gids)
+	body := "<html><body><table class=\"itg\">\n"
+	for _, gid := range gids {
+		g := s.galleries[gid]
+		body += fmt.Sprintf("<tr><td><a href=\"%s/g/%d/%s/\">%s</a></td></tr>\n", s.URL, g.GID, g.Token, g.Title)
+	}
+	body += "</table></body></html>"
+	s.mu.Unlock()
+
+	writeHTML(w, body)
+}
+
+// ─────────────────────────────────────────────
+// Helpers
+// ─────────────────────────────────────────────
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeHTML(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	_, _ = w.Write([]byte(body))
+}
+
+func toInt(v any) int {
+	switch n := v.(type) {
+	case float64:
+		return int(n)
+	case string:
+		i, _ := strconv.Atoi(n)
+		return i
+	}
+	return 0
+}
+
+// commas formats 12345 as "12,345".
+func commas(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
@@ -0,0 +1,132 @@
+package e2e
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/e2e/fakeeh"
+	"github.com/Archive-At-Home/archive-at-home/node/nodetest"
+	"github.com/Archive-At-Home/archive-at-home/server/servertest"
+)
+
+// Fixture galleries. The status gallery has the lowest gid so nodes pick
+// it from the homepage for their free-quota/balance checks.
+const (
+	gidStatus      = 100
+	gidPaid        = 1001 // old, 10 MB: estimate 603 GP, actual 500 GP
+	gidFree        = 1002 // new, 5 MB: free tier, estimate 101 GP, actual 0
+	gidUnavailable = 1003 // archiver error page
+
+	paidEstimate = 603
+	paidActual   = 500
+	freeEstimate = 101
+)
+
+var galleries = map[int]fakeeh.Gallery{
+	gidStatus:      {GID: gidStatus, Token: "0000000000", Title: "status", Posted: time.Now(), Filesize: 1 << 20},
+	gidPaid:        {GID: gidPaid, Token: "aaaaaaaaaa", Title: "paid", Posted: time.Now().AddDate(-3, 0, 0), Filesize: 10_000_000, CostGP: paidActual},
+	gidFree:        {GID: gidFree, Token: "bbbbbbbbbb", Title: "free", Posted: time.Now().Add(-time.Hour), Filesize: 5_000_000},
+	gidUnavailable: {GID: gidUnavailable, Token: "cccccccccc", Title: "broken", Posted: time.Now(), Filesize: 1 << 20, Archive: fakeeh.ArchiveUnavailable},
+}
+
+// env is one isolated deployment: fake upstream, server and nodes.
+type env struct {
+	t     *testing.T
+	fake  *fakeeh.Server
+	srv   *servertest.Server
+	nodes int
+}
+
+// newEnv boots a fake upstream and a server. Extra config overrides the
+// test defaults; call startNode to attach workers.
+func newEnv(t *testing.T, extra map[string]string) *env {
+	t.Helper()
+
+	fake := fakeeh.New()
+	t.Cleanup(fake.Close)
+	for _, g := range galleries {
+		fake.AddGallery(g)
+	}
+	fake.SetFunds(100_000, 0)
+
+	return &env{
+		t:    t,
+		fake: fake,
+		srv:  servertest.Start(t, servertest.Options{Env: serverEnv(fake, extra)}),
+	}
+}
+
+// startReplica boots a second server instance sharing Redis and the
+// database with e.srv. Nodes stay attached to e.srv.
+func (e *env) startReplica(extra map[string]string) *servertest.Server {
+	e.t.Helper()
+	return servertest.Start(e.t, servertest.Options{Env: serverEnv(e.fake, extra), Join: e.srv})
+}
+
+func serverEnv(fake *fakeeh.Server, extra map[string]string) map[string]string {
+	cfg := map[string]string{"EH_API_URL": fake.APIURL()}
+	for k, v := range extra {
+		cfg[k] = v
+	}
+	return cfg
+}
+
+// startNode connects a new worker node and waits until the hub sees it.
+func (e *env) startNode() *nodetest.Node {
+	e.t.Helper()
+	e.nodes++
+	id := fmt.Sprintf("node-%d", e.nodes)
+	before := e.srv.NodeCount()
+	n := nodetest.Start(e.t, nodetest.Options{
+		NodeID:    id,
+		Signature: e.srv.SignNode(id),
+		ServerURL: e.srv.WSURL,
+		EHBaseURL: e.fake.URL,
+	})
+	e.srv.WaitForNodes(e.t, before+1)
+	return n
+}
+
+func (e *env) parse(u *servertest.User, gid int) *servertest.ParseResult {
+	e.t.Helper()
+	g := galleries[gid]
+	return e.srv.Parse(e.t, u, fmt.Sprint(g.GID), g.Token)
+}
+
+// parseAsync runs parse in the background; receive from the channel to
+// get the result.
+func (e *env) parseAsync(u *servertest.User, gid int) <-chan *servertest.ParseResult {
+	ch := make(chan *servertest.ParseResult, 1)
+	go func() { ch <- e.parse(u, gid) }()
+	return ch
+}
+
+// assertBalance waits for the settlement worker to bring the user's
+// account to the wanted state.
+func (e *env) assertBalance(u *servertest.User, wantBalance, wantFrozen int64) {
+	e.t.Helper()
+	var balance, frozen int64
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		balance, frozen = e.srv.Balance(e.t, u.ID)
+		if balance == wantBalance && frozen == wantFrozen {
+			return
+		}
+		if time.Now().After(deadline) {
+			e.t.Fatalf("balance = %d (frozen %d), want %d (frozen %d)", balance, frozen, wantBalance, wantFrozen)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func await(t *testing.T, ch <-chan *servertest.ParseResult) *servertest.ParseResult {
+	t.Helper()
+	select {
+	case res := <-ch:
+		return res
+	case <-time.After(15 * time.Second):
+		t.Fatal("parse did not return")
+		return nil
+	}
+}
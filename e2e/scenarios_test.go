@@ -0,0 +1,1363 @@
+package e2e
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/e2e/fakeeh"
+	"github.com/Archive-At-Home/archive-at-home/server/servertest"
+)
+
+func TestCacheHit(t *testing.T) {
+	e := newEnv(t, nil)
+	e.startNode()
+	u := e.srv.CreateUser(t, 10_000)
+
+	first := e.parse(u, gidPaid)
+	if first.Error != "" || first.Cached || first.ArchiveURL == "" {
+		t.Fatalf("first parse = %+v, want fresh archive", first)
+	}
+	if first.GPCost != paidEstimate {
+		t.Fatalf("gp_cost = %d, want %d", first.GPCost, paidEstimate)
+	}
+	e.assertBalance(u, 10_000-paidEstimate, 0)
+
+	second := e.parse(u, gidPaid)
+	if !second.Cached || second.ArchiveURL != first.ArchiveURL {
+		t.Fatalf("second parse = %+v, want cached %s", second, first.ArchiveURL)
+	}
+	if grants := e.fake.Stats().ArchiveGrants; grants != 1 {
+		t.Fatalf("archive grants = %d, want 1", grants)
+	}
+	e.assertBalance(u, 10_000-paidEstimate, 0)
+}
+
+func TestCollapse(t *testing.T) {
+	e := newEnv(t, nil)
+	e.startNode()
+	u := e.srv.CreateUser(t, 10_000)
+
+	e.fake.Block(gidPaid)
+	first := e.parseAsync(u, gidPaid)
+	servertest.Eventually(t, 5*time.Second, func() bool { return e.fake.Blocked(gidPaid) == 1 },
+		"node to start working on the gallery")
+
+	second := e.parseAsync(u, gidPaid)
+	// The second request must collapse into the first before the node
+	// finishes: it only starts waiting once PublishTask returned.
+	servertest.Eventually(t, 5*time.Second, func() bool { return e.srv.Waiting() == 2 },
+		"second request to collapse into the first")
+	e.fake.Release(gidPaid)
+
+	a, b := await(t, first), await(t, second)
+	if a.Error != "" || b.Error != "" {
+		t.Fatalf("parse errors: %q, %q", a.Error, b.Error)
+	}
+	if a.ArchiveURL != b.ArchiveURL {
+		t.Fatalf("archive URLs differ: %s vs %s", a.ArchiveURL, b.ArchiveURL)
+	}
+	if a.GPCost+b.GPCost != paidEstimate {
+		t.Fatalf("gp_cost = %d + %d, want exactly one charge of %d", a.GPCost, b.GPCost, paidEstimate)
+	}
+	if grants := e.fake.Stats().ArchiveGrants; grants != 1 {
+		t.Fatalf("archive grants = %d, want 1", grants)
+	}
+	e.assertBalance(u, 10_000-paidEstimate, 0)
+}
+
+func TestNodeFailureRefunds(t *testing.T) {
+	e := newEnv(t, nil)
+	e.startNode()
+	u := e.srv.CreateUser(t, 10_000)
+
+	res := e.parse(u, gidUnavailable)
+	if res.Error == "" || res.ArchiveURL != "" {
+		t.Fatalf("parse = %+v, want node failure", res)
+	}
+	e.assertBalance(u, 10_000, 0)
+
+	// The failed task must not linger as a collapse target or cache entry.
+	g := galleries[gidUnavailable]
+	g.Archive = fakeeh.ArchiveOK
+	e.fake.AddGallery(g)
+	res = e.parse(u, gidUnavailable)
+	if res.Error != "" || res.Cached {
+		t.Fatalf("retry = %+v, want fresh success", res)
+	}
+}
+
+func TestLeaseReclaim(t *testing.T) {
+	e := newEnv(t, map[string]string{"TASK_LEASE_TTL": "60s"})
+	crashing := e.startNode()
+	u := e.srv.CreateUser(t, 10_000)
+
+	e.fake.Block(gidPaid)
+	pending := e.parseAsync(u, gidPaid)
+	servertest.Eventually(t, 5*time.Second, func() bool { return e.fake.Blocked(gidPaid) == 1 },
+		"first node to claim the task")
+
+	// A healthy node joins, then the claiming node dies mid-task.
+	e.startNode()
+	crashing.Kill()
+	servertest.Eventually(t, 5*time.Second, func() bool { return e.srv.NodeCount() == 1 },
+		"crashed node to disconnect")
+
+	// Nothing is reclaimed while the lease is fresh.
+	if got := e.srv.ReclaimExpiredTasks(); len(got) != 0 {
+		t.Fatalf("reclaimed %v before lease ran low", got)
+	}
+
+	e.srv.FastForward(e.srv.LeaseTTL() * 2 / 3)
+	if got := e.srv.ReclaimExpiredTasks(); len(got) != 1 {
+		t.Fatalf("reclaimed %v, want the stuck task", got)
+	}
+	servertest.Eventually(t, 5*time.Second, func() bool { return e.fake.Blocked(gidPaid) == 2 },
+		"healthy node to claim the re-announced task")
+	e.fake.Release(gidPaid)
+
+	res := await(t, pending)
+	if res.Error != "" || res.ArchiveURL == "" {
+		t.Fatalf("parse = %+v, want success after reclaim", res)
+	}
+	e.assertBalance(u, 10_000-paidEstimate, 0)
+}
+
+func TestSettlementAfterTimeout(t *testing.T) {
+	e := newEnv(t, map[string]string{"TASK_WAIT_TIMEOUT": "1s"})
+	e.startNode()
+	u := e.srv.CreateUser(t, 10_000)
+
+	e.fake.Block(gidPaid)
+	res := e.parse(u, gidPaid)
+	if res.Error == "" || res.ArchiveURL != "" {
+		t.Fatalf("parse = %+v, want timeout", res)
+	}
+	// The request gave up but the task is still running: GP stays frozen.
+	e.assertBalance(u, 10_000, paidEstimate)
+
+	// The node finishes later; billing follows the task, not the request.
+	e.fake.Release(gidPaid)
+	e.assertBalance(u, 10_000-paidEstimate, 0)
+
+	res = e.parse(u, gidPaid)
+	if !res.Cached {
+		t.Fatalf("retry = %+v, want cached result of the late task", res)
+	}
+	e.assertBalance(u, 10_000-paidEstimate, 0)
+}
+
+func TestExpiredTaskRefunds(t *testing.T) {
+	e := newEnv(t, map[string]string{"TASK_WAIT_TIMEOUT": "1s"})
+	n := e.startNode()
+	u := e.srv.CreateUser(t, 10_000)
+
+	// The only node dies mid-task and never answers.
+	e.fake.Block(gidPaid)
+	pending := e.parseAsync(u, gidPaid)
+	servertest.Eventually(t, 5*time.Second, func() bool { return e.fake.Blocked(gidPaid) == 1 },
+		"node to claim the task")
+	n.Kill()
+	await(t, pending)
+	e.assertBalance(u, 10_000, paidEstimate)
+
+	// Once the lease has run out the watchdog drops the task and fails it
+	// for settlement: the GP is refunded without admin action.
+	e.srv.FastForward(e.srv.LeaseTTL() + time.Second)
+	if got := e.srv.ReclaimExpiredTasks(); len(got) != 0 {
+		t.Fatalf("reclaimed %v, want the task dropped", got)
+	}
+	e.assertBalance(u, 10_000, 0)
+}
+
+func TestReconcileOrphanedFreeze(t *testing.T) {
+	e := newEnv(t, map[string]string{"TASK_WAIT_TIMEOUT": "1s", "RECONCILE_ORPHAN_AGE": "1ms"})
+	n := e.startNode()
+	u := e.srv.CreateUser(t, 10_000)
+
+	// The only node dies mid-task: no result will ever arrive.
+	e.fake.Block(gidPaid)
+	pending := e.parseAsync(u, gidPaid)
+	servertest.Eventually(t, 5*time.Second, func() bool { return e.fake.Blocked(gidPaid) == 1 },
+		"node to claim the task")
+	n.Kill()
+	await(t, pending)
+	e.assertBalance(u, 10_000, paidEstimate)
+
+	type discrepancy struct {
+		Kind     string `json:"kind"`
+		UserID   string `json:"user_id"`
+		Expected int64  `json:"expected"`
+	}
+	var report struct {
+		OpenFreezes   int           `json:"open_freezes"`
+		Discrepancies []discrepancy `json:"discrepancies"`
+	}
+	if code := e.srv.Do(t, servertest.Admin, http.MethodGet, "/api/v1/admin/reconcile", nil, &report); code != http.StatusOK {
+		t.Fatalf("report status = %d", code)
+	}
+	want := discrepancy{Kind: "orphaned_freeze", UserID: u.ID, Expected: paidEstimate}
+	if report.OpenFreezes != 1 || len(report.Discrepancies) != 1 || report.Discrepancies[0] != want {
+		t.Fatalf("report = %+v, want one orphaned freeze %+v", report, want)
+	}
+
+	var res struct {
+		Released int `json:"released"`
+		Report   struct {
+			Discrepancies []discrepancy `json:"discrepancies"`
+		} `json:"report"`
+	}
+	if code := e.srv.Do(t, servertest.Admin, http.MethodPost, "/api/v1/admin/reconcile", nil, &res); code != http.StatusOK {
+		t.Fatalf("reconcile status = %d", code)
+	}
+	if res.Released != 1 || len(res.Report.Discrepancies) != 0 {
+		t.Fatalf("reconcile = %+v, want one release and a clean report", res)
+	}
+	e.assertBalance(u, 10_000, 0)
+}
+
+func TestInsufficientBalance(t *testing.T) {
+	e := newEnv(t, nil)
+	e.startNode()
+	u := e.srv.CreateUser(t, 100)
+
+	res := e.parse(u, gidPaid)
+	if !strings.Contains(res.Error, "insufficient balance") {
+		t.Fatalf("parse = %+v, want insufficient balance", res)
+	}
+	e.assertBalance(u, 100, 0)
+	if stats := e.fake.Stats(); stats.ArchiveGrants != 0 {
+		t.Fatalf("archive grants = %d, want 0", stats.ArchiveGrants)
+	}
+}
+
+func TestRefundUnusedEstimate(t *testing.T) {
+	e := newEnv(t, map[string]string{"SETTLEMENT_MODE": "actual"})
+	e.startNode()
+	u := e.srv.CreateUser(t, 10_000)
+
+	// Free archive: the whole estimate comes back.
+	res := e.parse(u, gidFree)
+	if res.Error != "" || res.GPCost != 0 {
+		t.Fatalf("free parse = %+v, want gp_cost 0", res)
+	}
+	e.assertBalance(u, 10_000, 0)
+
+	// Paid archive: charged the actual cost, the rest of the estimate refunded.
+	res = e.parse(u, gidPaid)
+	if res.Error != "" || res.GPCost != paidActual {
+		t.Fatalf("paid parse = %+v, want gp_cost %d", res, paidActual)
+	}
+	e.assertBalance(u, 10_000-paidActual, 0)
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	e := newEnv(t, nil)
+	e.startNode()
+	u := e.srv.CreateUser(t, 10_000)
+
+	// A forced parse retried with the same key is charged once.
+	g := galleries[gidPaid]
+	body := map[string]any{"gallery_id": fmt.Sprint(g.GID), "gallery_key": g.Token, "force": true}
+	header := http.Header{"Idempotency-Key": {"parse-1"}}
+	var first, second servertest.ParseResult
+	resp := e.srv.DoHeader(t, u, http.MethodPost, "/api/v1/parse", header, body, &first)
+	if resp.StatusCode != http.StatusOK || first.Error != "" {
+		t.Fatalf("first parse = %d %+v", resp.StatusCode, first)
+	}
+	resp = e.srv.DoHeader(t, u, http.MethodPost, "/api/v1/parse", header, body, &second)
+	if resp.Header.Get("Idempotent-Replayed") != "true" || second != first {
+		t.Fatalf("retry = %+v (replayed %q), want replay of %+v", second, resp.Header.Get("Idempotent-Replayed"), first)
+	}
+	e.assertBalance(u, 10_000-paidEstimate, 0)
+
+	// Same key, different body.
+	body["gallery_id"] = fmt.Sprint(galleries[gidFree].GID)
+	if resp := e.srv.DoHeader(t, u, http.MethodPost, "/api/v1/parse", header, body, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("reused key status = %d, want 422", resp.StatusCode)
+	}
+
+	// Admin credits are applied once per key.
+	credit := map[string]any{"amount": 1000}
+	header = http.Header{"Idempotency-Key": {"credit-1"}}
+	for range 2 {
+		if resp := e.srv.DoHeader(t, servertest.Admin, http.MethodPost, "/api/v1/admin/users/"+u.ID+"/credits", header, credit, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("credit status = %d", resp.StatusCode)
+		}
+	}
+	e.assertBalance(u, 11_000-paidEstimate, 0)
+
+	// A parse that failed (still 200, with an error in the body) is not
+	// stored: retrying with the same key runs again.
+	g = galleries[gidUnavailable]
+	body = map[string]any{"gallery_id": fmt.Sprint(g.GID), "gallery_key": g.Token}
+	header = http.Header{"Idempotency-Key": {"parse-2"}}
+	var failed, retried servertest.ParseResult
+	if resp := e.srv.DoHeader(t, u, http.MethodPost, "/api/v1/parse", header, body, &failed); resp.StatusCode != http.StatusOK || failed.Error == "" {
+		t.Fatalf("failing parse = %d %+v, want node failure", resp.StatusCode, failed)
+	}
+	g.Archive = fakeeh.ArchiveOK
+	e.fake.AddGallery(g)
+	resp = e.srv.DoHeader(t, u, http.MethodPost, "/api/v1/parse", header, body, &retried)
+	if resp.Header.Get("Idempotent-Replayed") != "" || retried.Error != "" {
+		t.Fatalf("retry = %+v (replayed %q), want a fresh success", retried, resp.Header.Get("Idempotent-Replayed"))
+	}
+}
+
+func TestTransactionHistory(t *testing.T) {
+	e := newEnv(t, nil)
+	e.startNode()
+	u := e.srv.CreateUser(t, 10_000)
+
+	if res := e.parse(u, gidPaid); res.Error != "" {
+		t.Fatalf("parse error: %s", res.Error)
+	}
+	e.assertBalance(u, 10_000-paidEstimate, 0)
+
+	type page struct {
+		Transactions []struct {
+			Type   string `json:"type"`
+			Amount int64  `json:"amount"`
+		} `json:"transactions"`
+		NextCursor uint `json:"next_cursor"`
+	}
+
+	// Newest first, two per page.
+	var types []string
+	var p page
+	for cursor := uint(0); ; cursor = p.NextCursor {
+		p = page{}
+		path := fmt.Sprintf("/api/v1/me/transactions?limit=2&cursor=%d", cursor)
+		if code := e.srv.Do(t, u, http.MethodGet, path, nil, &p); code != http.StatusOK {
+			t.Fatalf("GET %s = %d", path, code)
+		}
+		for _, tx := range p.Transactions {
+			types = append(types, tx.Type)
+		}
+		if p.NextCursor == 0 {
+			break
+		}
+	}
+	if got, want := strings.Join(types, ","), "DEDUCT,UNFREEZE,FREEZE,DEPOSIT"; got != want {
+		t.Fatalf("ledger = %s, want %s", got, want)
+	}
+
+	p = page{}
+	e.srv.Do(t, u, http.MethodGet, "/api/v1/me/transactions?type=deduct", nil, &p)
+	if len(p.Transactions) != 1 || p.Transactions[0].Amount != -paidEstimate {
+		t.Fatalf("DEDUCT filter = %+v", p.Transactions)
+	}
+
+	// The admin sees the same ledger; the CSV export has a header row.
+	p = page{}
+	e.srv.Do(t, servertest.Admin, http.MethodGet, "/api/v1/admin/transactions?user_id="+u.ID, nil, &p)
+	if len(p.Transactions) != 4 {
+		t.Fatalf("admin ledger has %d entries, want 4", len(p.Transactions))
+	}
+	// Text a spreadsheet would run as a formula is exported quoted.
+	formula := `=HYPERLINK("https://example.com","refund")`
+	if code := e.srv.Do(t, servertest.Admin, http.MethodPost, "/api/v1/admin/users/"+u.ID+"/credits",
+		map[string]any{"amount": 1, "remark": formula}, nil); code != http.StatusOK {
+		t.Fatalf("credit = %d", code)
+	}
+	req, _ := http.NewRequest(http.MethodGet, e.srv.URL+"/api/v1/me/transactions/export", nil)
+	req.Header.Set("Authorization", "Bearer "+u.APIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil || len(rows) != 6 || rows[0][0] != "id" {
+		t.Fatalf("csv export = %v, %v", rows, err)
+	}
+	var remarks []string
+	for _, row := range rows[1:] {
+		if row[3] == "DEPOSIT" {
+			remarks = append(remarks, row[7])
+		}
+	}
+	if !slices.Contains(remarks, "'"+formula) {
+		t.Fatalf("deposit remarks = %q, want the formula quoted", remarks)
+	}
+}
+
+func TestBalanceDetail(t *testing.T) {
+	e := newEnv(t, nil)
+	e.startNode()
+	u := e.srv.CreateUser(t, 10_000)
+
+	type detail struct {
+		Total     int64 `json:"total"`
+		Frozen    int64 `json:"frozen"`
+		Available int64 `json:"available"`
+		InFlight  []struct {
+			GalleryID string `json:"gallery_id"`
+			Amount    int64  `json:"amount"`
+		} `json:"in_flight"`
+		Lifetime struct {
+			Deposited int64 `json:"deposited"`
+			CheckedIn int64 `json:"checked_in"`
+			Spent     int64 `json:"spent"`
+		} `json:"lifetime"`
+	}
+	get := func() detail {
+		var d detail
+		if code := e.srv.Do(t, u, http.MethodGet, "/api/v1/me/balance", nil, &d); code != http.StatusOK {
+			t.Fatalf("GET /me/balance = %d", code)
+		}
+		return d
+	}
+
+	// While the node is stuck the freeze is listed against its gallery.
+	e.fake.Block(gidPaid)
+	pending := e.parseAsync(u, gidPaid)
+	gid := fmt.Sprint(galleries[gidPaid].GID)
+	servertest.Eventually(t, 5*time.Second, func() bool {
+		d := get()
+		return len(d.InFlight) == 1 && d.InFlight[0].GalleryID == gid
+	}, "in-flight task to show up")
+	if d := get(); d.Total != 10_000 || d.Frozen != paidEstimate || d.Available != 10_000-paidEstimate || d.InFlight[0].Amount != paidEstimate {
+		t.Fatalf("in-flight balance = %+v", d)
+	}
+
+	e.fake.Release(gidPaid)
+	await(t, pending)
+	e.assertBalance(u, 10_000-paidEstimate, 0)
+
+	var checkin struct {
+		Reward int64 `json:"reward"`
+	}
+	e.srv.Do(t, u, http.MethodPost, "/api/v1/me/checkin", nil, &checkin)
+
+	d := get()
+	if len(d.InFlight) != 0 || d.Lifetime.Deposited != 10_000 || d.Lifetime.Spent != paidEstimate || d.Lifetime.CheckedIn != checkin.Reward {
+		t.Fatalf("settled balance = %+v, want checked_in %d", d, checkin.Reward)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	e := newEnv(t, map[string]string{
+		"TRANSFER_MIN_ACCOUNT_AGE": "0s",
+		"TRANSFER_DAILY_COUNT":     "2",
+	})
+	alice := e.srv.CreateUser(t, 10_000)
+	bob := e.srv.CreateUser(t, 0)
+
+	transfer := func(from *servertest.User, to string, amount int64) int {
+		return e.srv.Do(t, from, http.MethodPost, "/api/v1/me/transfer",
+			map[string]any{"to": to, "amount": amount, "memo": "thanks"}, nil)
+	}
+
+	if code := transfer(alice, bob.ID, 3_000); code != http.StatusOK {
+		t.Fatalf("transfer = %d", code)
+	}
+	e.assertBalance(alice, 7_000, 0)
+	e.assertBalance(bob, 3_000, 0)
+
+	// Only available GP can be sent.
+	if code := transfer(bob, alice.ID, 3_001); code != http.StatusPaymentRequired {
+		t.Fatalf("overdraft transfer = %d, want 402", code)
+	}
+	if code := transfer(alice, "nobody@example.com", 1); code != http.StatusNotFound {
+		t.Fatalf("unknown recipient = %d, want 404", code)
+	}
+	if code := transfer(alice, alice.ID, 1); code != http.StatusBadRequest {
+		t.Fatalf("self transfer = %d, want 400", code)
+	}
+
+	// TRANSFER_DAILY_COUNT=2: the third transfer in 24h is refused.
+	if code := transfer(alice, bob.ID, 1_000); code != http.StatusOK {
+		t.Fatalf("second transfer = %d", code)
+	}
+	if code := transfer(alice, bob.ID, 1_000); code != http.StatusTooManyRequests {
+		t.Fatalf("third transfer = %d, want 429", code)
+	}
+	e.assertBalance(alice, 6_000, 0)
+	e.assertBalance(bob, 4_000, 0)
+
+	var p struct {
+		Transactions []struct {
+			Type    string `json:"type"`
+			Amount  int64  `json:"amount"`
+			TraceID string `json:"trace_id"`
+		} `json:"transactions"`
+	}
+	e.srv.Do(t, bob, http.MethodGet, "/api/v1/me/transactions?type=TRANSFER_IN", nil, &p)
+	if len(p.Transactions) != 2 || p.Transactions[0].Amount != 1_000 || !strings.HasPrefix(p.Transactions[0].TraceID, "transfer-") {
+		t.Fatalf("recipient ledger = %+v", p.Transactions)
+	}
+}
+
+func TestVouchers(t *testing.T) {
+	e := newEnv(t, nil)
+	alice := e.srv.CreateUser(t, 0)
+	bob := e.srv.CreateUser(t, 0)
+
+	var batch struct {
+		BatchID string   `json:"batch_id"`
+		Codes   []string `json:"codes"`
+	}
+	code := e.srv.Do(t, servertest.Admin, http.MethodPost, "/api/v1/admin/vouchers",
+		map[string]any{"count": 2, "amount": 500, "max_redemptions": 2}, &batch)
+	if code != http.StatusOK || len(batch.Codes) != 2 {
+		t.Fatalf("mint = %d %+v", code, batch)
+	}
+	redeem := func(u *servertest.User, code string) int {
+		return e.srv.Do(t, u, http.MethodPost, "/api/v1/me/redeem", map[string]any{"code": code}, nil)
+	}
+
+	// Codes are case- and dash-insensitive; one redemption per user.
+	sloppy := strings.ToLower(strings.ReplaceAll(batch.Codes[0], "-", ""))
+	if code := redeem(alice, sloppy); code != http.StatusOK {
+		t.Fatalf("redeem = %d", code)
+	}
+	if code := redeem(alice, batch.Codes[0]); code != http.StatusConflict {
+		t.Fatalf("second redeem by same user = %d, want 409", code)
+	}
+	if code := redeem(bob, batch.Codes[0]); code != http.StatusOK {
+		t.Fatalf("redeem by second user = %d", code)
+	}
+	// max_redemptions=2 reached.
+	carol := e.srv.CreateUser(t, 0)
+	if code := redeem(carol, batch.Codes[0]); code != http.StatusGone {
+		t.Fatalf("redeem of exhausted code = %d, want 410", code)
+	}
+	if code := redeem(carol, "NOPE-NOPE-NOPE-NOPE"); code != http.StatusNotFound {
+		t.Fatalf("redeem of unknown code = %d, want 404", code)
+	}
+	e.assertBalance(alice, 500, 0)
+	e.assertBalance(bob, 500, 0)
+
+	// Revoking the batch disables the unused code.
+	e.srv.Do(t, servertest.Admin, http.MethodPost, "/api/v1/admin/vouchers/revoke", map[string]any{"batch_id": batch.BatchID}, nil)
+	if code := redeem(carol, batch.Codes[1]); code != http.StatusGone {
+		t.Fatalf("redeem of revoked code = %d, want 410", code)
+	}
+
+	var stats struct {
+		Batches []struct {
+			BatchID    string `json:"batch_id"`
+			Redeemed   int    `json:"redeemed"`
+			RedeemedGP int64  `json:"redeemed_gp"`
+			Users      int    `json:"users"`
+			Revoked    int    `json:"revoked"`
+		} `json:"batches"`
+	}
+	e.srv.Do(t, servertest.Admin, http.MethodGet, "/api/v1/admin/vouchers/batches", nil, &stats)
+	if len(stats.Batches) != 1 {
+		t.Fatalf("batches = %+v", stats.Batches)
+	}
+	if b := stats.Batches[0]; b.BatchID != batch.BatchID || b.Redeemed != 2 || b.RedeemedGP != 1_000 || b.Users != 2 || b.Revoked != 2 {
+		t.Fatalf("batch stats = %+v", b)
+	}
+}
+
+func TestNodeOperatorRewards(t *testing.T) {
+	e := newEnv(t, map[string]string{"NODE_REWARD_SHARE": "0.8"})
+	e.startNode()
+	operator := e.srv.CreateUser(t, 0)
+	other := e.srv.CreateUser(t, 0)
+	u := e.srv.CreateUser(t, 10_000)
+
+	claim := func(by *servertest.User, nodeID, sig string) int {
+		return e.srv.Do(t, by, http.MethodPost, "/api/v1/me/nodes", map[string]any{"token": nodeID + ":" + sig}, nil)
+	}
+	if code := claim(operator, "node-1", "bm90LWEtc2lnbmF0dXJl"); code != http.StatusBadRequest {
+		t.Fatalf("claim with bad signature = %d, want 400", code)
+	}
+	if code := claim(operator, "node-1", e.srv.SignNode("node-1")); code != http.StatusOK {
+		t.Fatalf("claim = %d", code)
+	}
+	if code := claim(other, "node-1", e.srv.SignNode("node-1")); code != http.StatusConflict {
+		t.Fatalf("claim of owned node = %d, want 409", code)
+	}
+
+	// Estimate mode charges 603; the operator gets 0.8 of the 500 GP the
+	// node actually spent.
+	if res := e.parse(u, gidPaid); res.Error != "" {
+		t.Fatalf("parse = %+v", res)
+	}
+	e.assertBalance(u, 10_000-paidEstimate, 0)
+	e.assertBalance(operator, paidActual*8/10, 0)
+
+	var nodes struct {
+		Nodes []struct {
+			NodeID   string `json:"node_id"`
+			Tasks    int64  `json:"tasks"`
+			RewardGP int64  `json:"reward_gp"`
+		} `json:"nodes"`
+		TotalGP int64 `json:"total_gp"`
+	}
+	servertest.Eventually(t, 5*time.Second, func() bool {
+		e.srv.Do(t, operator, http.MethodGet, "/api/v1/me/nodes", nil, &nodes)
+		return nodes.TotalGP == paidActual*8/10 && len(nodes.Nodes) == 1 && nodes.Nodes[0].Tasks == 1
+	}, "node earnings = %+v", &nodes)
+	if nodes.Nodes[0].NodeID != "node-1" {
+		t.Fatalf("node earnings = %+v", nodes.Nodes)
+	}
+
+	// Admins can reassign a node; the old operator keeps past earnings.
+	if code := e.srv.Do(t, servertest.Admin, http.MethodPut, "/api/v1/admin/nodes/node-1/owner",
+		map[string]any{"user_id": other.ID}, nil); code != http.StatusOK {
+		t.Fatalf("set owner = %d", code)
+	}
+	if code := e.srv.Do(t, operator, http.MethodDelete, "/api/v1/me/nodes/node-1", nil, nil); code != http.StatusNotFound {
+		t.Fatalf("release of reassigned node = %d, want 404", code)
+	}
+	e.srv.Do(t, operator, http.MethodGet, "/api/v1/me/nodes", nil, &nodes)
+	if nodes.TotalGP != paidActual*8/10 {
+		t.Fatalf("earnings after reassignment = %+v", nodes)
+	}
+}
+
+func TestPlans(t *testing.T) {
+	e := newEnv(t, map[string]string{
+		"PLAN_DISCOUNT":       "supporter=0.5",
+		"PLAN_MONTHLY_PARSES": "supporter=1",
+	})
+	e.startNode()
+	u := e.srv.CreateUser(t, 10_000)
+
+	type planStatus struct {
+		Plan           string  `json:"plan"`
+		Discount       float64 `json:"discount"`
+		ParsesUsed     int     `json:"parses_used"`
+		ParsesIncluded int     `json:"parses_included"`
+	}
+	me := func() planStatus {
+		var p struct {
+			Plan planStatus `json:"plan"`
+		}
+		e.srv.Do(t, u, http.MethodGet, "/api/v1/me", nil, &p)
+		return p.Plan
+	}
+	if p := me(); p.Plan != "free" || p.ParsesIncluded != 0 {
+		t.Fatalf("default plan = %+v", p)
+	}
+
+	if code := e.srv.Do(t, servertest.Admin, http.MethodPut, "/api/v1/admin/users/"+u.ID+"/plan",
+		map[string]any{"plan": "gold"}, nil); code != http.StatusBadRequest {
+		t.Fatalf("unknown plan = %d, want 400", code)
+	}
+	expires := time.Now().Add(30 * 24 * time.Hour)
+	if code := e.srv.Do(t, servertest.Admin, http.MethodPut, "/api/v1/admin/users/"+u.ID+"/plan",
+		map[string]any{"plan": "supporter", "expires_at": expires}, nil); code != http.StatusOK {
+		t.Fatalf("assign plan = %d", code)
+	}
+	if p := me(); p.Plan != "supporter" || p.Discount != 0.5 || p.ParsesIncluded != 1 {
+		t.Fatalf("plan after assign = %+v", p)
+	}
+
+	// A failed included task gives the allowance back.
+	if res := e.parse(u, gidUnavailable); res.Error == "" {
+		t.Fatalf("parse of unavailable gallery = %+v, want error", res)
+	}
+	servertest.Eventually(t, 5*time.Second, func() bool { return me().ParsesUsed == 0 }, "allowance not released")
+
+	// The included parse costs nothing; the next one pays the discounted price.
+	if res := e.parse(u, gidPaid); res.Error != "" || res.GPCost != 0 {
+		t.Fatalf("included parse = %+v, want gp_cost 0", res)
+	}
+	e.assertBalance(u, 10_000, 0)
+	if p := me(); p.ParsesUsed != 1 {
+		t.Fatalf("usage after included parse = %+v", p)
+	}
+	res := e.parse(u, gidFree)
+	if want := (freeEstimate + 1) / 2; res.Error != "" || res.GPCost != want {
+		t.Fatalf("parse over allowance = %+v, want gp_cost %d", res, want)
+	}
+	e.assertBalance(u, 10_000-int64(res.GPCost), 0)
+
+	// Cancelling returns the user to the default plan.
+	e.srv.Do(t, servertest.Admin, http.MethodDelete, "/api/v1/admin/users/"+u.ID+"/plan", nil, nil)
+	if p := me(); p.Plan != "free" {
+		t.Fatalf("plan after cancel = %+v", p)
+	}
+}
+
+func TestCheckinStreaks(t *testing.T) {
+	e := newEnv(t, map[string]string{
+		"CHECKIN_MIN_GP":       "100",
+		"CHECKIN_MAX_GP":       "100",
+		"CHECKIN_TIMEZONE":     "UTC",
+		"CHECKIN_STREAK_BONUS": "2=1.5,7=2",
+	})
+	u := e.srv.CreateUser(t, 0)
+
+	// Yesterday (UTC) the user was on a 6-day streak; today makes 7.
+	yesterday := time.Now().UTC().AddDate(0, 0, -1)
+	e.srv.Exec(t, "INSERT INTO checkins (user_id, day, streak, base, multiplier, reward, created_at) VALUES (?, ?, 6, 100, 1.5, 150, ?)",
+		u.ID, yesterday.Format(time.DateOnly), yesterday)
+
+	type checkinResult struct {
+		Success    bool    `json:"success"`
+		Reward     int64   `json:"reward"`
+		Streak     int     `json:"streak"`
+		Multiplier float64 `json:"multiplier"`
+	}
+	// Parallel requests: exactly one is credited.
+	results := make(chan checkinResult, 5)
+	for range 5 {
+		go func() {
+			var r checkinResult
+			e.srv.Do(t, u, http.MethodPost, "/api/v1/me/checkin", nil, &r)
+			results <- r
+		}()
+	}
+	succeeded := 0
+	for range 5 {
+		if r := <-results; r.Success {
+			succeeded++
+			if r.Streak != 7 || r.Multiplier != 2 || r.Reward != 200 {
+				t.Fatalf("checkin = %+v, want streak 7 x2 = 200", r)
+			}
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%d parallel check-ins succeeded, want 1", succeeded)
+	}
+	e.assertBalance(u, 200, 0)
+
+	var history struct {
+		Today         bool  `json:"checked_in_today"`
+		Streak        int   `json:"streak"`
+		LongestStreak int   `json:"longest_streak"`
+		Days          int   `json:"days"`
+		TotalGP       int64 `json:"total_gp"`
+		Checkins      []struct {
+			Day    string `json:"day"`
+			Streak int    `json:"streak"`
+			Reward int64  `json:"reward"`
+		} `json:"checkins"`
+		NextCursor uint `json:"next_cursor"`
+	}
+	e.srv.Do(t, u, http.MethodGet, "/api/v1/me/checkins?limit=1", nil, &history)
+	if !history.Today || history.Streak != 7 || history.LongestStreak != 7 || history.Days != 2 || history.TotalGP != 350 {
+		t.Fatalf("checkin summary = %+v", history)
+	}
+	if len(history.Checkins) != 1 || history.Checkins[0].Day != time.Now().UTC().Format(time.DateOnly) || history.NextCursor == 0 {
+		t.Fatalf("checkin history page = %+v", history)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	e := newEnv(t, map[string]string{
+		"RATE_LIMIT_RPM":          "3",
+		"RATE_LIMIT_DAILY_PARSES": "1",
+	})
+	e.startNode()
+	u := e.srv.CreateUser(t, 10_000)
+
+	// Requests carry the limit; window arithmetic is covered by the
+	// ratelimit unit tests. Eight requests span at most two one-minute
+	// windows (six allowed), so one of them must be refused.
+	resp := e.srv.DoHeader(t, u, http.MethodGet, "/api/v1/me", nil, nil, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-RateLimit-Limit") != "3" ||
+		resp.Header.Get("X-RateLimit-Remaining") == "" || resp.Header.Get("X-RateLimit-Reset") == "" {
+		t.Fatalf("request within limit = %d %v", resp.StatusCode, resp.Header)
+	}
+	for range 7 {
+		if resp = e.srv.DoHeader(t, u, http.MethodGet, "/api/v1/me", nil, nil, nil); resp.StatusCode != http.StatusOK {
+			break
+		}
+	}
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" ||
+		resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("request over limit = %d %v, want 429 with Retry-After", resp.StatusCode, resp.Header)
+	}
+
+	// An admin override lifts the per-minute limit; the plan's daily cap stays.
+	var limits struct {
+		Limits struct {
+			RequestsPerMinute int `json:"requests_per_minute"`
+			DailyParses       int `json:"daily_parses"`
+		} `json:"limits"`
+	}
+	if code := e.srv.Do(t, servertest.Admin, http.MethodPut, "/api/v1/admin/users/"+u.ID+"/limits",
+		map[string]any{"requests_per_minute": 0}, &limits); code != http.StatusOK {
+		t.Fatalf("set limits = %d", code)
+	}
+	if limits.Limits.RequestsPerMinute != 0 || limits.Limits.DailyParses != 1 {
+		t.Fatalf("limits after override = %+v", limits.Limits)
+	}
+	if res := e.parse(u, gidFree); res.Error != "" {
+		t.Fatalf("first parse = %+v", res)
+	}
+	g := galleries[gidFree]
+	body := map[string]any{"gallery_id": fmt.Sprint(g.GID), "gallery_key": g.Token}
+	resp = e.srv.DoHeader(t, u, http.MethodPost, "/api/v1/parse", nil, body, nil)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("X-RateLimit-Limit") != "1" {
+		t.Fatalf("parse over daily cap = %d %v, want 429", resp.StatusCode, resp.Header)
+	}
+
+	// Clearing the override restores the plan's per-minute limit.
+	e.srv.Do(t, servertest.Admin, http.MethodDelete, "/api/v1/admin/users/"+u.ID+"/limits", nil, &limits)
+	if limits.Limits.RequestsPerMinute != 3 {
+		t.Fatalf("limits after clear = %+v", limits.Limits)
+	}
+}
+
+func TestScopedAPIKeys(t *testing.T) {
+	e := newEnv(t, nil)
+	e.startNode()
+	u := e.srv.CreateUser(t, 10_000)
+
+	type created struct {
+		APIKey string `json:"api_key"`
+		Key    struct {
+			ID     string   `json:"id"`
+			Prefix string   `json:"prefix"`
+			Scopes []string `json:"scopes"`
+		} `json:"key"`
+	}
+	create := func(as *servertest.User, path string, body map[string]any) (*servertest.User, int) {
+		var out created
+		code := e.srv.Do(t, as, http.MethodPost, path, body, &out)
+		return &servertest.User{ID: u.ID, APIKey: out.APIKey}, code
+	}
+
+	// A parse-only key can parse but not read the balance or manage keys.
+	parser, code := create(u, "/api/v1/me/api-keys", map[string]any{"name": "bot", "scopes": []string{"parse"}})
+	if code != http.StatusCreated || parser.APIKey == "" {
+		t.Fatalf("create key = %d", code)
+	}
+	if res := e.parse(parser, gidFree); res.Error != "" {
+		t.Fatalf("parse with scoped key = %+v", res)
+	}
+	for _, path := range []string{"/api/v1/me/balance", "/api/v1/me", "/api/v1/me/api-keys"} {
+		if code := e.srv.Do(t, parser, http.MethodGet, path, nil, nil); code != http.StatusForbidden {
+			t.Fatalf("GET %s with parse key = %d, want 403", path, code)
+		}
+	}
+
+	// Keys cannot grant scopes they lack, and users cannot grant admin ones.
+	manager, _ := create(u, "/api/v1/me/api-keys", map[string]any{"name": "dashboard", "scopes": []string{"account", "read:balance"}})
+	if _, code := create(manager, "/api/v1/me/api-keys", map[string]any{"name": "x", "scopes": []string{"transfer"}}); code != http.StatusForbidden {
+		t.Fatalf("escalating key = %d, want 403", code)
+	}
+	if _, code := create(u, "/api/v1/me/api-keys", map[string]any{"name": "x", "scopes": []string{"admin:read"}}); code != http.StatusForbidden {
+		t.Fatalf("self-granted admin:read = %d, want 403", code)
+	}
+	if _, code := create(u, "/api/v1/me/api-keys", map[string]any{"name": "x", "scopes": []string{"root"}}); code != http.StatusBadRequest {
+		t.Fatalf("unknown scope = %d, want 400", code)
+	}
+
+	var list struct {
+		Keys []struct {
+			ID         string     `json:"id"`
+			Name       string     `json:"name"`
+			LastUsedAt *time.Time `json:"last_used_at"`
+		} `json:"keys"`
+	}
+	e.srv.Do(t, manager, http.MethodGet, "/api/v1/me/api-keys", nil, &list)
+	if len(list.Keys) != 2 || list.Keys[1].Name != "bot" || list.Keys[1].LastUsedAt == nil {
+		t.Fatalf("key list = %+v", list.Keys)
+	}
+
+	// Revoking one key leaves the others working.
+	if code := e.srv.Do(t, u, http.MethodDelete, "/api/v1/me/api-keys/"+list.Keys[1].ID, nil, nil); code != http.StatusOK {
+		t.Fatalf("revoke = %d", code)
+	}
+	if code := e.srv.Do(t, parser, http.MethodGet, "/api/v1/quote?gallery_id=1&gallery_key=x", nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("revoked key = %d, want 401", code)
+	}
+	if code := e.srv.Do(t, manager, http.MethodGet, "/api/v1/me/balance", nil, nil); code != http.StatusOK {
+		t.Fatalf("other key after revoke = %d", code)
+	}
+
+	// admin:read keys, granted by an admin, may read but not write the admin API.
+	auditor, code := create(servertest.Admin, "/api/v1/admin/users/"+u.ID+"/api-keys", map[string]any{"name": "audit", "scopes": []string{"admin:read"}})
+	if code != http.StatusCreated {
+		t.Fatalf("admin create key = %d", code)
+	}
+	if code := e.srv.Do(t, auditor, http.MethodGet, "/api/v1/admin/users/"+u.ID, nil, nil); code != http.StatusOK {
+		t.Fatalf("admin read with admin:read key = %d", code)
+	}
+	if code := e.srv.Do(t, auditor, http.MethodPost, "/api/v1/admin/users/"+u.ID+"/credits", map[string]any{"amount": 1}, nil); code != http.StatusUnauthorized {
+		t.Fatalf("admin write with admin:read key = %d, want 401", code)
+	}
+	if code := e.srv.Do(t, manager, http.MethodGet, "/api/v1/admin/users/"+u.ID, nil, nil); code != http.StatusForbidden {
+		t.Fatalf("admin read without admin:read = %d, want 403", code)
+	}
+}
+
+func TestAccountKeyHashing(t *testing.T) {
+	e := newEnv(t, nil)
+	replica := e.startReplica(nil)
+	u := e.srv.CreateUser(t, 0)
+
+	type profile struct {
+		User map[string]any `json:"user"`
+	}
+	var me profile
+	if code := replica.Do(t, u, http.MethodGet, "/api/v1/me", nil, &me); code != http.StatusOK {
+		t.Fatalf("GET /me = %d", code)
+	}
+	if _, ok := me.User["api_key"]; ok || me.User["api_key_prefix"] != u.APIKey[:11] {
+		t.Fatalf("profile = %v, want prefix only", me.User)
+	}
+	var admin profile
+	e.srv.Do(t, servertest.Admin, http.MethodGet, "/api/v1/admin/users/"+u.ID, nil, &admin)
+	if _, ok := admin.User["api_key"]; ok {
+		t.Fatalf("admin view exposes api_key: %v", admin.User)
+	}
+
+	// Resetting on one instance invalidates the key cached by the other.
+	var reset struct {
+		APIKey string `json:"api_key"`
+	}
+	e.srv.Do(t, u, http.MethodPost, "/api/v1/me/reset-key", nil, &reset)
+	if code := replica.Do(t, u, http.MethodGet, "/api/v1/me", nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("old key after reset = %d, want 401", code)
+	}
+	u = &servertest.User{ID: u.ID, APIKey: reset.APIKey}
+	if code := replica.Do(t, u, http.MethodGet, "/api/v1/me", nil, nil); code != http.StatusOK {
+		t.Fatalf("new key = %d", code)
+	}
+
+	// So does a status change.
+	e.srv.Do(t, servertest.Admin, http.MethodPut, "/api/v1/admin/users/"+u.ID+"/status", map[string]any{"status": "banned"}, nil)
+	if code := replica.Do(t, u, http.MethodGet, "/api/v1/me", nil, nil); code != http.StatusForbidden {
+		t.Fatalf("banned user = %d, want 403", code)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	emailAuth := map[string]string{"EMAIL_AUTH_ENABLED": "true"}
+	e := newEnv(t, emailAuth)
+	replica := e.startReplica(emailAuth)
+
+	type authResponse struct {
+		User         struct{ ID string } `json:"user"`
+		APIKey       string              `json:"api_key"`
+		SessionID    string              `json:"session_id"`
+		AccessToken  string              `json:"access_token"`
+		RefreshToken string              `json:"refresh_token"`
+	}
+	creds := map[string]any{"email": "sessions@example.com", "password": "hunter22"}
+
+	// Registering returns the new account key and opens a session.
+	var reg authResponse
+	if code := e.srv.Do(t, nil, http.MethodPost, "/auth/register", creds, &reg); code != http.StatusCreated {
+		t.Fatalf("register = %d", code)
+	}
+	if reg.APIKey == "" || reg.AccessToken == "" || reg.RefreshToken == "" {
+		t.Fatalf("register response = %+v", reg)
+	}
+	key := &servertest.User{ID: reg.User.ID, APIKey: reg.APIKey}
+
+	// Logging in opens another session without touching the account key.
+	var login authResponse
+	if code := e.srv.Do(t, nil, http.MethodPost, "/auth/login", creds, &login); code != http.StatusOK {
+		t.Fatalf("login = %d", code)
+	}
+	if login.APIKey != "" || login.AccessToken == "" {
+		t.Fatalf("login response = %+v, want tokens only", login)
+	}
+	web := &servertest.User{ID: reg.User.ID, APIKey: login.AccessToken}
+	if code := replica.Do(t, web, http.MethodGet, "/api/v1/me/balance", nil, nil); code != http.StatusOK {
+		t.Fatalf("access token = %d", code)
+	}
+	if code := replica.Do(t, key, http.MethodGet, "/api/v1/me", nil, nil); code != http.StatusOK {
+		t.Fatalf("account key after login = %d", code)
+	}
+
+	var list struct {
+		Sessions []struct {
+			ID      string `json:"id"`
+			Current bool   `json:"current"`
+		} `json:"sessions"`
+	}
+	e.srv.Do(t, web, http.MethodGet, "/api/v1/me/sessions", nil, &list)
+	if len(list.Sessions) != 2 || !list.Sessions[0].Current || list.Sessions[0].ID != login.SessionID {
+		t.Fatalf("sessions = %+v", list.Sessions)
+	}
+
+	// Refreshing rotates both tokens; the replica drops the cached old one.
+	var next authResponse
+	if code := e.srv.Do(t, nil, http.MethodPost, "/auth/refresh", map[string]any{"refresh_token": login.RefreshToken}, &next); code != http.StatusOK {
+		t.Fatalf("refresh = %d", code)
+	}
+	if code := replica.Do(t, web, http.MethodGet, "/api/v1/me", nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("old access token = %d, want 401", code)
+	}
+	if code := e.srv.Do(t, nil, http.MethodPost, "/auth/refresh", map[string]any{"refresh_token": login.RefreshToken}, nil); code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token = %d, want 401", code)
+	}
+	web.APIKey = next.AccessToken
+
+	// Logout ends only the session it is called with.
+	if code := e.srv.Do(t, key, http.MethodPost, "/api/v1/me/logout", nil, nil); code != http.StatusBadRequest {
+		t.Fatalf("logout with api key = %d, want 400", code)
+	}
+	if code := e.srv.Do(t, web, http.MethodPost, "/api/v1/me/logout", nil, nil); code != http.StatusOK {
+		t.Fatalf("logout = %d", code)
+	}
+	if code := replica.Do(t, web, http.MethodGet, "/api/v1/me", nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("access token after logout = %d, want 401", code)
+	}
+	if code := e.srv.Do(t, nil, http.MethodPost, "/auth/refresh", map[string]any{"refresh_token": next.RefreshToken}, nil); code != http.StatusUnauthorized {
+		t.Fatalf("refresh after logout = %d, want 401", code)
+	}
+
+	// Other sessions can be revoked by ID.
+	first := &servertest.User{ID: reg.User.ID, APIKey: reg.AccessToken}
+	if code := e.srv.Do(t, key, http.MethodDelete, "/api/v1/me/sessions/"+reg.SessionID, nil, nil); code != http.StatusOK {
+		t.Fatalf("revoke session = %d", code)
+	}
+	if code := replica.Do(t, first, http.MethodGet, "/api/v1/me", nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("revoked session = %d, want 401", code)
+	}
+
+	// Logging in never rotates the account key, even when asked to.
+	var relogin authResponse
+	e.srv.Do(t, nil, http.MethodPost, "/auth/login?with_api_key=true", creds, &relogin)
+	if relogin.APIKey != "" || relogin.AccessToken == "" {
+		t.Fatalf("login with_api_key = %+v, want tokens and no key", relogin)
+	}
+	if code := replica.Do(t, key, http.MethodGet, "/api/v1/me", nil, nil); code != http.StatusOK {
+		t.Fatalf("account key after login = %d, want 200", code)
+	}
+}
+
+func TestEmailVerificationAndPasswordReset(t *testing.T) {
+	e := newEnv(t, map[string]string{"EMAIL_AUTH_ENABLED": "true", "REQUIRE_EMAIL_VERIFIED": "true"})
+	e.startNode()
+
+	const email = "alice@example.com"
+	codeRe := regexp.MustCompile(`验证码：([0-9a-f]+)`)
+	lastCode := func(want int) string {
+		t.Helper()
+		mails := e.srv.Mails(email)
+		if len(mails) != want {
+			t.Fatalf("sent %d mails, want %d", len(mails), want)
+		}
+		m := codeRe.FindStringSubmatch(mails[len(mails)-1].Body)
+		if m == nil {
+			t.Fatalf("no code in mail: %q", mails[len(mails)-1].Body)
+		}
+		return m[1]
+	}
+	type authResponse struct {
+		User struct {
+			ID              string     `json:"id"`
+			EmailVerifiedAt *time.Time `json:"email_verified_at"`
+		} `json:"user"`
+		AccessToken string `json:"access_token"`
+	}
+	login := func(password string) (*servertest.User, int) {
+		var res authResponse
+		code := e.srv.Do(t, nil, http.MethodPost, "/auth/login", map[string]any{"email": email, "password": password}, &res)
+		return &servertest.User{ID: res.User.ID, APIKey: res.AccessToken}, code
+	}
+
+	// Registering mails a verification code; until it is used, parsing is
+	// refused.
+	var reg authResponse
+	e.srv.Do(t, nil, http.MethodPost, "/auth/register", map[string]any{"email": email, "password": "first-pw"}, &reg)
+	u := &servertest.User{ID: reg.User.ID, APIKey: reg.AccessToken}
+	e.srv.Do(t, servertest.Admin, http.MethodPost, "/api/v1/admin/users/"+u.ID+"/credits", map[string]any{"amount": 1000}, nil)
+	verifyCode := lastCode(1)
+	if code := e.srv.Do(t, u, http.MethodPost, "/api/v1/parse", map[string]any{
+		"gallery_id": fmt.Sprint(gidFree), "gallery_key": galleries[gidFree].Token,
+	}, nil); code != http.StatusForbidden {
+		t.Fatalf("parse unverified = %d, want 403", code)
+	}
+	if code := e.srv.Do(t, u, http.MethodPost, "/api/v1/me/email/verify", nil, nil); code != http.StatusTooManyRequests {
+		t.Fatalf("immediate resend = %d, want 429", code)
+	}
+
+	var verified authResponse
+	if code := e.srv.Do(t, nil, http.MethodPost, "/auth/email/verify", map[string]any{"token": verifyCode}, &verified); code != http.StatusOK {
+		t.Fatalf("verify = %d", code)
+	}
+	if verified.User.EmailVerifiedAt == nil {
+		t.Fatalf("email_verified_at not set")
+	}
+	if code := e.srv.Do(t, nil, http.MethodPost, "/auth/email/verify", map[string]any{"token": verifyCode}, nil); code != http.StatusBadRequest {
+		t.Fatalf("reused verification code = %d, want 400", code)
+	}
+	if res := e.parse(u, gidFree); res.Error != "" || res.ArchiveURL == "" {
+		t.Fatalf("parse verified = %+v", res)
+	}
+
+	// Forgot password: unknown addresses get the same answer and no mail,
+	// and repeated requests are throttled. Mails go out in the background,
+	// in order, so once bob's arrives the ones before it were handled.
+	const marker = "bob@example.com"
+	e.srv.Do(t, nil, http.MethodPost, "/auth/register", map[string]any{"email": marker, "password": "bob-pw"}, nil)
+	for _, addr := range []string{"nobody@example.com", email, email, marker} {
+		if code := e.srv.Do(t, nil, http.MethodPost, "/auth/password/forgot", map[string]any{"email": addr}, nil); code != http.StatusAccepted {
+			t.Fatalf("forgot %s = %d, want 202", addr, code)
+		}
+	}
+	servertest.Eventually(t, 5*time.Second, func() bool { return len(e.srv.Mails(marker)) == 2 }, "reset mail to %s", marker)
+	if n := len(e.srv.Mails("nobody@example.com")); n != 0 {
+		t.Fatalf("mailed unknown address %d times", n)
+	}
+	resetCode := lastCode(2)
+
+	// Resetting sets the password and logs out everywhere.
+	reset := map[string]any{"token": resetCode, "password": "second-pw"}
+	if code := e.srv.Do(t, nil, http.MethodPost, "/auth/password/reset", map[string]any{"token": "bogus", "password": "second-pw"}, nil); code != http.StatusBadRequest {
+		t.Fatalf("reset with bad token = %d, want 400", code)
+	}
+	if code := e.srv.Do(t, nil, http.MethodPost, "/auth/password/reset", reset, nil); code != http.StatusOK {
+		t.Fatalf("reset = %d", code)
+	}
+	if code := e.srv.Do(t, nil, http.MethodPost, "/auth/password/reset", reset, nil); code != http.StatusBadRequest {
+		t.Fatalf("reused reset code = %d, want 400", code)
+	}
+	if code := e.srv.Do(t, u, http.MethodGet, "/api/v1/me", nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("session after reset = %d, want 401", code)
+	}
+	if _, code := login("first-pw"); code != http.StatusUnauthorized {
+		t.Fatalf("login with old password = %d, want 401", code)
+	}
+
+	// Changing the password ends the other sessions but keeps this one.
+	other, _ := login("second-pw")
+	current, _ := login("second-pw")
+	change := map[string]any{"current_password": "wrong", "new_password": "third-pw"}
+	if code := e.srv.Do(t, current, http.MethodPut, "/api/v1/me/password", change, nil); code != http.StatusForbidden {
+		t.Fatalf("change with wrong password = %d, want 403", code)
+	}
+	change["current_password"] = "second-pw"
+	if code := e.srv.Do(t, current, http.MethodPut, "/api/v1/me/password", change, nil); code != http.StatusOK {
+		t.Fatalf("change password = %d", code)
+	}
+	if code := e.srv.Do(t, other, http.MethodGet, "/api/v1/me", nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("other session = %d, want 401", code)
+	}
+	if code := e.srv.Do(t, current, http.MethodGet, "/api/v1/me", nil, nil); code != http.StatusOK {
+		t.Fatalf("current session = %d", code)
+	}
+	if _, code := login("third-pw"); code != http.StatusOK {
+		t.Fatalf("login with new password = %d", code)
+	}
+}
+
+// telegramLogin returns Login Widget data for id, signed with botToken
+// like Telegram does.
+func telegramLogin(botToken string, id int64) map[string]any {
+	data := map[string]any{"id": id, "first_name": "Tg", "auth_date": time.Now().Unix()}
+	secret := sha256.Sum256([]byte(botToken))
+	mac := hmac.New(sha256.New, secret[:])
+	fmt.Fprintf(mac, "auth_date=%d\nfirst_name=Tg\nid=%d", data["auth_date"], id)
+	data["hash"] = hex.EncodeToString(mac.Sum(nil))
+	return data
+}
+
+func TestTelegramLoginKey(t *testing.T) {
+	const botToken = "123456:test-bot-token"
+	e := newEnv(t, map[string]string{"TELEGRAM_BOT_TOKEN": botToken})
+
+	// What the login page does each time: log in, then swap the bot's key.
+	type createResponse struct {
+		APIKey string `json:"api_key"`
+	}
+	var web, prev *servertest.User
+	for i := range 60 { // more logins than the per-user key limit
+		var session struct {
+			User struct {
+				ID string `json:"id"`
+			} `json:"user"`
+			AccessToken string `json:"access_token"`
+		}
+		if code := e.srv.Do(t, nil, http.MethodPost, "/auth/telegram/callback", telegramLogin(botToken, 42), &session); code != http.StatusOK {
+			t.Fatalf("login %d = %d", i, code)
+		}
+		web = &servertest.User{ID: session.User.ID, APIKey: session.AccessToken}
+		var created createResponse
+		req := map[string]any{"name": "telegram-login", "scopes": []string{"parse", "read:balance"}, "replace": true}
+		if code := e.srv.Do(t, web, http.MethodPost, "/api/v1/me/api-keys", req, &created); code != http.StatusCreated {
+			t.Fatalf("login %d: create key = %d", i, code)
+		}
+		bot := &servertest.User{ID: session.User.ID, APIKey: created.APIKey}
+		if code := e.srv.Do(t, bot, http.MethodGet, "/api/v1/me/balance", nil, nil); code != http.StatusOK {
+			t.Fatalf("login %d: new key = %d", i, code)
+		}
+		if prev != nil {
+			if code := e.srv.Do(t, prev, http.MethodGet, "/api/v1/me/balance", nil, nil); code != http.StatusUnauthorized {
+				t.Fatalf("login %d: previous key = %d, want 401", i, code)
+			}
+		}
+		prev = bot
+	}
+
+	var list struct {
+		Keys []struct {
+			RevokedAt *time.Time `json:"revoked_at"`
+		} `json:"keys"`
+	}
+	if code := e.srv.Do(t, web, http.MethodGet, "/api/v1/me/api-keys", nil, &list); code != http.StatusOK {
+		t.Fatalf("list keys = %d", code)
+	}
+	active := 0
+	for _, k := range list.Keys {
+		if k.RevokedAt == nil {
+			active++
+		}
+	}
+	if len(list.Keys) != 60 || active != 1 {
+		t.Fatalf("%d keys, %d active; want 60 and 1", len(list.Keys), active)
+	}
+}
+
+func TestIdentityLinkingAndMerge(t *testing.T) {
+	const botToken = "123456:test-bot-token"
+	extra := map[string]string{"EMAIL_AUTH_ENABLED": "true", "TELEGRAM_BOT_TOKEN": botToken}
+	e := newEnv(t, extra)
+	replica := e.startReplica(extra)
+
+	telegram := func(id int64) map[string]any { return telegramLogin(botToken, id) }
+	type authResponse struct {
+		User struct {
+			ID         string `json:"id"`
+			TelegramID *int64 `json:"telegram_id"`
+		} `json:"user"`
+		APIKey      string `json:"api_key"`
+		AccessToken string `json:"access_token"`
+	}
+	credit := func(u *servertest.User, amount int64) {
+		t.Helper()
+		if code := e.srv.Do(t, servertest.Admin, http.MethodPost, "/api/v1/admin/users/"+u.ID+"/credits", map[string]any{"amount": amount}, nil); code != http.StatusOK {
+			t.Fatalf("credit = %d", code)
+		}
+	}
+
+	// The same person registered by email and, separately, with Telegram.
+	var reg, tg authResponse
+	e.srv.Do(t, nil, http.MethodPost, "/auth/register", map[string]any{"email": "carol@example.com", "password": "carol-pw"}, &reg)
+	if code := e.srv.Do(t, nil, http.MethodPost, "/auth/telegram/callback", telegram(42), &tg); code != http.StatusOK {
+		t.Fatalf("telegram login = %d", code)
+	}
+	web := &servertest.User{ID: reg.User.ID, APIKey: reg.AccessToken}
+	bot := &servertest.User{ID: tg.User.ID, APIKey: tg.APIKey}
+	credit(web, 1000)
+	credit(bot, 500)
+
+	// The Telegram account is taken, so it cannot simply be linked; a bad
+	// signature is refused outright.
+	if code := e.srv.Do(t, web, http.MethodPost, "/api/v1/me/identities/telegram", telegram(42), nil); code != http.StatusConflict {
+		t.Fatalf("link taken telegram = %d, want 409", code)
+	}
+	forged := telegram(43)
+	forged["id"] = 44
+	if code := e.srv.Do(t, web, http.MethodPost, "/api/v1/me/identities/telegram", forged, nil); code != http.StatusUnauthorized {
+		t.Fatalf("link forged telegram = %d, want 401", code)
+	}
+
+	// An admin merges the Telegram account (named by its Telegram ID) into
+	// the email one.
+	var merged struct {
+		Target struct {
+			ID         string `json:"id"`
+			TelegramID *int64 `json:"telegram_id"`
+		} `json:"target"`
+		Amount int64            `json:"amount"`
+		Moved  map[string]int64 `json:"moved"`
+	}
+	mergePath := "/api/v1/admin/users/" + web.ID + "/merge"
+	if code := e.srv.Do(t, servertest.Admin, http.MethodPost, mergePath, map[string]any{"source": "42"}, &merged); code != http.StatusOK {
+		t.Fatalf("merge = %d", code)
+	}
+	if merged.Amount != 500 || merged.Moved["transactions"] != 1 || merged.Target.TelegramID == nil || *merged.Target.TelegramID != 42 {
+		t.Fatalf("merge = %+v", merged)
+	}
+	e.assertBalance(web, 1500, 0)
+	e.assertBalance(bot, 0, 0)
+	var history struct {
+		Transactions []struct {
+			Type string `json:"type"`
+		} `json:"transactions"`
+	}
+	e.srv.Do(t, web, http.MethodGet, "/api/v1/me/transactions", nil, &history)
+	if len(history.Transactions) != 3 || history.Transactions[0].Type != "MERGE" {
+		t.Fatalf("merged history = %+v", history.Transactions)
+	}
+	if code := replica.Do(t, bot, http.MethodGet, "/api/v1/me", nil, nil); code != http.StatusForbidden {
+		t.Fatalf("merged account key = %d, want 403", code)
+	}
+	if code := e.srv.Do(t, servertest.Admin, http.MethodPost, mergePath, map[string]any{"source": bot.ID}, nil); code != http.StatusConflict {
+		t.Fatalf("merge again = %d, want 409", code)
+	}
+	if code := e.srv.Do(t, servertest.Admin, http.MethodPut, "/api/v1/admin/users/"+bot.ID+"/status", map[string]any{"status": "active"}, nil); code != http.StatusConflict {
+		t.Fatalf("reactivate merged = %d, want 409", code)
+	}
+
+	// Telegram now logs into the merged account.
+	var again authResponse
+	e.srv.Do(t, nil, http.MethodPost, "/auth/telegram/callback", telegram(42), &again)
+	if again.User.ID != web.ID {
+		t.Fatalf("telegram login after merge = user %s, want %s", again.User.ID, web.ID)
+	}
+
+	// Identities can be unlinked while another remains, and relinked.
+	if code := e.srv.Do(t, web, http.MethodDelete, "/api/v1/me/identities/telegram", nil, nil); code != http.StatusOK {
+		t.Fatalf("unlink telegram = %d", code)
+	}
+	if code := e.srv.Do(t, web, http.MethodDelete, "/api/v1/me/identities/email", nil, nil); code != http.StatusConflict {
+		t.Fatalf("unlink last identity = %d, want 409", code)
+	}
+	if code := e.srv.Do(t, web, http.MethodPost, "/api/v1/me/identities/telegram", telegram(42), nil); code != http.StatusOK {
+		t.Fatalf("relink telegram = %d", code)
+	}
+
+	// A Telegram-only account links an email and can then log in with it.
+	var dave authResponse
+	e.srv.Do(t, nil, http.MethodPost, "/auth/telegram/callback", telegram(77), &dave)
+	d := &servertest.User{ID: dave.User.ID, APIKey: dave.AccessToken}
+	if code := e.srv.Do(t, d, http.MethodPost, "/api/v1/me/identities/email", map[string]any{"email": "carol@example.com", "password": "dave-pw"}, nil); code != http.StatusConflict {
+		t.Fatalf("link taken email = %d, want 409", code)
+	}
+	if code := e.srv.Do(t, d, http.MethodPost, "/api/v1/me/identities/email", map[string]any{"email": "Dave@example.com", "password": "dave-pw"}, nil); code != http.StatusOK {
+		t.Fatalf("link email = %d", code)
+	}
+	if n := len(e.srv.Mails("dave@example.com")); n != 1 {
+		t.Fatalf("verification mails = %d, want 1", n)
+	}
+	var login authResponse
+	if code := e.srv.Do(t, nil, http.MethodPost, "/auth/login", map[string]any{"email": "dave@example.com", "password": "dave-pw"}, &login); code != http.StatusOK || login.User.ID != d.ID {
+		t.Fatalf("login with linked email = %d, user %s", code, login.User.ID)
+	}
+	if code := replica.Do(t, d, http.MethodDelete, "/api/v1/me/identities/telegram", nil, nil); code != http.StatusOK {
+		t.Fatalf("unlink telegram after linking email = %d", code)
+	}
+}
+
+func TestClusterReplicas(t *testing.T) {
+	cluster := map[string]string{"CLUSTER_MODE": "true"}
+	e := newEnv(t, cluster)
+	replica := e.startReplica(cluster)
+	e.startNode()
+	u := e.srv.CreateUser(t, 10_000)
+
+	// The replica sees the node connected to the other instance.
+	if n := replica.NodeCount(); n != 1 {
+		t.Fatalf("replica node count = %d, want 1", n)
+	}
+
+	// Announced on the replica, completed by a node on the primary, and the
+	// result has to find its way back to the replica's waiter.
+	g := galleries[gidPaid]
+	res := replica.Parse(t, u, fmt.Sprint(g.GID), g.Token)
+	if res.Error != "" || res.ArchiveURL == "" {
+		t.Fatalf("parse via replica = %+v, want success", res)
+	}
+	e.assertBalance(u, 10_000-paidEstimate, 0)
+
+	// Shared cache: the primary now answers from it.
+	if again := e.parse(u, gidPaid); !again.Cached {
+		t.Fatalf("parse via primary = %+v, want cached", again)
+	}
+}
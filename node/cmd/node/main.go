@@ -27,11 +27,16 @@ func main() {
 	log.Printf("Connecting to server: %s", cfg.Server.URL)
 
 	// Create EHentai client
+	var ehOpts []ehentai.Option
+	if cfg.EHentai.BaseURL != "" {
+		ehOpts = append(ehOpts, ehentai.WithBaseURL(cfg.EHentai.BaseURL))
+	}
 	ehClient, err := ehentai.NewClient(
 		cfg.EHentai.Cookie,
 		cfg.EHentai.UseExhentai,
 		cfg.EHentai.MaxGPCost,
 		cfg.Database.Path,
+		ehOpts...,
 	)
 	if err != nil {
 		log.Fatalf("Failed to create EHentai client: %v", err)
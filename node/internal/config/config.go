@@ -22,6 +22,7 @@ type Config struct {
 		Cookie      string `yaml:"cookie"`       // EHentai cookie (ipb_member_id=xxx; ipb_pass_hash=xxx)
 		UseExhentai bool   `yaml:"use_exhentai"` // Whether to use ExHentai instead of E-Hentai
 		MaxGPCost   int    `yaml:"max_gp_cost"`  // Maximum GP cost per day (-1 for unlimited)
+		BaseURL     string `yaml:"base_url"`     // Override the site URL (optional, e.g. for a mirror or local fake)
 	} `yaml:"ehentai"`
 
 	Task struct {
@@ -1,6 +1,9 @@
 package ehentai
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -45,8 +48,37 @@ type Client struct {
 	testToken string
 }
 
+// ErrInsufficientFunds is returned when the account cannot pay for an archive.
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// Option customises a Client.
+type Option func(*Client)
+
+// WithBaseURL overrides the site URL (e.g. a mirror or a local fake).
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithTransport sets the HTTP transport used for every upstream request.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *Client) {
+		c.httpClient.Transport = rt
+	}
+}
+
+// WithTestGallery sets the gallery used for status checks, skipping the
+// homepage lookup.
+func WithTestGallery(gid, token string) Option {
+	return func(c *Client) {
+		c.testGID = gid
+		c.testToken = token
+	}
+}
+
 // NewClient creates a new EHentai client
-func NewClient(cookie string, useExhentai bool, maxGPCost int, dbPath string) (*Client, error) {
+func NewClient(cookie string, useExhentai bool, maxGPCost int, dbPath string, opts ...Option) (*Client, error) {
 	baseURL := BaseURL
 	if useExhentai {
 		baseURL = ExBaseURL
@@ -65,6 +97,9 @@ func NewClient(cookie string, useExhentai bool, maxGPCost int, dbPath string) (*
 		httpClient: &http.Client{Timeout: HTTPTimeout},
 		db:         db,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
 
 	// Load today's GP cost from database so daily limit survives restarts
 	if stats, err := db.GetAggregateStats(); err != nil {
@@ -74,9 +109,11 @@ func NewClient(cookie string, useExhentai bool, maxGPCost int, dbPath string) (*
 	}
 
 	// Fetch a test gallery ID for status checking
-	if err := c.initTestGallery(); err != nil {
-		db.Close()
-		return nil, fmt.Errorf("init test gallery failed: %w", err)
+	if c.testGID == "" {
+		if err := c.initTestGallery(); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("init test gallery failed: %w", err)
+		}
 	}
 
 	return c, nil
@@ -220,6 +257,77 @@ func (c *Client) ResetDailyGPCost() {
 	c.mu.Unlock()
 }
 
+// GalleryError is returned when the API answers but rejects the gallery
+// (e.g. wrong key or removed gallery).
+type GalleryError struct {
+	Msg string
+}
+
+func (e *GalleryError) Error() string {
+	return "api returned error: " + e.Msg
+}
+
+// GetGalleryMetadata looks up a gallery's upload time (unix seconds) and
+// archive size (bytes) through the gdata API, using the node's cookie so
+// ExHentai-only galleries resolve too.
+func (c *Client) GetGalleryMetadata(gid, token string) (posted int64, filesize int64, err error) {
+	gidNum, err := strconv.Atoi(gid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid gallery id: %w", err)
+	}
+
+	payload, err := json.Marshal(map[string]any{
+		"method":    "gdata",
+		"gidlist":   [][]any{{gidNum, token}},
+		"namespace": 1,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	req, err := http.NewRequest("POST", c.baseURL+"/api.php", bytes.NewReader(payload))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Cookie", c.cookie)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("api status code: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Gmetadata []struct {
+			Posted   string `json:"posted"`
+			Filesize int64  `json:"filesize"`
+			Error    string `json:"error"`
+		} `json:"gmetadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, 0, fmt.Errorf("decode json failed: %w", err)
+	}
+
+	if len(result.Gmetadata) == 0 {
+		return 0, 0, &GalleryError{Msg: "empty metadata"}
+	}
+	meta := result.Gmetadata[0]
+	if meta.Error != "" {
+		return 0, 0, &GalleryError{Msg: meta.Error}
+	}
+
+	posted, err = strconv.ParseInt(meta.Posted, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid posted timestamp: %w", err)
+	}
+	return posted, meta.Filesize, nil
+}
+
 // GetArchiveURL requests E-Hentai to generate an archive and returns the download URL, actual GP cost, and estimated size.
 // Note: This function only obtains the download link; it does NOT download the actual archive file.
 func (c *Client) GetArchiveURL(gid, token string) (archiveURL string, actualGP int, sizeMiB float64, err error) {
@@ -287,6 +395,10 @@ func (c *Client) GetArchiveURL(gid, token string) (archiveURL string, actualGP i
 		return "", 0, sizeMiB, err
 	}
 
+	if strings.Contains(string(body2), "Insufficient funds") {
+		return "", 0, sizeMiB, ErrInsufficientFunds
+	}
+
 	// Extract archive download URL from response
 	urlRe := regexp.MustCompile(`document\.location = "(.*?)";`)
 	urlMatches := urlRe.FindStringSubmatch(string(body2))
@@ -14,6 +14,10 @@ const (
 	// Server → Node (response to FETCH)
 	MsgTypeTaskAssigned MsgType = "TASK_ASSIGNED"
 	MsgTypeTaskGone     MsgType = "TASK_GONE"
+
+	// Server → Node → Server: gallery metadata lookup
+	MsgTypeMetadataRequest  MsgType = "METADATA_REQUEST"
+	MsgTypeMetadataResponse MsgType = "METADATA_RESPONSE"
 )
 
 // Envelope is the top-level WebSocket frame
@@ -52,3 +56,21 @@ type TaskResult struct {
 	ArchiveURL string `json:"archive_url,omitempty"`
 	Error      string `json:"error,omitempty"`
 }
+
+// MetadataRequest asks the node to look up gallery metadata
+type MetadataRequest struct {
+	RequestID  string `json:"request_id"`
+	GalleryID  string `json:"gallery_id"`
+	GalleryKey string `json:"gallery_key"`
+}
+
+// MetadataResponse is the node's reply to a MetadataRequest.
+// GalleryError means the API rejected the gallery; Error means the lookup itself failed.
+type MetadataResponse struct {
+	RequestID    string `json:"request_id"`
+	GalleryID    string `json:"gallery_id"`
+	Posted       int64  `json:"posted"`
+	Filesize     int64  `json:"filesize"`
+	GalleryError string `json:"gallery_error,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
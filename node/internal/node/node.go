@@ -2,6 +2,7 @@ package node
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -176,6 +177,35 @@ func (n *Node) OnTaskGone(ctx context.Context, traceID string) {
 	n.logf("task gone: trace=%s", traceID)
 }
 
+// OnMetadataRequest looks up gallery metadata on behalf of the server
+func (n *Node) OnMetadataRequest(ctx context.Context, req *model.MetadataRequest) {
+	go func() {
+		res := &model.MetadataResponse{
+			RequestID: req.RequestID,
+			GalleryID: req.GalleryID,
+		}
+
+		posted, filesize, err := n.ehClient.GetGalleryMetadata(req.GalleryID, req.GalleryKey)
+		var galleryErr *ehentai.GalleryError
+		switch {
+		case errors.As(err, &galleryErr):
+			res.GalleryError = galleryErr.Msg
+		case err != nil:
+			res.Error = err.Error()
+		default:
+			res.Posted = posted
+			res.Filesize = filesize
+		}
+
+		if err != nil {
+			n.logf("metadata lookup for gallery %s failed: %v", req.GalleryID, err)
+		}
+		if err := n.wsClient.SendMetadataResponse(res); err != nil {
+			n.logf("failed to send metadata response: %v", err)
+		}
+	}()
+}
+
 // OnConnected handles WebSocket connection established
 func (n *Node) OnConnected() {
 	n.logf("connected to server")
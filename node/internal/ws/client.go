@@ -29,6 +29,7 @@ type MessageHandler interface {
 	OnTaskAnnouncement(ctx context.Context, ann *model.TaskAnnouncement)
 	OnTaskAssigned(ctx context.Context, task *model.TaskAssignment)
 	OnTaskGone(ctx context.Context, traceID string)
+	OnMetadataRequest(ctx context.Context, req *model.MetadataRequest)
 	OnConnected()
 	OnDisconnected()
 }
@@ -197,6 +198,14 @@ func (c *Client) SendTaskResult(result *model.TaskResult) error {
 	})
 }
 
+// SendMetadataResponse replies to a METADATA_REQUEST.
+func (c *Client) SendMetadataResponse(res *model.MetadataResponse) error {
+	return c.sendJSON(model.Envelope{
+		Type:    model.MsgTypeMetadataResponse,
+		Payload: res,
+	})
+}
+
 func (c *Client) sendJSON(v interface{}) error {
 	data, err := json.Marshal(v)
 	if err != nil {
@@ -347,6 +356,14 @@ func (c *Client) handleMessage(ctx context.Context, data []byte) {
 		}
 		c.handler.OnTaskGone(ctx, payload.TraceID)
 
+	case model.MsgTypeMetadataRequest:
+		var req model.MetadataRequest
+		if err := json.Unmarshal(env.Payload, &req); err != nil {
+			log.Printf("[ws] bad METADATA_REQUEST payload: %v", err)
+			return
+		}
+		c.handler.OnMetadataRequest(ctx, &req)
+
 	default:
 		log.Printf("[ws] unknown message type: %s", env.Type)
 	}
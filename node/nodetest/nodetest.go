@@ -0,0 +1,71 @@
+// Package nodetest runs a worker node in-process for integration tests.
+package nodetest
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/Archive-At-Home/archive-at-home/node/internal/ehentai"
+	"github.com/Archive-At-Home/archive-at-home/node/internal/node"
+)
+
+// Options configures a test node.
+type Options struct {
+	NodeID    string
+	Signature string // ED25519 signature of NodeID
+	ServerURL string // server WebSocket endpoint
+	EHBaseURL string // fake e-hentai site URL
+
+	MaxGPCost      int // daily GP limit (default -1, unlimited)
+	BaseBalanceGP  int // balance above which claims are not delayed (default 1000)
+	BaseClaimDelay int // seconds (default 1)
+}
+
+// Node is a running test node.
+type Node struct {
+	*node.Node
+	cancel context.CancelFunc
+}
+
+// Start connects a node to the server and registers cleanup on t.
+func Start(t testing.TB, opts Options) *Node {
+	t.Helper()
+
+	if opts.MaxGPCost == 0 {
+		opts.MaxGPCost = -1
+	}
+	if opts.BaseBalanceGP == 0 {
+		opts.BaseBalanceGP = 1000
+	}
+	if opts.BaseClaimDelay == 0 {
+		opts.BaseClaimDelay = 1
+	}
+
+	dbPath := filepath.Join(t.TempDir(), opts.NodeID+".db")
+	eh, err := ehentai.NewClient("ipb_member_id=1; ipb_pass_hash=test", false, opts.MaxGPCost, dbPath,
+		ehentai.WithBaseURL(opts.EHBaseURL))
+	if err != nil {
+		t.Fatalf("node %s: create ehentai client: %v", opts.NodeID, err)
+	}
+
+	n := node.NewNode(opts.NodeID, opts.Signature, opts.ServerURL, eh,
+		opts.MaxGPCost, opts.BaseBalanceGP, opts.BaseClaimDelay)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := n.Start(ctx, ""); err != nil {
+		cancel()
+		t.Fatalf("node %s: start: %v", opts.NodeID, err)
+	}
+
+	tn := &Node{Node: n, cancel: cancel}
+	t.Cleanup(tn.Kill)
+	return tn
+}
+
+// Kill simulates a crash: the WebSocket connection drops and no further
+// announcements are handled. Work already in flight is abandoned rather
+// than awaited. Safe to call more than once.
+func (n *Node) Kill() {
+	n.cancel()
+}
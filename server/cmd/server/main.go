@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -10,16 +9,12 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Archive-At-Home/archive-at-home/server/internal/app"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/auth"
-	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
-	"github.com/Archive-At-Home/archive-at-home/server/internal/handler"
-	"github.com/Archive-At-Home/archive-at-home/server/internal/middleware"
-	"github.com/Archive-At-Home/archive-at-home/server/internal/node"
-	"github.com/Archive-At-Home/archive-at-home/server/internal/scheduler"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/mail"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/service"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/store"
-	"github.com/Archive-At-Home/archive-at-home/server/internal/ws"
 	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
 )
@@ -28,76 +23,62 @@ func main() {
 	// ── Configuration ──
 	cfg := config.Load()
 
-	// ── Redis ──
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     cfg.RedisAddr,
-		Password: cfg.RedisPassword,
-		DB:       cfg.RedisDB,
-	})
+	// ── Redis (not needed by the in-memory scheduler) ──
 	ctx := context.Background()
-	if err := rdb.Ping(ctx).Err(); err != nil {
-		log.Fatalf("failed to connect to redis: %v", err)
+	var rdb *redis.Client
+	if cfg.SchedulerBackend != "memory" {
+		rdb = redis.NewClient(&redis.Options{
+			Addr:     cfg.RedisAddr,
+			Password: cfg.RedisPassword,
+			DB:       cfg.RedisDB,
+		})
+		if err := rdb.Ping(ctx).Err(); err != nil {
+			log.Fatalf("failed to connect to redis: %v", err)
+		}
+		log.Println("connected to Redis at", cfg.RedisAddr)
 	}
-	log.Println("connected to Redis at", cfg.RedisAddr)
 
 	// ── SQL Store ──
-	dbDSN := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName, cfg.DBSSLMode)
-	st, err := store.NewStore(dbDSN)
+	dialector, dbDesc, err := store.Dialector(cfg)
 	if err != nil {
 		log.Fatalf("failed to init store: %v", err)
 	}
-	log.Printf("database initialised: %s@%s:%s/%s", cfg.DBUser, cfg.DBHost, cfg.DBPort, cfg.DBName)
-
-	// ── Scheduler ──
-	sched := scheduler.NewScheduler(rdb, cfg)
-
-	// ── WebSocket Hub ──
-	waiter := ws.NewResultWaiter()
-	hub := ws.NewHub(sched, waiter)
-
-	// ── User & Balance Services ──
-	userSvc := auth.NewUserService(st.DB())
-	balanceSvc := balance.NewBalanceService(st.DB())
+	st, err := store.Open(dialector)
+	if err != nil {
+		log.Fatalf("failed to init store: %v", err)
+	}
+	log.Printf("database initialised: %s", dbDesc)
+	if cfg.DropLegacyAPIKeys {
+		if err := auth.DropLegacyAPIKeys(st.DB()); err != nil {
+			log.Fatalf("failed to drop legacy api keys: %v", err)
+		}
+	}
 
-	// ── Node Authenticator (ED25519) ──
-	nodeAuth, err := node.NewAuthenticator(cfg.NodeVerifyKey)
+	// ── Mail ──
+	mailer, err := mail.New(cfg)
 	if err != nil {
-		log.Fatalf("failed to init node authenticator: %v", err)
+		log.Fatalf("failed to init mailer: %v", err)
 	}
+	log.Printf("mail backend=%s", cfg.MailBackend)
 
-	// ── Service ──
-	svc := service.NewGalleryService(sched, hub, waiter, st, cfg, balanceSvc)
+	// ── Application ──
+	gin.SetMode(gin.ReleaseMode)
+	a, err := app.New(cfg, rdb, st, service.NewEHAPIClient(cfg), mailer)
+	if err != nil {
+		log.Fatalf("failed to init app: %v", err)
+	}
 
-	// ── Lease Watchdog (background) ──
+	// ── Background workers (cluster membership, lease watchdog) ──
 	watchdogCtx, watchdogCancel := context.WithCancel(ctx)
 	defer watchdogCancel()
-	go sched.StartLeaseWatchdog(watchdogCtx)
-
-	// ── Gin Router ──
-	gin.SetMode(gin.ReleaseMode)
-	r := gin.New()
-	r.Use(gin.Recovery())
-	r.Use(middleware.CORS())
-	r.Use(middleware.Logger())
-
-	h := handler.NewHandler(svc, hub, nodeAuth, cfg)
-	authHandler := handler.NewAuthHandler(userSvc, cfg)
-	userHandler := handler.NewUserHandler(userSvc, balanceSvc, cfg)
-	adminHandler := handler.NewAdminHandler(userSvc, balanceSvc, hub)
-
-	// Register routes with API key authentication
-	authHandler.RegisterRoutes(r)
-	h.RegisterRoutes(r, middleware.APIKeyAuth(userSvc))
-	userHandler.RegisterRoutes(r.Group("/api/v1", middleware.APIKeyAuth(userSvc)))
-
-	// Register admin routes with admin token authentication
-	adminHandler.RegisterRoutes(r.Group("/api/v1/admin", middleware.AdminTokenAuth(cfg.AdminToken)))
+	if err := a.StartBackground(watchdogCtx); err != nil {
+		log.Fatalf("failed to start background workers: %v", err)
+	}
 
 	// ── HTTP Server with graceful shutdown ──
 	srv := &http.Server{
 		Addr:    cfg.ServerAddr,
-		Handler: r,
+		Handler: a.Router,
 	}
 
 	go func() {
@@ -121,6 +102,8 @@ func main() {
 		log.Printf("server shutdown error: %v", err)
 	}
 
-	rdb.Close()
+	if rdb != nil {
+		rdb.Close()
+	}
 	log.Println("server exited cleanly")
 }
@@ -0,0 +1,210 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/auth"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/checkin"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/cluster"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/ehapi"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/handler"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/idempotency"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/mail"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/merge"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/middleware"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/node"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/plan"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/pricing"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/ratelimit"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/reconcile"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/scheduler"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/service"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/settlement"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/store"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/voucher"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/ws"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// App is the fully wired server stack: services, WebSocket hub and
+// HTTP router. cmd/server runs it in production; servertest runs it
+// in-process for integration tests.
+type App struct {
+	Config    *config.Config
+	Redis     *redis.Client
+	Store     *store.Store
+	Scheduler scheduler.TaskScheduler
+	Cluster   *cluster.Cluster // nil unless CLUSTER_MODE
+	Results   settlement.Queue
+	Settler   *settlement.Settler
+	Reconcile *reconcile.Reconciler
+	Hub       *ws.Hub
+	Waiter    *ws.ResultWaiter // parse requests waiting for a task result
+	Users     auth.UserService
+	Emails    *auth.EmailService
+	Balance   balance.BalanceService
+	Gallery   *service.GalleryService
+	Router    *gin.Engine
+}
+
+// New wires the server around already-connected Redis and SQL stores.
+// rdb may be nil when SCHEDULER_BACKEND=memory.
+// ehClient is the direct api.php client (see service.NewEHAPIClient);
+// mailer delivers verification and password reset mails (see mail.New).
+func New(cfg *config.Config, rdb *redis.Client, st *store.Store, ehClient *ehapi.Client, mailer mail.Mailer) (*App, error) {
+	if cfg.InstanceID == "" {
+		cfg.InstanceID = cluster.DefaultInstanceID()
+	}
+
+	// ── Scheduler ──
+	sched, err := scheduler.New(cfg, rdb)
+	if err != nil {
+		return nil, fmt.Errorf("init scheduler: %w", err)
+	}
+	log.Printf("scheduler backend=%s", cfg.SchedulerBackend)
+
+	// ── User & Balance Services ──
+	authCache := auth.NewCache(cfg, rdb)
+	userSvc := auth.NewUserService(st.DB(), authCache)
+	keys := auth.NewKeyService(st.DB(), userSvc, authCache)
+	sessions := auth.NewSessionService(st.DB(), authCache, cfg.SessionAccessTTL, cfg.SessionRefreshTTL)
+	emails := auth.NewEmailService(st.DB(), authCache, mailer, sessions, cfg)
+	balanceSvc := balance.NewBalanceService(st.DB())
+	voucherSvc := voucher.NewService(st.DB())
+	checkinSchedule, err := checkin.ParseSchedule(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("init checkin: %w", err)
+	}
+	checkins := checkin.NewService(st.DB(), balanceSvc, userSvc, checkinSchedule)
+
+	// ── Plans ──
+	planTable, err := plan.Load(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("init plans: %w", err)
+	}
+	plans := plan.NewService(st.DB(), planTable, cfg.PricingDefaultTier)
+
+	// ── Pricing ──
+	pricingEngine, err := pricing.New(cfg, plans)
+	if err != nil {
+		return nil, fmt.Errorf("init pricing: %w", err)
+	}
+	log.Printf("pricing policy=%s settlement=%s", cfg.PricingPolicy, pricingEngine.Mode())
+
+	// ── Settlement ──
+	results := settlement.NewQueue(cfg, rdb, cfg.InstanceID)
+	operators := node.NewOperatorService(st.DB())
+	settler := settlement.NewSettler(balanceSvc, pricingEngine, st, operators, cfg.NodeRewardShare, plans)
+	reconciler := reconcile.New(st.DB(), balanceSvc, settler, cfg)
+
+	// ── WebSocket Hub ──
+	waiter := ws.NewResultWaiter()
+	hub := ws.NewHub(sched, waiter, results)
+
+	// ── Cluster (optional) ──
+	var cl *cluster.Cluster
+	if cfg.ClusterMode {
+		if rdb == nil || cfg.SchedulerBackend == "memory" {
+			return nil, fmt.Errorf("CLUSTER_MODE requires the redis scheduler backend")
+		}
+		cl = cluster.New(rdb, cfg.InstanceID, cfg.ClusterHeartbeat)
+		hub.EnableCluster(cl)
+		log.Printf("cluster mode enabled, instance=%s", cl.InstanceID())
+	}
+
+	// ── Node Authenticator (ED25519) ──
+	nodeAuth, err := node.NewAuthenticator(cfg.NodeVerifyKey)
+	if err != nil {
+		return nil, fmt.Errorf("init node authenticator: %w", err)
+	}
+
+	// ── Service ──
+	svc := service.NewGalleryService(sched, hub, waiter, st, cfg, balanceSvc, pricingEngine, settler, plans, ehClient)
+
+	// ── Gin Router ──
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.Use(middleware.CORS())
+	r.Use(middleware.Logger())
+
+	idempotent := middleware.Idempotency(idempotency.New(cfg, rdb))
+	limiter := ratelimit.NewLimiter(st.DB(), plans, ratelimit.NewCounter(cfg, rdb), cfg.TaskWaitTimeout+time.Minute, checkinSchedule.Location)
+	rateLimit := middleware.RateLimit(limiter)
+	h := handler.NewHandler(svc, hub, nodeAuth, cfg, idempotent, middleware.ParseLimit(limiter))
+	authHandler := handler.NewAuthHandler(userSvc, sessions, emails, cfg)
+	userHandler := handler.NewUserHandler(userSvc, keys, sessions, emails, balanceSvc, voucherSvc, operators, plans, checkins, nodeAuth, cfg, idempotent)
+	merger := merge.New(st.DB(), authCache, sessions, limiter)
+	adminHandler := handler.NewAdminHandler(userSvc, keys, balanceSvc, hub, reconciler, merger, voucherSvc, operators, plans, limiter, idempotent)
+
+	// Register routes with API key (or login session) authentication
+	authHandler.RegisterRoutes(r)
+	apiKeyAuth := middleware.APIKeyAuth(keys, sessions)
+	h.RegisterRoutes(r, apiKeyAuth, rateLimit)
+	userHandler.RegisterRoutes(r.Group("/api/v1", apiKeyAuth, rateLimit))
+
+	// Register admin routes with admin token authentication
+	adminHandler.RegisterRoutes(r.Group("/api/v1/admin", middleware.AdminTokenAuth(cfg.AdminToken, keys)))
+
+	return &App{
+		Config:    cfg,
+		Redis:     rdb,
+		Store:     st,
+		Scheduler: sched,
+		Cluster:   cl,
+		Results:   results,
+		Settler:   settler,
+		Reconcile: reconciler,
+		Hub:       hub,
+		Waiter:    waiter,
+		Users:     userSvc,
+		Emails:    emails,
+		Balance:   balanceSvc,
+		Gallery:   svc,
+		Router:    r,
+	}, nil
+}
+
+// StartBackground starts the workers (see StartWorkers), the lease
+// watchdog and the reconciliation job, all running until ctx is cancelled.
+func (a *App) StartBackground(ctx context.Context) error {
+	if err := a.StartWorkers(ctx); err != nil {
+		return err
+	}
+	go a.Scheduler.StartLeaseWatchdog(ctx, a.Gallery.ReannounceTasks, a.Hub.ExpireTasks)
+	go a.Reconcile.Run(ctx)
+	return nil
+}
+
+// StartWorkers joins the cluster (if enabled) and starts the settlement
+// and password reset mail workers. Unlike StartBackground it leaves lease reclaiming and
+// reconciliation to explicit calls, which is what tests want.
+func (a *App) StartWorkers(ctx context.Context) error {
+	if a.Cluster != nil {
+		if err := a.Cluster.Start(ctx); err != nil {
+			return err
+		}
+	}
+	go a.Settler.Run(ctx, a.Results)
+	go a.Emails.Run(ctx)
+	return nil
+}
+
+// ReclaimExpiredTasks runs one lease watchdog pass synchronously and
+// re-announces whatever it reclaimed. Expired tasks are failed for
+// settlement. Returns the reclaimed trace IDs.
+func (a *App) ReclaimExpiredTasks(ctx context.Context) []string {
+	reclaimed, expired := a.Scheduler.ReclaimExpiredTasks(ctx)
+	if len(reclaimed) > 0 {
+		a.Gallery.ReannounceTasks(ctx, reclaimed)
+	}
+	if len(expired) > 0 {
+		a.Hub.ExpireTasks(ctx, expired)
+	}
+	return reclaimed
+}
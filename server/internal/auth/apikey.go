@@ -0,0 +1,321 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ─────────────────────────────────────────────
+// Named API Keys
+//
+// Besides the account's own key (User.APIKey), users create any number of
+// named keys, each limited to a set of scopes and optionally expiring.
+// Only a SHA-256 of the key is stored; the key itself is shown once, when
+// it is created.
+// ─────────────────────────────────────────────
+
+// Scopes a key can carry.
+const (
+	ScopeParse       = "parse"        // POST /parse, /quote
+	ScopeReadBalance = "read:balance" // balance and transaction history
+	ScopeTransfer    = "transfer"     // POST /me/transfer
+	ScopeAccount     = "account"      // profile, check-in, vouchers, nodes, API keys
+	ScopeAdminRead   = "admin:read"   // GET /api/v1/admin/*, granted by admins only
+)
+
+// UserScopes are the scopes users may grant themselves. The account key
+// (User.APIKey) has all of them.
+var UserScopes = Scopes{ScopeParse, ScopeReadBalance, ScopeTransfer, ScopeAccount}
+
+// allScopes is every known scope.
+var allScopes = append(slices.Clone(UserScopes), ScopeAdminRead)
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrAPIKeyExpired  = errors.New("api key expired")
+	ErrUnknownScope   = errors.New("unknown scope")
+	ErrTooManyAPIKeys = errors.New("too many api keys")
+)
+
+// maxAPIKeysPerUser caps a user's unrevoked keys.
+const maxAPIKeysPerUser = 50
+
+// lastUsedResolution limits how often a key's last-used columns are written.
+const lastUsedResolution = time.Minute
+
+// Scopes is a set of scope names, stored space-separated.
+type Scopes []string
+
+// Has reports whether s contains scope.
+func (s Scopes) Has(scope string) bool {
+	return slices.Contains(s, scope)
+}
+
+// Contains reports whether every scope in other is in s.
+func (s Scopes) Contains(other Scopes) bool {
+	for _, scope := range other {
+		if !s.Has(scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// GormDataType stores Scopes as a string column.
+func (Scopes) GormDataType() string { return "string" }
+
+// Value implements driver.Valuer.
+func (s Scopes) Value() (driver.Value, error) {
+	return strings.Join(s, " "), nil
+}
+
+// Scan implements sql.Scanner.
+func (s *Scopes) Scan(v any) error {
+	switch v := v.(type) {
+	case string:
+		*s = strings.Fields(v)
+	case []byte:
+		*s = strings.Fields(string(v))
+	case nil:
+		*s = nil
+	default:
+		return fmt.Errorf("scan scopes: unsupported type %T", v)
+	}
+	return nil
+}
+
+// ParseScopes validates names and returns them sorted without duplicates.
+// An empty list means all UserScopes.
+func ParseScopes(names []string) (Scopes, error) {
+	if len(names) == 0 {
+		return slices.Clone(UserScopes), nil
+	}
+	var s Scopes
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if !slices.Contains(allScopes, name) {
+			return nil, fmt.Errorf("%w %q", ErrUnknownScope, name)
+		}
+		if !s.Has(name) {
+			s = append(s, name)
+		}
+	}
+	slices.Sort(s)
+	return s, nil
+}
+
+// APIKey is a named key belonging to a user.
+type APIKey struct {
+	ID         string     `json:"id" gorm:"primaryKey;size:36"`
+	UserID     string     `json:"user_id" gorm:"size:64;index"`
+	Name       string     `json:"name" gorm:"size:64"`
+	Prefix     string     `json:"prefix" gorm:"size:16"` // first characters, to tell keys apart
+	Hash       string     `json:"-" gorm:"size:64;uniqueIndex"`
+	Scopes     Scopes     `json:"scopes" gorm:"size:255"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // nil = never
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty" gorm:"size:45"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (APIKey) TableName() string { return "api_keys" }
+
+// HashAPIKey returns the stored form of a key.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyPrefix returns the part of a key shown in listings.
+func apiKeyPrefix(key string) string {
+	return key[:min(len(key), 11)] // "sk-" + 8 hex digits
+}
+
+// ─────────────────────────────────────────────
+// KeyService
+// ─────────────────────────────────────────────
+
+// KeyService manages named API keys and authenticates requests.
+type KeyService struct {
+	db    *gorm.DB
+	users UserService
+	cache Cache
+	now   func() time.Time
+}
+
+// NewKeyService creates a key service. Keys not found in api_keys are
+// looked up as account keys through users.GetByAPIKey. cache should be the
+// one users was created with, so both see each other's invalidations.
+func NewKeyService(db *gorm.DB, users UserService, cache Cache) *KeyService {
+	return &KeyService{db: db, users: users, cache: cache, now: time.Now}
+}
+
+// Create issues a key and returns it with its plaintext, which is not
+// stored. scopes must already be validated (ParseScopes).
+func (s *KeyService) Create(ctx context.Context, userID, name string, scopes Scopes, expiresAt *time.Time) (*APIKey, string, error) {
+	return s.create(s.db.WithContext(ctx), userID, name, scopes, expiresAt)
+}
+
+// Replace is Create, revoking the user's other active keys of the same
+// name in the same transaction. Clients that fetch a fresh key on every
+// login (the Telegram login page) use it so their keys do not pile up
+// against the per-user limit.
+func (s *KeyService) Replace(ctx context.Context, userID, name string, scopes Scopes, expiresAt *time.Time) (*APIKey, string, error) {
+	var (
+		old   []APIKey
+		k     *APIKey
+		plain string
+	)
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ? AND name = ? AND revoked_at IS NULL", userID, name).Find(&old).Error
+		if err != nil {
+			return err
+		}
+		if len(old) > 0 {
+			ids := make([]string, len(old))
+			for i, o := range old {
+				ids[i] = o.ID
+			}
+			err := tx.Model(&APIKey{}).Where("id IN ? AND revoked_at IS NULL", ids).Update("revoked_at", s.now()).Error
+			if err != nil {
+				return err
+			}
+		}
+		k, plain, err = s.create(tx, userID, name, scopes, expiresAt)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	for _, o := range old {
+		s.cache.Delete(ctx, keyCacheKey(o.Hash))
+	}
+	return k, plain, nil
+}
+
+func (s *KeyService) create(db *gorm.DB, userID, name string, scopes Scopes, expiresAt *time.Time) (*APIKey, string, error) {
+	var active int64
+	err := db.Model(&APIKey{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Count(&active).Error
+	if err != nil {
+		return nil, "", err
+	}
+	if active >= maxAPIKeysPerUser {
+		return nil, "", fmt.Errorf("%w (at most %d)", ErrTooManyAPIKeys, maxAPIKeysPerUser)
+	}
+
+	plain, err := generateAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+	k := &APIKey{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		Name:      name,
+		Prefix:    apiKeyPrefix(plain),
+		Hash:      HashAPIKey(plain),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+		CreatedAt: s.now(),
+	}
+	if err := db.Create(k).Error; err != nil {
+		return nil, "", err
+	}
+	return k, plain, nil
+}
+
+// List returns the user's keys, newest first, including revoked ones.
+func (s *KeyService) List(ctx context.Context, userID string) ([]APIKey, error) {
+	var keys []APIKey
+	err := s.db.WithContext(ctx).Where("user_id = ?", userID).Order("created_at DESC").Find(&keys).Error
+	return keys, err
+}
+
+// Revoke disables one of the user's keys. Revoking a revoked key is a
+// no-op.
+func (s *KeyService) Revoke(ctx context.Context, userID, keyID string) (*APIKey, error) {
+	var k APIKey
+	err := s.db.WithContext(ctx).Where("id = ? AND user_id = ?", keyID, userID).Take(&k).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if k.RevokedAt != nil {
+		return &k, nil
+	}
+	now := s.now()
+	err = s.db.WithContext(ctx).Model(&k).Where("revoked_at IS NULL").Update("revoked_at", now).Error
+	if err != nil {
+		return nil, err
+	}
+	k.RevokedAt = &now
+	s.cache.Delete(ctx, keyCacheKey(k.Hash))
+	return &k, nil
+}
+
+// Authenticate resolves a presented key to its user and scopes, and
+// records when and from where the key was used. Account keys carry
+// UserScopes. Lookups go through the cache.
+func (s *KeyService) Authenticate(ctx context.Context, raw, ip string) (*User, Scopes, error) {
+	hash := HashAPIKey(raw)
+	e, ok := cacheGet[keyEntry](ctx, s.cache, keyCacheKey(hash))
+	if !ok {
+		var k APIKey
+		err := s.db.WithContext(ctx).Where("hash = ?", hash).Take(&k).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			user, err := s.users.GetByAPIKey(ctx, raw)
+			if err != nil {
+				return nil, nil, err
+			}
+			return user, UserScopes, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if k.RevokedAt != nil {
+			return nil, nil, ErrInvalidAPIKey
+		}
+		e = &keyEntry{
+			UserID:     k.UserID,
+			KeyID:      k.ID,
+			Scopes:     k.Scopes,
+			ExpiresAt:  k.ExpiresAt,
+			LastUsedAt: k.LastUsedAt,
+			LastUsedIP: k.LastUsedIP,
+		}
+		cacheSet(ctx, s.cache, keyCacheKey(hash), e)
+	}
+
+	now := s.now()
+	if e.ExpiresAt != nil && !now.Before(*e.ExpiresAt) {
+		return nil, nil, ErrAPIKeyExpired
+	}
+	user, err := loadUser(ctx, s.db, s.cache, e.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if e.KeyID != "" && (e.LastUsedAt == nil || now.Sub(*e.LastUsedAt) >= lastUsedResolution || e.LastUsedIP != ip) {
+		err := s.db.WithContext(ctx).Model(&APIKey{}).Where("id = ?", e.KeyID).
+			Updates(map[string]any{"last_used_at": now, "last_used_ip": ip}).Error
+		if err == nil {
+			e.LastUsedAt, e.LastUsedIP = &now, ip
+			cacheSet(ctx, s.cache, keyCacheKey(hash), e)
+		}
+	}
+	return user, e.Scopes, nil
+}
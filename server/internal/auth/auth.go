@@ -10,18 +10,32 @@ import (
 // ─────────────────────────────────────────────
 
 type User struct {
-	ID            string     `json:"id" gorm:"primaryKey"`
-	Email         *string    `json:"email,omitempty" gorm:"uniqueIndex"`
-	Password      string     `json:"-"` // bcrypt hash, never serialised
-	Nickname      string     `json:"nickname"`
-	Provider      string     `json:"provider" gorm:"default:email"` // "email" | "telegram"
-	TelegramID    *int64     `json:"telegram_id,omitempty" gorm:"uniqueIndex"`
-	APIKey        string     `json:"api_key" gorm:"uniqueIndex"`   // non-expiring key, issued on login/register
-	Status        string     `json:"status" gorm:"default:active"` // active | banned | suspended
-	LastUsedAt    *time.Time `json:"last_used_at,omitempty"`
-	LastCheckinAt *time.Time `json:"last_checkin_at,omitempty"` // last daily checkin time
-	CreatedAt     time.Time  `json:"created_at"`
-	UpdatedAt     time.Time  `json:"updated_at"`
+	ID              string     `json:"id" gorm:"primaryKey"`
+	Email           *string    `json:"email,omitempty" gorm:"uniqueIndex"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"` // nil until the address is confirmed
+	Password        string     `json:"-"`                           // bcrypt hash, never serialised
+	Nickname        string     `json:"nickname"`
+	Provider        string     `json:"provider" gorm:"default:email"` // "email" | "telegram"
+	TelegramID      *int64     `json:"telegram_id,omitempty" gorm:"uniqueIndex"`
+	APIKey          string     `json:"api_key,omitempty" gorm:"-"`    // account key in plaintext, set only when issued (register, reset)
+	APIKeyHash      string     `json:"-" gorm:"size:64;uniqueIndex"`  // SHA-256 of the account key
+	APIKeyPrefix    string     `json:"api_key_prefix" gorm:"size:16"` // first characters of the account key
+	Status          string     `json:"status" gorm:"default:active"`  // active | banned | suspended | merged
+	LastUsedAt      *time.Time `json:"last_used_at,omitempty"`
+	LastCheckinAt   *time.Time `json:"last_checkin_at,omitempty"`            // last daily checkin time
+	MergedInto      *string    `json:"merged_into,omitempty" gorm:"size:64"` // set when an admin merged the account into another
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// StatusMerged is the status of an account an admin merged into another
+// (User.MergedInto). It is final: such accounts cannot be reactivated.
+const StatusMerged = "merged"
+
+// EmailVerified reports whether the user has no email or has confirmed
+// it. Telegram-only accounts count as verified.
+func (u *User) EmailVerified() bool {
+	return u.Email == nil || u.EmailVerifiedAt != nil
 }
 
 // ─────────────────────────────────────────────
@@ -38,20 +52,44 @@ type UserService interface {
 	// A unique API key is generated and returned with the User.
 	Register(ctx context.Context, email, password, nickname string) (*User, error)
 
-	// LoginEmail authenticates via email + password, returns the user (incl. API key).
+	// LoginEmail authenticates via email + password. The account key is
+	// not returned (only its hash is stored); callers open a session.
 	LoginEmail(ctx context.Context, email, password string) (*User, error)
 
-	// LoginTelegram authenticates via Telegram OAuth callback data.
+	// LoginTelegram authenticates via Telegram OAuth callback data,
+	// creating the user on first login (with a new account key in
+	// User.APIKey).
 	// Concrete parameter type TBD — depends on Telegram Bot API docs at implementation time.
 	LoginTelegram(ctx context.Context, telegramData map[string]interface{}) (*User, error)
 
-	// GetByAPIKey looks up a user by their API key.
-	// This is the main method used by the auth middleware on every request.
+	// GetByAPIKey looks up a user by their account key.
+	// This is the main method used by the auth middleware on every request,
+	// so lookups are cached briefly.
 	GetByAPIKey(ctx context.Context, apiKey string) (*User, error)
 
 	// GetByID retrieves a user by their internal ID.
 	GetByID(ctx context.Context, userID string) (*User, error)
 
+	// Resolve finds a user by internal ID, email or Telegram ID, in that
+	// order. Used where users name each other (transfers).
+	Resolve(ctx context.Context, ref string) (*User, error)
+
+	// ChangePassword sets a new password after checking the current one
+	// (ErrInvalidCredential). Fails with ErrNoPassword for accounts
+	// without a password.
+	ChangePassword(ctx context.Context, userID, current, next string) error
+
+	// LinkTelegram / LinkEmail add a login identity the user lacks
+	// (ErrAlreadyLinked), unless another account has it (ErrIdentityTaken).
+	// A linked email starts out unverified.
+	LinkTelegram(ctx context.Context, userID string, telegramID int64) (*User, error)
+	LinkEmail(ctx context.Context, userID, email, password string) (*User, error)
+
+	// UnlinkTelegram / UnlinkEmail remove a login identity, as long as the
+	// other one remains (ErrLastIdentity).
+	UnlinkTelegram(ctx context.Context, userID string) (*User, error)
+	UnlinkEmail(ctx context.Context, userID string) (*User, error)
+
 	// ResetAPIKey regenerates the user's API key (invalidates old one).
 	ResetAPIKey(ctx context.Context, userID string) (*User, error)
 
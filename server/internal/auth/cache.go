@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// ─────────────────────────────────────────────
+// Lookup cache
+//
+// Every API request resolves its key to a user. The cache keeps, for a
+// short TTL:
+//
+//	key:{sha256}      → keyEntry (which user and scopes a key stands for)
+//	session:{sha256}  → sessionEntry (which session an access token belongs to)
+//	user:{id}         → User
+//
+// Entries are deleted whenever the key or user changes (reset, revoke,
+// status, ...); the TTL bounds staleness if a delete is lost.
+// ─────────────────────────────────────────────
+
+// Cache stores serialized lookups.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, bool)
+	Set(ctx context.Context, key string, value []byte)
+	Delete(ctx context.Context, keys ...string)
+}
+
+// NewCache returns a Redis cache shared by all instances, an in-process
+// LRU when running without Redis, or a no-op cache when cfg.AuthCacheTTL
+// is 0.
+func NewCache(cfg *config.Config, rdb *redis.Client) Cache {
+	switch {
+	case cfg.AuthCacheTTL <= 0:
+		return nopCache{}
+	case cfg.SchedulerBackend == "memory" || rdb == nil:
+		return NewMemoryCache(cfg.AuthCacheTTL, 10000)
+	default:
+		return NewRedisCache(rdb, cfg.AuthCacheTTL)
+	}
+}
+
+// keyEntry is what an API key resolves to.
+type keyEntry struct {
+	UserID string `json:"user_id"`
+	KeyID  string `json:"key_id,omitempty"` // named key; empty for the account key
+	Scopes Scopes `json:"scopes"`
+
+	// Named keys only.
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+}
+
+func keyCacheKey(hash string) string { return "key:" + hash }
+func userCacheKey(id string) string  { return "user:" + id }
+
+func cacheGet[T any](ctx context.Context, c Cache, key string) (*T, bool) {
+	data, ok := c.Get(ctx, key)
+	if !ok {
+		return nil, false
+	}
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, false
+	}
+	return &v, true
+}
+
+func cacheSet(ctx context.Context, c Cache, key string, v any) {
+	if data, err := json.Marshal(v); err == nil {
+		c.Set(ctx, key, data)
+	}
+}
+
+// loadUser returns the user with id, from the cache if possible. Cached
+// users come from their JSON form, so Password is empty: callers that
+// check passwords must read the database.
+func loadUser(ctx context.Context, db *gorm.DB, c Cache, id string) (*User, error) {
+	if u, ok := cacheGet[User](ctx, c, userCacheKey(id)); ok {
+		return u, nil
+	}
+	var user User
+	if err := db.WithContext(ctx).Where("id = ?", id).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	cacheSet(ctx, c, userCacheKey(id), &user)
+	return &user, nil
+}
+
+// ForgetUser drops everything cached for the user: the user itself and
+// the entries of its account key and named keys. Used after changes made
+// outside the auth services, such as an account merge moving keys.
+func ForgetUser(ctx context.Context, db *gorm.DB, c Cache, userID string) error {
+	keys := []string{userCacheKey(userID)}
+	var user User
+	err := db.WithContext(ctx).Select("api_key_hash").Where("id = ?", userID).Take(&user).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	if user.APIKeyHash != "" {
+		keys = append(keys, keyCacheKey(user.APIKeyHash))
+	}
+	var hashes []string
+	if err := db.WithContext(ctx).Model(&APIKey{}).Where("user_id = ?", userID).Pluck("hash", &hashes).Error; err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		keys = append(keys, keyCacheKey(h))
+	}
+	c.Delete(ctx, keys...)
+	return nil
+}
+
+// ─────────────────────────────────────────────
+// Implementations
+// ─────────────────────────────────────────────
+
+type nopCache struct{}
+
+func (nopCache) Get(context.Context, string) ([]byte, bool) { return nil, false }
+func (nopCache) Set(context.Context, string, []byte)        {}
+func (nopCache) Delete(context.Context, ...string)          {}
+
+// RedisCache keeps entries under "authc:{key}".
+type RedisCache struct {
+	rdb *redis.Client
+	ttl time.Duration
+}
+
+// NewRedisCache creates a Redis-backed cache.
+func NewRedisCache(rdb *redis.Client, ttl time.Duration) *RedisCache {
+	return &RedisCache{rdb: rdb, ttl: ttl}
+}
+
+func (c *RedisCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	data, err := c.rdb.Get(ctx, "authc:"+key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Printf("[auth] cache get: %v", err)
+		}
+		return nil, false
+	}
+	return data, true
+}
+
+func (c *RedisCache) Set(ctx context.Context, key string, value []byte) {
+	if err := c.rdb.Set(ctx, "authc:"+key, value, c.ttl).Err(); err != nil {
+		log.Printf("[auth] cache set: %v", err)
+	}
+}
+
+func (c *RedisCache) Delete(ctx context.Context, keys ...string) {
+	prefixed := make([]string, len(keys))
+	for i, k := range keys {
+		prefixed[i] = "authc:" + k
+	}
+	// Must not be skipped because the request was cancelled.
+	if err := c.rdb.Del(context.WithoutCancel(ctx), prefixed...).Err(); err != nil {
+		log.Printf("[auth] cache delete: %v (stale for up to %s)", err, c.ttl)
+	}
+}
+
+// MemoryCache is an in-process LRU with a per-entry TTL.
+type MemoryCache struct {
+	ttl time.Duration
+	cap int
+
+	mu      sync.Mutex
+	order   *list.List // front = most recently used
+	entries map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewMemoryCache creates an LRU holding at most capacity entries.
+func NewMemoryCache(ttl time.Duration, capacity int) *MemoryCache {
+	return &MemoryCache{ttl: ttl, cap: capacity, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *MemoryCache) Get(_ context.Context, key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*memoryEntry)
+	if time.Now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *MemoryCache) Set(_ context.Context, key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &memoryEntry{key: key, value: value, expires: time.Now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(e)
+	for c.order.Len() > c.cap {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryEntry).key)
+	}
+}
+
+func (c *MemoryCache) Delete(_ context.Context, keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if el, ok := c.entries[key]; ok {
+			c.order.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/mail"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ─────────────────────────────────────────────
+// Email verification & password reset
+//
+// Both work by mailing a single-use token to the account's address. Like
+// API keys, only SHA-256 hashes of the tokens are stored.
+// ─────────────────────────────────────────────
+
+// Token purposes.
+const (
+	PurposeVerifyEmail   = "verify_email"
+	PurposeResetPassword = "reset_password"
+)
+
+var (
+	ErrInvalidToken    = errors.New("invalid or expired token")
+	ErrNoEmail         = errors.New("account has no email")
+	ErrAlreadyVerified = errors.New("email already verified")
+	ErrMailThrottled   = errors.New("an email was sent recently, try again later")
+)
+
+// mailInterval is the minimum time between two mails of the same kind to
+// one user.
+const mailInterval = time.Minute
+
+// EmailToken is a mailed verification or password reset token.
+type EmailToken struct {
+	ID        string `gorm:"primaryKey;size:36"`
+	UserID    string `gorm:"size:64;index"`
+	Purpose   string `gorm:"size:32"`
+	Email     string `gorm:"size:255"` // address the token was sent to
+	Hash      string `gorm:"size:64;uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+func (EmailToken) TableName() string { return "email_tokens" }
+
+// EmailService sends verification and password reset mails and redeems
+// their tokens.
+type EmailService struct {
+	db       *gorm.DB
+	cache    Cache
+	mailer   mail.Mailer
+	sessions *SessionService
+	cfg      *config.Config
+	now      func() time.Time
+	resets   chan string // addresses waiting for a password reset mail
+}
+
+// NewEmailService creates an email service. Password reset mails are
+// sent by Run. Resetting a password ends the user's sessions in sessions;
+// cache is the shared auth cache.
+func NewEmailService(db *gorm.DB, cache Cache, mailer mail.Mailer, sessions *SessionService, cfg *config.Config) *EmailService {
+	return &EmailService{db: db, cache: cache, mailer: mailer, sessions: sessions, cfg: cfg, now: time.Now,
+		resets: make(chan string, 256)}
+}
+
+// SendVerification mails the user a link to confirm their address.
+func (s *EmailService) SendVerification(ctx context.Context, user *User) error {
+	if user.Email == nil {
+		return ErrNoEmail
+	}
+	if user.EmailVerifiedAt != nil {
+		return ErrAlreadyVerified
+	}
+	token, err := s.issue(ctx, user.ID, PurposeVerifyEmail, *user.Email, s.cfg.EmailVerifyTTL)
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(ctx, mail.Message{
+		To:      *user.Email,
+		Subject: "验证邮箱地址",
+		Body: fmt.Sprintf("%s\n\n请确认 %s 是你的 Archive-at-Home 账户邮箱。\n\n%s\n\n%s内有效。如果你没有注册，请忽略这封邮件。\n",
+			greeting(user), *user.Email, tokenLine(s.cfg.MailVerifyURL, token, "/auth/email/verify"), humanDuration(s.cfg.EmailVerifyTTL)),
+	})
+}
+
+// Verify redeems a verification token and marks the address verified.
+// The token is rejected if the account's email changed since it was sent.
+func (s *EmailService) Verify(ctx context.Context, token string) (*User, error) {
+	var userID string
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		t, err := s.claim(ctx, tx, token, PurposeVerifyEmail)
+		if err != nil {
+			return err
+		}
+		res := tx.Model(&User{}).Where("id = ? AND email = ?", t.UserID, t.Email).
+			Updates(map[string]interface{}{"email_verified_at": s.now(), "updated_at": s.now()})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInvalidToken
+		}
+		userID = t.UserID
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.cache.Delete(ctx, userCacheKey(userID))
+	return loadUser(ctx, s.db, s.cache, userID)
+}
+
+// ForgotPassword queues a password reset mail to the account with email,
+// if there is one, and returns at once. The lookup and the mail happen in
+// the background so neither the response nor its timing reveals which
+// addresses exist; unknown addresses and throttled requests are dropped
+// silently.
+func (s *EmailService) ForgotPassword(email string) {
+	select {
+	case s.resets <- strings.ToLower(strings.TrimSpace(email)):
+	default:
+		log.Printf("[auth] password reset queue full, dropped request")
+	}
+}
+
+// Run sends queued password reset mails one at a time, so repeated
+// requests for one address see each other's tokens and are throttled.
+// Blocks until ctx is cancelled; requests still queued then are dropped.
+func (s *EmailService) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case email := <-s.resets:
+			if err := s.sendPasswordReset(ctx, email); err != nil && ctx.Err() == nil {
+				log.Printf("[auth] password reset mail: %v", err)
+			}
+		}
+	}
+}
+
+func (s *EmailService) sendPasswordReset(ctx context.Context, email string) error {
+	var user User
+	err := s.db.WithContext(ctx).Where("email = ?", email).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := s.issue(ctx, user.ID, PurposeResetPassword, email, s.cfg.PasswordResetTTL)
+	if errors.Is(err, ErrMailThrottled) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "重置密码",
+		Body: fmt.Sprintf("%s\n\n有人申请重置你的 Archive-at-Home 账户密码。\n\n%s\n\n%s内有效。如果不是你本人操作，请忽略这封邮件，密码不会改变。\n",
+			greeting(&user), tokenLine(s.cfg.MailResetURL, token, "/auth/password/reset"), humanDuration(s.cfg.PasswordResetTTL)),
+	})
+}
+
+// ResetPassword redeems a reset token and sets a new password. The token
+// proves the user reads the address, so it is marked verified too. All of
+// the user's sessions are ended and other outstanding reset tokens
+// dropped; API keys are unaffected.
+func (s *EmailService) ResetPassword(ctx context.Context, token, password string) error {
+	var userID string
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		t, err := s.claim(ctx, tx, token, PurposeResetPassword)
+		if err != nil {
+			return err
+		}
+		userID = t.UserID
+		if err := setPassword(ctx, tx, t.UserID, password); err != nil {
+			return err
+		}
+		err = tx.Model(&User{}).
+			Where("id = ? AND email = ? AND email_verified_at IS NULL", t.UserID, t.Email).
+			Update("email_verified_at", s.now()).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&EmailToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", t.UserID, PurposeResetPassword).
+			Update("used_at", s.now()).Error
+	})
+	if err != nil {
+		return err
+	}
+	s.cache.Delete(ctx, userCacheKey(userID))
+	return s.sessions.RevokeAll(ctx, userID, "")
+}
+
+// issue creates a token, refusing if one of the same kind was issued to
+// the user within mailInterval. Spent tokens of that kind are removed.
+func (s *EmailService) issue(ctx context.Context, userID, purpose, email string, ttl time.Duration) (string, error) {
+	now := s.now()
+	db := s.db.WithContext(ctx)
+
+	var recent int64
+	err := db.Model(&EmailToken{}).
+		Where("user_id = ? AND purpose = ? AND created_at > ?", userID, purpose, now.Add(-mailInterval)).
+		Count(&recent).Error
+	if err != nil {
+		return "", err
+	}
+	if recent > 0 {
+		return "", ErrMailThrottled
+	}
+	db.Where("user_id = ? AND purpose = ? AND (used_at IS NOT NULL OR expires_at <= ?)", userID, purpose, now).
+		Delete(&EmailToken{})
+
+	token, err := randomToken("")
+	if err != nil {
+		return "", err
+	}
+	t := &EmailToken{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		Purpose:   purpose,
+		Email:     email,
+		Hash:      HashAPIKey(token),
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+	if err := db.Create(t).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// claim marks an unexpired, unused token of purpose as used and returns
+// it. Of two concurrent claims only one succeeds.
+func (s *EmailService) claim(ctx context.Context, tx *gorm.DB, token, purpose string) (*EmailToken, error) {
+	var t EmailToken
+	err := tx.WithContext(ctx).Where("hash = ? AND purpose = ?", HashAPIKey(token), purpose).Take(&t).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	if t.UsedAt != nil || !now.Before(t.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+	res := tx.WithContext(ctx).Model(&EmailToken{}).Where("id = ? AND used_at IS NULL", t.ID).Update("used_at", now)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrInvalidToken
+	}
+	return &t, nil
+}
+
+// tokenLine is the part of a mail carrying the token: a link built from
+// tmpl, or the bare token and the endpoint to submit it to.
+func tokenLine(tmpl, token, endpoint string) string {
+	if tmpl == "" {
+		return fmt.Sprintf("验证码：%s\n（提交到 POST %s）", token, endpoint)
+	}
+	return "请打开链接：\n" + strings.ReplaceAll(tmpl, "{token}", url.QueryEscape(token))
+}
+
+func greeting(u *User) string {
+	if u.Nickname != "" {
+		return u.Nickname + "，你好："
+	}
+	return "你好："
+}
+
+func humanDuration(d time.Duration) string {
+	switch {
+	case d >= time.Hour && d%time.Hour == 0:
+		return fmt.Sprintf("%d 小时", d/time.Hour)
+	case d >= time.Minute:
+		return fmt.Sprintf("%d 分钟", d/time.Minute)
+	default:
+		return d.String()
+	}
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/dbtest"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/mail"
+)
+
+// outbox collects sent mails on a channel.
+type outbox chan mail.Message
+
+func (o outbox) Send(_ context.Context, msg mail.Message) error {
+	o <- msg
+	return nil
+}
+
+var codeRe = regexp.MustCompile(`验证码：([0-9a-f]+)`)
+
+func (o outbox) code(t *testing.T, to string) string {
+	t.Helper()
+	select {
+	case msg := <-o:
+		m := codeRe.FindStringSubmatch(msg.Body)
+		if msg.To != to || m == nil {
+			t.Fatalf("mail = %+v, want a code for %s", msg, to)
+		}
+		return m[1]
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no mail to %s", to)
+		return ""
+	}
+}
+
+func newTestEmails(t *testing.T) (*EmailService, UserService, outbox) {
+	t.Helper()
+	db := dbtest.Open(t, &User{}, &APIKey{}, &Session{}, &EmailToken{})
+	cache := NewMemoryCache(time.Minute, 100)
+	sessions := NewSessionService(db, cache, time.Minute, time.Hour)
+	mails := make(outbox, 10)
+	cfg := &config.Config{EmailVerifyTTL: time.Hour, PasswordResetTTL: time.Hour}
+	emails := NewEmailService(db, cache, mails, sessions, cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go emails.Run(ctx)
+	return emails, NewUserService(db, cache), mails
+}
+
+// claimConcurrently redeems the same token from several goroutines and
+// returns how many succeeded.
+func claimConcurrently(t *testing.T, redeem func() error) int {
+	t.Helper()
+	const attempts = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, attempts)
+	for range attempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- redeem()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	n := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			n++
+		case !errors.Is(err, ErrInvalidToken):
+			t.Errorf("redeem: %v", err)
+		}
+	}
+	return n
+}
+
+func TestEmailTokenClaimRace(t *testing.T) {
+	emails, users, mails := newTestEmails(t)
+	ctx := context.Background()
+	u, err := users.Register(ctx, "alice@example.com", "first-pw", "")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	if err := emails.SendVerification(ctx, u); err != nil {
+		t.Fatalf("send verification: %v", err)
+	}
+	verify := mails.code(t, "alice@example.com")
+	if n := claimConcurrently(t, func() error { _, err := emails.Verify(ctx, verify); return err }); n != 1 {
+		t.Fatalf("%d concurrent verifications with one token succeeded, want 1", n)
+	}
+
+	emails.ForgotPassword("alice@example.com")
+	reset := mails.code(t, "alice@example.com")
+	if n := claimConcurrently(t, func() error { return emails.ResetPassword(ctx, reset, "second-pw") }); n != 1 {
+		t.Fatalf("%d concurrent resets with one token succeeded, want 1", n)
+	}
+	if _, err := users.LoginEmail(ctx, "alice@example.com", "second-pw"); err != nil {
+		t.Fatalf("login with new password: %v", err)
+	}
+}
+
+func TestEmailTokenExpiry(t *testing.T) {
+	emails, users, mails := newTestEmails(t)
+	ctx := context.Background()
+	u, _ := users.Register(ctx, "alice@example.com", "pw-123", "")
+	now := time.Now()
+	emails.now = func() time.Time { return now }
+
+	if err := emails.SendVerification(ctx, u); err != nil {
+		t.Fatalf("send verification: %v", err)
+	}
+	token := mails.code(t, "alice@example.com")
+	if err := emails.SendVerification(ctx, u); !errors.Is(err, ErrMailThrottled) {
+		t.Fatalf("immediate resend = %v, want ErrMailThrottled", err)
+	}
+	now = now.Add(time.Hour)
+	if _, err := emails.Verify(ctx, token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("verify expired token = %v, want ErrInvalidToken", err)
+	}
+	if _, err := emails.Verify(ctx, "not-a-token"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("verify unknown token = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestForgotPasswordInBackground(t *testing.T) {
+	emails, users, mails := newTestEmails(t)
+	ctx := context.Background()
+	users.Register(ctx, "alice@example.com", "pw-123", "")
+	users.Register(ctx, "bob@example.com", "pw-123", "")
+
+	// Mails go out in order: unknown addresses get none and a repeated
+	// request within mailInterval is throttled, so bob's is the second.
+	for _, addr := range []string{"nobody@example.com", " Alice@Example.com ", "alice@example.com", "bob@example.com"} {
+		emails.ForgotPassword(addr)
+	}
+	mails.code(t, "alice@example.com")
+	mails.code(t, "bob@example.com")
+}
@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// ─────────────────────────────────────────────
+// Linked identities
+//
+// An account can log in with an email and password, a Telegram account,
+// or both. Users link the one they lack and unlink one as long as the
+// other remains, so the same person does not end up with two accounts
+// (and two balances). Accounts that already exist twice are combined by
+// an admin merge (package merge).
+// ─────────────────────────────────────────────
+
+var (
+	ErrIdentityTaken = errors.New("identity is linked to another account")
+	ErrAlreadyLinked = errors.New("account already has an identity of this kind")
+	ErrNotLinked     = errors.New("identity is not linked")
+	ErrLastIdentity  = errors.New("cannot unlink the only way to log in")
+)
+
+// LinkTelegram attaches a Telegram account to the user.
+func (s *userService) LinkTelegram(ctx context.Context, userID string, telegramID int64) (*User, error) {
+	user, err := s.lookup(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TelegramID != nil {
+		if *user.TelegramID == telegramID {
+			return user, nil
+		}
+		return nil, ErrAlreadyLinked
+	}
+	if err := s.identityFree(ctx, "telegram_id = ?", telegramID); err != nil {
+		return nil, err
+	}
+
+	return s.updateIdentity(ctx, userID, "telegram_id IS NULL", map[string]interface{}{
+		"telegram_id": telegramID,
+	}, ErrAlreadyLinked)
+}
+
+// UnlinkTelegram detaches the user's Telegram account. The user must have
+// an email to log in with instead.
+func (s *userService) UnlinkTelegram(ctx context.Context, userID string) (*User, error) {
+	user, err := s.lookup(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case user.TelegramID == nil:
+		return nil, ErrNotLinked
+	case user.Email == nil:
+		return nil, ErrLastIdentity
+	}
+
+	return s.updateIdentity(ctx, userID, "email IS NOT NULL", map[string]interface{}{
+		"telegram_id": nil,
+	}, ErrLastIdentity)
+}
+
+// LinkEmail gives an account without an email an email and password. The
+// address starts out unverified.
+func (s *userService) LinkEmail(ctx context.Context, userID, email, password string) (*User, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	user, err := s.lookup(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Email != nil {
+		return nil, ErrAlreadyLinked
+	}
+	if err := s.identityFree(ctx, "email = ?", email); err != nil {
+		return nil, err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return s.updateIdentity(ctx, userID, "email IS NULL", map[string]interface{}{
+		"email":             email,
+		"password":          string(hash),
+		"email_verified_at": nil,
+	}, ErrAlreadyLinked)
+}
+
+// UnlinkEmail removes the user's email and password. The user must have a
+// Telegram account to log in with instead.
+func (s *userService) UnlinkEmail(ctx context.Context, userID string) (*User, error) {
+	user, err := s.lookup(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case user.Email == nil:
+		return nil, ErrNotLinked
+	case user.TelegramID == nil:
+		return nil, ErrLastIdentity
+	}
+
+	return s.updateIdentity(ctx, userID, "telegram_id IS NOT NULL", map[string]interface{}{
+		"email":             nil,
+		"password":          "",
+		"email_verified_at": nil,
+	}, ErrLastIdentity)
+}
+
+// lookup reads the user from the database (not the cache: identity
+// changes must see the current row).
+func (s *userService) lookup(ctx context.Context, userID string) (*User, error) {
+	var user User
+	if err := s.db.WithContext(ctx).Where("id = ?", userID).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// identityFree fails with ErrIdentityTaken if another user matches cond.
+func (s *userService) identityFree(ctx context.Context, cond string, arg interface{}) error {
+	var n int64
+	if err := s.db.WithContext(ctx).Model(&User{}).Where(cond, arg).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrIdentityTaken
+	}
+	return nil
+}
+
+// updateIdentity applies updates to the user if guard still holds and
+// returns the updated user. It fails with errGuard if guard no longer
+// holds (a concurrent change).
+func (s *userService) updateIdentity(ctx context.Context, userID, guard string, updates map[string]interface{}, errGuard error) (*User, error) {
+	updates["updated_at"] = time.Now()
+	res := s.db.WithContext(ctx).Model(&User{}).Where("id = ?", userID).Where(guard).Updates(updates)
+	if res.Error != nil {
+		// Lost a race for the unique index against another account
+		// (modernc SQLite errors are not translated by the GORM driver).
+		if errors.Is(res.Error, gorm.ErrDuplicatedKey) || strings.Contains(res.Error.Error(), "UNIQUE constraint failed") {
+			return nil, ErrIdentityTaken
+		}
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, errGuard
+	}
+	s.cache.Delete(ctx, userCacheKey(userID))
+	return s.lookup(ctx, userID)
+}
@@ -5,7 +5,10 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"log"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -20,8 +23,10 @@ import (
 var (
 	ErrUserNotFound      = errors.New("user not found")
 	ErrEmailExists       = errors.New("email already registered")
+	ErrUserMerged        = errors.New("account was merged into another")
 	ErrInvalidCredential = errors.New("invalid email or password")
 	ErrInvalidAPIKey     = errors.New("invalid api key")
+	ErrNoPassword        = errors.New("account has no password")
 )
 
 // ─────────────────────────────────────────────
@@ -29,12 +34,24 @@ var (
 // ─────────────────────────────────────────────
 
 type userService struct {
-	db *gorm.DB
+	db    *gorm.DB
+	cache Cache
+
+	// legacyKeys is set while users.api_key (plaintext keys of earlier
+	// versions) still exists; see MigrateLegacyAPIKeys.
+	legacyKeys atomic.Bool
 }
 
-// NewUserService creates a new UserService backed by the given DB.
-func NewUserService(db *gorm.DB) UserService {
-	return &userService{db: db}
+// NewUserService creates a new UserService backed by the given DB, with
+// API key lookups cached in cache (see NewCache).
+func NewUserService(db *gorm.DB, cache Cache) UserService {
+	s := &userService{db: db, cache: cache}
+	if db.Migrator().HasColumn(&User{}, "api_key") {
+		s.legacyKeys.Store(true)
+		log.Printf("[auth] WARNING: users.api_key still holds plaintext keys of an earlier version; " +
+			"set DROP_LEGACY_API_KEYS=true once every instance is upgraded")
+	}
+	return s
 }
 
 // Register creates a new user with email + password.
@@ -53,23 +70,19 @@ func (s *userService) Register(ctx context.Context, email, password, nickname st
 		return nil, err
 	}
 
-	// Generate API key
-	apiKey, err := generateAPIKey()
-	if err != nil {
-		return nil, err
-	}
-
 	user := &User{
 		ID:        uuid.NewString(),
 		Email:     &email,
 		Password:  string(hash),
 		Nickname:  nickname,
 		Provider:  "email",
-		APIKey:    apiKey,
 		Status:    "active",
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
+	if err := user.issueAPIKey(); err != nil {
+		return nil, err
+	}
 
 	if err := s.db.WithContext(ctx).Create(user).Error; err != nil {
 		return nil, err
@@ -94,11 +107,7 @@ func (s *userService) LoginEmail(ctx context.Context, email, password string) (*
 		return nil, ErrInvalidCredential
 	}
 
-	// Update last used
-	now := time.Now()
-	user.LastUsedAt = &now
-	s.db.WithContext(ctx).Model(&user).Update("last_used_at", now)
-
+	s.touch(ctx, &user)
 	return &user, nil
 }
 
@@ -115,10 +124,7 @@ func (s *userService) LoginTelegram(ctx context.Context, telegramData map[string
 	var user User
 	err := s.db.WithContext(ctx).Where("telegram_id = ?", telegramID).First(&user).Error
 	if err == nil {
-		// User exists, update last used
-		now := time.Now()
-		user.LastUsedAt = &now
-		s.db.WithContext(ctx).Model(&user).Update("last_used_at", now)
+		s.touch(ctx, &user)
 		return &user, nil
 	}
 
@@ -126,12 +132,6 @@ func (s *userService) LoginTelegram(ctx context.Context, telegramData map[string
 		return nil, err
 	}
 
-	// Create new user from Telegram
-	apiKey, err := generateAPIKey()
-	if err != nil {
-		return nil, err
-	}
-
 	// Extract optional fields
 	nickname := ""
 	if firstName, ok := telegramData["first_name"].(string); ok {
@@ -149,11 +149,13 @@ func (s *userService) LoginTelegram(ctx context.Context, telegramData map[string
 		Nickname:   nickname,
 		Provider:   "telegram",
 		TelegramID: &telegramID,
-		APIKey:     apiKey,
 		Status:     "active",
 		CreatedAt:  time.Now(),
 		UpdatedAt:  time.Now(),
 	}
+	if err := user.issueAPIKey(); err != nil {
+		return nil, err
+	}
 
 	if err := s.db.WithContext(ctx).Create(&user).Error; err != nil {
 		return nil, err
@@ -162,18 +164,79 @@ func (s *userService) LoginTelegram(ctx context.Context, telegramData map[string
 	return &user, nil
 }
 
-// GetByAPIKey looks up a user by API key.
+// GetByAPIKey looks up a user by account key, through the cache.
 func (s *userService) GetByAPIKey(ctx context.Context, apiKey string) (*User, error) {
+	hash := HashAPIKey(apiKey)
+	if e, ok := cacheGet[keyEntry](ctx, s.cache, keyCacheKey(hash)); ok && e.KeyID == "" {
+		return loadUser(ctx, s.db, s.cache, e.UserID)
+	}
+
 	var user User
-	if err := s.db.WithContext(ctx).Where("api_key = ?", apiKey).First(&user).Error; err != nil {
+	err := s.db.WithContext(ctx).Where("api_key_hash = ?", hash).First(&user).Error
+	if s.legacyKeys.Load() && strings.HasPrefix(apiKey, "sk-") {
+		legacyErr := s.checkLegacyAPIKey(ctx, apiKey, &user, err)
+		if legacyErr == nil || errors.Is(legacyErr, gorm.ErrRecordNotFound) || !s.legacyColumnGone() {
+			err = legacyErr
+		}
+	}
+	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, ErrInvalidAPIKey
 		}
 		return nil, err
 	}
+	cacheSet(ctx, s.cache, keyCacheKey(hash), keyEntry{UserID: user.ID, Scopes: UserScopes})
+	cacheSet(ctx, s.cache, userCacheKey(user.ID), &user)
 	return &user, nil
 }
 
+// checkLegacyAPIKey reconciles a key lookup (user, err) with users.api_key.
+// During a rolling deploy instances of earlier versions keep issuing and
+// resetting keys in plaintext after MigrateLegacyAPIKeys ran: a key only
+// found there is hashed and accepted, and a hashed key that an earlier
+// instance has since replaced is rejected (and the replacement hashed).
+func (s *userService) checkLegacyAPIKey(ctx context.Context, apiKey string, user *User, err error) error {
+	db := s.db.WithContext(ctx)
+	var row struct {
+		ID     string
+		APIKey *string
+	}
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		if err := db.Table("users").Select("id, api_key").Where("api_key = ?", apiKey).Take(&row).Error; err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		if err := db.Table("users").Select("id, api_key").Where("id = ?", user.ID).Take(&row).Error; err != nil {
+			return err
+		}
+		if row.APIKey == nil || *row.APIKey == "" || *row.APIKey == apiKey {
+			return nil
+		}
+	}
+
+	if err := hashLegacyAPIKey(db, row.ID, *row.APIKey); err != nil {
+		return err
+	}
+	if *row.APIKey != apiKey {
+		return gorm.ErrRecordNotFound
+	}
+	return db.Where("id = ?", row.ID).First(user).Error
+}
+
+// legacyColumnGone reports whether users.api_key has been dropped since
+// this instance started (another instance ran with DROP_LEGACY_API_KEYS),
+// and stops the legacy lookups if so.
+func (s *userService) legacyColumnGone() bool {
+	if s.db.Migrator().HasColumn(&User{}, "api_key") {
+		return false
+	}
+	s.legacyKeys.Store(false)
+	return true
+}
+
 // GetByID retrieves a user by ID.
 func (s *userService) GetByID(ctx context.Context, userID string) (*User, error) {
 	var user User
@@ -186,6 +249,67 @@ func (s *userService) GetByID(ctx context.Context, userID string) (*User, error)
 	return &user, nil
 }
 
+// Resolve finds a user by ID, email or Telegram ID.
+func (s *userService) Resolve(ctx context.Context, ref string) (*User, error) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return nil, ErrUserNotFound
+	}
+
+	q := s.db.WithContext(ctx).Where("id = ?", ref)
+	if strings.Contains(ref, "@") {
+		q = q.Or("email = ?", strings.ToLower(ref))
+	}
+	if tgID, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		q = q.Or("telegram_id = ?", tgID)
+	}
+
+	// A ref can only match several rows if an ID looks like another
+	// user's email or Telegram ID; the ID wins.
+	var users []User
+	if err := q.Find(&users).Error; err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, ErrUserNotFound
+	}
+	for i := range users {
+		if users[i].ID == ref {
+			return &users[i], nil
+		}
+	}
+	return &users[0], nil
+}
+
+// ChangePassword sets a new password after checking the current one.
+func (s *userService) ChangePassword(ctx context.Context, userID, current, next string) error {
+	var user User
+	if err := s.db.WithContext(ctx).Where("id = ?", userID).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		}
+		return err
+	}
+	if user.Password == "" {
+		return ErrNoPassword
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(current)); err != nil {
+		return ErrInvalidCredential
+	}
+	return setPassword(ctx, s.db, userID, next)
+}
+
+// setPassword stores a bcrypt hash of password for the user. db may be a
+// transaction. Cached users carry no password, so the cache is left alone.
+func setPassword(ctx context.Context, db *gorm.DB, userID, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return db.WithContext(ctx).Model(&User{}).Where("id = ?", userID).
+		Updates(map[string]interface{}{"password": string(hash), "updated_at": time.Now()}).Error
+}
+
 // ResetAPIKey regenerates the user's API key.
 func (s *userService) ResetAPIKey(ctx context.Context, userID string) (*User, error) {
 	var user User
@@ -196,25 +320,59 @@ func (s *userService) ResetAPIKey(ctx context.Context, userID string) (*User, er
 		return nil, err
 	}
 
-	newKey, err := generateAPIKey()
-	if err != nil {
+	if err := s.rotateAPIKey(ctx, &user); err != nil {
 		return nil, err
 	}
+	return &user, nil
+}
 
-	user.APIKey = newKey
-	user.UpdatedAt = time.Now()
+// rotateAPIKey issues user a new account key, stores its hash and marks
+// the user as just used. The old key's cache entry is dropped.
+func (s *userService) rotateAPIKey(ctx context.Context, user *User) error {
+	oldHash := user.APIKeyHash
+	if err := user.issueAPIKey(); err != nil {
+		return err
+	}
+	now := time.Now()
+	user.LastUsedAt = &now
+	user.UpdatedAt = now
 
-	if err := s.db.WithContext(ctx).Save(&user).Error; err != nil {
-		return nil, err
+	updates := map[string]interface{}{
+		"api_key_hash":   user.APIKeyHash,
+		"api_key_prefix": user.APIKeyPrefix,
+		"last_used_at":   now,
+		"updated_at":     now,
+	}
+	legacy := s.legacyKeys.Load()
+	if legacy {
+		// Instances of earlier versions would still accept the old key.
+		updates["api_key"] = nil
+	}
+	err := s.db.WithContext(ctx).Model(&User{}).Where("id = ?", user.ID).Updates(updates).Error
+	if err != nil && legacy && s.legacyColumnGone() {
+		delete(updates, "api_key")
+		err = s.db.WithContext(ctx).Model(&User{}).Where("id = ?", user.ID).Updates(updates).Error
+	}
+	if err != nil {
+		return err
 	}
+	s.cache.Delete(ctx, keyCacheKey(oldHash), userCacheKey(user.ID))
+	return nil
+}
 
-	return &user, nil
+// touch records that user just logged in.
+func (s *userService) touch(ctx context.Context, user *User) {
+	now := time.Now()
+	user.LastUsedAt = &now
+	s.db.WithContext(ctx).Model(&User{}).Where("id = ?", user.ID).Update("last_used_at", now)
+	s.cache.Delete(ctx, userCacheKey(user.ID))
 }
 
-// SetStatus sets user account status.
+// SetStatus sets user account status. Merged accounts keep theirs
+// (ErrUserMerged).
 func (s *userService) SetStatus(ctx context.Context, userID string, status string) error {
 	result := s.db.WithContext(ctx).Model(&User{}).
-		Where("id = ?", userID).
+		Where("id = ? AND status <> ?", userID, StatusMerged).
 		Updates(map[string]interface{}{
 			"status":     status,
 			"updated_at": time.Now(),
@@ -223,8 +381,12 @@ func (s *userService) SetStatus(ctx context.Context, userID string, status strin
 		return result.Error
 	}
 	if result.RowsAffected == 0 {
-		return ErrUserNotFound
+		if _, err := s.lookup(ctx, userID); err != nil {
+			return err
+		}
+		return ErrUserMerged
 	}
+	s.cache.Delete(ctx, userCacheKey(userID))
 	return nil
 }
 
@@ -243,6 +405,7 @@ func (s *userService) UpdateLastCheckin(ctx context.Context, userID string) erro
 	if result.RowsAffected == 0 {
 		return ErrUserNotFound
 	}
+	s.cache.Delete(ctx, userCacheKey(userID))
 	return nil
 }
 
@@ -250,6 +413,77 @@ func (s *userService) UpdateLastCheckin(ctx context.Context, userID string) erro
 // Helpers
 // ─────────────────────────────────────────────
 
+// issueAPIKey gives u a new account key: the plaintext in APIKey, to be
+// shown once, and what is stored.
+func (u *User) issueAPIKey() error {
+	key, err := generateAPIKey()
+	if err != nil {
+		return err
+	}
+	u.APIKey = key
+	u.APIKeyHash = HashAPIKey(key)
+	u.APIKeyPrefix = apiKeyPrefix(key)
+	return nil
+}
+
+// MigrateLegacyAPIKeys hashes account keys that earlier versions stored in
+// plaintext in users.api_key. Run after AutoMigrate.
+//
+// The column itself is kept so that instances of the earlier version keep
+// working during a rolling deploy; keys they issue meanwhile are hashed on
+// first use. Once every instance runs this version, DropLegacyAPIKeys
+// removes it.
+func MigrateLegacyAPIKeys(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&User{}, "api_key") {
+		return nil
+	}
+
+	var rows []struct {
+		ID     string
+		APIKey string
+	}
+	err := db.Table("users").Select("id, api_key").
+		Where("api_key IS NOT NULL AND api_key <> '' AND (api_key_hash IS NULL OR api_key_hash = '')").
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		if err := hashLegacyAPIKey(db, r.ID, r.APIKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DropLegacyAPIKeys hashes any remaining plaintext keys and drops
+// users.api_key. Only run it once no instance of a version that reads the
+// column is left (DROP_LEGACY_API_KEYS).
+func DropLegacyAPIKeys(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasColumn(&User{}, "api_key") {
+		return nil
+	}
+	if err := MigrateLegacyAPIKeys(db); err != nil {
+		return err
+	}
+	if m.HasIndex(&User{}, "idx_users_api_key") {
+		if err := m.DropIndex(&User{}, "idx_users_api_key"); err != nil {
+			return err
+		}
+	}
+	// Plain ALTER TABLE: the SQLite migrator rebuilds the table by parsing its
+	// DDL and silently keeps columns it fails to match.
+	return db.Exec("ALTER TABLE users DROP COLUMN api_key").Error
+}
+
+func hashLegacyAPIKey(db *gorm.DB, userID, apiKey string) error {
+	return db.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"api_key_hash":   HashAPIKey(apiKey),
+		"api_key_prefix": apiKeyPrefix(apiKey),
+	}).Error
+}
+
 // generateAPIKey creates a new API key with "sk-" prefix.
 func generateAPIKey() (string, error) {
 	bytes := make([]byte, 24)
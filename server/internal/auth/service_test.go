@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/dbtest"
+	"gorm.io/gorm"
+)
+
+// legacyDB returns a database with the users table of an earlier version:
+// plaintext keys in api_key, one user already in it.
+func legacyDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db := dbtest.Open(t, &User{})
+	if err := db.Exec("ALTER TABLE users ADD COLUMN api_key TEXT").Error; err != nil {
+		t.Fatalf("add legacy column: %v", err)
+	}
+	insertLegacyUser(t, db, "old", "sk-old")
+	return db
+}
+
+// insertLegacyUser adds a user the way an instance of an earlier version
+// would: plaintext key, no hash.
+func insertLegacyUser(t *testing.T, db *gorm.DB, id, key string) {
+	t.Helper()
+	err := db.Exec("INSERT INTO users (id, provider, status, api_key, created_at, updated_at) VALUES (?, 'email', 'active', ?, ?, ?)",
+		id, key, time.Now(), time.Now()).Error
+	if err != nil {
+		t.Fatalf("insert legacy user: %v", err)
+	}
+}
+
+func wantKey(t *testing.T, s UserService, key, wantUser string) {
+	t.Helper()
+	u, err := s.GetByAPIKey(context.Background(), key)
+	switch {
+	case wantUser == "" && !errors.Is(err, ErrInvalidAPIKey):
+		t.Fatalf("key %s = %v, %v; want ErrInvalidAPIKey", key, u, err)
+	case wantUser != "" && (err != nil || u.ID != wantUser):
+		t.Fatalf("key %s = %v, %v; want user %s", key, u, err, wantUser)
+	}
+}
+
+func TestLegacyAPIKeysDuringRollingDeploy(t *testing.T) {
+	db := legacyDB(t)
+	if err := MigrateLegacyAPIKeys(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if !db.Migrator().HasColumn(&User{}, "api_key") {
+		t.Fatal("migration dropped users.api_key while old instances may still run")
+	}
+	s := NewUserService(db, NewMemoryCache(0, 0))
+	wantKey(t, s, "sk-old", "old")
+
+	// An old instance registers a user after the migration ran.
+	insertLegacyUser(t, db, "late", "sk-late")
+	wantKey(t, s, "sk-late", "late")
+
+	// An old instance resets a key: the hashed one stops working.
+	db.Exec("UPDATE users SET api_key = ? WHERE id = ?", "sk-old-2", "old")
+	wantKey(t, s, "sk-old", "")
+	wantKey(t, s, "sk-old-2", "old")
+
+	// A reset here clears the plaintext copy old instances would accept.
+	u, err := s.ResetAPIKey(context.Background(), "late")
+	if err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	var plaintext *string
+	db.Raw("SELECT api_key FROM users WHERE id = ?", "late").Scan(&plaintext)
+	if plaintext != nil {
+		t.Fatalf("api_key after reset = %q, want NULL", *plaintext)
+	}
+	wantKey(t, s, "sk-late", "")
+	wantKey(t, s, u.APIKey, "late")
+
+	if err := DropLegacyAPIKeys(db); err != nil {
+		t.Fatalf("drop: %v", err)
+	}
+	if db.Migrator().HasColumn(&User{}, "api_key") {
+		t.Fatal("users.api_key still exists after DropLegacyAPIKeys")
+	}
+	wantKey(t, NewUserService(db, NewMemoryCache(0, 0)), "sk-old-2", "old")
+
+	// An instance started before the drop carries on without the column.
+	wantKey(t, s, "sk-unknown", "")
+	if u, err = s.ResetAPIKey(context.Background(), "old"); err != nil {
+		t.Fatalf("reset after drop: %v", err)
+	}
+	wantKey(t, s, u.APIKey, "old")
+}
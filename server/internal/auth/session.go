@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ─────────────────────────────────────────────
+// Login Sessions
+//
+// Logging in opens a session with two opaque tokens: a short-lived access
+// token, accepted by the API like an API key, and a longer-lived refresh
+// token that exchanges for a new pair. Web clients keep only these, never
+// the account key. Like API keys, only SHA-256 hashes are stored.
+// ─────────────────────────────────────────────
+
+// Token prefixes; the auth middleware tells access tokens from API keys
+// by the prefix.
+const (
+	AccessTokenPrefix  = "at-"
+	RefreshTokenPrefix = "rt-"
+)
+
+var ErrInvalidSession = errors.New("invalid or expired session")
+
+// Session is one login.
+type Session struct {
+	ID              string     `json:"id" gorm:"primaryKey;size:36"`
+	UserID          string     `json:"-" gorm:"size:64;index"`
+	AccessHash      string     `json:"-" gorm:"size:64;uniqueIndex"`
+	RefreshHash     string     `json:"-" gorm:"size:64;uniqueIndex"`
+	AccessExpiresAt time.Time  `json:"-"`
+	ExpiresAt       time.Time  `json:"expires_at"` // refresh token expiry
+	UserAgent       string     `json:"user_agent" gorm:"size:255"`
+	IP              string     `json:"ip" gorm:"size:45"`
+	CreatedAt       time.Time  `json:"created_at"`
+	RefreshedAt     time.Time  `json:"refreshed_at"` // last token refresh (or creation)
+	RevokedAt       *time.Time `json:"-"`
+	Current         bool       `json:"current" gorm:"-"` // the session the listing request was made with
+}
+
+// Tokens is a session's token pair, returned on login and refresh.
+type Tokens struct {
+	SessionID        string    `json:"session_id"`
+	AccessToken      string    `json:"access_token"`
+	RefreshToken     string    `json:"refresh_token"`
+	TokenType        string    `json:"token_type"`
+	ExpiresIn        int       `json:"expires_in"` // access token lifetime, seconds
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// sessionEntry is what an access token resolves to in the cache.
+type sessionEntry struct {
+	SessionID string    `json:"session_id"`
+	UserID    string    `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func sessionCacheKey(accessHash string) string { return "session:" + accessHash }
+
+// SessionService opens, refreshes and revokes sessions.
+type SessionService struct {
+	db         *gorm.DB
+	cache      Cache
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	now        func() time.Time
+}
+
+// NewSessionService creates a session service. cache should be shared with
+// the user and key services.
+func NewSessionService(db *gorm.DB, cache Cache, accessTTL, refreshTTL time.Duration) *SessionService {
+	return &SessionService{db: db, cache: cache, accessTTL: accessTTL, refreshTTL: refreshTTL, now: time.Now}
+}
+
+// Create opens a session for the user. Expired and revoked sessions of
+// the user are removed at the same time.
+func (s *SessionService) Create(ctx context.Context, userID, userAgent, ip string) (*Tokens, error) {
+	now := s.now()
+	s.db.WithContext(ctx).
+		Where("user_id = ? AND (expires_at <= ? OR revoked_at IS NOT NULL)", userID, now).
+		Delete(&Session{})
+
+	sess := &Session{
+		ID:          uuid.NewString(),
+		UserID:      userID,
+		UserAgent:   truncate(userAgent, 255),
+		IP:          ip,
+		CreatedAt:   now,
+		RefreshedAt: now,
+		ExpiresAt:   now.Add(s.refreshTTL),
+	}
+	tokens, err := s.issue(sess, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.WithContext(ctx).Create(sess).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Refresh exchanges a refresh token for a new token pair. Both old tokens
+// stop working.
+func (s *SessionService) Refresh(ctx context.Context, refreshToken, ip string) (*Tokens, error) {
+	now := s.now()
+	var sess Session
+	err := s.db.WithContext(ctx).Where("refresh_hash = ?", HashAPIKey(refreshToken)).Take(&sess).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sess.RevokedAt != nil || !now.Before(sess.ExpiresAt) {
+		return nil, ErrInvalidSession
+	}
+
+	oldAccess, oldRefresh := sess.AccessHash, sess.RefreshHash
+	tokens, err := s.issue(&sess, now)
+	if err != nil {
+		return nil, err
+	}
+	// Conditional on the old refresh hash, so of two concurrent refreshes
+	// with the same token only one succeeds.
+	res := s.db.WithContext(ctx).Model(&Session{}).
+		Where("id = ? AND refresh_hash = ?", sess.ID, oldRefresh).
+		Updates(map[string]any{
+			"access_hash":       sess.AccessHash,
+			"refresh_hash":      sess.RefreshHash,
+			"access_expires_at": sess.AccessExpiresAt,
+			"refreshed_at":      now,
+			"ip":                ip,
+		})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrInvalidSession
+	}
+	s.cache.Delete(ctx, sessionCacheKey(oldAccess))
+	return tokens, nil
+}
+
+// Authenticate resolves an access token to its user and session ID.
+func (s *SessionService) Authenticate(ctx context.Context, accessToken string) (*User, string, error) {
+	hash := HashAPIKey(accessToken)
+	e, ok := cacheGet[sessionEntry](ctx, s.cache, sessionCacheKey(hash))
+	if !ok {
+		var sess Session
+		err := s.db.WithContext(ctx).Where("access_hash = ?", hash).Take(&sess).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && sess.RevokedAt != nil) {
+			return nil, "", ErrInvalidSession
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		e = &sessionEntry{SessionID: sess.ID, UserID: sess.UserID, ExpiresAt: sess.AccessExpiresAt}
+		cacheSet(ctx, s.cache, sessionCacheKey(hash), e)
+	}
+	if !s.now().Before(e.ExpiresAt) {
+		return nil, "", ErrInvalidSession
+	}
+	user, err := loadUser(ctx, s.db, s.cache, e.UserID)
+	if err != nil {
+		return nil, "", err
+	}
+	return user, e.SessionID, nil
+}
+
+// List returns the user's open sessions, most recently refreshed first.
+func (s *SessionService) List(ctx context.Context, userID string) ([]Session, error) {
+	var sessions []Session
+	err := s.db.WithContext(ctx).
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, s.now()).
+		Order("refreshed_at DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// Revoke ends one of the user's sessions. Returns false if there was no
+// such open session.
+func (s *SessionService) Revoke(ctx context.Context, userID, sessionID string) (bool, error) {
+	return s.revoke(ctx, s.db.WithContext(ctx).Where("id = ? AND user_id = ?", sessionID, userID))
+}
+
+// RevokeAll ends all of the user's sessions except the one with ID
+// except (if not empty).
+func (s *SessionService) RevokeAll(ctx context.Context, userID, except string) error {
+	_, err := s.revoke(ctx, s.db.WithContext(ctx).Where("user_id = ? AND id <> ?", userID, except))
+	return err
+}
+
+func (s *SessionService) revoke(ctx context.Context, q *gorm.DB) (bool, error) {
+	var sessions []Session
+	if err := q.Where("revoked_at IS NULL").Find(&sessions).Error; err != nil {
+		return false, err
+	}
+	if len(sessions) == 0 {
+		return false, nil
+	}
+	ids := make([]string, len(sessions))
+	keys := make([]string, len(sessions))
+	for i, sess := range sessions {
+		ids[i] = sess.ID
+		keys[i] = sessionCacheKey(sess.AccessHash)
+	}
+	err := s.db.WithContext(ctx).Model(&Session{}).Where("id IN ?", ids).Update("revoked_at", s.now()).Error
+	if err != nil {
+		return false, err
+	}
+	s.cache.Delete(ctx, keys...)
+	return true, nil
+}
+
+// issue sets new token hashes and expiry on sess and returns the tokens.
+func (s *SessionService) issue(sess *Session, now time.Time) (*Tokens, error) {
+	access, err := randomToken(AccessTokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := randomToken(RefreshTokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+	sess.AccessHash = HashAPIKey(access)
+	sess.RefreshHash = HashAPIKey(refresh)
+	sess.AccessExpiresAt = now.Add(s.accessTTL)
+	return &Tokens{
+		SessionID:        sess.ID,
+		AccessToken:      access,
+		RefreshToken:     refresh,
+		TokenType:        "Bearer",
+		ExpiresIn:        int(s.accessTTL.Seconds()),
+		RefreshExpiresAt: sess.ExpiresAt,
+	}, nil
+}
+
+// IsAccessToken reports whether a bearer token is a session access token
+// rather than an API key.
+func IsAccessToken(token string) bool {
+	return strings.HasPrefix(token, AccessTokenPrefix)
+}
+
+func randomToken(prefix string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/dbtest"
+)
+
+// newTestSessions returns a session service with one-minute access tokens
+// and one-hour refresh tokens whose clock moves with advance.
+func newTestSessions(t *testing.T) (s *SessionService, advance func(time.Duration)) {
+	t.Helper()
+	db := dbtest.Open(t, &User{}, &Session{})
+	if err := db.Create(&User{ID: "u1", Provider: "email", Status: "active"}).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	s = NewSessionService(db, NewMemoryCache(time.Minute, 100), time.Minute, time.Hour)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	return s, func(d time.Duration) { now = now.Add(d) }
+}
+
+func wantSession(t *testing.T, s *SessionService, access string, ok bool) {
+	t.Helper()
+	u, _, err := s.Authenticate(context.Background(), access)
+	switch {
+	case ok && (err != nil || u.ID != "u1"):
+		t.Fatalf("authenticate = %v, %v; want u1", u, err)
+	case !ok && !errors.Is(err, ErrInvalidSession):
+		t.Fatalf("authenticate = %v, %v; want ErrInvalidSession", u, err)
+	}
+}
+
+func TestRefreshRace(t *testing.T) {
+	s, _ := newTestSessions(t)
+	ctx := context.Background()
+	first, err := s.Create(ctx, "u1", "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	wantSession(t, s, first.AccessToken, true) // cached from here on
+
+	const attempts = 8
+	var wg sync.WaitGroup
+	results := make(chan *Tokens, attempts)
+	for range attempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokens, err := s.Refresh(ctx, first.RefreshToken, "127.0.0.1")
+			if err != nil && !errors.Is(err, ErrInvalidSession) {
+				t.Errorf("refresh: %v", err)
+			}
+			results <- tokens
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	var won []*Tokens
+	for tokens := range results {
+		if tokens != nil {
+			won = append(won, tokens)
+		}
+	}
+	if len(won) != 1 {
+		t.Fatalf("%d concurrent refreshes with one token succeeded, want 1", len(won))
+	}
+	wantSession(t, s, first.AccessToken, false)
+	wantSession(t, s, won[0].AccessToken, true)
+	if _, err := s.Refresh(ctx, first.RefreshToken, ""); !errors.Is(err, ErrInvalidSession) {
+		t.Fatalf("refresh with spent token = %v, want ErrInvalidSession", err)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	s, advance := newTestSessions(t)
+	ctx := context.Background()
+	tokens, err := s.Create(ctx, "u1", "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		advance     time.Duration
+		wantAccess  bool
+		wantRefresh bool
+	}{
+		{"fresh", 0, true, true},
+		{"access expired", time.Minute, false, true},
+		{"refresh expired", time.Hour, false, false},
+	}
+	for _, tt := range tests {
+		advance(tt.advance)
+		wantSession(t, s, tokens.AccessToken, tt.wantAccess)
+		if tt.wantRefresh {
+			if tokens, err = s.Refresh(ctx, tokens.RefreshToken, ""); err != nil {
+				t.Fatalf("%s: refresh: %v", tt.name, err)
+			}
+			wantSession(t, s, tokens.AccessToken, true)
+		} else if _, err := s.Refresh(ctx, tokens.RefreshToken, ""); !errors.Is(err, ErrInvalidSession) {
+			t.Fatalf("%s: refresh = %v, want ErrInvalidSession", tt.name, err)
+		}
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	s, _ := newTestSessions(t)
+	ctx := context.Background()
+	a, _ := s.Create(ctx, "u1", "a", "")
+	b, _ := s.Create(ctx, "u1", "b", "")
+	c, _ := s.Create(ctx, "u1", "c", "")
+	for _, tokens := range []*Tokens{a, b, c} {
+		wantSession(t, s, tokens.AccessToken, true)
+	}
+
+	if ok, err := s.Revoke(ctx, "someone-else", a.SessionID); ok || err != nil {
+		t.Fatalf("revoke another user's session = %v, %v", ok, err)
+	}
+	if ok, err := s.Revoke(ctx, "u1", a.SessionID); !ok || err != nil {
+		t.Fatalf("revoke = %v, %v", ok, err)
+	}
+	wantSession(t, s, a.AccessToken, false)
+	if _, err := s.Refresh(ctx, a.RefreshToken, ""); !errors.Is(err, ErrInvalidSession) {
+		t.Fatalf("refresh revoked session = %v, want ErrInvalidSession", err)
+	}
+
+	if err := s.RevokeAll(ctx, "u1", c.SessionID); err != nil {
+		t.Fatalf("revoke all: %v", err)
+	}
+	wantSession(t, s, b.AccessToken, false)
+	wantSession(t, s, c.AccessToken, true)
+	if list, err := s.List(ctx, "u1"); err != nil || len(list) != 1 || list[0].ID != c.SessionID {
+		t.Fatalf("sessions = %+v, %v; want only c", list, err)
+	}
+}
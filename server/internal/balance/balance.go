@@ -36,16 +36,36 @@ const (
 	TxFreeze   TransactionType = "FREEZE"   // reserve GP for in-flight task
 	TxUnfreeze TransactionType = "UNFREEZE" // release frozen GP
 	TxCheckin  TransactionType = "CHECKIN"  // daily checkin reward
+
+	TxTransferOut TransactionType = "TRANSFER_OUT" // GP sent to another user
+	TxTransferIn  TransactionType = "TRANSFER_IN"  // GP received from another user
+	TxVoucher     TransactionType = "VOUCHER"      // voucher code redeemed
+	TxNodeReward  TransactionType = "NODE_REWARD"  // share of a task's GP paid to the node operator
+	TxMerge       TransactionType = "MERGE"        // another account was merged in; Amount is 0, its entries moved over
 )
 
+// Valid reports whether t is a known transaction type.
+func (t TransactionType) Valid() bool {
+	switch t {
+	case TxDeposit, TxDeduct, TxRefund, TxFreeze, TxUnfreeze, TxCheckin, TxTransferOut, TxTransferIn, TxVoucher, TxNodeReward, TxMerge:
+		return true
+	}
+	return false
+}
+
 // Transaction is an immutable ledger entry.
+//
+// (TraceID, Type) is unique, so a task can never be settled or refunded
+// twice even if the application-level checks race. The two sides of a
+// transfer share the transfer's ID as TraceID. Other entries store TraceID
+// as NULL, which the index ignores.
 type Transaction struct {
 	ID        uint            `json:"id" gorm:"primaryKey"`
 	UserID    string          `json:"user_id" gorm:"index"`
-	Type      TransactionType `json:"type"`
+	Type      TransactionType `json:"type" gorm:"size:16;uniqueIndex:idx_tx_trace_type,priority:2"`
 	Amount    int64           `json:"amount"` // positive = credit, negative = debit
 	Balance   int64           `json:"balance_after"`
-	TraceID   string          `json:"trace_id,omitempty" gorm:"index"` // link to task
+	TraceID   string          `json:"trace_id,omitempty" gorm:"size:64;default:null;uniqueIndex:idx_tx_trace_type,priority:1"` // link to task, NULL when none
 	Remark    string          `json:"remark,omitempty"`
 	CreatedAt time.Time       `json:"created_at"`
 }
@@ -60,20 +80,115 @@ type BalanceService interface {
 	// Creates an account with zero balance if not exists.
 	GetAccount(ctx context.Context, userID string) (*Account, error)
 
-	// Deposit adds GP to a user's balance.
-	Deposit(ctx context.Context, userID string, amount int64, remark string) (*Account, error)
+	// Deposit adds GP to a user's balance, recorded as a txType entry
+	// (TxDeposit, TxCheckin or TxVoucher).
+	Deposit(ctx context.Context, userID string, txType TransactionType, amount int64, remark string) (*Account, error)
+
+	// Transfer moves amount of available GP from one user to another in a
+	// single transaction, writing a TRANSFER_OUT/TRANSFER_IN pair. limits
+	// are checked against the sender's transfers in the last 24 hours.
+	Transfer(ctx context.Context, fromUserID, toUserID string, amount int64, memo string, limits TransferLimits) (*Transfer, error)
+
+	// GetBalanceDetail returns the account breakdown shown by
+	// /api/v1/me/balance: totals, in-flight freezes and lifetime sums.
+	GetBalanceDetail(ctx context.Context, userID string) (*BalanceDetail, error)
 
 	// FreezeGP reserves GP for an in-flight task.
 	// Returns error if insufficient balance.
 	FreezeGP(ctx context.Context, userID string, traceID string, amount int64) error
 
 	// SettleTask finalises a completed task:
-	//   - Unfreezes the reserved amount
-	//   - Deducts the frozen amount (estimatedGP) from balance
-	//   - actualGP parameter is for internal statistics only
+	//   - Releases the whole frozen amount
+	//   - Deducts chargeAmount (clamped to [0, frozenAmount]) from balance
+	//   - Records the unused part of the estimate as a REFUND entry
+	//   - Credits reward (if non-nil) to the node's operator as NODE_REWARD
 	//   - Returns the updated account
-	SettleTask(ctx context.Context, userID string, traceID string, frozenAmount, actualGP int64) (*Account, error)
+	// SettleTask and RefundTask apply at most once per traceID; later calls
+	// return ErrAlreadySettled.
+	SettleTask(ctx context.Context, userID string, traceID string, frozenAmount, chargeAmount int64, reward *NodeReward) (*Account, error)
 
 	// RefundTask releases frozen GP when a task fails.
 	RefundTask(ctx context.Context, userID string, traceID string, frozenAmount int64) (*Account, error)
+
+	// ReleaseFrozen is RefundTask with a custom ledger remark, used when
+	// GP is released for a reason other than task failure (reconciliation).
+	ReleaseFrozen(ctx context.Context, userID string, traceID string, frozenAmount int64, remark string) (*Account, error)
+
+	// GetFreeze returns the FREEZE entry recorded for a task, or nil if
+	// nothing was frozen for it.
+	GetFreeze(ctx context.Context, traceID string) (*Transaction, error)
+
+	// ListTransactions returns ledger entries matching filter, newest
+	// first, and the cursor for the next page (0 when there is none).
+	ListTransactions(ctx context.Context, filter TransactionFilter) ([]Transaction, uint, error)
+}
+
+// NodeReward is GP credited to the operator of the node that ran a task,
+// paid out of the task's charge.
+type NodeReward struct {
+	UserID string // operator
+	NodeID string
+	Amount int64 // clamped to [0, charge]
+}
+
+// TransferLimits caps what one user can send per rolling 24 hours.
+// Zero disables a limit.
+type TransferLimits struct {
+	DailyAmount int64
+	DailyCount  int
 }
+
+// Transfer is a completed transfer.
+type Transfer struct {
+	ID     string   `json:"transfer_id"`
+	From   string   `json:"from_user_id"`
+	To     string   `json:"to_user_id"`
+	Amount int64    `json:"amount"`
+	Memo   string   `json:"memo,omitempty"`
+	Sender *Account `json:"-"`
+}
+
+// BalanceDetail breaks an account down for display.
+type BalanceDetail struct {
+	Total     int64         `json:"total"`     // Account.Balance
+	Frozen    int64         `json:"frozen"`    // reserved for in-flight tasks
+	Available int64         `json:"available"` // Total - Frozen
+	InFlight  []FrozenEntry `json:"in_flight"`
+	Lifetime  LedgerTotals  `json:"lifetime"`
+}
+
+// FrozenEntry is GP reserved for a task that has not been settled yet.
+type FrozenEntry struct {
+	TraceID   string    `json:"trace_id"`
+	GalleryID string    `json:"gallery_id,omitempty"`
+	Amount    int64     `json:"amount"`
+	FrozenAt  time.Time `json:"frozen_at"`
+}
+
+// LedgerTotals are sums over a user's whole ledger, all positive.
+type LedgerTotals struct {
+	Deposited      int64 `json:"deposited"`       // DEPOSIT
+	CheckedIn      int64 `json:"checked_in"`      // CHECKIN
+	Spent          int64 `json:"spent"`           // DEDUCT
+	TransferredIn  int64 `json:"transferred_in"`  // TRANSFER_IN
+	TransferredOut int64 `json:"transferred_out"` // TRANSFER_OUT
+	Vouchers       int64 `json:"vouchers"`        // VOUCHER
+	NodeRewards    int64 `json:"node_rewards"`    // NODE_REWARD
+}
+
+// TransactionFilter selects ledger entries. Zero fields match everything.
+type TransactionFilter struct {
+	UserID  string
+	TraceID string
+	Types   []TransactionType
+	Since   time.Time // inclusive
+	Until   time.Time // exclusive
+	Cursor  uint      // only entries with ID below this (a previous page's next cursor)
+	Limit   int       // page size, capped at MaxTransactionPage
+}
+
+// Page sizes for ListTransactions.
+const (
+	DefaultTransactionPage = 50
+	MaxTransactionPage     = 500
+)
@@ -3,10 +3,15 @@ package balance
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // ─────────────────────────────────────────────
@@ -16,6 +21,8 @@ import (
 var (
 	ErrInsufficientBalance = errors.New("insufficient balance")
 	ErrAccountNotFound     = errors.New("account not found")
+	ErrAlreadySettled      = errors.New("task already settled")
+	ErrTransferLimit       = errors.New("daily transfer limit exceeded")
 )
 
 // ─────────────────────────────────────────────
@@ -60,53 +67,66 @@ func (s *balanceService) GetAccount(ctx context.Context, userID string) (*Accoun
 }
 
 // Deposit adds GP to a user's balance.
-func (s *balanceService) Deposit(ctx context.Context, userID string, amount int64, remark string) (*Account, error) {
+func (s *balanceService) Deposit(ctx context.Context, userID string, txType TransactionType, amount int64, remark string) (*Account, error) {
 	return s.withTx(ctx, func(tx *gorm.DB) (*Account, error) {
-		acc, err := s.getOrCreateAccountTx(tx, userID)
-		if err != nil {
-			return nil, err
-		}
-
-		acc.Balance += amount
-		acc.UpdatedAt = time.Now()
-
-		if err := tx.Save(acc).Error; err != nil {
-			return nil, err
-		}
+		return DepositTx(tx, userID, txType, amount, remark)
+	})
+}
 
-		// Record transaction
-		txn := Transaction{
-			UserID:    userID,
-			Type:      TxDeposit,
-			Amount:    amount,
-			Balance:   acc.Balance,
-			Remark:    remark,
-			CreatedAt: time.Now(),
-		}
-		if err := tx.Create(&txn).Error; err != nil {
-			return nil, err
-		}
+// DepositTx is Deposit inside the caller's transaction, for callers whose
+// own rows must commit or roll back together with the credit.
+func DepositTx(tx *gorm.DB, userID string, txType TransactionType, amount int64, remark string) (*Account, error) {
+	if txType != TxDeposit && txType != TxCheckin && txType != TxVoucher {
+		return nil, fmt.Errorf("deposit: invalid transaction type %s", txType)
+	}
+	if err := ensureAccountTx(tx, userID); err != nil {
+		return nil, err
+	}
+	if _, err := updateAccountTx(tx, userID, map[string]any{
+		"balance": gorm.Expr("balance + ?", amount),
+	}); err != nil {
+		return nil, err
+	}
+	acc, err := loadAccountTx(tx, userID)
+	if err != nil {
+		return nil, err
+	}
 
-		return acc, nil
-	})
+	// Record transaction
+	txn := Transaction{
+		UserID:    userID,
+		Type:      txType,
+		Amount:    amount,
+		Balance:   acc.Balance,
+		Remark:    remark,
+		CreatedAt: time.Now(),
+	}
+	if err := tx.Create(&txn).Error; err != nil {
+		return nil, err
+	}
+	return acc, nil
 }
 
 // FreezeGP reserves GP for an in-flight task.
+//
+// The availability check is part of the UPDATE itself, so two concurrent
+// freezes cannot both pass against the same stale read.
 func (s *balanceService) FreezeGP(ctx context.Context, userID string, traceID string, amount int64) error {
 	_, err := s.withTx(ctx, func(tx *gorm.DB) (*Account, error) {
-		acc, err := s.getOrCreateAccountTx(tx, userID)
+		if err := ensureAccountTx(tx, userID); err != nil {
+			return nil, err
+		}
+		n, err := updateAccountTx(tx, userID, map[string]any{
+			"frozen": gorm.Expr("frozen + ?", amount),
+		}, "balance - frozen >= ?", amount)
 		if err != nil {
 			return nil, err
 		}
-
-		if acc.Available() < amount {
+		if n == 0 {
 			return nil, ErrInsufficientBalance
 		}
-
-		acc.Frozen += amount
-		acc.UpdatedAt = time.Now()
-
-		if err := tx.Save(acc).Error; err != nil {
+		acc, err := loadAccountTx(tx, userID)
+		if err != nil {
 			return nil, err
 		}
 
@@ -129,27 +149,47 @@ func (s *balanceService) FreezeGP(ctx context.Context, userID string, traceID st
 }
 
 // SettleTask finalises a completed task.
-func (s *balanceService) SettleTask(ctx context.Context, userID string, traceID string, frozenAmount, actualGP int64) (*Account, error) {
-	return s.withTx(ctx, func(tx *gorm.DB) (*Account, error) {
-		var acc Account
-		if err := tx.Where("user_id = ?", userID).First(&acc).Error; err != nil {
+//
+// Ledger entries: UNFREEZE(charge) + DEDUCT(-charge), plus
+// REFUND(frozen-charge) when the charge is below the estimate, so that
+// UNFREEZE + REFUND always sums to the frozen amount for a trace. With a
+// reward, the payer's and the operator's rows are locked in user ID order
+// up front, so two settlements paying each other's nodes cannot deadlock.
+func (s *balanceService) SettleTask(ctx context.Context, userID string, traceID string, frozenAmount, chargeAmount int64, reward *NodeReward) (*Account, error) {
+	chargeAmount = max(0, min(chargeAmount, frozenAmount))
+	unused := frozenAmount - chargeAmount
+
+	rewarded := reward != nil && reward.UserID != userID
+	acc, err := s.withTx(ctx, func(tx *gorm.DB) (*Account, error) {
+		// Unfreeze the reserved amount and deduct the charged part
+		if err := checkNotSettledTx(tx, traceID); err != nil {
 			return nil, err
 		}
-
-		// Unfreeze the reserved amount
-		acc.Frozen -= frozenAmount
-		if acc.Frozen < 0 {
-			log.Printf("[balance] WARNING: frozen went negative for user=%s trace=%s (frozen=%d amount=%d), resetting to 0",
-				userID, traceID, acc.Frozen+frozenAmount, frozenAmount)
-			acc.Frozen = 0
+		if rewarded {
+			if err := lockAccountsTx(tx, userID, reward.UserID); err != nil {
+				return nil, err
+			}
+		}
+		if err := unfreezeTx(tx, userID, traceID, frozenAmount, map[string]any{
+			"balance": gorm.Expr("balance - ?", chargeAmount),
+		}); err != nil {
+			return nil, err
+		}
+		// Check again now that we hold the account row lock.
+		if err := checkNotSettledTx(tx, traceID); err != nil {
+			return nil, err
+		}
+		acc, err := loadAccountTx(tx, userID)
+		if err != nil {
+			return nil, err
 		}
 
-		// Record unfreeze
+		// Record unfreeze of the charged part
 		txnUnfreeze := Transaction{
 			UserID:    userID,
 			Type:      TxUnfreeze,
-			Amount:    frozenAmount,
-			Balance:   acc.Balance,
+			Amount:    chargeAmount,
+			Balance:   acc.Balance + chargeAmount,
 			TraceID:   traceID,
 			CreatedAt: time.Now(),
 		}
@@ -157,14 +197,10 @@ func (s *balanceService) SettleTask(ctx context.Context, userID string, traceID
 			return nil, err
 		}
 
-		// Deduct estimated GP (always charge based on frozen amount)
-		// actualGP is for internal statistics only
-		acc.Balance -= frozenAmount
-
 		txnDeduct := Transaction{
 			UserID:    userID,
 			Type:      TxDeduct,
-			Amount:    -frozenAmount,
+			Amount:    -chargeAmount,
 			Balance:   acc.Balance,
 			TraceID:   traceID,
 			CreatedAt: time.Now(),
@@ -173,33 +209,83 @@ func (s *balanceService) SettleTask(ctx context.Context, userID string, traceID
 			return nil, err
 		}
 
-		acc.UpdatedAt = time.Now()
-		if err := tx.Save(&acc).Error; err != nil {
-			return nil, err
+		// Return the unused part of the estimate
+		if unused > 0 {
+			txnRefund := Transaction{
+				UserID:    userID,
+				Type:      TxRefund,
+				Amount:    unused,
+				Balance:   acc.Balance,
+				TraceID:   traceID,
+				Remark:    "unused estimate",
+				CreatedAt: time.Now(),
+			}
+			if err := tx.Create(&txnRefund).Error; err != nil {
+				return nil, err
+			}
 		}
 
-		return &acc, nil
+		if rewarded {
+			if err := s.rewardNodeTx(tx, traceID, reward, chargeAmount); err != nil {
+				return nil, err
+			}
+		}
+
+		return acc, nil
 	})
+	return acc, settleErr(err)
+}
+
+// rewardNodeTx credits the node operator's share of a settled task.
+func (s *balanceService) rewardNodeTx(tx *gorm.DB, traceID string, reward *NodeReward, charge int64) error {
+	amount := max(0, min(reward.Amount, charge))
+	if amount == 0 {
+		return nil
+	}
+	if err := ensureAccountTx(tx, reward.UserID); err != nil {
+		return err
+	}
+	if _, err := updateAccountTx(tx, reward.UserID, map[string]any{
+		"balance": gorm.Expr("balance + ?", amount),
+	}); err != nil {
+		return err
+	}
+	op, err := loadAccountTx(tx, reward.UserID)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&Transaction{
+		UserID:    reward.UserID,
+		Type:      TxNodeReward,
+		Amount:    amount,
+		Balance:   op.Balance,
+		TraceID:   traceID,
+		Remark:    "node " + reward.NodeID,
+		CreatedAt: time.Now(),
+	}).Error
 }
 
 // RefundTask releases frozen GP when a task fails.
 func (s *balanceService) RefundTask(ctx context.Context, userID string, traceID string, frozenAmount int64) (*Account, error) {
-	return s.withTx(ctx, func(tx *gorm.DB) (*Account, error) {
-		var acc Account
-		if err := tx.Where("user_id = ?", userID).First(&acc).Error; err != nil {
-			return nil, err
-		}
+	return s.ReleaseFrozen(ctx, userID, traceID, frozenAmount, "task failed/cancelled")
+}
 
+// ReleaseFrozen releases frozen GP with a REFUND entry carrying remark.
+func (s *balanceService) ReleaseFrozen(ctx context.Context, userID string, traceID string, frozenAmount int64, remark string) (*Account, error) {
+	acc, err := s.withTx(ctx, func(tx *gorm.DB) (*Account, error) {
 		// Unfreeze the reserved amount
-		acc.Frozen -= frozenAmount
-		if acc.Frozen < 0 {
-			log.Printf("[balance] WARNING: frozen went negative for user=%s trace=%s (frozen=%d amount=%d), resetting to 0",
-				userID, traceID, acc.Frozen+frozenAmount, frozenAmount)
-			acc.Frozen = 0
+		if err := checkNotSettledTx(tx, traceID); err != nil {
+			return nil, err
 		}
-		acc.UpdatedAt = time.Now()
-
-		if err := tx.Save(&acc).Error; err != nil {
+		if err := unfreezeTx(tx, userID, traceID, frozenAmount, nil); err != nil {
+			return nil, err
+		}
+		// Check again now that we hold the account row lock.
+		if err := checkNotSettledTx(tx, traceID); err != nil {
+			return nil, err
+		}
+		acc, err := loadAccountTx(tx, userID)
+		if err != nil {
 			return nil, err
 		}
 
@@ -210,15 +296,279 @@ func (s *balanceService) RefundTask(ctx context.Context, userID string, traceID
 			Amount:    frozenAmount,
 			Balance:   acc.Balance,
 			TraceID:   traceID,
-			Remark:    "task failed/cancelled",
+			Remark:    remark,
 			CreatedAt: time.Now(),
 		}
 		if err := tx.Create(&txn).Error; err != nil {
 			return nil, err
 		}
 
-		return &acc, nil
+		return acc, nil
 	})
+	return acc, settleErr(err)
+}
+
+// GetFreeze returns the FREEZE entry recorded for a task, or nil.
+func (s *balanceService) GetFreeze(ctx context.Context, traceID string) (*Transaction, error) {
+	var txns []Transaction
+	err := s.db.WithContext(ctx).
+		Where("trace_id = ? AND type = ?", traceID, TxFreeze).
+		Limit(1).Find(&txns).Error
+	if err != nil || len(txns) == 0 {
+		return nil, err
+	}
+	return &txns[0], nil
+}
+
+// Transfer debits the sender and credits the recipient in one
+// transaction. The sender's debit is guarded like FreezeGP (frozen GP
+// cannot be sent), and the daily limits are checked after it, so
+// concurrent transfers from the same user serialise on the account row.
+// Rows are always updated in user ID order to avoid deadlocks between
+// opposite transfers.
+func (s *balanceService) Transfer(ctx context.Context, fromUserID, toUserID string, amount int64, memo string, limits TransferLimits) (*Transfer, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("transfer amount must be positive")
+	}
+	if fromUserID == toUserID {
+		return nil, fmt.Errorf("cannot transfer to yourself")
+	}
+
+	t := &Transfer{
+		ID:     "transfer-" + uuid.NewString(),
+		From:   fromUserID,
+		To:     toUserID,
+		Amount: amount,
+		Memo:   memo,
+	}
+	sender, err := s.withTx(ctx, func(tx *gorm.DB) (*Account, error) {
+		if err := ensureAccountTx(tx, fromUserID); err != nil {
+			return nil, err
+		}
+		if err := ensureAccountTx(tx, toUserID); err != nil {
+			return nil, err
+		}
+
+		debit := func() error {
+			n, err := updateAccountTx(tx, fromUserID, map[string]any{
+				"balance": gorm.Expr("balance - ?", amount),
+			}, "balance - frozen >= ?", amount)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return ErrInsufficientBalance
+			}
+			return checkTransferLimitsTx(tx, fromUserID, amount, limits)
+		}
+		credit := func() error {
+			_, err := updateAccountTx(tx, toUserID, map[string]any{
+				"balance": gorm.Expr("balance + ?", amount),
+			})
+			return err
+		}
+		first, second := debit, credit
+		if toUserID < fromUserID {
+			first, second = credit, debit
+		}
+		if err := first(); err != nil {
+			return nil, err
+		}
+		if err := second(); err != nil {
+			return nil, err
+		}
+
+		from, err := loadAccountTx(tx, fromUserID)
+		if err != nil {
+			return nil, err
+		}
+		to, err := loadAccountTx(tx, toUserID)
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		txns := []Transaction{
+			{
+				UserID:    fromUserID,
+				Type:      TxTransferOut,
+				Amount:    -amount,
+				Balance:   from.Balance,
+				TraceID:   t.ID,
+				Remark:    transferRemark("to", toUserID, memo),
+				CreatedAt: now,
+			},
+			{
+				UserID:    toUserID,
+				Type:      TxTransferIn,
+				Amount:    amount,
+				Balance:   to.Balance,
+				TraceID:   t.ID,
+				Remark:    transferRemark("from", fromUserID, memo),
+				CreatedAt: now,
+			},
+		}
+		if err := tx.Create(&txns).Error; err != nil {
+			return nil, err
+		}
+		return from, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.Sender = sender
+	return t, nil
+}
+
+// checkTransferLimitsTx fails with ErrTransferLimit if amount would take
+// the sender past limits. The transfer being checked has no entry yet.
+func checkTransferLimitsTx(tx *gorm.DB, userID string, amount int64, limits TransferLimits) error {
+	if limits.DailyAmount <= 0 && limits.DailyCount <= 0 {
+		return nil
+	}
+	var sent struct {
+		Count int
+		Total int64
+	}
+	err := tx.Model(&Transaction{}).
+		Select("COUNT(*) AS count, COALESCE(SUM(-amount), 0) AS total").
+		Where("user_id = ? AND type = ? AND created_at >= ?", userID, TxTransferOut, time.Now().Add(-24*time.Hour)).
+		Scan(&sent).Error
+	if err != nil {
+		return err
+	}
+	if limits.DailyCount > 0 && sent.Count+1 > limits.DailyCount {
+		return ErrTransferLimit
+	}
+	if limits.DailyAmount > 0 && sent.Total+amount > limits.DailyAmount {
+		return ErrTransferLimit
+	}
+	return nil
+}
+
+// transferRemark records the counterparty and memo on each side.
+func transferRemark(dir, userID, memo string) string {
+	remark := dir + " " + userID
+	if memo != "" {
+		remark += ": " + memo
+	}
+	return remark
+}
+
+// GetBalanceDetail combines the account row with the open FREEZE entries
+// (joined to the task log for gallery IDs) and per-type ledger sums.
+func (s *balanceService) GetBalanceDetail(ctx context.Context, userID string) (*BalanceDetail, error) {
+	acc, err := s.GetAccount(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	detail := &BalanceDetail{
+		Total:     acc.Balance,
+		Frozen:    acc.Frozen,
+		Available: acc.Available(),
+		InFlight:  []FrozenEntry{},
+	}
+
+	settled := s.db.Table("transactions AS s").Select("1").
+		Where("s.trace_id = transactions.trace_id AND s.type IN ?", []TransactionType{TxUnfreeze, TxRefund})
+	var freezes []struct {
+		TraceID   string
+		GalleryID string
+		Amount    int64
+		CreatedAt time.Time
+	}
+	err = s.db.WithContext(ctx).Model(&Transaction{}).
+		Select("transactions.trace_id, task_logs.gallery_id, transactions.amount, transactions.created_at").
+		Joins("LEFT JOIN task_logs ON task_logs.trace_id = transactions.trace_id").
+		Where("transactions.user_id = ? AND transactions.type = ?", userID, TxFreeze).
+		Where("NOT EXISTS (?)", settled).
+		Order("transactions.id").
+		Scan(&freezes).Error
+	if err != nil {
+		return nil, fmt.Errorf("load open freezes: %w", err)
+	}
+	for _, f := range freezes {
+		detail.InFlight = append(detail.InFlight, FrozenEntry{
+			TraceID:   f.TraceID,
+			GalleryID: f.GalleryID,
+			Amount:    -f.Amount,
+			FrozenAt:  f.CreatedAt,
+		})
+	}
+
+	var sums []struct {
+		Type  TransactionType
+		Total int64
+	}
+	err = s.db.WithContext(ctx).Model(&Transaction{}).
+		Select("type, SUM(amount) AS total").
+		Where("user_id = ? AND type IN ?", userID,
+			[]TransactionType{TxDeposit, TxCheckin, TxDeduct, TxTransferIn, TxTransferOut, TxVoucher, TxNodeReward}).
+		Group("type").
+		Scan(&sums).Error
+	if err != nil {
+		return nil, fmt.Errorf("sum ledger: %w", err)
+	}
+	for _, sum := range sums {
+		switch sum.Type {
+		case TxDeposit:
+			detail.Lifetime.Deposited = sum.Total
+		case TxCheckin:
+			detail.Lifetime.CheckedIn = sum.Total
+		case TxDeduct:
+			detail.Lifetime.Spent = -sum.Total
+		case TxTransferIn:
+			detail.Lifetime.TransferredIn = sum.Total
+		case TxTransferOut:
+			detail.Lifetime.TransferredOut = -sum.Total
+		case TxVoucher:
+			detail.Lifetime.Vouchers = sum.Total
+		case TxNodeReward:
+			detail.Lifetime.NodeRewards = sum.Total
+		}
+	}
+	return detail, nil
+}
+
+// ListTransactions pages through the ledger by descending ID, which is
+// also creation order and stays stable while new entries are appended.
+func (s *balanceService) ListTransactions(ctx context.Context, f TransactionFilter) ([]Transaction, uint, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultTransactionPage
+	}
+	limit = min(limit, MaxTransactionPage)
+
+	q := s.db.WithContext(ctx).Model(&Transaction{})
+	if f.UserID != "" {
+		q = q.Where("user_id = ?", f.UserID)
+	}
+	if f.TraceID != "" {
+		q = q.Where("trace_id = ?", f.TraceID)
+	}
+	if len(f.Types) > 0 {
+		q = q.Where("type IN ?", f.Types)
+	}
+	if !f.Since.IsZero() {
+		q = q.Where("created_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		q = q.Where("created_at < ?", f.Until)
+	}
+	if f.Cursor > 0 {
+		q = q.Where("id < ?", f.Cursor)
+	}
+
+	// One extra row tells whether another page exists.
+	var txns []Transaction
+	if err := q.Order("id DESC").Limit(limit + 1).Find(&txns).Error; err != nil {
+		return nil, 0, err
+	}
+	if len(txns) <= limit {
+		return txns, 0, nil
+	}
+	txns = txns[:limit]
+	return txns, txns[limit-1].ID, nil
 }
 
 // ─────────────────────────────────────────────
@@ -238,23 +588,105 @@ func (s *balanceService) withTx(ctx context.Context, fn func(tx *gorm.DB) (*Acco
 	return result, err
 }
 
-func (s *balanceService) getOrCreateAccountTx(tx *gorm.DB, userID string) (*Account, error) {
-	var acc Account
-	err := tx.Where("user_id = ?", userID).First(&acc).Error
-	if err == nil {
-		return &acc, nil
+// ensureAccountTx creates the user's account row if it does not exist yet.
+// ON CONFLICT DO NOTHING (INSERT IGNORE on MySQL) makes concurrent first
+// deposits/freezes safe on every supported database.
+func ensureAccountTx(tx *gorm.DB, userID string) error {
+	acc := Account{UserID: userID, UpdatedAt: time.Now()}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&acc).Error
+}
+
+// lockAccountsTx takes the row locks of the given accounts in user ID
+// order, creating missing accounts first, as Transfer does with its two
+// updates.
+func lockAccountsTx(tx *gorm.DB, userIDs ...string) error {
+	userIDs = slices.Clone(userIDs)
+	slices.Sort(userIDs)
+	for _, id := range userIDs {
+		if err := ensureAccountTx(tx, id); err != nil {
+			return err
+		}
+		if _, err := updateAccountTx(tx, id, map[string]any{}); err != nil {
+			return err
+		}
 	}
-	if !errors.Is(err, gorm.ErrRecordNotFound) {
-		return nil, err
+	return nil
+}
+
+// updateAccountTx applies column expressions to the user's account in a
+// single UPDATE, optionally guarded by an extra WHERE condition. Balance
+// changes are always expressed relative to the stored value (never a
+// read-modify-write), which keeps them atomic without SELECT ... FOR UPDATE,
+// which SQLite does not support.
+func updateAccountTx(tx *gorm.DB, userID string, updates map[string]any, cond ...any) (int64, error) {
+	updates["updated_at"] = time.Now()
+	q := tx.Model(&Account{}).Where("user_id = ?", userID)
+	if len(cond) > 0 {
+		q = q.Where(cond[0], cond[1:]...)
 	}
+	res := q.Updates(updates)
+	return res.RowsAffected, res.Error
+}
 
-	acc = Account{
-		UserID:    userID,
-		Balance:   0,
-		Frozen:    0,
-		UpdatedAt: time.Now(),
+// unfreezeTx releases amount from the user's frozen GP, clamping at zero,
+// and applies any extra updates in the same statement.
+func unfreezeTx(tx *gorm.DB, userID, traceID string, amount int64, extra map[string]any) error {
+	acc, err := loadAccountTx(tx, userID)
+	if err != nil {
+		return err
+	}
+	if acc.Frozen < amount {
+		log.Printf("[balance] WARNING: frozen would go negative for user=%s trace=%s (frozen=%d amount=%d), clamping to 0",
+			userID, traceID, acc.Frozen, amount)
+	}
+
+	updates := map[string]any{
+		"frozen": gorm.Expr("CASE WHEN frozen >= ? THEN frozen - ? ELSE 0 END", amount, amount),
+	}
+	for k, v := range extra {
+		updates[k] = v
+	}
+	_, err = updateAccountTx(tx, userID, updates)
+	return err
+}
+
+// checkNotSettledTx fails with ErrAlreadySettled if the trace already has
+// an UNFREEZE or REFUND entry. Callers check once up front (cheap path for
+// redelivered events) and again after updating the account row: a
+// concurrent settlement of the same trace blocks on that row lock until the
+// first commits and then sees its entries (SQLite serialises the whole
+// transaction anyway).
+func checkNotSettledTx(tx *gorm.DB, traceID string) error {
+	var n int64
+	if err := tx.Model(&Transaction{}).
+		Where("trace_id = ? AND type IN ?", traceID, []TransactionType{TxUnfreeze, TxRefund}).
+		Count(&n).Error; err != nil {
+		return err
 	}
-	if err := tx.Create(&acc).Error; err != nil {
+	if n > 0 {
+		return ErrAlreadySettled
+	}
+	return nil
+}
+
+// settleErr maps a unique violation on (trace_id, type) to
+// ErrAlreadySettled: the checks above can only miss a concurrent settlement
+// if the database does not serialise on the account row, and then the
+// index rejects the second one.
+func settleErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	// modernc SQLite errors are not translated by the GORM driver.
+	if errors.Is(err, gorm.ErrDuplicatedKey) || strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return ErrAlreadySettled
+	}
+	return err
+}
+
+func loadAccountTx(tx *gorm.DB, userID string) (*Account, error) {
+	var acc Account
+	if err := tx.Where("user_id = ?", userID).First(&acc).Error; err != nil {
 		return nil, err
 	}
 	return &acc, nil
@@ -0,0 +1,108 @@
+package checkin
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+)
+
+// ─────────────────────────────────────────────
+// Daily Check-in
+//
+// One check-in per user per calendar day in the configured timezone,
+// enforced by a unique (user_id, day) index. Consecutive days build a
+// streak whose bonus multiplies the random base reward.
+// ─────────────────────────────────────────────
+
+// Checkin is one user's check-in on one day.
+type Checkin struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	UserID     string    `json:"-" gorm:"size:64;uniqueIndex:idx_checkin_user_day,priority:1"`
+	Day        string    `json:"day" gorm:"size:10;uniqueIndex:idx_checkin_user_day,priority:2"` // YYYY-MM-DD in the check-in timezone
+	Streak     int       `json:"streak"`                                                         // consecutive days including this one
+	Base       int64     `json:"base"`                                                           // random base reward
+	Multiplier float64   `json:"multiplier"`                                                     // streak bonus applied to Base
+	Reward     int64     `json:"reward"`                                                         // GP credited
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Summary describes a user's check-in record.
+type Summary struct {
+	Today         bool  `json:"checked_in_today"`
+	Streak        int   `json:"streak"` // current streak, 0 if it is broken
+	LongestStreak int   `json:"longest_streak"`
+	Days          int   `json:"days"`     // total check-ins
+	TotalGP       int64 `json:"total_gp"` // total rewards
+}
+
+// Bonus multiplies the base reward from the Streak-th consecutive day on.
+type Bonus struct {
+	Streak     int     `json:"streak"`
+	Multiplier float64 `json:"multiplier"`
+}
+
+// Schedule configures rewards.
+type Schedule struct {
+	MinGP    int
+	MaxGP    int
+	Location *time.Location // calendar days are counted in this zone
+	Bonuses  []Bonus        // ascending by Streak
+}
+
+// Multiplier returns the bonus for a streak of n days.
+func (s *Schedule) Multiplier(n int) float64 {
+	m := 1.0
+	for _, b := range s.Bonuses {
+		if n >= b.Streak {
+			m = b.Multiplier
+		}
+	}
+	return m
+}
+
+// day returns the calendar day of t in the schedule's zone.
+func (s *Schedule) day(t time.Time) string {
+	return t.In(s.Location).Format(time.DateOnly)
+}
+
+// ParseSchedule reads CHECKIN_MIN_GP, CHECKIN_MAX_GP, CHECKIN_TIMEZONE and
+// CHECKIN_STREAK_BONUS ("3=1.2,7=1.5": from the 3rd consecutive day x1.2,
+// from the 7th x1.5).
+func ParseSchedule(cfg *config.Config) (Schedule, error) {
+	s := Schedule{MinGP: cfg.CheckinMinGP, MaxGP: cfg.CheckinMaxGP}
+	if s.MinGP > s.MaxGP {
+		s.MinGP, s.MaxGP = s.MaxGP, s.MinGP
+	}
+
+	loc, err := time.LoadLocation(cfg.CheckinTimezone)
+	if err != nil {
+		return s, fmt.Errorf("CHECKIN_TIMEZONE: %w", err)
+	}
+	s.Location = loc
+
+	for _, part := range strings.Split(cfg.CheckinStreakBonus, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		days, mult, ok := strings.Cut(part, "=")
+		if !ok {
+			return s, fmt.Errorf("CHECKIN_STREAK_BONUS: invalid entry %q (expected days=multiplier)", part)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(days))
+		if err != nil || n < 1 {
+			return s, fmt.Errorf("CHECKIN_STREAK_BONUS: invalid streak length in %q", part)
+		}
+		m, err := strconv.ParseFloat(strings.TrimSpace(mult), 64)
+		if err != nil || m < 0 {
+			return s, fmt.Errorf("CHECKIN_STREAK_BONUS: invalid multiplier in %q", part)
+		}
+		s.Bonuses = append(s.Bonuses, Bonus{Streak: n, Multiplier: m})
+	}
+	sort.Slice(s.Bonuses, func(i, j int) bool { return s.Bonuses[i].Streak < s.Bonuses[j].Streak })
+	return s, nil
+}
@@ -0,0 +1,69 @@
+package checkin
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         config.Config
+		wantMin     int
+		wantMax     int
+		wantBonuses []Bonus
+		wantErr     bool
+	}{
+		{
+			name:    "defaults",
+			cfg:     config.Config{CheckinMinGP: 10, CheckinMaxGP: 50, CheckinTimezone: "UTC"},
+			wantMin: 10, wantMax: 50,
+		},
+		{
+			name:    "swapped range, bonuses sorted",
+			cfg:     config.Config{CheckinMinGP: 50, CheckinMaxGP: 10, CheckinTimezone: "UTC", CheckinStreakBonus: " 7=1.5, 3 = 1.2,"},
+			wantMin: 10, wantMax: 50,
+			wantBonuses: []Bonus{{Streak: 3, Multiplier: 1.2}, {Streak: 7, Multiplier: 1.5}},
+		},
+		{name: "unknown timezone", cfg: config.Config{CheckinTimezone: "Nowhere/Special"}, wantErr: true},
+		{name: "missing multiplier", cfg: config.Config{CheckinTimezone: "UTC", CheckinStreakBonus: "3"}, wantErr: true},
+		{name: "zero streak", cfg: config.Config{CheckinTimezone: "UTC", CheckinStreakBonus: "0=2"}, wantErr: true},
+		{name: "negative multiplier", cfg: config.Config{CheckinTimezone: "UTC", CheckinStreakBonus: "3=-1"}, wantErr: true},
+		{name: "bad multiplier", cfg: config.Config{CheckinTimezone: "UTC", CheckinStreakBonus: "3=x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseSchedule(&tt.cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseSchedule = %+v, want error", s)
+				}
+				return
+			}
+			if err != nil || s.MinGP != tt.wantMin || s.MaxGP != tt.wantMax || s.Location == nil ||
+				!reflect.DeepEqual(s.Bonuses, tt.wantBonuses) {
+				t.Fatalf("ParseSchedule = %+v, %v", s, err)
+			}
+		})
+	}
+}
+
+func TestMultiplier(t *testing.T) {
+	s := Schedule{Bonuses: []Bonus{{Streak: 3, Multiplier: 1.2}, {Streak: 7, Multiplier: 1.5}}}
+	tests := []struct {
+		streak int
+		want   float64
+	}{
+		{0, 1}, {1, 1}, {2, 1}, {3, 1.2}, {6, 1.2}, {7, 1.5}, {365, 1.5},
+	}
+	for _, tt := range tests {
+		if got := s.Multiplier(tt.streak); got != tt.want {
+			t.Errorf("Multiplier(%d) = %v, want %v", tt.streak, got, tt.want)
+		}
+	}
+	if got := (&Schedule{}).Multiplier(10); got != 1 {
+		t.Errorf("Multiplier without bonuses = %v, want 1", got)
+	}
+}
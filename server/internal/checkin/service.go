@@ -0,0 +1,169 @@
+package checkin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/auth"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrAlreadyCheckedIn = errors.New("already checked in today")
+
+// Service records check-ins and credits their rewards.
+type Service struct {
+	db         *gorm.DB
+	balanceSvc balance.BalanceService
+	users      auth.UserService
+	schedule   Schedule
+	now        func() time.Time
+}
+
+// NewService creates a check-in service. Rewards are credited through
+// balanceSvc.Deposit as CHECKIN entries.
+func NewService(db *gorm.DB, balanceSvc balance.BalanceService, users auth.UserService, schedule Schedule) *Service {
+	return &Service{db: db, balanceSvc: balanceSvc, users: users, schedule: schedule, now: time.Now}
+}
+
+// Schedule returns the reward schedule.
+func (s *Service) Schedule() Schedule {
+	return s.schedule
+}
+
+// Checkin checks the user in for today. Returns the check-in and the
+// user's account afterwards, or ErrAlreadyCheckedIn.
+//
+// The row is inserted first with ON CONFLICT DO NOTHING on (user_id, day),
+// so of two concurrent requests exactly one gets to deposit. If the
+// deposit fails the row is removed again.
+func (s *Service) Checkin(ctx context.Context, userID string) (*Checkin, *balance.Account, error) {
+	now := s.now()
+	today := s.schedule.day(now)
+	yesterday := s.schedule.day(now.In(s.schedule.Location).AddDate(0, 0, -1))
+
+	var prev Checkin
+	err := s.db.WithContext(ctx).Where("user_id = ?", userID).Order("day DESC").Take(&prev).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		prev, err = s.legacyCheckin(ctx, userID)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if prev.Day == today {
+		return &prev, nil, ErrAlreadyCheckedIn
+	}
+
+	c := &Checkin{UserID: userID, Day: today, Streak: 1, CreatedAt: now}
+	if prev.Day == yesterday {
+		c.Streak = prev.Streak + 1
+	}
+	c.Base = int64(s.schedule.MinGP)
+	if s.schedule.MaxGP > s.schedule.MinGP {
+		c.Base += int64(rand.Intn(s.schedule.MaxGP - s.schedule.MinGP + 1))
+	}
+	c.Multiplier = s.schedule.Multiplier(c.Streak)
+	c.Reward = int64(math.Round(float64(c.Base) * c.Multiplier))
+
+	res := s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(c)
+	if res.Error != nil {
+		return nil, nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return c, nil, ErrAlreadyCheckedIn
+	}
+
+	remark := "每日签到"
+	if c.Streak > 1 {
+		remark = fmt.Sprintf("每日签到（连续 %d 天 ×%g）", c.Streak, c.Multiplier)
+	}
+	acc, err := s.balanceSvc.Deposit(ctx, userID, balance.TxCheckin, c.Reward, remark)
+	if err != nil {
+		if undoErr := s.db.WithContext(context.WithoutCancel(ctx)).Delete(&Checkin{}, c.ID).Error; undoErr != nil {
+			log.Printf("[checkin] ERROR: check-in %d of user=%s recorded but not credited: %v", c.ID, userID, undoErr)
+		}
+		return nil, nil, err
+	}
+
+	// Kept for clients that read last_checkin_at from /api/v1/me.
+	if err := s.users.UpdateLastCheckin(ctx, userID); err != nil {
+		log.Printf("[checkin] update last_checkin_at user=%s: %v", userID, err)
+	}
+	return c, acc, nil
+}
+
+// legacyCheckin stands in for the previous check-in of a user who has
+// none recorded: before check-ins had their own table only
+// users.last_checkin_at was kept. Seeding from it stops a user who already
+// checked in today from checking in again, and one who checked in
+// yesterday from losing their streak. Returns a zero Checkin when the user
+// never checked in.
+func (s *Service) legacyCheckin(ctx context.Context, userID string) (Checkin, error) {
+	user, err := s.users.GetByID(ctx, userID)
+	if err != nil {
+		return Checkin{}, err
+	}
+	if user.LastCheckinAt == nil {
+		return Checkin{}, nil
+	}
+	return Checkin{UserID: userID, Day: s.schedule.day(*user.LastCheckinAt), Streak: 1}, nil
+}
+
+// History pages through the user's check-ins, newest first, and returns
+// the cursor for the next page (0 when there is none).
+func (s *Service) History(ctx context.Context, userID string, cursor uint, limit int) ([]Checkin, uint, error) {
+	if limit <= 0 {
+		limit = 30
+	}
+	limit = min(limit, 366)
+
+	q := s.db.WithContext(ctx).Where("user_id = ?", userID)
+	if cursor > 0 {
+		q = q.Where("id < ?", cursor)
+	}
+	var checkins []Checkin
+	if err := q.Order("id DESC").Limit(limit + 1).Find(&checkins).Error; err != nil {
+		return nil, 0, err
+	}
+	if len(checkins) <= limit {
+		return checkins, 0, nil
+	}
+	checkins = checkins[:limit]
+	return checkins, checkins[limit-1].ID, nil
+}
+
+// Summary returns the user's streak and totals.
+func (s *Service) Summary(ctx context.Context, userID string) (*Summary, error) {
+	var sum Summary
+	err := s.db.WithContext(ctx).Model(&Checkin{}).
+		Select("COUNT(*) AS days, COALESCE(SUM(reward), 0) AS total_gp, COALESCE(MAX(streak), 0) AS longest_streak").
+		Where("user_id = ?", userID).
+		Scan(&sum).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var last Checkin
+	err = s.db.WithContext(ctx).Where("user_id = ?", userID).Order("day DESC").Take(&last).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &sum, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	switch last.Day {
+	case s.schedule.day(now):
+		sum.Today = true
+		sum.Streak = last.Streak
+	case s.schedule.day(now.In(s.schedule.Location).AddDate(0, 0, -1)):
+		sum.Streak = last.Streak // still alive until the end of today
+	}
+	return &sum, nil
+}
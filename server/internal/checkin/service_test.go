@@ -0,0 +1,94 @@
+package checkin
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/auth"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/dbtest"
+)
+
+// stubUsers serves the one user the tests check in.
+type stubUsers struct {
+	auth.UserService
+	user *auth.User
+}
+
+func (u *stubUsers) GetByID(context.Context, string) (*auth.User, error) {
+	return u.user, nil
+}
+
+func (u *stubUsers) UpdateLastCheckin(context.Context, string) error {
+	now := time.Now()
+	u.user.LastCheckinAt = &now
+	return nil
+}
+
+// newTestService returns a service whose clock starts at noon UTC on
+// 2026-03-10 and moves with advance.
+func newTestService(t *testing.T, lastCheckin *time.Time) (s *Service, advance func(time.Duration)) {
+	t.Helper()
+	db := dbtest.Open(t, &Checkin{}, &balance.Account{}, &balance.Transaction{})
+	users := &stubUsers{user: &auth.User{ID: "u1", LastCheckinAt: lastCheckin}}
+	schedule := Schedule{MinGP: 100, MaxGP: 100, Location: time.UTC, Bonuses: []Bonus{{Streak: 2, Multiplier: 2}}}
+	s = NewService(db, balance.NewBalanceService(db), users, schedule)
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	return s, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestCheckinStreak(t *testing.T) {
+	s, advance := newTestService(t, nil)
+	ctx := context.Background()
+
+	steps := []struct {
+		advance    time.Duration
+		wantStreak int
+		wantReward int64
+		wantErr    error
+	}{
+		{0, 1, 100, nil},
+		{time.Hour, 1, 0, ErrAlreadyCheckedIn},
+		{24 * time.Hour, 2, 200, nil},
+		{48 * time.Hour, 1, 100, nil}, // a day skipped breaks the streak
+	}
+	for i, step := range steps {
+		advance(step.advance)
+		c, _, err := s.Checkin(ctx, "u1")
+		if !errors.Is(err, step.wantErr) || c.Streak != step.wantStreak {
+			t.Fatalf("step %d: checkin = %+v, %v; want streak %d, err %v", i, c, err, step.wantStreak, step.wantErr)
+		}
+		if err == nil && c.Reward != step.wantReward {
+			t.Fatalf("step %d: reward = %d, want %d", i, c.Reward, step.wantReward)
+		}
+	}
+}
+
+func TestCheckinSeedsFromLastCheckinAt(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name       string
+		last       time.Time
+		wantStreak int
+		wantErr    error
+	}{
+		{"checked in today", time.Date(2026, 3, 10, 1, 0, 0, 0, time.UTC), 1, ErrAlreadyCheckedIn},
+		{"checked in yesterday", time.Date(2026, 3, 9, 23, 0, 0, 0, time.UTC), 2, nil},
+		{"streak broken", time.Date(2026, 3, 8, 12, 0, 0, 0, time.UTC), 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestService(t, &tt.last)
+			c, acc, err := s.Checkin(ctx, "u1")
+			if !errors.Is(err, tt.wantErr) || c.Streak != tt.wantStreak {
+				t.Fatalf("checkin = %+v, %v; want streak %d, err %v", c, err, tt.wantStreak, tt.wantErr)
+			}
+			if err != nil && acc != nil {
+				t.Fatalf("rejected check-in credited %+v", acc)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+// Package cluster lets several server instances share one node pool.
+//
+// Instances talk through Redis:
+//
+//   - pub/sub fan-out of task announcements (so every instance pushes them
+//     to its own WebSocket clients) and task results (so the instance
+//     holding the HTTP waiter wakes up, whichever instance the node that
+//     finished the task is connected to)
+//   - a node registry (hash nodeID → instanceID) validated against
+//     per-instance heartbeat keys, so a node can only be connected once
+//     cluster-wide and crashed instances drop out on their own
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// ─────────────────────────────────────────────
+// Redis keys & channels
+// ─────────────────────────────────────────────
+
+const (
+	announceChannel = "cluster:announce"
+	resultChannel   = "cluster:result"
+	nodesKey        = "cluster:nodes" // hash nodeID → instanceID
+)
+
+func instanceKey(instanceID string) string {
+	return "cluster:instance:" + instanceID
+}
+
+// luaRegisterNode claims nodeID for this instance unless a live instance
+// already holds it. The caller reads the current owner first and passes
+// its heartbeat key, so the script only touches keys it is given; if the
+// owner changed in between, it returns "RETRY".
+//
+// KEYS[1] = cluster:nodes
+// KEYS[2] = cluster:instance:{owner} (owner as read by the caller)
+// ARGV[1] = nodeID
+// ARGV[2] = instanceID
+// ARGV[3] = owner as read by the caller ("" if none)
+//
+// Returns: "OK", "RETRY" or the owning instanceID
+const luaRegisterNode = `
+local owner = redis.call("HGET", KEYS[1], ARGV[1]) or ""
+if owner ~= ARGV[3] then
+    return "RETRY"
+end
+if owner ~= "" and owner ~= ARGV[2] and redis.call("EXISTS", KEYS[2]) == 1 then
+    return owner
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+return "OK"
+`
+
+// luaUnregisterNode releases nodeID if this instance still owns it.
+//
+// KEYS[1] = cluster:nodes
+// ARGV[1] = nodeID
+// ARGV[2] = instanceID
+const luaUnregisterNode = `
+if redis.call("HGET", KEYS[1], ARGV[1]) == ARGV[2] then
+    redis.call("HDEL", KEYS[1], ARGV[1])
+end
+return "OK"
+`
+
+// ─────────────────────────────────────────────
+// Cluster
+// ─────────────────────────────────────────────
+
+// message is the pub/sub envelope. Origin lets instances skip their own
+// messages, which they already handled locally.
+type message struct {
+	Origin       string                  `json:"origin"`
+	Announcement *model.TaskAnnouncement `json:"announcement,omitempty"`
+	Result       *model.TaskResult       `json:"result,omitempty"`
+}
+
+// Handlers receive messages published by other instances.
+type Handlers struct {
+	Announcement func(ann *model.TaskAnnouncement)
+	Result       func(result *model.TaskResult)
+}
+
+// Cluster is one instance's membership in the cluster.
+type Cluster struct {
+	rdb        *redis.Client
+	instanceID string
+	heartbeat  time.Duration
+	handlers   Handlers
+
+	registerScript   *redis.Script
+	unregisterScript *redis.Script
+}
+
+// New creates a cluster member. An empty instanceID is replaced by
+// hostname plus a random suffix. The instance is considered dead after
+// three missed heartbeats.
+func New(rdb *redis.Client, instanceID string, heartbeat time.Duration) *Cluster {
+	if instanceID == "" {
+		instanceID = DefaultInstanceID()
+	}
+	return &Cluster{
+		rdb:              rdb,
+		instanceID:       instanceID,
+		heartbeat:        heartbeat,
+		registerScript:   redis.NewScript(luaRegisterNode),
+		unregisterScript: redis.NewScript(luaUnregisterNode),
+	}
+}
+
+// DefaultInstanceID returns hostname plus a random suffix, for instances
+// started without INSTANCE_ID.
+func DefaultInstanceID() string {
+	host, _ := os.Hostname()
+	return host + "-" + uuid.NewString()[:8]
+}
+
+// InstanceID returns this instance's ID.
+func (c *Cluster) InstanceID() string {
+	return c.instanceID
+}
+
+// SetHandlers sets the callbacks for messages from other instances.
+// Must be called before Start.
+func (c *Cluster) SetHandlers(h Handlers) {
+	c.handlers = h
+}
+
+// Start writes the first heartbeat and subscribes to the cluster channels,
+// returning once the subscription is active. Heartbeats and message
+// delivery continue in the background until ctx is cancelled.
+func (c *Cluster) Start(ctx context.Context) error {
+	if err := c.beat(ctx); err != nil {
+		return fmt.Errorf("cluster heartbeat: %w", err)
+	}
+
+	sub := c.rdb.Subscribe(ctx, announceChannel, resultChannel)
+	for range 2 {
+		if _, err := sub.Receive(ctx); err != nil {
+			sub.Close()
+			return fmt.Errorf("cluster subscribe: %w", err)
+		}
+	}
+
+	go c.heartbeatLoop(ctx)
+	go c.receiveLoop(ctx, sub)
+
+	log.Printf("[cluster] instance %s joined", c.instanceID)
+	return nil
+}
+
+func (c *Cluster) beat(ctx context.Context) error {
+	return c.rdb.Set(ctx, instanceKey(c.instanceID), time.Now().Unix(), c.heartbeat*3).Err()
+}
+
+func (c *Cluster) heartbeatLoop(ctx context.Context) {
+	ticker := time.NewTicker(c.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Leave promptly so our nodes can reconnect elsewhere.
+			c.rdb.Del(context.Background(), instanceKey(c.instanceID))
+			log.Printf("[cluster] instance %s left", c.instanceID)
+			return
+		case <-ticker.C:
+			if err := c.beat(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("[cluster] heartbeat error: %v", err)
+			}
+		}
+	}
+}
+
+func (c *Cluster) receiveLoop(ctx context.Context, sub *redis.PubSub) {
+	defer sub.Close()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			var m message
+			if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
+				log.Printf("[cluster] bad message on %s: %v", msg.Channel, err)
+				continue
+			}
+			if m.Origin == c.instanceID {
+				continue
+			}
+			switch {
+			case m.Announcement != nil && c.handlers.Announcement != nil:
+				c.handlers.Announcement(m.Announcement)
+			case m.Result != nil && c.handlers.Result != nil:
+				c.handlers.Result(m.Result)
+			}
+		}
+	}
+}
+
+// ─────────────────────────────────────────────
+// Fan-out
+// ─────────────────────────────────────────────
+
+// PublishAnnouncement forwards a task announcement to the other instances.
+func (c *Cluster) PublishAnnouncement(ctx context.Context, ann *model.TaskAnnouncement) error {
+	return c.publish(ctx, announceChannel, &message{Origin: c.instanceID, Announcement: ann})
+}
+
+// PublishResult forwards a task result to the other instances.
+func (c *Cluster) PublishResult(ctx context.Context, result *model.TaskResult) error {
+	return c.publish(ctx, resultChannel, &message{Origin: c.instanceID, Result: result})
+}
+
+func (c *Cluster) publish(ctx context.Context, channel string, m *message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("marshal cluster message: %w", err)
+	}
+	if err := c.rdb.Publish(ctx, channel, data).Err(); err != nil {
+		return fmt.Errorf("publish %s: %w", channel, err)
+	}
+	return nil
+}
+
+// ─────────────────────────────────────────────
+// Node registry
+// ─────────────────────────────────────────────
+
+// RegisterNode records that nodeID is connected to this instance.
+// Fails if it is connected to another live instance.
+func (c *Cluster) RegisterNode(ctx context.Context, nodeID string) error {
+	for range 3 {
+		owner, err := c.rdb.HGet(ctx, nodesKey, nodeID).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return fmt.Errorf("register node: %w", err)
+		}
+		keys := []string{nodesKey, instanceKey(owner)}
+		res, err := c.registerScript.Run(ctx, c.rdb, keys, nodeID, c.instanceID, owner).Text()
+		if err != nil {
+			return fmt.Errorf("register node: %w", err)
+		}
+		switch res {
+		case "OK":
+			return nil
+		case "RETRY":
+			continue
+		default:
+			return fmt.Errorf("node %s already connected to instance %s", nodeID, res)
+		}
+	}
+	return fmt.Errorf("register node %s: contended", nodeID)
+}
+
+// UnregisterNode removes nodeID from the registry if this instance owns it.
+func (c *Cluster) UnregisterNode(ctx context.Context, nodeID string) error {
+	if err := c.unregisterScript.Run(ctx, c.rdb, []string{nodesKey}, nodeID, c.instanceID).Err(); err != nil {
+		return fmt.Errorf("unregister node: %w", err)
+	}
+	return nil
+}
+
+// Nodes returns nodeID → instanceID for every node connected to a live
+// instance. Entries left behind by dead instances are pruned.
+func (c *Cluster) Nodes(ctx context.Context) (map[string]string, error) {
+	all, err := c.rdb.HGetAll(ctx, nodesKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("list nodes: %w", err)
+	}
+
+	alive := make(map[string]bool)
+	for _, instanceID := range all {
+		if _, ok := alive[instanceID]; ok {
+			continue
+		}
+		n, err := c.rdb.Exists(ctx, instanceKey(instanceID)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("check instance: %w", err)
+		}
+		alive[instanceID] = n > 0
+	}
+
+	nodes := make(map[string]string, len(all))
+	for nodeID, instanceID := range all {
+		if alive[instanceID] {
+			nodes[nodeID] = instanceID
+			continue
+		}
+		// Only remove the entry if it still points at the dead instance.
+		c.unregisterScript.Run(ctx, c.rdb, []string{nodesKey}, nodeID, instanceID)
+	}
+	return nodes, nil
+}
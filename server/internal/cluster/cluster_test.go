@@ -0,0 +1,54 @@
+package cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRegisterNode(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	ctx := context.Background()
+	a, b := New(rdb, "a", time.Second), New(rdb, "b", time.Second)
+	for _, c := range []*Cluster{a, b} {
+		if err := c.beat(ctx); err != nil {
+			t.Fatalf("heartbeat: %v", err)
+		}
+	}
+
+	steps := []struct {
+		name    string
+		c       *Cluster
+		prepare func()
+		wantErr bool
+	}{
+		{"first claim", a, nil, false},
+		{"claim again", a, nil, false},
+		{"held by a live instance", b, nil, true},
+		{"owner died", b, func() { mr.Del(instanceKey("a")) }, false},
+		{"back to the old owner", a, func() { a.beat(ctx) }, true},
+	}
+	for _, step := range steps {
+		if step.prepare != nil {
+			step.prepare()
+		}
+		if err := step.c.RegisterNode(ctx, "n1"); (err != nil) != step.wantErr {
+			t.Fatalf("%s: RegisterNode = %v, want error %v", step.name, err, step.wantErr)
+		}
+	}
+
+	// Only the owner can release the node.
+	a.UnregisterNode(ctx, "n1")
+	if nodes, err := a.Nodes(ctx); err != nil || nodes["n1"] != "b" {
+		t.Fatalf("nodes = %v, %v; want n1 on b", nodes, err)
+	}
+	b.UnregisterNode(ctx, "n1")
+	if nodes, _ := a.Nodes(ctx); len(nodes) != 0 {
+		t.Fatalf("nodes after unregister = %v", nodes)
+	}
+}
@@ -11,37 +11,130 @@ type Config struct {
 	// Server
 	ServerAddr string
 
+	// Scheduler
+	SchedulerBackend string // redis | memory
+
+	// Cluster (multiple server instances sharing Redis)
+	ClusterMode      bool          // fan out announcements/results over Redis pub/sub
+	InstanceID       string        // unique per instance (default hostname + random suffix)
+	ClusterHeartbeat time.Duration // instance liveness refresh; dead after 3 missed beats
+
 	// Redis
 	RedisAddr     string
 	RedisPassword string
 	RedisDB       int
 
 	// Cache
-	CacheTTL time.Duration // per-user result cache lifetime
+	CacheTTL      time.Duration // per-user result cache lifetime
+	QuoteCacheTTL time.Duration // per-gallery price quote cache lifetime
 
 	// Task
 	TaskLeaseTTL    time.Duration // lease timeout for claimed tasks
 	TaskWaitTimeout time.Duration // max time HTTP handler blocks waiting for result
 
-	// PostgreSQL
+	// Idempotency-Key
+	IdempotencyTTL time.Duration // how long stored responses are replayed
+
+	// E-Hentai metadata
+	MetadataViaNodes    bool          // ask a connected node for gallery metadata before calling api.php directly
+	MetadataNodeTimeout time.Duration // how long to wait for a node's METADATA_RESPONSE
+	EHAPIRate           float64       // direct api.php calls per second (token bucket refill rate)
+	EHAPIBurst          int           // direct api.php token bucket size
+
+	// E-Hentai API client
+	EHAPIURL              string        // api.php endpoint (override to point at a mirror or fake)
+	EHAPITimeout          time.Duration // per-attempt HTTP timeout
+	EHAPIMaxRetries       int           // retries on 5xx / 429 / timeouts
+	EHAPIRetryDelay       time.Duration // first retry delay (doubled per attempt, jittered)
+	EHAPIBreakerThreshold int           // consecutive failures before the circuit opens
+	EHAPIBreakerCooldown  time.Duration // how long the circuit stays open
+	EHAPIBatchWindow      time.Duration // how long a lookup waits to share a gdata call
+
+	// Pricing
+	PricingPolicy          string        // size | fixed | passthrough | tiered
+	PricingGPPerMB         int           // size-based GP per MB
+	PricingOldMultiplier   int           // size-based multiplier for galleries older than PricingNewGalleryAge
+	PricingNewGalleryAge   time.Duration // galleries younger than this are "new" (free tier)
+	PricingFixedGP         int           // flat GP per gallery for the fixed policy
+	PricingMargin          float64       // passthrough margin (0.1 = +10%)
+	PricingTierMultipliers string        // tiered multipliers, e.g. "free=1,supporter=0.8"
+	PricingDefaultTier     string        // tier used when no resolver is configured
+	SettlementMode         string        // estimate | actual | min
+
+	// Authentication
+	AuthCacheTTL      time.Duration // how long API key lookups are cached (0 disables)
+	DropLegacyAPIKeys bool          // drop users.api_key (plaintext keys) at startup
+	SessionAccessTTL  time.Duration // lifetime of login access tokens
+	SessionRefreshTTL time.Duration // lifetime of login refresh tokens (the session)
+
+	// Email verification & password reset
+	MailBackend          string        // log | smtp
+	SMTPAddr             string        // host:port of the SMTP relay
+	SMTPUsername         string        // empty = no authentication
+	SMTPPassword         string        // used with SMTPUsername
+	MailFrom             string        // sender, e.g. "Archive-at-Home <noreply@example.com>"
+	MailVerifyURL        string        // link in verification mails, "{token}" is replaced; empty = token only
+	MailResetURL         string        // link in password reset mails, "{token}" is replaced; empty = token only
+	EmailVerifyTTL       time.Duration // lifetime of verification tokens
+	PasswordResetTTL     time.Duration // lifetime of password reset tokens
+	RequireEmailVerified bool          // block parsing for accounts with an unverified email
+
+	// Subscription plans
+	Plans             string // plan names, e.g. "free,supporter,premium"
+	PlanDiscount      string // per-plan price multiplier, e.g. "supporter=0.8,premium=0.5"
+	PlanMonthlyParses string // tasks included per month, e.g. "supporter=100,premium=1000"
+	PlanMonthlyGP     string // GP included per month, e.g. "supporter=50000"
+	PlanCacheTTL      string // per-plan result cache lifetime, e.g. "premium=720h"
+	PlanRateLimitRPM  string // per-plan requests per minute, e.g. "premium=600"
+	PlanMaxInFlight   string // per-plan concurrent parse requests, e.g. "premium=20"
+	PlanDailyParses   string // per-plan parse requests per day, e.g. "free=200"
+
+	// Rate limits, defaults for plans without their own (0 = unlimited)
+	RateLimitRPM         int // API requests per user per minute
+	RateLimitMaxInFlight int // concurrent POST /parse requests per user
+	RateLimitDailyParses int // POST /parse requests per user per day
+
+	// Settlement worker
+	SettlementClaimIdle  time.Duration // unacknowledged stream entries are retried after this long
+	SettlementRetryDelay time.Duration // in-memory queue retry delay
+
+	// Frozen balance reconciliation
+	ReconcileInterval  time.Duration // how often the job runs (0 disables)
+	ReconcileOrphanAge time.Duration // open freezes older than this are released or replayed
+	ReconcileLookback  time.Duration // settled traces checked for amount mismatches
+
+	// Database
+	DBDriver   string // postgres | mysql | sqlite
+	DBDSN      string // full DSN, overrides the individual fields below
+	DBPath     string // SQLite database file
 	DBHost     string
-	DBPort     string
+	DBPort     string // default 5432 (postgres) / 3306 (mysql)
 	DBUser     string
 	DBPassword string
 	DBName     string
-	DBSSLMode  string
+	DBSSLMode  string // postgres only
 
 	// Telegram
 	TelegramBotToken    string // Bot token for Telegram Login Widget verification
 	TelegramBotUsername string // Bot username for Telegram Login Widget (e.g., "EhArchive_bot")
 
+	// User-to-user transfers
+	TransferDailyLimit    int64         // GP one user can send per 24h (0 = unlimited)
+	TransferDailyCount    int           // transfers one user can send per 24h (0 = unlimited)
+	TransferMinAccountAge time.Duration // senders must have registered at least this long ago
+
 	// Checkin
-	CheckinMinGP int // Minimum GP reward for daily checkin
-	CheckinMaxGP int // Maximum GP reward for daily checkin
+	CheckinMinGP       int    // Minimum GP reward for daily checkin
+	CheckinMaxGP       int    // Maximum GP reward for daily checkin
+	CheckinTimezone    string // IANA zone whose calendar days count for check-ins and daily parses (e.g. "Asia/Shanghai"), "Local" = server zone
+	CheckinStreakBonus string // streak multipliers, e.g. "3=1.2,7=1.5"
 
 	// Node Authentication
 	NodeVerifyKey string // ED25519 public key (Base64 encoded) for verifying node signatures
 
+	// Node operator rewards
+	NodeRewardShare float64 // share of a task's ActualGP credited to the node's operator (0 = off)
+
 	// Admin Authentication
 	AdminToken string // Bearer token for admin API access
 
@@ -51,28 +144,106 @@ type Config struct {
 
 // Load reads configuration from environment variables with sensible defaults.
 func Load() *Config {
-	return &Config{
-		ServerAddr:          envOr("SERVER_ADDR", ":8080"),
-		RedisAddr:           envOr("REDIS_ADDR", "localhost:6379"),
-		RedisPassword:       envOr("REDIS_PASSWORD", ""),
-		RedisDB:             envIntOr("REDIS_DB", 0),
-		CacheTTL:            envDurationOr("CACHE_TTL", 7*24*time.Hour),
-		TaskLeaseTTL:        envDurationOr("TASK_LEASE_TTL", 2*time.Minute),
-		TaskWaitTimeout:     envDurationOr("TASK_WAIT_TIMEOUT", 90*time.Second),
-		DBHost:              envOr("DB_HOST", "localhost"),
-		DBPort:              envOr("DB_PORT", "5432"),
-		DBUser:              envOr("DB_USER", "postgres"),
-		DBPassword:          envOr("DB_PASSWORD", "postgres"),
-		DBName:              envOr("DB_NAME", "ehentai"),
-		DBSSLMode:           envOr("DB_SSLMODE", "disable"),
-		TelegramBotToken:    envOr("TELEGRAM_BOT_TOKEN", ""),
-		TelegramBotUsername: envOr("TELEGRAM_BOT_USERNAME", ""),
-		CheckinMinGP:        envIntOr("CHECKIN_MIN_GP", 10000),
-		CheckinMaxGP:        envIntOr("CHECKIN_MAX_GP", 20000),
-		NodeVerifyKey:       envOr("NODE_VERIFY_KEY", ""),
-		AdminToken:          envOr("ADMIN_TOKEN", ""),
-		EmailAuthEnabled:    envBoolOr("EMAIL_AUTH_ENABLED", false),
+	cfg := &Config{
+		ServerAddr:             envOr("SERVER_ADDR", ":8080"),
+		SchedulerBackend:       envOr("SCHEDULER_BACKEND", "redis"),
+		ClusterMode:            envBoolOr("CLUSTER_MODE", false),
+		InstanceID:             envOr("INSTANCE_ID", ""),
+		ClusterHeartbeat:       envDurationOr("CLUSTER_HEARTBEAT", 10*time.Second),
+		RedisAddr:              envOr("REDIS_ADDR", "localhost:6379"),
+		RedisPassword:          envOr("REDIS_PASSWORD", ""),
+		RedisDB:                envIntOr("REDIS_DB", 0),
+		CacheTTL:               envDurationOr("CACHE_TTL", 7*24*time.Hour),
+		QuoteCacheTTL:          envDurationOr("QUOTE_CACHE_TTL", 10*time.Minute),
+		TaskLeaseTTL:           envDurationOr("TASK_LEASE_TTL", 2*time.Minute),
+		TaskWaitTimeout:        envDurationOr("TASK_WAIT_TIMEOUT", 90*time.Second),
+		IdempotencyTTL:         envDurationOr("IDEMPOTENCY_TTL", 24*time.Hour),
+		MetadataViaNodes:       envBoolOr("METADATA_VIA_NODES", false),
+		MetadataNodeTimeout:    envDurationOr("METADATA_NODE_TIMEOUT", 5*time.Second),
+		EHAPIRate:              envFloatOr("EH_API_RATE", 1),
+		EHAPIBurst:             envIntOr("EH_API_BURST", 4),
+		EHAPIURL:               envOr("EH_API_URL", "https://e-hentai.org/api.php"),
+		EHAPITimeout:           envDurationOr("EH_API_TIMEOUT", 15*time.Second),
+		EHAPIMaxRetries:        envIntOr("EH_API_MAX_RETRIES", 2),
+		EHAPIRetryDelay:        envDurationOr("EH_API_RETRY_DELAY", 500*time.Millisecond),
+		EHAPIBreakerThreshold:  envIntOr("EH_API_BREAKER_THRESHOLD", 5),
+		EHAPIBreakerCooldown:   envDurationOr("EH_API_BREAKER_COOLDOWN", 30*time.Second),
+		EHAPIBatchWindow:       envDurationOr("EH_API_BATCH_WINDOW", 50*time.Millisecond),
+		PricingPolicy:          envOr("PRICING_POLICY", "size"),
+		PricingGPPerMB:         envIntOr("PRICING_GP_PER_MB", 20),
+		PricingOldMultiplier:   envIntOr("PRICING_OLD_MULTIPLIER", 3),
+		PricingNewGalleryAge:   envDurationOr("PRICING_NEW_GALLERY_AGE", 365*24*time.Hour),
+		PricingFixedGP:         envIntOr("PRICING_FIXED_GP", 100),
+		PricingMargin:          envFloatOr("PRICING_MARGIN", 0),
+		PricingTierMultipliers: envOr("PRICING_TIER_MULTIPLIERS", ""),
+		PricingDefaultTier:     envOr("PRICING_DEFAULT_TIER", "free"),
+		SettlementMode:         envOr("SETTLEMENT_MODE", "estimate"),
+		AuthCacheTTL:           envDurationOr("AUTH_CACHE_TTL", 30*time.Second),
+		DropLegacyAPIKeys:      envBoolOr("DROP_LEGACY_API_KEYS", false),
+		SessionAccessTTL:       envDurationOr("SESSION_ACCESS_TTL", 15*time.Minute),
+		SessionRefreshTTL:      envDurationOr("SESSION_REFRESH_TTL", 30*24*time.Hour),
+		MailBackend:            envOr("MAIL_BACKEND", "log"),
+		SMTPAddr:               envOr("SMTP_ADDR", ""),
+		SMTPUsername:           envOr("SMTP_USERNAME", ""),
+		SMTPPassword:           envOr("SMTP_PASSWORD", ""),
+		MailFrom:               envOr("MAIL_FROM", ""),
+		MailVerifyURL:          envOr("MAIL_VERIFY_URL", ""),
+		MailResetURL:           envOr("MAIL_RESET_URL", ""),
+		EmailVerifyTTL:         envDurationOr("EMAIL_VERIFY_TTL", 48*time.Hour),
+		PasswordResetTTL:       envDurationOr("PASSWORD_RESET_TTL", time.Hour),
+		RequireEmailVerified:   envBoolOr("REQUIRE_EMAIL_VERIFIED", false),
+		Plans:                  envOr("PLANS", "free,supporter,premium"),
+		PlanDiscount:           envOr("PLAN_DISCOUNT", ""),
+		PlanMonthlyParses:      envOr("PLAN_MONTHLY_PARSES", ""),
+		PlanMonthlyGP:          envOr("PLAN_MONTHLY_GP", ""),
+		PlanCacheTTL:           envOr("PLAN_CACHE_TTL", ""),
+		PlanRateLimitRPM:       envOr("PLAN_RATE_LIMIT_RPM", ""),
+		PlanMaxInFlight:        envOr("PLAN_MAX_IN_FLIGHT", ""),
+		PlanDailyParses:        envOr("PLAN_DAILY_PARSES", ""),
+		RateLimitRPM:           envIntOr("RATE_LIMIT_RPM", 0),
+		RateLimitMaxInFlight:   envIntOr("RATE_LIMIT_MAX_IN_FLIGHT", 0),
+		RateLimitDailyParses:   envIntOr("RATE_LIMIT_DAILY_PARSES", 0),
+		SettlementClaimIdle:    envDurationOr("SETTLEMENT_CLAIM_IDLE", time.Minute),
+		SettlementRetryDelay:   envDurationOr("SETTLEMENT_RETRY_DELAY", 5*time.Second),
+		ReconcileInterval:      envDurationOr("RECONCILE_INTERVAL", 10*time.Minute),
+		ReconcileOrphanAge:     envDurationOr("RECONCILE_ORPHAN_AGE", 0),
+		ReconcileLookback:      envDurationOr("RECONCILE_LOOKBACK", 7*24*time.Hour),
+		DBDriver:               envOr("DB_DRIVER", "postgres"),
+		DBDSN:                  envOr("DB_DSN", ""),
+		DBPath:                 envOr("DB_PATH", "./data/server.db"),
+		DBHost:                 envOr("DB_HOST", "localhost"),
+		DBPort:                 envOr("DB_PORT", ""),
+		DBUser:                 envOr("DB_USER", "postgres"),
+		DBPassword:             envOr("DB_PASSWORD", "postgres"),
+		DBName:                 envOr("DB_NAME", "ehentai"),
+		DBSSLMode:              envOr("DB_SSLMODE", "disable"),
+		TelegramBotToken:       envOr("TELEGRAM_BOT_TOKEN", ""),
+		TelegramBotUsername:    envOr("TELEGRAM_BOT_USERNAME", ""),
+		TransferDailyLimit:     int64(envIntOr("TRANSFER_DAILY_LIMIT", 1_000_000)),
+		TransferDailyCount:     envIntOr("TRANSFER_DAILY_COUNT", 20),
+		TransferMinAccountAge:  envDurationOr("TRANSFER_MIN_ACCOUNT_AGE", 72*time.Hour),
+		CheckinMinGP:           envIntOr("CHECKIN_MIN_GP", 10000),
+		CheckinMaxGP:           envIntOr("CHECKIN_MAX_GP", 20000),
+		CheckinTimezone:        envOr("CHECKIN_TIMEZONE", "Local"),
+		CheckinStreakBonus:     envOr("CHECKIN_STREAK_BONUS", "3=1.2,7=1.5,30=2"),
+		NodeVerifyKey:          envOr("NODE_VERIFY_KEY", ""),
+		NodeRewardShare:        envFloatOr("NODE_REWARD_SHARE", 0),
+		AdminToken:             envOr("ADMIN_TOKEN", ""),
+		EmailAuthEnabled:       envBoolOr("EMAIL_AUTH_ENABLED", false),
+	}
+	if cfg.ReconcileOrphanAge <= 0 {
+		cfg.ReconcileOrphanAge = DefaultOrphanAge(cfg.TaskLeaseTTL, cfg.TaskWaitTimeout)
 	}
+	return cfg
+}
+
+// DefaultOrphanAge is how long a freeze may stay open before
+// reconciliation treats it as orphaned. An unclaimed task expires three
+// leases after it was published and the lease watchdog then fails it for
+// settlement, so no freeze legitimately outlives the request's wait plus
+// that; twice as long leaves room for reclaims and watchdog delay.
+func DefaultOrphanAge(leaseTTL, waitTimeout time.Duration) time.Duration {
+	return 2 * (waitTimeout + 3*leaseTTL)
 }
 
 // ─── helpers ───
@@ -93,6 +264,15 @@ func envIntOr(key string, fallback int) int {
 	return fallback
 }
 
+func envFloatOr(key string, fallback float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return fallback
+}
+
 func envBoolOr(key string, fallback bool) bool {
 	if v := os.Getenv(key); v != "" {
 		if b, err := strconv.ParseBool(v); err == nil {
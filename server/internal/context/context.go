@@ -5,8 +5,13 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// Context key for the authenticated user.
-const CtxKeyUser = "auth_user"
+// Context keys for the authenticated user, the scopes of the key used and,
+// for login access tokens, the session.
+const (
+	CtxKeyUser    = "auth_user"
+	CtxKeyScopes  = "auth_scopes"
+	CtxKeySession = "auth_session"
+)
 
 // MustGetUser extracts the authenticated user from the Gin context.
 // Panics if not present (should only be called after APIKeyAuth middleware).
@@ -23,3 +28,17 @@ func GetUserID(c *gin.Context) string {
 	u := MustGetUser(c)
 	return u.ID
 }
+
+// GetScopes returns the scopes of the API key the request was made with,
+// or nil if it was not authenticated by APIKeyAuth.
+func GetScopes(c *gin.Context) auth.Scopes {
+	v, _ := c.Get(CtxKeyScopes)
+	scopes, _ := v.(auth.Scopes)
+	return scopes
+}
+
+// GetSessionID returns the ID of the login session the request was made
+// with, or "" if it was made with an API key.
+func GetSessionID(c *gin.Context) string {
+	return c.GetString(CtxKeySession)
+}
@@ -0,0 +1,119 @@
+package ehapi
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ─────────────────────────────────────────────
+// Batch coalescing
+//
+// The first lookup opens a batch and waits up to window for others to
+// join. The batch is sent when the window elapses or MaxBatchSize gids
+// have been collected, whichever comes first. Every caller then picks
+// its own gallery out of the shared response.
+// ─────────────────────────────────────────────
+
+type fetchFunc func(ctx context.Context, ids []gidToken) (map[int]*Metadata, map[int]error, error)
+
+type batch struct {
+	ids    []gidToken
+	tokens map[int]string
+	sent   bool
+	done   chan struct{}
+
+	metas map[int]*Metadata
+	errs  map[int]error
+	err   error
+}
+
+type batcher struct {
+	mu      sync.Mutex
+	window  time.Duration
+	fetch   fetchFunc
+	current *batch
+}
+
+func newBatcher(window time.Duration, fetch fetchFunc) *batcher {
+	return &batcher{window: window, fetch: fetch}
+}
+
+func (bt *batcher) lookup(ctx context.Context, gid int, token string) (*Metadata, error) {
+	b := bt.join(gid, token)
+
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if b.err != nil {
+		return nil, b.err
+	}
+	if err := b.errs[gid]; err != nil {
+		return nil, err
+	}
+	return b.metas[gid], nil
+}
+
+// join adds the gallery to the open batch (opening one if needed) and
+// returns the batch whose result the caller should wait for.
+func (bt *batcher) join(gid int, token string) *batch {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	// gdata answers by gid, so the same gid with a different token cannot
+	// share a call: send what we have and start over.
+	if b := bt.current; b != nil {
+		if t, ok := b.tokens[gid]; ok {
+			if t == token {
+				return b
+			}
+			bt.sendLocked(b)
+		}
+	}
+
+	b := bt.current
+	if b == nil {
+		b = &batch{
+			tokens: make(map[int]string),
+			done:   make(chan struct{}),
+		}
+		bt.current = b
+		if bt.window > 0 {
+			time.AfterFunc(bt.window, func() {
+				bt.mu.Lock()
+				defer bt.mu.Unlock()
+				bt.sendLocked(b)
+			})
+		}
+	}
+
+	b.tokens[gid] = token
+	b.ids = append(b.ids, gidToken{gid: gid, token: token})
+
+	if bt.window <= 0 || len(b.ids) >= MaxBatchSize {
+		bt.sendLocked(b)
+	}
+	return b
+}
+
+// sendLocked detaches b and runs it in the background. Must hold bt.mu.
+func (bt *batcher) sendLocked(b *batch) {
+	if b.sent {
+		return
+	}
+	b.sent = true
+	if bt.current == b {
+		bt.current = nil
+	}
+
+	go func() {
+		// The call is shared by several callers, so it is not bound to
+		// any one of their contexts; HTTP timeouts and the retry budget
+		// keep it finite.
+		b.metas, b.errs, b.err = bt.fetch(context.Background(), b.ids)
+		close(b.done)
+	}()
+}
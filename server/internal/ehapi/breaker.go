@@ -0,0 +1,90 @@
+package ehapi
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// ─────────────────────────────────────────────
+// Circuit breaker
+//
+// closed    → calls pass; threshold consecutive failures open it
+// open      → calls fail fast with ErrCircuitOpen until cooldown ends
+// half-open → a single probe is let through; success closes the
+//             breaker, failure re-opens it for another cooldown
+// ─────────────────────────────────────────────
+
+type breakerState int
+
+const (
+	stateClosed breakerState = iota
+	stateOpen
+	stateHalfOpen
+)
+
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a call may be attempted now.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case stateOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = stateHalfOpen
+		b.probing = true
+		return true
+	case stateHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != stateClosed {
+		log.Println("[ehapi] circuit closed")
+	}
+	b.state = stateClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == stateHalfOpen || b.failures >= b.threshold {
+		if b.state != stateOpen {
+			log.Printf("[ehapi] circuit opened after %d consecutive failures (cooldown %s)", b.failures, b.cooldown)
+		}
+		b.state = stateOpen
+		b.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,291 @@
+package ehapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ─────────────────────────────────────────────
+// E-Hentai API client
+//
+// Wraps api.php (gdata) with:
+//   - a token-bucket rate limiter shared by every call
+//   - jittered retries on 5xx / 429 / timeouts
+//   - a circuit breaker that fails fast while upstream is down
+//   - batch coalescing: concurrent lookups are merged into one
+//     gdata call of up to MaxBatchSize gids
+// ─────────────────────────────────────────────
+
+// DefaultEndpoint is the public e-hentai API endpoint.
+const DefaultEndpoint = "https://e-hentai.org/api.php"
+
+// MaxBatchSize is the maximum number of gids accepted by one gdata call.
+const MaxBatchSize = 25
+
+// ErrCircuitOpen is returned without contacting upstream while the breaker is open.
+var ErrCircuitOpen = errors.New("e-hentai API unavailable (circuit open), try again later")
+
+// GalleryError is returned when the API answered but rejected a gallery
+// (wrong key, removed gallery, ...). It is never retried.
+type GalleryError struct {
+	GID int
+	Msg string
+}
+
+func (e *GalleryError) Error() string {
+	return "api returned error: " + e.Msg
+}
+
+// Metadata is the subset of gdata fields the server needs.
+type Metadata struct {
+	GID      int
+	Token    string
+	Posted   time.Time
+	Filesize int64 // bytes
+}
+
+// Options configures a Client. Zero values fall back to sensible defaults.
+type Options struct {
+	Endpoint         string            // api.php URL (default DefaultEndpoint)
+	Transport        http.RoundTripper // HTTP transport (default http.DefaultTransport)
+	Timeout          time.Duration     // per-attempt HTTP timeout (default 15s)
+	Rate             float64           // requests per second; <= 0 disables limiting
+	Burst            int               // token bucket size (default 1)
+	MaxRetries       int               // retries after the first attempt
+	RetryBaseDelay   time.Duration     // first retry delay, doubled per attempt (default 500ms)
+	BreakerThreshold int               // consecutive failures that open the breaker (default 5)
+	BreakerCooldown  time.Duration     // how long the breaker stays open (default 30s)
+	BatchWindow      time.Duration     // how long a lookup waits for others to join its batch
+}
+
+// Client is safe for concurrent use.
+type Client struct {
+	endpoint       string
+	httpClient     *http.Client
+	limiter        *rate.Limiter
+	maxRetries     int
+	retryBaseDelay time.Duration
+	breaker        *breaker
+	batcher        *batcher
+}
+
+// New creates an API client.
+func New(opts Options) *Client {
+	if opts.Endpoint == "" {
+		opts.Endpoint = DefaultEndpoint
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 15 * time.Second
+	}
+	if opts.RetryBaseDelay <= 0 {
+		opts.RetryBaseDelay = 500 * time.Millisecond
+	}
+	if opts.BreakerThreshold <= 0 {
+		opts.BreakerThreshold = 5
+	}
+	if opts.BreakerCooldown <= 0 {
+		opts.BreakerCooldown = 30 * time.Second
+	}
+
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if opts.Rate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(opts.Rate), max(opts.Burst, 1))
+	}
+
+	c := &Client{
+		endpoint:       opts.Endpoint,
+		httpClient:     &http.Client{Timeout: opts.Timeout, Transport: opts.Transport},
+		limiter:        limiter,
+		maxRetries:     max(opts.MaxRetries, 0),
+		retryBaseDelay: opts.RetryBaseDelay,
+		breaker:        newBreaker(opts.BreakerThreshold, opts.BreakerCooldown),
+	}
+	c.batcher = newBatcher(opts.BatchWindow, c.gdata)
+	return c
+}
+
+// GalleryMetadata looks up one gallery. Concurrent calls are coalesced
+// into shared gdata requests.
+func (c *Client) GalleryMetadata(ctx context.Context, gid int, token string) (*Metadata, error) {
+	return c.batcher.lookup(ctx, gid, token)
+}
+
+// ─────────────────────────────────────────────
+// gdata call with limiter, retries and breaker
+// ─────────────────────────────────────────────
+
+type gidToken struct {
+	gid   int
+	token string
+}
+
+type gdataEntry struct {
+	GID      int    `json:"gid"`
+	Token    string `json:"token"`
+	Posted   string `json:"posted"`
+	Filesize int64  `json:"filesize"`
+	Error    string `json:"error"`
+}
+
+// gdata fetches metadata for up to MaxBatchSize galleries in one call.
+// Per-gallery failures are reported in the returned error map.
+func (c *Client) gdata(ctx context.Context, ids []gidToken) (map[int]*Metadata, map[int]error, error) {
+	gidlist := make([][]any, len(ids))
+	for i, id := range ids {
+		gidlist[i] = []any{id.gid, id.token}
+	}
+	payload, err := json.Marshal(map[string]any{
+		"method":    "gdata",
+		"gidlist":   gidlist,
+		"namespace": 1,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, err := c.postWithRetry(ctx, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var result struct {
+		Gmetadata []gdataEntry `json:"gmetadata"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, nil, fmt.Errorf("decode json failed: %w", err)
+	}
+
+	metas := make(map[int]*Metadata, len(result.Gmetadata))
+	errs := make(map[int]error)
+	for _, e := range result.Gmetadata {
+		if e.Error != "" {
+			errs[e.GID] = &GalleryError{GID: e.GID, Msg: e.Error}
+			continue
+		}
+		postedUnix, err := strconv.ParseInt(e.Posted, 10, 64)
+		if err != nil {
+			errs[e.GID] = fmt.Errorf("invalid posted timestamp: %w", err)
+			continue
+		}
+		metas[e.GID] = &Metadata{
+			GID:      e.GID,
+			Token:    e.Token,
+			Posted:   time.Unix(postedUnix, 0),
+			Filesize: e.Filesize,
+		}
+	}
+	for _, id := range ids {
+		if _, ok := metas[id.gid]; !ok && errs[id.gid] == nil {
+			errs[id.gid] = &GalleryError{GID: id.gid, Msg: "empty metadata"}
+		}
+	}
+	return metas, errs, nil
+}
+
+// retryableError marks failures worth another attempt (5xx, 429, timeouts).
+type retryableError struct{ err error }
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+func (c *Client) postWithRetry(ctx context.Context, payload []byte) ([]byte, error) {
+	var lastErr error
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleepCtx(ctx, c.backoff(attempt)); err != nil {
+				return nil, err
+			}
+		}
+
+		if !c.breaker.allow() {
+			return nil, ErrCircuitOpen
+		}
+		if err := c.limiter.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("api rate limit: %w", err)
+		}
+
+		body, err := c.post(ctx, payload)
+		if err == nil {
+			c.breaker.success()
+			return body, nil
+		}
+
+		var re *retryableError
+		if !errors.As(err, &re) {
+			// Client-side problem (4xx, bad request): upstream is healthy.
+			c.breaker.success()
+			return nil, err
+		}
+		c.breaker.failure()
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+		log.Printf("[ehapi] attempt %d/%d failed: %v", attempt+1, c.maxRetries+1, err)
+	}
+	return nil, lastErr
+}
+
+func (c *Client) post(ctx context.Context, payload []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, context.DeadlineExceeded) {
+			return nil, &retryableError{fmt.Errorf("http request timed out: %w", err)}
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("http request failed: %w", err)
+		}
+		// Connection refused / reset: treat as upstream failure.
+		return nil, &retryableError{fmt.Errorf("http request failed: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &retryableError{fmt.Errorf("read body failed: %w", err)}
+	}
+
+	switch {
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return nil, &retryableError{fmt.Errorf("api status code: %d", resp.StatusCode)}
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("api status code: %d", resp.StatusCode)
+	}
+	return body, nil
+}
+
+// backoff returns base * 2^(attempt-1), jittered to 50%–150%.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.retryBaseDelay << (attempt - 1)
+	return time.Duration(float64(d) * (0.5 + rand.Float64()))
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -3,10 +3,18 @@ package handler
 import (
 	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/Archive-At-Home/archive-at-home/server/internal/auth"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/merge"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/node"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/plan"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/ratelimit"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/reconcile"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/voucher"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/ws"
 	"github.com/gin-gonic/gin"
 )
@@ -14,16 +22,33 @@ import (
 // AdminHandler handles admin-only endpoints.
 type AdminHandler struct {
 	userSvc    auth.UserService
+	keys       *auth.KeyService
 	balanceSvc balance.BalanceService
 	hub        *ws.Hub
+	reconciler *reconcile.Reconciler
+	merger     *merge.Merger
+	voucherSvc voucher.Service
+	operators  *node.OperatorService
+	plans      *plan.Service
+	limiter    *ratelimit.Limiter
+	idempotent gin.HandlerFunc
 }
 
-// NewAdminHandler creates a new AdminHandler.
-func NewAdminHandler(userSvc auth.UserService, balanceSvc balance.BalanceService, hub *ws.Hub) *AdminHandler {
+// NewAdminHandler creates a new AdminHandler. idempotent guards the
+// endpoints that move GP (see middleware.Idempotency).
+func NewAdminHandler(userSvc auth.UserService, keys *auth.KeyService, balanceSvc balance.BalanceService, hub *ws.Hub, reconciler *reconcile.Reconciler, merger *merge.Merger, voucherSvc voucher.Service, operators *node.OperatorService, plans *plan.Service, limiter *ratelimit.Limiter, idempotent gin.HandlerFunc) *AdminHandler {
 	return &AdminHandler{
 		userSvc:    userSvc,
+		keys:       keys,
 		balanceSvc: balanceSvc,
 		hub:        hub,
+		reconciler: reconciler,
+		merger:     merger,
+		voucherSvc: voucherSvc,
+		operators:  operators,
+		plans:      plans,
+		limiter:    limiter,
+		idempotent: idempotent,
 	}
 }
 
@@ -32,7 +57,28 @@ func (h *AdminHandler) RegisterRoutes(admin *gin.RouterGroup) {
 	admin.GET("/health", h.Health)
 	admin.GET("/users/:id", h.GetUser)
 	admin.PUT("/users/:id/status", h.SetUserStatus)
-	admin.POST("/users/:id/credits", h.AddCredits)
+	admin.POST("/users/:id/credits", h.idempotent, h.AddCredits)
+	admin.POST("/users/:id/merge", h.idempotent, h.MergeUser)
+	admin.PUT("/users/:id/plan", h.SetUserPlan)
+	admin.DELETE("/users/:id/plan", h.CancelUserPlan)
+	admin.GET("/plans", h.ListPlans)
+	admin.GET("/users/:id/api-keys", h.UserAPIKeys)
+	admin.POST("/users/:id/api-keys", h.CreateUserAPIKey)
+	admin.DELETE("/users/:id/api-keys/:key_id", h.RevokeUserAPIKey)
+	admin.GET("/users/:id/limits", h.GetUserLimits)
+	admin.PUT("/users/:id/limits", h.SetUserLimits)
+	admin.DELETE("/users/:id/limits", h.ClearUserLimits)
+	admin.GET("/users/:id/transactions", h.UserTransactions)
+	admin.GET("/users/:id/transactions/export", h.ExportUserTransactions)
+	admin.GET("/transactions", h.Ledger)
+	admin.GET("/transactions/export", h.ExportLedger)
+	admin.POST("/vouchers", h.idempotent, h.MintVouchers)
+	admin.GET("/vouchers", h.ListVouchers)
+	admin.GET("/vouchers/batches", h.VoucherBatches)
+	admin.POST("/vouchers/revoke", h.RevokeVouchers)
+	admin.PUT("/nodes/:id/owner", h.SetNodeOwner)
+	admin.GET("/reconcile", h.ReconcileReport)
+	admin.POST("/reconcile", h.Reconcile)
 }
 
 // ─────────────────────────────────────────────
@@ -70,16 +116,21 @@ func (h *AdminHandler) GetUser(c *gin.Context) {
 	}
 
 	// Get balance
-	var balance int64
+	var available, frozen int64
 	acc, err := h.balanceSvc.GetAccount(ctx, userID)
 	if err == nil {
-		balance = acc.Available()
+		available, frozen = acc.Available(), acc.Frozen
 	}
 
-	c.JSON(http.StatusOK, model.UserProfile{
+	profile := model.UserProfile{
 		User:    user,
-		Balance: balance,
-	})
+		Balance: available,
+		Frozen:  frozen,
+	}
+	if st, err := h.plans.Status(ctx, userID); err == nil {
+		profile.Plan = st
+	}
+	c.JSON(http.StatusOK, profile)
 }
 
 // ─────────────────────────────────────────────
@@ -115,6 +166,10 @@ func (h *AdminHandler) SetUserStatus(c *gin.Context) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 			return
 		}
+		if errors.Is(err, auth.ErrUserMerged) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update status"})
 		return
 	}
@@ -168,7 +223,7 @@ func (h *AdminHandler) AddCredits(c *gin.Context) {
 	if remark == "" {
 		remark = "管理员充值"
 	}
-	acc, err := h.balanceSvc.Deposit(ctx, userID, req.Amount, remark)
+	acc, err := h.balanceSvc.Deposit(ctx, userID, balance.TxDeposit, req.Amount, remark)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add credits"})
 		return
@@ -180,3 +235,472 @@ func (h *AdminHandler) AddCredits(c *gin.Context) {
 		Message: "credits added successfully",
 	})
 }
+
+// ─────────────────────────────────────────────
+// POST /api/v1/admin/users/:id/merge
+// ─────────────────────────────────────────────
+
+type MergeUserRequest struct {
+	Source string `json:"source" binding:"required"` // user ID, email or Telegram ID of the account to merge in
+}
+
+// MergeUser merges the source account into :id, moving its balance,
+// history and login identities (admin-only). The source is left with
+// status "merged".
+func (h *AdminHandler) MergeUser(c *gin.Context) {
+	var req MergeUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	targetID, ok := h.existingUser(c)
+	if !ok {
+		return
+	}
+	source, err := h.userSvc.Resolve(ctx, req.Source)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "source user not found"})
+		return
+	}
+
+	res, err := h.merger.Merge(ctx, targetID, source.ID)
+	switch {
+	case errors.Is(err, merge.ErrSameUser):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, auth.ErrUserMerged), errors.Is(err, merge.ErrBusy):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, auth.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "merge failed"})
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// ─────────────────────────────────────────────
+// PUT /api/v1/admin/users/:id/plan
+// ─────────────────────────────────────────────
+
+type SetUserPlanRequest struct {
+	Plan      string     `json:"plan" binding:"required"`
+	ExpiresAt *time.Time `json:"expires_at"` // omit for no expiry
+	Note      string     `json:"note" binding:"max=200"`
+}
+
+// SetUserPlan assigns a plan to a user, replacing the current one.
+func (h *AdminHandler) SetUserPlan(c *gin.Context) {
+	userID, ok := h.existingUser(c)
+	if !ok {
+		return
+	}
+	var req SetUserPlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	sub, err := h.plans.Assign(c.Request.Context(), userID, req.Plan, req.ExpiresAt, req.Note)
+	switch {
+	case errors.Is(err, plan.ErrUnknownPlan):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to assign plan"})
+		return
+	}
+	h.limiter.Invalidate(userID)
+	c.JSON(http.StatusOK, gin.H{"success": true, "subscription": sub})
+}
+
+// CancelUserPlan moves a user back to the default plan.
+func (h *AdminHandler) CancelUserPlan(c *gin.Context) {
+	userID, ok := h.existingUser(c)
+	if !ok {
+		return
+	}
+	cancelled, err := h.plans.Cancel(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel plan"})
+		return
+	}
+	h.limiter.Invalidate(userID)
+	c.JSON(http.StatusOK, gin.H{"success": true, "cancelled": cancelled})
+}
+
+// ─────────────────────────────────────────────
+// GET /api/v1/admin/plans
+// ─────────────────────────────────────────────
+
+// PlanView is a configured plan as shown to admins.
+type PlanView struct {
+	plan.Plan
+	CacheTTL string `json:"cache_ttl"`
+}
+
+// ListPlans returns the plans defined in config.
+func (h *AdminHandler) ListPlans(c *gin.Context) {
+	plans := h.plans.Plans()
+	views := make([]PlanView, len(plans))
+	for i, p := range plans {
+		views[i] = PlanView{Plan: p, CacheTTL: p.CacheTTL.String()}
+	}
+	c.JSON(http.StatusOK, gin.H{"plans": views})
+}
+
+// ─────────────────────────────────────────────
+// /api/v1/admin/users/:id/api-keys
+// ─────────────────────────────────────────────
+
+// UserAPIKeys lists a user's named API keys.
+func (h *AdminHandler) UserAPIKeys(c *gin.Context) {
+	if userID, ok := h.existingUser(c); ok {
+		listAPIKeys(c, h.keys, userID)
+	}
+}
+
+// CreateUserAPIKey issues a key for a user; unlike users, admins may grant
+// admin:read.
+func (h *AdminHandler) CreateUserAPIKey(c *gin.Context) {
+	if userID, ok := h.existingUser(c); ok {
+		createAPIKey(c, h.keys, userID, append(auth.Scopes{auth.ScopeAdminRead}, auth.UserScopes...))
+	}
+}
+
+// RevokeUserAPIKey revokes one of a user's named keys.
+func (h *AdminHandler) RevokeUserAPIKey(c *gin.Context) {
+	if userID, ok := h.existingUser(c); ok {
+		revokeAPIKey(c, h.keys, userID)
+	}
+}
+
+// ─────────────────────────────────────────────
+// /api/v1/admin/users/:id/limits
+// ─────────────────────────────────────────────
+
+// UserLimitsResponse shows a user's effective rate limits and the override
+// (null if none) applied on top of their plan's.
+type UserLimitsResponse struct {
+	UserID   string              `json:"user_id"`
+	Limits   ratelimit.Limits    `json:"limits"`
+	Override *ratelimit.Override `json:"override"`
+}
+
+// GetUserLimits returns the user's effective rate limits.
+func (h *AdminHandler) GetUserLimits(c *gin.Context) {
+	if userID, ok := h.existingUser(c); ok {
+		h.writeUserLimits(c, userID)
+	}
+}
+
+// SetUserLimitsRequest overrides a user's plan limits. Omitted or null
+// fields keep the plan's value; 0 removes the limit.
+type SetUserLimitsRequest struct {
+	RequestsPerMinute *int `json:"requests_per_minute" binding:"omitempty,min=0"`
+	MaxInFlight       *int `json:"max_in_flight" binding:"omitempty,min=0"`
+	DailyParses       *int `json:"daily_parses" binding:"omitempty,min=0"`
+}
+
+// SetUserLimits replaces the user's rate limit override.
+func (h *AdminHandler) SetUserLimits(c *gin.Context) {
+	userID, ok := h.existingUser(c)
+	if !ok {
+		return
+	}
+	var req SetUserLimitsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := h.limiter.SetOverride(c.Request.Context(), &ratelimit.Override{
+		UserID:            userID,
+		RequestsPerMinute: req.RequestsPerMinute,
+		MaxInFlight:       req.MaxInFlight,
+		DailyParses:       req.DailyParses,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set limits"})
+		return
+	}
+	h.writeUserLimits(c, userID)
+}
+
+// ClearUserLimits removes the user's override, restoring the plan's limits.
+func (h *AdminHandler) ClearUserLimits(c *gin.Context) {
+	userID, ok := h.existingUser(c)
+	if !ok {
+		return
+	}
+	if _, err := h.limiter.ClearOverride(c.Request.Context(), userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to clear limits"})
+		return
+	}
+	h.writeUserLimits(c, userID)
+}
+
+func (h *AdminHandler) writeUserLimits(c *gin.Context, userID string) {
+	ctx := c.Request.Context()
+	h.limiter.Invalidate(userID)
+	limits, err := h.limiter.Limits(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load limits"})
+		return
+	}
+	override, err := h.limiter.Override(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load limits"})
+		return
+	}
+	c.JSON(http.StatusOK, UserLimitsResponse{UserID: userID, Limits: limits, Override: override})
+}
+
+// ─────────────────────────────────────────────
+// GET /api/v1/admin/users/:id/transactions
+// ─────────────────────────────────────────────
+
+// UserTransactions returns a page of one user's ledger (same filters as
+// /api/v1/me/transactions).
+func (h *AdminHandler) UserTransactions(c *gin.Context) {
+	if userID, ok := h.existingUser(c); ok {
+		listTransactions(c, h.balanceSvc, userID)
+	}
+}
+
+// ExportUserTransactions downloads one user's ledger as CSV or JSON.
+func (h *AdminHandler) ExportUserTransactions(c *gin.Context) {
+	if userID, ok := h.existingUser(c); ok {
+		exportTransactions(c, h.balanceSvc, userID)
+	}
+}
+
+// existingUser returns the :id parameter, answering 404 if no such user.
+func (h *AdminHandler) existingUser(c *gin.Context) (string, bool) {
+	userID := c.Param("id")
+	if _, err := h.userSvc.GetByID(c.Request.Context(), userID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return "", false
+	}
+	return userID, true
+}
+
+// ─────────────────────────────────────────────
+// GET /api/v1/admin/transactions
+// ─────────────────────────────────────────────
+
+// Ledger returns a page of the global ledger. Besides the usual filters it
+// accepts user_id and trace_id.
+func (h *AdminHandler) Ledger(c *gin.Context) {
+	listTransactions(c, h.balanceSvc, c.Query("user_id"))
+}
+
+// ExportLedger downloads the global ledger as CSV or JSON.
+func (h *AdminHandler) ExportLedger(c *gin.Context) {
+	exportTransactions(c, h.balanceSvc, c.Query("user_id"))
+}
+
+// ─────────────────────────────────────────────
+// POST /api/v1/admin/vouchers
+// ─────────────────────────────────────────────
+
+type MintVouchersRequest struct {
+	Count          int        `json:"count" binding:"required,min=1,max=1000"`
+	Amount         int64      `json:"amount" binding:"required,min=1"`
+	MaxRedemptions int        `json:"max_redemptions"` // default 1
+	PerUserLimit   *int       `json:"per_user_limit"`  // default 1, 0 = unlimited
+	ExpiresAt      *time.Time `json:"expires_at"`      // optional, RFC 3339
+	Note           string     `json:"note" binding:"max=200"`
+}
+
+// MintVouchers creates a batch of voucher codes.
+func (h *AdminHandler) MintVouchers(c *gin.Context) {
+	var req MintVouchersRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+	perUser := 1
+	if req.PerUserLimit != nil {
+		perUser = *req.PerUserLimit
+	}
+
+	batch, err := h.voucherSvc.Mint(c.Request.Context(), voucher.MintRequest{
+		Count:          req.Count,
+		Amount:         req.Amount,
+		MaxRedemptions: req.MaxRedemptions,
+		PerUserLimit:   perUser,
+		ExpiresAt:      req.ExpiresAt,
+		Note:           req.Note,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to mint vouchers"})
+		return
+	}
+	c.JSON(http.StatusOK, batch)
+}
+
+// ─────────────────────────────────────────────
+// GET /api/v1/admin/vouchers
+// ─────────────────────────────────────────────
+
+// VoucherView is a voucher with its current status.
+type VoucherView struct {
+	voucher.Voucher
+	Status    string `json:"status"`    // active | revoked | expired | exhausted
+	Remaining int    `json:"remaining"` // redemptions left
+}
+
+type VouchersResponse struct {
+	Vouchers   []VoucherView `json:"vouchers"`
+	NextCursor uint          `json:"next_cursor,omitempty"`
+}
+
+// ListVouchers pages through vouchers, filtered by batch_id and status.
+func (h *AdminHandler) ListVouchers(c *gin.Context) {
+	f := voucher.ListFilter{BatchID: c.Query("batch_id"), Status: c.Query("status")}
+	if v := c.Query("cursor"); v != "" {
+		cursor, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		f.Cursor = uint(cursor)
+	}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return
+		}
+		f.Limit = limit
+	}
+
+	vouchers, next, err := h.voucherSvc.List(c.Request.Context(), f)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	resp := VouchersResponse{Vouchers: make([]VoucherView, 0, len(vouchers)), NextCursor: next}
+	for _, v := range vouchers {
+		resp.Vouchers = append(resp.Vouchers, VoucherView{
+			Voucher:   v,
+			Status:    v.Status(now),
+			Remaining: max(0, v.MaxRedemptions-v.Redeemed),
+		})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// VoucherBatches returns redemption statistics per batch.
+func (h *AdminHandler) VoucherBatches(c *gin.Context) {
+	stats, err := h.voucherSvc.Batches(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load batches"})
+		return
+	}
+	if stats == nil {
+		stats = []voucher.BatchStats{}
+	}
+	c.JSON(http.StatusOK, gin.H{"batches": stats})
+}
+
+// ─────────────────────────────────────────────
+// POST /api/v1/admin/vouchers/revoke
+// ─────────────────────────────────────────────
+
+type RevokeVouchersRequest struct {
+	Code    string `json:"code"`     // revoke one code
+	BatchID string `json:"batch_id"` // or every code in a batch
+}
+
+// RevokeVouchers disables a code or a whole batch. GP already redeemed
+// stays with the users.
+func (h *AdminHandler) RevokeVouchers(c *gin.Context) {
+	var req RevokeVouchersRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Code == "" && req.BatchID == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code or batch_id required"})
+		return
+	}
+
+	n, err := h.voucherSvc.Revoke(c.Request.Context(), req.Code, req.BatchID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke vouchers"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "revoked": n})
+}
+
+// ─────────────────────────────────────────────
+// PUT /api/v1/admin/nodes/:id/owner
+// ─────────────────────────────────────────────
+
+type SetNodeOwnerRequest struct {
+	UserID string `json:"user_id"` // empty unlinks the node
+}
+
+// SetNodeOwner links a node to a user (or unlinks it), overriding any
+// existing claim.
+func (h *AdminHandler) SetNodeOwner(c *gin.Context) {
+	var req SetNodeOwnerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	if req.UserID != "" {
+		if _, err := h.userSvc.GetByID(ctx, req.UserID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+	}
+
+	nodeID := c.Param("id")
+	if err := h.operators.SetOwner(ctx, nodeID, req.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set node owner"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "node_id": nodeID, "user_id": req.UserID})
+}
+
+// ─────────────────────────────────────────────
+// GET /api/v1/admin/reconcile
+// ─────────────────────────────────────────────
+
+// ReconcileReport lists frozen-balance discrepancies without changing
+// anything (admin-only).
+func (h *AdminHandler) ReconcileReport(c *gin.Context) {
+	report, err := h.reconciler.Report(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to build report"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// ─────────────────────────────────────────────
+// POST /api/v1/admin/reconcile
+// ─────────────────────────────────────────────
+
+// Reconcile runs a reconciliation pass now and returns what it repaired
+// plus the remaining discrepancies (admin-only).
+func (h *AdminHandler) Reconcile(c *gin.Context) {
+	res, err := h.reconciler.Reconcile(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "reconciliation failed"})
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
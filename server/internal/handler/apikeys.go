@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────────
+// Named API keys, shared by /api/v1/me/api-keys and
+// /api/v1/admin/users/:id/api-keys
+// ─────────────────────────────────────────────
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name" binding:"required,max=64"`
+	Scopes    []string   `json:"scopes"`     // omit for all user scopes
+	ExpiresAt *time.Time `json:"expires_at"` // omit for no expiry
+	Replace   bool       `json:"replace"`    // revoke the user's active keys of the same name
+}
+
+// CreateAPIKeyResponse carries the key itself, shown only this once.
+type CreateAPIKeyResponse struct {
+	APIKey string       `json:"api_key"`
+	Key    *auth.APIKey `json:"key"`
+}
+
+// createAPIKey issues a key for userID. The requested scopes must be a
+// subset of grantable.
+func createAPIKey(c *gin.Context, keys *auth.KeyService, userID string, grantable auth.Scopes) {
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+	scopes, err := auth.ParseScopes(req.Scopes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !grantable.Contains(scopes) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "cannot grant scopes beyond your own"})
+		return
+	}
+
+	create := keys.Create
+	if req.Replace {
+		create = keys.Replace
+	}
+	k, plain, err := create(c.Request.Context(), userID, req.Name, scopes, req.ExpiresAt)
+	switch {
+	case errors.Is(err, auth.ErrTooManyAPIKeys):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create api key"})
+		return
+	}
+	c.JSON(http.StatusCreated, CreateAPIKeyResponse{APIKey: plain, Key: k})
+}
+
+// listAPIKeys returns userID's keys.
+func listAPIKeys(c *gin.Context, keys *auth.KeyService, userID string) {
+	list, err := keys.List(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list api keys"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": list})
+}
+
+// revokeAPIKey revokes the key named by the :key_id path parameter.
+func revokeAPIKey(c *gin.Context, keys *auth.KeyService, userID string) {
+	k, err := keys.Revoke(c.Request.Context(), userID, c.Param("key_id"))
+	switch {
+	case errors.Is(err, auth.ErrAPIKeyNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke api key"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "key": k})
+}
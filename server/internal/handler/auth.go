@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"sort"
 	"strings"
@@ -19,13 +20,16 @@ import (
 
 // AuthHandler handles authentication endpoints.
 type AuthHandler struct {
-	userSvc auth.UserService
-	cfg     *config.Config
+	userSvc  auth.UserService
+	sessions *auth.SessionService
+	emails   *auth.EmailService
+	cfg      *config.Config
 }
 
-// NewAuthHandler creates a new AuthHandler.
-func NewAuthHandler(userSvc auth.UserService, cfg *config.Config) *AuthHandler {
-	return &AuthHandler{userSvc: userSvc, cfg: cfg}
+// NewAuthHandler creates a new AuthHandler. Logins open sessions in
+// sessions; emails sends verification and password reset mails.
+func NewAuthHandler(userSvc auth.UserService, sessions *auth.SessionService, emails *auth.EmailService, cfg *config.Config) *AuthHandler {
+	return &AuthHandler{userSvc: userSvc, sessions: sessions, emails: emails, cfg: cfg}
 }
 
 // ─────────────────────────────────────────────
@@ -38,9 +42,12 @@ type RegisterRequest struct {
 	Nickname string `json:"nickname"`
 }
 
+// AuthResponse is returned by register and login: the user, the tokens
+// of the new session and, when one was issued, the account key.
 type AuthResponse struct {
 	User   *auth.User `json:"user"`
-	APIKey string     `json:"api_key"`
+	APIKey string     `json:"api_key,omitempty"`
+	*auth.Tokens
 }
 
 // Register handles user registration via email.
@@ -61,10 +68,11 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, AuthResponse{
-		User:   user,
-		APIKey: user.APIKey,
-	})
+	// A failed mail does not fail registration; the user can ask again.
+	if err := h.emails.SendVerification(c.Request.Context(), user); err != nil {
+		log.Printf("[auth] verification mail for user=%s: %v", user.ID, err)
+	}
+	h.respond(c, http.StatusCreated, user)
 }
 
 // ─────────────────────────────────────────────
@@ -94,10 +102,81 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, AuthResponse{
-		User:   user,
-		APIKey: user.APIKey,
-	})
+	h.respond(c, http.StatusOK, user)
+}
+
+// ─────────────────────────────────────────────
+// POST /auth/email/verify
+// ─────────────────────────────────────────────
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// VerifyEmail redeems the token from a verification mail.
+func (h *AuthHandler) VerifyEmail(c *gin.Context) {
+	var req VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := h.emails.Verify(c.Request.Context(), req.Token)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "verification failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// ─────────────────────────────────────────────
+// POST /auth/password/forgot, POST /auth/password/reset
+// ─────────────────────────────────────────────
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ForgotPassword queues a reset link mail. The response is the same, and
+// as fast, whether or not the address belongs to an account.
+func (h *AuthHandler) ForgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.emails.ForgotPassword(req.Email)
+	c.JSON(http.StatusAccepted, gin.H{"success": true})
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+// ResetPassword sets a new password with the token from a reset mail and
+// logs the user out everywhere.
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.emails.ResetPassword(c.Request.Context(), req.Token, req.Password); err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "password reset failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
 // ─────────────────────────────────────────────
@@ -145,7 +224,7 @@ func (h *AuthHandler) TelegramCallback(c *gin.Context) {
 		return
 	}
 
-	if err := h.validateTelegramAuth(telegramData); err != nil {
+	if err := validateTelegramAuth(h.cfg.TelegramBotToken, telegramData); err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 		return
 	}
@@ -156,16 +235,60 @@ func (h *AuthHandler) TelegramCallback(c *gin.Context) {
 		return
 	}
 
-	// Return API key for client use (redirect handled by frontend)
-	c.JSON(http.StatusOK, AuthResponse{
-		User:   user,
-		APIKey: user.APIKey,
-	})
+	// Redirect (if any) is handled by the frontend
+	h.respond(c, http.StatusOK, user)
+}
+
+// respond opens a session for a user who just registered or logged in and
+// writes the AuthResponse.
+//
+// The account key is included only when it was just created (new users).
+// Logging in never issues a key: only its hash is stored, so handing it
+// out again would mean rotating it. Clients use the session tokens, or
+// create a named key with them.
+func (h *AuthHandler) respond(c *gin.Context, status int, user *auth.User) {
+	ctx := c.Request.Context()
+	tokens, err := h.sessions.Create(ctx, user.ID, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+		return
+	}
+	c.JSON(status, AuthResponse{User: user, APIKey: user.APIKey, Tokens: tokens})
+}
+
+// ─────────────────────────────────────────────
+// POST /auth/refresh
+// ─────────────────────────────────────────────
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// Refresh exchanges a refresh token for a new access and refresh token.
+// The old pair stops working.
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokens, err := h.sessions.Refresh(c.Request.Context(), req.RefreshToken, c.ClientIP())
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidSession) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "refresh failed"})
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
 }
 
-// validateTelegramAuth validates the Telegram Login Widget data.
+// validateTelegramAuth validates the Telegram Login Widget data against
+// the bot's token. Used by the login callback and by identity linking.
 // See: https://core.telegram.org/widgets/login#checking-authorization
-func (h *AuthHandler) validateTelegramAuth(data map[string]interface{}) error {
+func validateTelegramAuth(botToken string, data map[string]interface{}) error {
 	// Extract hash from data
 	hashValue, ok := data["hash"].(string)
 	if !ok || hashValue == "" {
@@ -215,7 +338,7 @@ func (h *AuthHandler) validateTelegramAuth(data map[string]interface{}) error {
 	dataCheckString := strings.Join(pairs, "\n")
 
 	// secret_key = SHA256(bot_token)
-	secretKey := sha256.Sum256([]byte(h.cfg.TelegramBotToken))
+	secretKey := sha256.Sum256([]byte(botToken))
 
 	// hash = HMAC-SHA256(data_check_string, secret_key)
 	mac := hmac.New(sha256.New, secretKey[:])
@@ -236,7 +359,11 @@ func (h *AuthHandler) RegisterRoutes(r *gin.Engine) {
 		if h.cfg.EmailAuthEnabled {
 			authGroup.POST("/register", h.Register)
 			authGroup.POST("/login", h.Login)
+			authGroup.POST("/password/forgot", h.ForgotPassword)
+			authGroup.POST("/password/reset", h.ResetPassword)
 		}
+		authGroup.POST("/email/verify", h.VerifyEmail)
+		authGroup.POST("/refresh", h.Refresh)
 		authGroup.GET("/telegram/login", h.TelegramLoginPage)
 		authGroup.POST("/telegram/callback", h.TelegramCallback)
 	}
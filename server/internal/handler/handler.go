@@ -5,8 +5,10 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/Archive-At-Home/archive-at-home/server/internal/auth"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
 	appctx "github.com/Archive-At-Home/archive-at-home/server/internal/context"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/middleware"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/node"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/service"
@@ -22,15 +24,22 @@ type Handler struct {
 	nodeAuth *node.Authenticator
 	cfg      *config.Config
 	upgrader websocket.Upgrader
+
+	idempotent gin.HandlerFunc
+	parseLimit gin.HandlerFunc
 }
 
-// NewHandler creates the handler set.
-func NewHandler(svc *service.GalleryService, hub *ws.Hub, nodeAuth *node.Authenticator, cfg *config.Config) *Handler {
+// NewHandler creates the handler set. idempotent guards the parse
+// endpoint (see middleware.Idempotency); parseLimit applies the
+// in-flight and daily parse limits (see middleware.ParseLimit).
+func NewHandler(svc *service.GalleryService, hub *ws.Hub, nodeAuth *node.Authenticator, cfg *config.Config, idempotent, parseLimit gin.HandlerFunc) *Handler {
 	return &Handler{
-		svc:      svc,
-		hub:      hub,
-		nodeAuth: nodeAuth,
-		cfg:      cfg,
+		svc:        svc,
+		hub:        hub,
+		nodeAuth:   nodeAuth,
+		cfg:        cfg,
+		idempotent: idempotent,
+		parseLimit: parseLimit,
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
@@ -51,8 +60,15 @@ func (h *Handler) RegisterRoutes(r *gin.Engine, apiKeyMiddleware ...gin.HandlerF
 	for _, mw := range apiKeyMiddleware {
 		api.Use(mw)
 	}
+	api.Use(middleware.RequireScope(auth.ScopeParse))
 	{
-		api.POST("/parse", h.ParseGallery)
+		parse := []gin.HandlerFunc{h.idempotent, h.parseLimit, h.ParseGallery}
+		if h.cfg.RequireEmailVerified {
+			parse = append([]gin.HandlerFunc{middleware.RequireVerifiedEmail()}, parse...)
+		}
+		api.POST("/parse", parse...)
+		api.GET("/quote", h.Quote)
+		api.POST("/quote/batch", h.BatchQuote)
 	}
 }
 
@@ -93,6 +109,57 @@ func (h *Handler) ParseGallery(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
+// ─────────────────────────────────────────────
+// GET /api/v1/quote
+// ─────────────────────────────────────────────
+
+// Quote estimates the GP cost of a gallery without creating a task.
+//
+//	@Param        gallery_id   query  string  true  "Gallery ID"
+//	@Param        gallery_key  query  string  true  "Gallery token/key"
+//	@Success      200   {object}  model.QuoteResponse
+//	@Router       /api/v1/quote [get]
+func (h *Handler) Quote(c *gin.Context) {
+	var ref model.GalleryRef
+	if err := c.ShouldBindQuery(&ref); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := h.svc.QuoteGallery(c.Request.Context(), appctx.GetUserID(c), ref)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// ─────────────────────────────────────────────
+// POST /api/v1/quote/batch
+// ─────────────────────────────────────────────
+
+// BatchQuote estimates the GP cost of up to 25 galleries at once.
+//
+//	@Param        body  body  model.BatchQuoteRequest  true  "Galleries to quote"
+//	@Success      200   {object}  model.BatchQuoteResponse
+//	@Router       /api/v1/quote/batch [post]
+func (h *Handler) BatchQuote(c *gin.Context) {
+	var req model.BatchQuoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := h.svc.QuoteGalleries(c.Request.Context(), appctx.GetUserID(c), req.Galleries)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
 // ─────────────────────────────────────────────
 // GET /ws  (Worker node WebSocket)
 // ─────────────────────────────────────────────
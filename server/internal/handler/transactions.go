@@ -0,0 +1,241 @@
+package handler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────────
+// Ledger queries shared by /me/transactions and the admin ledger
+// ─────────────────────────────────────────────
+
+// TransactionsResponse is one page of ledger entries.
+type TransactionsResponse struct {
+	Transactions []balance.Transaction `json:"transactions"`
+	NextCursor   uint                  `json:"next_cursor,omitempty"` // pass as ?cursor= for the next page
+}
+
+// parseTransactionFilter reads the common query parameters:
+//
+//	type      comma-separated transaction types (DEPOSIT,DEDUCT,...)
+//	since     RFC 3339 time or YYYY-MM-DD (inclusive)
+//	until     RFC 3339 time (exclusive) or YYYY-MM-DD (inclusive day)
+//	trace_id  task trace ID
+//	cursor    next_cursor from the previous page
+//	limit     page size (default 50, max 500)
+func parseTransactionFilter(c *gin.Context) (balance.TransactionFilter, error) {
+	f := balance.TransactionFilter{TraceID: c.Query("trace_id")}
+
+	if v := c.Query("type"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			tt := balance.TransactionType(strings.ToUpper(strings.TrimSpace(t)))
+			if !tt.Valid() {
+				return f, fmt.Errorf("unknown transaction type %q", t)
+			}
+			f.Types = append(f.Types, tt)
+		}
+	}
+
+	var err error
+	if f.Since, err = parseLedgerTime(c.Query("since"), false); err != nil {
+		return f, fmt.Errorf("invalid since: %w", err)
+	}
+	if f.Until, err = parseLedgerTime(c.Query("until"), true); err != nil {
+		return f, fmt.Errorf("invalid until: %w", err)
+	}
+
+	if v := c.Query("cursor"); v != "" {
+		cursor, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return f, errors.New("invalid cursor")
+		}
+		f.Cursor = uint(cursor)
+	}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return f, errors.New("limit must be a positive integer")
+		}
+		f.Limit = limit
+	}
+	return f, nil
+}
+
+// parseLedgerTime accepts RFC 3339 or a bare date in server local time
+// (the zone ledger timestamps are written in). A bare end date covers the
+// whole day.
+func parseLedgerTime(v string, endOfDay bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, v, time.Local); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, errors.New("expected RFC 3339 time or YYYY-MM-DD")
+	}
+	return t.Local(), nil
+}
+
+// listTransactions serves one page of the ledger matching the request's
+// filters, restricted to userID when non-empty.
+func listTransactions(c *gin.Context, balanceSvc balance.BalanceService, userID string) {
+	f, err := parseTransactionFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if userID != "" {
+		f.UserID = userID
+	}
+
+	txns, next, err := balanceSvc.ListTransactions(c.Request.Context(), f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list transactions"})
+		return
+	}
+	if txns == nil {
+		txns = []balance.Transaction{}
+	}
+	c.JSON(http.StatusOK, TransactionsResponse{Transactions: txns, NextCursor: next})
+}
+
+// exportTransactions streams every entry matching the request's filters
+// as CSV (default) or a JSON array (?format=json). cursor and limit are
+// ignored; the export walks all pages.
+func exportTransactions(c *gin.Context, balanceSvc balance.BalanceService, userID string) {
+	f, err := parseTransactionFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if userID != "" {
+		f.UserID = userID
+	}
+	f.Cursor = 0
+	f.Limit = balance.MaxTransactionPage
+
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or json"})
+		return
+	}
+
+	// Fetch the first page before committing to a 200.
+	ctx := c.Request.Context()
+	txns, next, err := balanceSvc.ListTransactions(ctx, f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list transactions"})
+		return
+	}
+
+	name := "transactions"
+	if userID != "" {
+		name += "-" + userID
+	}
+	name += "-" + time.Now().Format("20060102") + "." + format
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+
+	var w ledgerWriter
+	if format == "json" {
+		c.Header("Content-Type", "application/json")
+		w = &jsonLedgerWriter{enc: json.NewEncoder(c.Writer), w: c.Writer}
+	} else {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		w = &csvLedgerWriter{w: csv.NewWriter(c.Writer)}
+	}
+	c.Status(http.StatusOK)
+
+	w.begin()
+	for {
+		for i := range txns {
+			w.write(&txns[i])
+		}
+		if next == 0 {
+			break
+		}
+		f.Cursor = next
+		if txns, next, err = balanceSvc.ListTransactions(ctx, f); err != nil {
+			// Headers are gone; a truncated file is the best we can signal.
+			c.Error(err)
+			return
+		}
+	}
+	w.end()
+}
+
+type ledgerWriter interface {
+	begin()
+	write(t *balance.Transaction)
+	end()
+}
+
+type csvLedgerWriter struct {
+	w *csv.Writer
+}
+
+func (l *csvLedgerWriter) begin() {
+	l.w.Write([]string{"id", "created_at", "user_id", "type", "amount", "balance_after", "trace_id", "remark"})
+}
+
+func (l *csvLedgerWriter) write(t *balance.Transaction) {
+	l.w.Write([]string{
+		strconv.FormatUint(uint64(t.ID), 10),
+		t.CreatedAt.Format(time.RFC3339),
+		csvText(t.UserID),
+		string(t.Type),
+		strconv.FormatInt(t.Amount, 10),
+		strconv.FormatInt(t.Balance, 10),
+		csvText(t.TraceID),
+		csvText(t.Remark),
+	})
+}
+
+// csvText neutralises user-controlled text (remarks carry transfer memos)
+// that a spreadsheet would evaluate as a formula, by prefixing it with a
+// quote. Numeric columns are written as numbers and left alone.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func (l *csvLedgerWriter) end() {
+	l.w.Flush()
+}
+
+type jsonLedgerWriter struct {
+	enc   *json.Encoder
+	w     gin.ResponseWriter
+	count int
+}
+
+func (l *jsonLedgerWriter) begin() {
+	l.w.WriteString("[\n")
+}
+
+func (l *jsonLedgerWriter) write(t *balance.Transaction) {
+	if l.count > 0 {
+		l.w.WriteString(",")
+	}
+	l.count++
+	l.enc.Encode(t)
+}
+
+func (l *jsonLedgerWriter) end() {
+	l.w.WriteString("]\n")
+}
@@ -1,31 +1,58 @@
 package handler
 
 import (
-	"math/rand"
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/Archive-At-Home/archive-at-home/server/internal/auth"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/checkin"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
 	appctx "github.com/Archive-At-Home/archive-at-home/server/internal/context"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/middleware"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/node"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/plan"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/voucher"
 	"github.com/gin-gonic/gin"
 )
 
 // UserHandler handles user-related endpoints.
 type UserHandler struct {
 	userSvc    auth.UserService
+	keys       *auth.KeyService
+	sessions   *auth.SessionService
+	emails     *auth.EmailService
 	balanceSvc balance.BalanceService
+	voucherSvc voucher.Service
+	operators  *node.OperatorService
+	plans      *plan.Service
+	checkins   *checkin.Service
+	nodeAuth   *node.Authenticator
 	cfg        *config.Config
+	idempotent gin.HandlerFunc
 }
 
-// NewUserHandler creates a new UserHandler.
-func NewUserHandler(userSvc auth.UserService, balanceSvc balance.BalanceService, cfg *config.Config) *UserHandler {
+// NewUserHandler creates a new UserHandler. idempotent guards the
+// endpoints that move GP (see middleware.Idempotency). nodeAuth verifies
+// node tokens when operators link their nodes.
+func NewUserHandler(userSvc auth.UserService, keys *auth.KeyService, sessions *auth.SessionService, emails *auth.EmailService, balanceSvc balance.BalanceService, voucherSvc voucher.Service, operators *node.OperatorService, plans *plan.Service, checkins *checkin.Service, nodeAuth *node.Authenticator, cfg *config.Config, idempotent gin.HandlerFunc) *UserHandler {
 	return &UserHandler{
 		userSvc:    userSvc,
+		keys:       keys,
+		sessions:   sessions,
+		emails:     emails,
 		balanceSvc: balanceSvc,
+		voucherSvc: voucherSvc,
+		operators:  operators,
+		plans:      plans,
+		checkins:   checkins,
+		nodeAuth:   nodeAuth,
 		cfg:        cfg,
+		idempotent: idempotent,
 	}
 }
 
@@ -52,57 +79,329 @@ func (h *UserHandler) ResetAPIKey(c *gin.Context) {
 	})
 }
 
+// ─────────────────────────────────────────────
+// PUT /api/v1/me/password
+// ─────────────────────────────────────────────
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=6"`
+}
+
+// ChangePassword sets a new password and ends the user's other sessions.
+func (h *UserHandler) ChangePassword(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	userID := appctx.GetUserID(c)
+	err := h.userSvc.ChangePassword(ctx, userID, req.CurrentPassword, req.NewPassword)
+	switch {
+	case errors.Is(err, auth.ErrInvalidCredential):
+		c.JSON(http.StatusForbidden, gin.H{"error": "current password is incorrect"})
+		return
+	case errors.Is(err, auth.ErrNoPassword):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to change password"})
+		return
+	}
+
+	if err := h.sessions.RevokeAll(ctx, userID, appctx.GetSessionID(c)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "password changed, but failed to end other sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// ─────────────────────────────────────────────
+// POST /api/v1/me/email/verify
+// ─────────────────────────────────────────────
+
+// ResendVerification mails the user a new verification link.
+func (h *UserHandler) ResendVerification(c *gin.Context) {
+	err := h.emails.SendVerification(c.Request.Context(), appctx.MustGetUser(c))
+	switch {
+	case errors.Is(err, auth.ErrNoEmail):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, auth.ErrAlreadyVerified):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, auth.ErrMailThrottled):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send verification mail"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"success": true})
+}
+
+// ─────────────────────────────────────────────
+// /api/v1/me/identities
+// ─────────────────────────────────────────────
+
+// LinkTelegram links the Telegram account in the body (signed Login Widget
+// data, as for /auth/telegram/callback) to the user.
+func (h *UserHandler) LinkTelegram(c *gin.Context) {
+	var telegramData map[string]interface{}
+	if err := c.ShouldBindJSON(&telegramData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if h.cfg.TelegramBotToken == "" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "telegram login not configured"})
+		return
+	}
+	if err := validateTelegramAuth(h.cfg.TelegramBotToken, telegramData); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	idFloat, ok := telegramData["id"].(float64)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing telegram id"})
+		return
+	}
+
+	user, err := h.userSvc.LinkTelegram(c.Request.Context(), appctx.GetUserID(c), int64(idFloat))
+	identityResponse(c, user, err)
+}
+
+// UnlinkTelegram removes the user's Telegram account.
+func (h *UserHandler) UnlinkTelegram(c *gin.Context) {
+	user, err := h.userSvc.UnlinkTelegram(c.Request.Context(), appctx.GetUserID(c))
+	identityResponse(c, user, err)
+}
+
+type LinkEmailRequest struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+// LinkEmail gives the user an email and password to log in with and mails
+// a verification link to the address.
+func (h *UserHandler) LinkEmail(c *gin.Context) {
+	var req LinkEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.userSvc.LinkEmail(ctx, appctx.GetUserID(c), req.Email, req.Password)
+	if err == nil {
+		// As on registration, a failed mail does not fail the request.
+		if err := h.emails.SendVerification(ctx, user); err != nil {
+			log.Printf("[auth] verification mail for user=%s: %v", user.ID, err)
+		}
+	}
+	identityResponse(c, user, err)
+}
+
+// UnlinkEmail removes the user's email and password.
+func (h *UserHandler) UnlinkEmail(c *gin.Context) {
+	user, err := h.userSvc.UnlinkEmail(c.Request.Context(), appctx.GetUserID(c))
+	identityResponse(c, user, err)
+}
+
+// identityResponse writes the result of linking or unlinking an identity.
+func identityResponse(c *gin.Context, user *auth.User, err error) {
+	switch {
+	case errors.Is(err, auth.ErrIdentityTaken), errors.Is(err, auth.ErrAlreadyLinked),
+		errors.Is(err, auth.ErrLastIdentity):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, auth.ErrNotLinked):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update identities"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
 // ─────────────────────────────────────────────
 // GET /api/v1/me/balance
 // ─────────────────────────────────────────────
 
 type BalanceResponse struct {
-	Balance int64 `json:"balance"`
+	Balance int64 `json:"balance"` // available GP, kept for older clients
+	*balance.BalanceDetail
 }
 
-// MyBalance returns the user's current available GP balance.
+// MyBalance returns the user's GP balance: total, frozen and available,
+// the tasks currently holding frozen GP, and lifetime totals.
 func (h *UserHandler) MyBalance(c *gin.Context) {
 	user := appctx.MustGetUser(c)
 
-	acc, err := h.balanceSvc.GetAccount(c.Request.Context(), user.ID)
+	detail, err := h.balanceSvc.GetBalanceDetail(c.Request.Context(), user.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get balance"})
 		return
 	}
 
 	c.JSON(http.StatusOK, BalanceResponse{
-		Balance: acc.Available(),
+		Balance:       detail.Available,
+		BalanceDetail: detail,
 	})
 }
 
-// RegisterRoutes registers user routes on the api group.
+// RegisterRoutes registers user routes on the api group, each behind the
+// API key scope it needs.
 func (h *UserHandler) RegisterRoutes(api *gin.RouterGroup) {
-	api.GET("/me", h.Me)
-	api.POST("/me/reset-key", h.ResetAPIKey)
-	api.GET("/me/balance", h.MyBalance)
-	api.POST("/me/checkin", h.Checkin)
+	account := api.Group("", middleware.RequireScope(auth.ScopeAccount))
+	account.GET("/me", h.Me)
+	account.POST("/me/reset-key", h.ResetAPIKey)
+	account.PUT("/me/password", h.ChangePassword)
+	account.POST("/me/email/verify", h.ResendVerification)
+	account.POST("/me/identities/telegram", h.LinkTelegram)
+	account.DELETE("/me/identities/telegram", h.UnlinkTelegram)
+	if h.cfg.EmailAuthEnabled {
+		account.POST("/me/identities/email", h.LinkEmail)
+		account.DELETE("/me/identities/email", h.UnlinkEmail)
+	}
+	account.GET("/me/api-keys", h.MyAPIKeys)
+	account.POST("/me/api-keys", h.CreateAPIKey)
+	account.DELETE("/me/api-keys/:key_id", h.RevokeAPIKey)
+	account.GET("/me/sessions", h.MySessions)
+	account.DELETE("/me/sessions/:session_id", h.RevokeSession)
+	account.POST("/me/logout", h.Logout)
+	account.POST("/me/checkin", h.Checkin)
+	account.GET("/me/checkins", h.MyCheckins)
+	account.POST("/me/redeem", h.idempotent, h.Redeem)
+	account.GET("/me/nodes", h.MyNodes)
+	account.POST("/me/nodes", h.ClaimNode)
+	account.DELETE("/me/nodes/:id", h.ReleaseNode)
+
+	read := api.Group("", middleware.RequireScope(auth.ScopeReadBalance))
+	read.GET("/me/balance", h.MyBalance)
+	read.GET("/me/transactions", h.MyTransactions)
+	read.GET("/me/transactions/export", h.ExportMyTransactions)
+
+	transfer := api.Group("", middleware.RequireScope(auth.ScopeTransfer))
+	transfer.POST("/me/transfer", h.idempotent, h.Transfer)
+}
+
+// ─────────────────────────────────────────────
+// /api/v1/me/api-keys
+// ─────────────────────────────────────────────
+
+// MyAPIKeys lists the user's named API keys.
+func (h *UserHandler) MyAPIKeys(c *gin.Context) {
+	listAPIKeys(c, h.keys, appctx.GetUserID(c))
+}
+
+// CreateAPIKey issues a named key. A key can only grant scopes it has
+// itself; admin scopes are granted by admins.
+func (h *UserHandler) CreateAPIKey(c *gin.Context) {
+	grantable := auth.Scopes{}
+	for _, scope := range appctx.GetScopes(c) {
+		if auth.UserScopes.Has(scope) {
+			grantable = append(grantable, scope)
+		}
+	}
+	createAPIKey(c, h.keys, appctx.GetUserID(c), grantable)
+}
+
+// RevokeAPIKey revokes one of the user's named keys.
+func (h *UserHandler) RevokeAPIKey(c *gin.Context) {
+	revokeAPIKey(c, h.keys, appctx.GetUserID(c))
+}
+
+// ─────────────────────────────────────────────
+// /api/v1/me/sessions, /api/v1/me/logout
+// ─────────────────────────────────────────────
+
+// MySessions lists the user's open login sessions. The one the request
+// was made with is marked current.
+func (h *UserHandler) MySessions(c *gin.Context) {
+	sessions, err := h.sessions.List(c.Request.Context(), appctx.GetUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list sessions"})
+		return
+	}
+	current := appctx.GetSessionID(c)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// RevokeSession ends one of the user's sessions (e.g. a lost device).
+func (h *UserHandler) RevokeSession(c *gin.Context) {
+	h.endSession(c, c.Param("session_id"))
+}
+
+// Logout ends the session the request was made with.
+func (h *UserHandler) Logout(c *gin.Context) {
+	sessionID := appctx.GetSessionID(c)
+	if sessionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "not logged in with a session (API keys are revoked under /me/api-keys)"})
+		return
+	}
+	h.endSession(c, sessionID)
+}
+
+func (h *UserHandler) endSession(c *gin.Context, sessionID string) {
+	found, err := h.sessions.Revoke(c.Request.Context(), appctx.GetUserID(c), sessionID)
+	switch {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke session"})
+		return
+	case !found:
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// ─────────────────────────────────────────────
+// GET /api/v1/me/transactions
+// ─────────────────────────────────────────────
+
+// MyTransactions returns a page of the user's ledger, newest first.
+// See parseTransactionFilter for the query parameters.
+func (h *UserHandler) MyTransactions(c *gin.Context) {
+	listTransactions(c, h.balanceSvc, appctx.GetUserID(c))
+}
+
+// ExportMyTransactions downloads the user's ledger as CSV or JSON.
+func (h *UserHandler) ExportMyTransactions(c *gin.Context) {
+	exportTransactions(c, h.balanceSvc, appctx.GetUserID(c))
 }
 
 // ─────────────────────────────────────────────
 // GET /api/v1/me
 // ─────────────────────────────────────────────
 
-// Me returns the authenticated user's profile with available balance.
+// Me returns the authenticated user's profile with available balance
+// and plan usage.
 func (h *UserHandler) Me(c *gin.Context) {
 	user := appctx.MustGetUser(c)
 	ctx := c.Request.Context()
 
 	// Get balance
-	var balance int64
+	var available, frozen int64
 	acc, err := h.balanceSvc.GetAccount(ctx, user.ID)
 	if err == nil {
-		balance = acc.Available()
+		available, frozen = acc.Available(), acc.Frozen
 	}
 
-	c.JSON(http.StatusOK, model.UserProfile{
+	profile := model.UserProfile{
 		User:    user,
-		Balance: balance,
-	})
+		Balance: available,
+		Frozen:  frozen,
+	}
+	if st, err := h.plans.Status(ctx, user.ID); err == nil {
+		profile.Plan = st
+	}
+	c.JSON(http.StatusOK, profile)
 }
 
 // ─────────────────────────────────────────────
@@ -110,58 +409,280 @@ func (h *UserHandler) Me(c *gin.Context) {
 // ─────────────────────────────────────────────
 
 type CheckinResponse struct {
-	Success bool   `json:"success"`
-	Reward  int64  `json:"reward"`
-	Balance int64  `json:"balance"`
-	Message string `json:"message,omitempty"`
+	Success    bool    `json:"success"`
+	Reward     int64   `json:"reward"`
+	Balance    int64   `json:"balance"`
+	Streak     int     `json:"streak"`               // consecutive days including today
+	Multiplier float64 `json:"multiplier,omitempty"` // streak bonus applied to the reward
+	Message    string  `json:"message,omitempty"`
 }
 
 // Checkin handles daily checkin.
 func (h *UserHandler) Checkin(c *gin.Context) {
 	user := appctx.MustGetUser(c)
+
+	ci, acc, err := h.checkins.Checkin(c.Request.Context(), user.ID)
+	switch {
+	case errors.Is(err, checkin.ErrAlreadyCheckedIn):
+		c.JSON(http.StatusOK, CheckinResponse{
+			Success: false,
+			Streak:  ci.Streak,
+			Message: "今日已签到",
+		})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add reward"})
+		return
+	}
+
+	c.JSON(http.StatusOK, CheckinResponse{
+		Success:    true,
+		Reward:     ci.Reward,
+		Balance:    acc.Balance,
+		Streak:     ci.Streak,
+		Multiplier: ci.Multiplier,
+		Message:    "签到成功",
+	})
+}
+
+// ─────────────────────────────────────────────
+// GET /api/v1/me/checkins
+// ─────────────────────────────────────────────
+
+type CheckinsResponse struct {
+	*checkin.Summary
+	Bonuses    []checkin.Bonus   `json:"bonuses"` // streak bonus schedule
+	Checkins   []checkin.Checkin `json:"checkins"`
+	NextCursor uint              `json:"next_cursor,omitempty"`
+}
+
+// MyCheckins returns the user's streak, totals and a page of past
+// check-ins (?cursor=, ?limit=, default 30).
+func (h *UserHandler) MyCheckins(c *gin.Context) {
+	userID := appctx.GetUserID(c)
 	ctx := c.Request.Context()
 
-	// Check if already checked in today
-	if user.LastCheckinAt != nil {
-		now := time.Now()
-		last := *user.LastCheckinAt
-		// Compare by date (same year, month, day)
-		if now.Year() == last.Year() && now.YearDay() == last.YearDay() {
-			c.JSON(http.StatusOK, CheckinResponse{
-				Success: false,
-				Message: "今日已签到",
-			})
+	var cursor uint
+	if v := c.Query("cursor"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
 			return
 		}
+		cursor = uint(n)
 	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+
+	sum, err := h.checkins.Summary(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load check-ins"})
+		return
+	}
+	history, next, err := h.checkins.History(ctx, userID, cursor, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load check-ins"})
+		return
+	}
+	if history == nil {
+		history = []checkin.Checkin{}
+	}
+	bonuses := h.checkins.Schedule().Bonuses
+	if bonuses == nil {
+		bonuses = []checkin.Bonus{}
+	}
+	c.JSON(http.StatusOK, CheckinsResponse{Summary: sum, Bonuses: bonuses, Checkins: history, NextCursor: next})
+}
+
+// ─────────────────────────────────────────────
+// POST /api/v1/me/transfer
+// ─────────────────────────────────────────────
+
+type TransferRequest struct {
+	To     string `json:"to" binding:"required"` // user ID, email or Telegram ID
+	Amount int64  `json:"amount" binding:"required,min=1"`
+	Memo   string `json:"memo" binding:"max=200"`
+}
+
+type TransferResponse struct {
+	Success bool `json:"success"`
+	*balance.Transfer
+	Balance int64 `json:"balance"` // sender's available GP after the transfer
+}
+
+// Transfer sends GP to another user.
+func (h *UserHandler) Transfer(c *gin.Context) {
+	user := appctx.MustGetUser(c)
+	ctx := c.Request.Context()
 
-	// Generate random reward in range [min, max]
-	minGP := h.cfg.CheckinMinGP
-	maxGP := h.cfg.CheckinMaxGP
-	if minGP > maxGP {
-		minGP, maxGP = maxGP, minGP
+	var req TransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	reward := int64(minGP)
-	if maxGP > minGP {
-		reward = int64(minGP + rand.Intn(maxGP-minGP+1))
+
+	if age := h.cfg.TransferMinAccountAge; time.Since(user.CreatedAt) < age {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "accounts can send transfers " + age.String() + " after registration",
+		})
+		return
 	}
 
-	// Deposit the reward
-	acc, err := h.balanceSvc.Deposit(ctx, user.ID, reward, "每日签到")
+	to, err := h.userSvc.Resolve(ctx, req.To)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add reward"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "recipient not found"})
+		return
+	}
+	if to.ID == user.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot transfer to yourself"})
+		return
+	}
+	if to.Status != "active" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "recipient account is " + to.Status})
 		return
 	}
 
-	// Update last checkin time
-	if err := h.userSvc.UpdateLastCheckin(ctx, user.ID); err != nil {
-		// Non-fatal, reward already added
+	t, err := h.balanceSvc.Transfer(ctx, user.ID, to.ID, req.Amount, req.Memo, balance.TransferLimits{
+		DailyAmount: h.cfg.TransferDailyLimit,
+		DailyCount:  h.cfg.TransferDailyCount,
+	})
+	switch {
+	case errors.Is(err, balance.ErrInsufficientBalance):
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, balance.ErrTransferLimit):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "transfer failed"})
+		return
 	}
 
-	c.JSON(http.StatusOK, CheckinResponse{
+	c.JSON(http.StatusOK, TransferResponse{
+		Success:  true,
+		Transfer: t,
+		Balance:  t.Sender.Available(),
+	})
+}
+
+// ─────────────────────────────────────────────
+// POST /api/v1/me/redeem
+// ─────────────────────────────────────────────
+
+type RedeemRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type RedeemResponse struct {
+	Success bool   `json:"success"`
+	Code    string `json:"code"`
+	Amount  int64  `json:"amount"`
+	Balance int64  `json:"balance"` // available GP after redeeming
+}
+
+// Redeem credits a voucher code to the user.
+func (h *UserHandler) Redeem(c *gin.Context) {
+	user := appctx.MustGetUser(c)
+
+	var req RedeemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	v, available, err := h.voucherSvc.Redeem(c.Request.Context(), user.ID, req.Code)
+	switch {
+	case errors.Is(err, voucher.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, voucher.ErrUnavailable):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, voucher.ErrUserLimit):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to redeem voucher"})
+		return
+	}
+
+	c.JSON(http.StatusOK, RedeemResponse{
 		Success: true,
-		Reward:  reward,
-		Balance: acc.Balance,
-		Message: "签到成功",
+		Code:    v.Code,
+		Amount:  v.Amount,
+		Balance: available,
 	})
 }
+
+// ─────────────────────────────────────────────
+// /api/v1/me/nodes — node operator accounts
+// ─────────────────────────────────────────────
+
+type NodesResponse struct {
+	Nodes       []node.Earnings `json:"nodes"`
+	RewardShare float64         `json:"reward_share"` // share of a task's ActualGP paid to the operator
+	TotalGP     int64           `json:"total_gp"`     // sum of reward_gp
+}
+
+// MyNodes lists the user's nodes and what each has earned.
+func (h *UserHandler) MyNodes(c *gin.Context) {
+	user := appctx.MustGetUser(c)
+
+	earnings, err := h.operators.Earnings(c.Request.Context(), user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load node earnings"})
+		return
+	}
+	resp := NodesResponse{Nodes: earnings, RewardShare: h.cfg.NodeRewardShare}
+	for _, e := range earnings {
+		resp.TotalGP += e.RewardGP
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type ClaimNodeRequest struct {
+	Token string `json:"token" binding:"required"` // the node's NODE_AUTH_TOKEN ("NodeID:Signature")
+}
+
+// ClaimNode links a node to the user. Presenting the signed node token
+// proves the user runs it.
+func (h *UserHandler) ClaimNode(c *gin.Context) {
+	user := appctx.MustGetUser(c)
+
+	var req ClaimNodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	nodeID, err := h.nodeAuth.VerifyAuthToken(req.Token)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid node token"})
+		return
+	}
+
+	switch err := h.operators.Claim(c.Request.Context(), user.ID, nodeID); {
+	case errors.Is(err, node.ErrNodeClaimed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to link node"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "node_id": nodeID})
+}
+
+// ReleaseNode unlinks one of the user's nodes. Past rewards stay in the
+// user's balance and earnings.
+func (h *UserHandler) ReleaseNode(c *gin.Context) {
+	user := appctx.MustGetUser(c)
+
+	ok, err := h.operators.Release(c.Request.Context(), user.ID, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to unlink node"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not linked to this account"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
@@ -0,0 +1,53 @@
+// Package idempotency stores the responses of requests sent with an
+// Idempotency-Key header, so a client retrying after a timeout or a dropped
+// connection gets the original response instead of a second parse or a
+// second credit.
+//
+// A key is first claimed with a pending record (Begin), then either
+// completed with the response (Complete) or released so the request can be
+// retried (Release). Pending records expire after lockTTL in case the
+// instance handling the request dies.
+package idempotency
+
+import (
+	"context"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// Record is a claimed key. Fingerprint identifies the request body the
+// key was first used with; the response fields are set once Done.
+type Record struct {
+	Fingerprint string `json:"fingerprint"`
+	Done        bool   `json:"done"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// Store persists records by scoped key.
+type Store interface {
+	// Begin claims key for a request with the given fingerprint. If the key
+	// is already taken it returns the existing record and false.
+	Begin(ctx context.Context, key, fingerprint string) (*Record, bool, error)
+
+	// Complete stores the response for a claimed key.
+	Complete(ctx context.Context, key string, rec *Record) error
+
+	// Release drops a claimed key so the request can be retried.
+	Release(ctx context.Context, key string) error
+}
+
+// New returns a Redis store shared by all instances, or an in-process one
+// when running without Redis. Completed responses are kept for
+// cfg.IdempotencyTTL; pending claims outlive the longest parse wait by a
+// minute.
+func New(cfg *config.Config, rdb *redis.Client) Store {
+	lockTTL := cfg.TaskWaitTimeout + time.Minute
+	if cfg.SchedulerBackend == "memory" || rdb == nil {
+		return NewMemoryStore(cfg.IdempotencyTTL, lockTTL)
+	}
+	return NewRedisStore(rdb, cfg.IdempotencyTTL, lockTTL)
+}
@@ -0,0 +1,131 @@
+package idempotency
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// The same cases run against every store, with a clock the test moves.
+
+const (
+	testTTL     = time.Hour
+	testLockTTL = time.Minute
+)
+
+type backend struct {
+	store   Store
+	advance func(time.Duration)
+}
+
+var backends = map[string]func(t *testing.T) backend{
+	"redis": func(t *testing.T) backend {
+		mr := miniredis.RunT(t)
+		rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { rdb.Close() })
+		return backend{store: NewRedisStore(rdb, testTTL, testLockTTL), advance: mr.FastForward}
+	},
+	"memory": func(t *testing.T) backend {
+		s := NewMemoryStore(testTTL, testLockTTL)
+		now := time.Now()
+		s.now = func() time.Time { return now }
+		return backend{store: s, advance: func(d time.Duration) { now = now.Add(d) }}
+	},
+}
+
+func forEachBackend(t *testing.T, fn func(t *testing.T, b backend)) {
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			fn(t, newBackend(t))
+		})
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	ctx := context.Background()
+	done := &Record{Fingerprint: "fp", Done: true, Status: 201, ContentType: "application/json", Body: []byte(`{"ok":true}`)}
+
+	tests := []struct {
+		name      string
+		prepare   func(s Store, advance func(time.Duration))
+		wantClaim bool
+		wantRec   *Record
+	}{
+		{"free key", func(Store, func(time.Duration)) {}, true, nil},
+		{"pending", func(s Store, _ func(time.Duration)) {
+			s.Begin(ctx, "k", "fp")
+		}, false, &Record{Fingerprint: "fp"}},
+		{"pending claim expired", func(s Store, advance func(time.Duration)) {
+			s.Begin(ctx, "k", "fp")
+			advance(testLockTTL)
+		}, true, nil},
+		{"released", func(s Store, _ func(time.Duration)) {
+			s.Begin(ctx, "k", "fp")
+			s.Release(ctx, "k")
+		}, true, nil},
+		{"completed", func(s Store, advance func(time.Duration)) {
+			s.Begin(ctx, "k", "fp")
+			s.Complete(ctx, "k", done)
+			advance(testLockTTL) // outlives the claim
+		}, false, done},
+		{"completed expired", func(s Store, advance func(time.Duration)) {
+			s.Begin(ctx, "k", "fp")
+			s.Complete(ctx, "k", done)
+			advance(testTTL)
+		}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, b backend) {
+				tt.prepare(b.store, b.advance)
+				rec, claimed, err := b.store.Begin(ctx, "k", "other")
+				if err != nil || claimed != tt.wantClaim {
+					t.Fatalf("Begin = %+v, %v, %v; want claimed %v", rec, claimed, err, tt.wantClaim)
+				}
+				if fmt.Sprint(rec) != fmt.Sprint(tt.wantRec) {
+					t.Fatalf("Begin record = %+v, want %+v", rec, tt.wantRec)
+				}
+				// Keys are independent.
+				if _, claimed, _ := b.store.Begin(ctx, "k2", "fp"); !claimed {
+					t.Fatal("unrelated key taken")
+				}
+			})
+		})
+	}
+}
+
+func TestBeginRace(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		const attempts = 16
+		var wg sync.WaitGroup
+		claims := make(chan bool, attempts)
+		for i := range attempts {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, claimed, err := b.store.Begin(context.Background(), "k", fmt.Sprint("fp", i))
+				if err != nil {
+					t.Errorf("Begin: %v", err)
+				}
+				claims <- claimed
+			}()
+		}
+		wg.Wait()
+		close(claims)
+
+		n := 0
+		for claimed := range claims {
+			if claimed {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Fatalf("%d concurrent Begins claimed the key, want 1", n)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-process Store for single-instance deployments
+// without Redis. Expired records are dropped lazily.
+type MemoryStore struct {
+	ttl     time.Duration
+	lockTTL time.Duration
+	now     func() time.Time
+
+	mu        sync.Mutex
+	records   map[string]memoryEntry
+	lastSweep time.Time
+}
+
+type memoryEntry struct {
+	rec     Record
+	expires time.Time
+}
+
+// NewMemoryStore creates an empty store.
+func NewMemoryStore(ttl, lockTTL time.Duration) *MemoryStore {
+	return &MemoryStore{
+		ttl:     ttl,
+		lockTTL: lockTTL,
+		now:     time.Now,
+		records: make(map[string]memoryEntry),
+	}
+}
+
+// Begin claims key unless a live record holds it.
+func (s *MemoryStore) Begin(_ context.Context, key, fingerprint string) (*Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	if e, ok := s.records[key]; ok && now.Before(e.expires) {
+		rec := e.rec
+		return &rec, false, nil
+	}
+	s.records[key] = memoryEntry{
+		rec:     Record{Fingerprint: fingerprint},
+		expires: now.Add(s.lockTTL),
+	}
+	return nil, true, nil
+}
+
+// Complete stores the response for key.
+func (s *MemoryStore) Complete(_ context.Context, key string, rec *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[key] = memoryEntry{rec: *rec, expires: s.now().Add(s.ttl)}
+	return nil
+}
+
+// Release drops key.
+func (s *MemoryStore) Release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
+
+// sweep removes expired records at most once a minute. Caller holds mu.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, e := range s.records {
+		if !now.Before(e.expires) {
+			delete(s.records, key)
+		}
+	}
+}
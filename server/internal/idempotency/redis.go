@@ -0,0 +1,80 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStore keeps records under "idem:{key}".
+type RedisStore struct {
+	rdb     *redis.Client
+	ttl     time.Duration
+	lockTTL time.Duration
+}
+
+// NewRedisStore creates a Redis-backed store.
+func NewRedisStore(rdb *redis.Client, ttl, lockTTL time.Duration) *RedisStore {
+	return &RedisStore{rdb: rdb, ttl: ttl, lockTTL: lockTTL}
+}
+
+func redisKey(key string) string {
+	return "idem:" + key
+}
+
+// Begin claims key with SET NX, falling back to reading the holder's record.
+func (s *RedisStore) Begin(ctx context.Context, key, fingerprint string) (*Record, bool, error) {
+	pending, err := json.Marshal(&Record{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Retry once if the holder's record expires between SET NX and GET.
+	for range 2 {
+		ok, err := s.rdb.SetNX(ctx, redisKey(key), pending, s.lockTTL).Result()
+		if err != nil {
+			return nil, false, fmt.Errorf("claim idempotency key: %w", err)
+		}
+		if ok {
+			return nil, true, nil
+		}
+
+		data, err := s.rdb.Get(ctx, redisKey(key)).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("load idempotency key: %w", err)
+		}
+		var rec Record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, false, fmt.Errorf("decode idempotency record: %w", err)
+		}
+		return &rec, false, nil
+	}
+	return nil, false, fmt.Errorf("claim idempotency key: contended")
+}
+
+// Complete overwrites the pending claim with the response.
+func (s *RedisStore) Complete(ctx context.Context, key string, rec *Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := s.rdb.Set(ctx, redisKey(key), data, s.ttl).Err(); err != nil {
+		return fmt.Errorf("store idempotent response: %w", err)
+	}
+	return nil
+}
+
+// Release deletes the claim.
+func (s *RedisStore) Release(ctx context.Context, key string) error {
+	if err := s.rdb.Del(ctx, redisKey(key)).Err(); err != nil {
+		return fmt.Errorf("release idempotency key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Package mail delivers the emails the server sends to users (address
+// verification, password reset).
+//
+// Production deployments use SMTP; the log mailer prints messages to
+// stdout instead, which is the default so that a local setup works
+// without a mail server.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New returns the mailer selected by cfg.MailBackend: "log" (default) or
+// "smtp".
+func New(cfg *config.Config) (Mailer, error) {
+	switch cfg.MailBackend {
+	case "", "log":
+		return NewLogMailer(os.Stdout), nil
+	case "smtp":
+		if cfg.SMTPAddr == "" || cfg.MailFrom == "" {
+			return nil, fmt.Errorf("MAIL_BACKEND=smtp requires SMTP_ADDR and MAIL_FROM")
+		}
+		return NewSMTPMailer(cfg.SMTPAddr, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom), nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_BACKEND %q (want log or smtp)", cfg.MailBackend)
+	}
+}
+
+// LogMailer writes messages to w instead of sending them.
+type LogMailer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewLogMailer creates a mailer that writes to w.
+func NewLogMailer(w io.Writer) *LogMailer {
+	return &LogMailer{w: w}
+}
+
+func (m *LogMailer) Send(_ context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintf(m.w, "[mail] %s\nTo: %s\nSubject: %s\n\n%s\n[mail] end\n",
+		time.Now().Format(time.RFC3339), msg.To, msg.Subject, msg.Body)
+	return err
+}
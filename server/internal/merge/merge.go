@@ -0,0 +1,400 @@
+// Package merge combines two user accounts into one.
+//
+// A person who registered by email and later logged in with Telegram
+// (before linking the two) owns two accounts. An admin merges the source
+// account into the target: the source's balance and everything keyed by
+// its user ID (ledger, task log, keys, nodes, redemptions, check-ins, plan
+// usage) move to the target in one database transaction, its login
+// identities move where the target lacks them, and the source is left
+// with status "merged" so it can no longer authenticate.
+package merge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/auth"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/checkin"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/node"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/plan"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/ratelimit"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/voucher"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrSameUser = errors.New("cannot merge an account into itself")
+	ErrBusy     = errors.New("source account has tasks in flight, try again when they finish")
+)
+
+// Result describes a completed merge.
+type Result struct {
+	Target   *auth.User       `json:"target"`
+	SourceID string           `json:"source_id"`
+	Amount   int64            `json:"amount"`            // GP moved to the target
+	Moved    map[string]int64 `json:"moved"`             // rows given to the target, per kind
+	Dropped  map[string]int64 `json:"dropped,omitempty"` // source rows discarded because the target had its own
+}
+
+// Merger merges accounts.
+type Merger struct {
+	db       *gorm.DB
+	cache    auth.Cache
+	sessions *auth.SessionService
+	limiter  *ratelimit.Limiter
+}
+
+// New creates a merger. cache is the shared auth cache; the source's
+// sessions are ended in sessions and the target's limits reloaded in
+// limiter.
+func New(db *gorm.DB, cache auth.Cache, sessions *auth.SessionService, limiter *ratelimit.Limiter) *Merger {
+	return &Merger{db: db, cache: cache, sessions: sessions, limiter: limiter}
+}
+
+// reassigned are the kinds of rows that simply change owner.
+var reassigned = []struct {
+	name  string
+	model any
+}{
+	{"transactions", &balance.Transaction{}},
+	{"tasks", &model.TaskLog{}},
+	{"api_keys", &auth.APIKey{}},
+	{"nodes", &node.Owner{}},
+	{"included_tasks", &plan.IncludedTask{}},
+}
+
+// Merge merges the account sourceID into targetID. It fails with ErrBusy
+// while the source has GP frozen or tasks pending, since their settlement
+// would still be booked to the source.
+func (m *Merger) Merge(ctx context.Context, targetID, sourceID string) (*Result, error) {
+	if targetID == sourceID {
+		return nil, ErrSameUser
+	}
+	res := &Result{SourceID: sourceID, Moved: map[string]int64{}, Dropped: map[string]int64{}}
+	now := time.Now()
+
+	err := m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		target, err := loadUser(tx, targetID)
+		if err != nil {
+			return err
+		}
+		source, err := loadUser(tx, sourceID)
+		if err != nil {
+			return err
+		}
+		if target.Status == auth.StatusMerged || source.Status == auth.StatusMerged {
+			return auth.ErrUserMerged
+		}
+
+		var inFlight int64
+		err = tx.Model(&model.TaskLog{}).
+			Where("user_id = ? AND status IN ?", sourceID, []model.TaskStatus{model.TaskStatusPending, model.TaskStatusProcessing}).
+			Count(&inFlight).Error
+		if err != nil {
+			return err
+		}
+		if inFlight > 0 {
+			return ErrBusy
+		}
+
+		if res.Amount, err = moveBalance(tx, targetID, sourceID); err != nil {
+			return err
+		}
+
+		for _, t := range reassigned {
+			r := tx.Model(t.model).Where("user_id = ?", sourceID).Update("user_id", targetID)
+			if r.Error != nil {
+				return fmt.Errorf("%s: %w", t.name, r.Error)
+			}
+			res.Moved[t.name] = r.RowsAffected
+		}
+		if err := moveRedemptions(tx, targetID, sourceID, res); err != nil {
+			return err
+		}
+		if err := moveCheckins(tx, targetID, sourceID, res); err != nil {
+			return err
+		}
+		if err := moveUsage(tx, targetID, sourceID, res); err != nil {
+			return err
+		}
+		for _, t := range []struct {
+			name  string
+			model any
+		}{
+			{"subscription", &plan.Subscription{}},
+			{"rate_limit_override", &ratelimit.Override{}},
+		} {
+			if err := moveSingle(tx, targetID, sourceID, t.name, t.model, res); err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("user_id = ?", sourceID).Delete(&auth.EmailToken{}).Error; err != nil {
+			return err
+		}
+
+		if err := moveIdentities(tx, target, source, now, res); err != nil {
+			return err
+		}
+
+		acc, err := loadAccount(tx, targetID)
+		if err != nil {
+			return err
+		}
+		return tx.Create(&balance.Transaction{
+			UserID:    targetID,
+			Type:      balance.TxMerge,
+			Balance:   acc.Balance,
+			Remark:    fmt.Sprintf("merged account %s (%d GP)", sourceID, res.Amount),
+			CreatedAt: now,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The source can no longer authenticate (its status says so), but end
+	// its sessions and drop cached keys, which now belong to the target.
+	if err := m.sessions.RevokeAll(ctx, sourceID, ""); err != nil {
+		log.Printf("[merge] revoke sessions of user=%s: %v", sourceID, err)
+	}
+	for _, id := range []string{sourceID, targetID} {
+		if err := auth.ForgetUser(ctx, m.db, m.cache, id); err != nil {
+			log.Printf("[merge] clear auth cache of user=%s: %v", id, err)
+		}
+		m.limiter.Invalidate(id)
+	}
+
+	if res.Target, err = loadUser(m.db.WithContext(ctx), targetID); err != nil {
+		return nil, err
+	}
+	log.Printf("[merge] merged user=%s into user=%s (%d GP, moved=%v dropped=%v)",
+		sourceID, targetID, res.Amount, res.Moved, res.Dropped)
+	return res, nil
+}
+
+// moveBalance zeroes the source account and credits its balance to the
+// target (creating the target's account if needed), returning the amount.
+// The source update is conditional on the balance read and nothing being
+// frozen, so a concurrent freeze or deposit makes the merge fail (ErrBusy)
+// rather than lose GP.
+func moveBalance(tx *gorm.DB, targetID, sourceID string) (int64, error) {
+	err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&balance.Account{UserID: targetID, UpdatedAt: time.Now()}).Error
+	if err != nil {
+		return 0, err
+	}
+
+	src, err := loadAccount(tx, sourceID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if src.Frozen > 0 {
+		return 0, ErrBusy
+	}
+	if src.Balance == 0 {
+		return 0, nil
+	}
+
+	r := tx.Model(&balance.Account{}).
+		Where("user_id = ? AND frozen = 0 AND balance = ?", sourceID, src.Balance).
+		Updates(map[string]any{"balance": 0, "updated_at": time.Now()})
+	if r.Error != nil {
+		return 0, r.Error
+	}
+	if r.RowsAffected == 0 {
+		return 0, ErrBusy
+	}
+	err = tx.Model(&balance.Account{}).Where("user_id = ?", targetID).
+		Updates(map[string]any{"balance": gorm.Expr("balance + ?", src.Balance), "updated_at": time.Now()}).Error
+	return src.Balance, err
+}
+
+// moveCheckins moves the source's check-ins except those on days the
+// target also checked in, which are dropped (their rewards are in the
+// ledger either way).
+func moveCheckins(tx *gorm.DB, targetID, sourceID string, res *Result) error {
+	var days []string
+	if err := tx.Model(&checkin.Checkin{}).Where("user_id = ?", targetID).Pluck("day", &days).Error; err != nil {
+		return err
+	}
+	q := tx.Model(&checkin.Checkin{}).Where("user_id = ?", sourceID)
+	if len(days) > 0 {
+		q = q.Where("day NOT IN ?", days)
+	}
+	r := q.Update("user_id", targetID)
+	if r.Error != nil {
+		return r.Error
+	}
+	res.Moved["checkins"] = r.RowsAffected
+
+	r = tx.Where("user_id = ?", sourceID).Delete(&checkin.Checkin{})
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.RowsAffected > 0 {
+		res.Dropped["checkins"] = r.RowsAffected
+	}
+	return nil
+}
+
+// moveRedemptions gives the source's voucher redemptions to the target.
+// Where both redeemed the same voucher with a per-user limit, the source's
+// sequence numbers (see voucher.Redeem) are moved past both users' so the
+// unique index holds. All redemptions are kept, since their GP was credited
+// already: the merged account can end up above the per-user limit, which
+// only stops it redeeming that voucher again.
+func moveRedemptions(tx *gorm.DB, targetID, sourceID string, res *Result) error {
+	var shared []struct {
+		VoucherID uint
+		Seq       int
+	}
+	err := tx.Model(&voucher.Redemption{}).Select("voucher_id, MAX(user_seq) AS seq").
+		Where("user_id IN ? AND user_seq IS NOT NULL", []string{targetID, sourceID}).
+		Group("voucher_id").Having("COUNT(DISTINCT user_id) = 2").
+		Scan(&shared).Error
+	if err != nil {
+		return err
+	}
+	for _, v := range shared {
+		var ids []uint
+		err := tx.Model(&voucher.Redemption{}).
+			Where("voucher_id = ? AND user_id = ? AND user_seq IS NOT NULL", v.VoucherID, sourceID).
+			Order("user_seq").Pluck("id", &ids).Error
+		if err != nil {
+			return err
+		}
+		for i, id := range ids {
+			if err := tx.Model(&voucher.Redemption{}).Where("id = ?", id).Update("user_seq", v.Seq+i+1).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	r := tx.Model(&voucher.Redemption{}).Where("user_id = ?", sourceID).Update("user_id", targetID)
+	if r.Error != nil {
+		return fmt.Errorf("redemptions: %w", r.Error)
+	}
+	res.Moved["redemptions"] = r.RowsAffected
+	return nil
+}
+
+// moveUsage adds the source's monthly plan usage to the target's.
+func moveUsage(tx *gorm.DB, targetID, sourceID string, res *Result) error {
+	var usage []plan.Usage
+	if err := tx.Where("user_id = ?", sourceID).Find(&usage).Error; err != nil {
+		return err
+	}
+	for _, u := range usage {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&plan.Usage{UserID: targetID, Period: u.Period}).Error; err != nil {
+			return err
+		}
+		err := tx.Model(&plan.Usage{}).Where("user_id = ? AND period = ?", targetID, u.Period).
+			Updates(map[string]any{
+				"parses": gorm.Expr("parses + ?", u.Parses),
+				"gp":     gorm.Expr("gp + ?", u.GP),
+			}).Error
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Where("user_id = ?", sourceID).Delete(&plan.Usage{}).Error; err != nil {
+		return err
+	}
+	res.Moved["plan_usage"] = int64(len(usage))
+	return nil
+}
+
+// moveSingle moves a per-user row (keyed by user_id) to the target if the
+// target has none, and otherwise drops the source's.
+func moveSingle(tx *gorm.DB, targetID, sourceID, name string, mdl any, res *Result) error {
+	var n int64
+	if err := tx.Model(mdl).Where("user_id = ?", targetID).Count(&n).Error; err != nil {
+		return err
+	}
+	if n == 0 {
+		r := tx.Model(mdl).Where("user_id = ?", sourceID).Update("user_id", targetID)
+		if r.Error != nil {
+			return fmt.Errorf("%s: %w", name, r.Error)
+		}
+		res.Moved[name] = r.RowsAffected
+		return nil
+	}
+	r := tx.Where("user_id = ?", sourceID).Delete(mdl)
+	if r.Error != nil {
+		return fmt.Errorf("%s: %w", name, r.Error)
+	}
+	if r.RowsAffected > 0 {
+		res.Dropped[name] = r.RowsAffected
+	}
+	return nil
+}
+
+// moveIdentities gives the target the source's email (with its password
+// and verification) and Telegram account where it has none, and marks the
+// source merged. The source's identities are cleared first: both columns
+// are unique.
+func moveIdentities(tx *gorm.DB, target, source *auth.User, now time.Time, res *Result) error {
+	err := tx.Model(&auth.User{}).Where("id = ?", source.ID).Updates(map[string]any{
+		"email":             nil,
+		"password":          "",
+		"email_verified_at": nil,
+		"telegram_id":       nil,
+		"status":            auth.StatusMerged,
+		"merged_into":       target.ID,
+		"updated_at":        now,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	updates := map[string]any{"updated_at": now}
+	if source.Email != nil {
+		if target.Email == nil {
+			updates["email"] = *source.Email
+			updates["password"] = source.Password
+			updates["email_verified_at"] = source.EmailVerifiedAt
+		} else {
+			res.Dropped["email"] = 1
+		}
+	}
+	if source.TelegramID != nil {
+		if target.TelegramID == nil {
+			updates["telegram_id"] = *source.TelegramID
+		} else {
+			res.Dropped["telegram"] = 1
+		}
+	}
+	if source.LastCheckinAt != nil && (target.LastCheckinAt == nil || source.LastCheckinAt.After(*target.LastCheckinAt)) {
+		updates["last_checkin_at"] = *source.LastCheckinAt
+	}
+	return tx.Model(&auth.User{}).Where("id = ?", target.ID).Updates(updates).Error
+}
+
+func loadUser(db *gorm.DB, id string) (*auth.User, error) {
+	var u auth.User
+	if err := db.Where("id = ?", id).Take(&u).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, auth.ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+func loadAccount(tx *gorm.DB, userID string) (*balance.Account, error) {
+	var acc balance.Account
+	if err := tx.Where("user_id = ?", userID).Take(&acc).Error; err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
@@ -0,0 +1,186 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/auth"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/checkin"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/dbtest"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/node"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/plan"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/ratelimit"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/voucher"
+	"gorm.io/gorm"
+)
+
+type testEnv struct {
+	db       *gorm.DB
+	merger   *Merger
+	balances balance.BalanceService
+	sessions *auth.SessionService
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	db := dbtest.Open(t,
+		&model.TaskLog{}, &auth.User{}, &auth.APIKey{}, &auth.Session{}, &auth.EmailToken{},
+		&balance.Account{}, &balance.Transaction{}, &voucher.Voucher{}, &voucher.Redemption{}, &node.Owner{},
+		&plan.Subscription{}, &plan.Usage{}, &plan.IncludedTask{}, &checkin.Checkin{}, &ratelimit.Override{})
+	cache := auth.NewMemoryCache(time.Minute, 100)
+	sessions := auth.NewSessionService(db, cache, time.Minute, time.Hour)
+	plans := plan.NewService(db, map[string]plan.Plan{"free": {Name: "free"}}, "free")
+	limiter := ratelimit.NewLimiter(db, plans, ratelimit.NewMemoryCounter(), time.Minute, time.Local)
+	return &testEnv{
+		db:       db,
+		merger:   New(db, cache, sessions, limiter),
+		balances: balance.NewBalanceService(db),
+		sessions: sessions,
+	}
+}
+
+func (e *testEnv) user(t *testing.T, id string, email *string, telegramID *int64, gp int64) {
+	t.Helper()
+	u := &auth.User{ID: id, Email: email, TelegramID: telegramID, Provider: "email", Status: "active", APIKeyHash: id}
+	if err := e.db.Create(u).Error; err != nil {
+		t.Fatalf("create user %s: %v", id, err)
+	}
+	if _, err := e.balances.Deposit(context.Background(), id, balance.TxDeposit, gp, "test"); err != nil {
+		t.Fatalf("deposit: %v", err)
+	}
+}
+
+func (e *testEnv) create(t *testing.T, rows ...any) {
+	t.Helper()
+	for _, r := range rows {
+		if err := e.db.Create(r).Error; err != nil {
+			t.Fatalf("create %T: %v", r, err)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	targetEmail, sourceEmail, tg := "a@example.com", "b@example.com", int64(42)
+	e.user(t, "target", &targetEmail, nil, 100)
+	e.user(t, "source", &sourceEmail, &tg, 50)
+	e.create(t,
+		&checkin.Checkin{UserID: "target", Day: "2026-03-01"},
+		&checkin.Checkin{UserID: "source", Day: "2026-03-01"},
+		&checkin.Checkin{UserID: "source", Day: "2026-03-02"},
+		&plan.Usage{UserID: "target", Period: "2026-03", Parses: 1, GP: 10},
+		&plan.Usage{UserID: "source", Period: "2026-03", Parses: 2, GP: 20},
+		&plan.Subscription{UserID: "source", Plan: "free"},
+		&ratelimit.Override{UserID: "target"},
+		&ratelimit.Override{UserID: "source"},
+	)
+	// Both redeemed the same voucher, limited to two per user.
+	vouchers := voucher.NewService(e.db)
+	batch, err := vouchers.Mint(ctx, voucher.MintRequest{Count: 1, Amount: 1, MaxRedemptions: 10, PerUserLimit: 2})
+	if err != nil {
+		t.Fatalf("mint: %v", err)
+	}
+	code := batch.Codes[0]
+	for _, id := range []string{"target", "source", "source"} {
+		if _, _, err := vouchers.Redeem(ctx, id, code); err != nil {
+			t.Fatalf("redeem by %s: %v", id, err)
+		}
+	}
+	session, err := e.sessions.Create(ctx, "source", "test", "")
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	res, err := e.merger.Merge(ctx, "target", "source")
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if res.Amount != 52 || res.Target.TelegramID == nil || *res.Target.TelegramID != tg || *res.Target.Email != targetEmail {
+		t.Fatalf("result = %+v, target %+v", res, res.Target)
+	}
+	for kind, want := range map[string]int64{"transactions": 3, "redemptions": 2, "checkins": 1, "plan_usage": 1, "subscription": 1} {
+		if res.Moved[kind] != want {
+			t.Errorf("moved %s = %d, want %d", kind, res.Moved[kind], want)
+		}
+	}
+	for kind, want := range map[string]int64{"checkins": 1, "email": 1, "rate_limit_override": 1} {
+		if res.Dropped[kind] != want {
+			t.Errorf("dropped %s = %d, want %d", kind, res.Dropped[kind], want)
+		}
+	}
+
+	if acc, _ := e.balances.GetAccount(ctx, "target"); acc.Balance != 153 {
+		t.Errorf("target balance = %d, want 153", acc.Balance)
+	}
+	// Three redemptions against a limit of two: all kept, none more allowed.
+	var seqs []int
+	e.db.Model(&voucher.Redemption{}).Where("user_id = ?", "target").Order("user_seq").Pluck("user_seq", &seqs)
+	if len(seqs) != 3 || seqs[0] != 1 || seqs[1] != 3 || seqs[2] != 4 {
+		t.Errorf("target redemption seqs = %v, want 1 3 4 (the source's moved past both)", seqs)
+	}
+	if _, _, err := vouchers.Redeem(ctx, "target", code); !errors.Is(err, voucher.ErrUserLimit) {
+		t.Errorf("redeem after merge = %v, want ErrUserLimit", err)
+	}
+	if acc, _ := e.balances.GetAccount(ctx, "source"); acc.Balance != 0 {
+		t.Errorf("source balance = %d, want 0", acc.Balance)
+	}
+	var usage plan.Usage
+	e.db.Where("user_id = ?", "target").Take(&usage)
+	if usage.Parses != 3 || usage.GP != 30 {
+		t.Errorf("target usage = %+v, want both months' usage added", usage)
+	}
+	var source auth.User
+	e.db.Where("id = ?", "source").Take(&source)
+	if source.Status != auth.StatusMerged || source.MergedInto == nil || *source.MergedInto != "target" || source.Email != nil || source.TelegramID != nil {
+		t.Errorf("source after merge = %+v", source)
+	}
+	if _, _, err := e.sessions.Authenticate(ctx, session.AccessToken); err == nil {
+		t.Error("source session still valid")
+	}
+
+	if _, err := e.merger.Merge(ctx, "target", "source"); !errors.Is(err, auth.ErrUserMerged) {
+		t.Fatalf("merge again = %v, want ErrUserMerged", err)
+	}
+}
+
+func TestMergeRefused(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, e *testEnv)
+		source  string
+		wantErr error
+	}{
+		{"same account", func(*testing.T, *testEnv) {}, "target", ErrSameUser},
+		{"unknown source", func(*testing.T, *testEnv) {}, "nobody", auth.ErrUserNotFound},
+		{"task in flight", func(t *testing.T, e *testEnv) {
+			e.create(t, &model.TaskLog{TraceID: "t1", UserID: "source", Status: model.TaskStatusProcessing})
+		}, "source", ErrBusy},
+		{"gp frozen", func(t *testing.T, e *testEnv) {
+			if err := e.balances.FreezeGP(ctx, "source", "t1", 10); err != nil {
+				t.Fatalf("freeze: %v", err)
+			}
+		}, "source", ErrBusy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.user(t, "target", nil, nil, 100)
+			e.user(t, "source", nil, nil, 50)
+			tt.prepare(t, e)
+
+			if _, err := e.merger.Merge(ctx, "target", tt.source); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("merge = %v, want %v", err, tt.wantErr)
+			}
+			// Nothing moved.
+			if acc, _ := e.balances.GetAccount(ctx, "target"); acc.Balance != 100 {
+				t.Fatalf("target balance = %d, want 100", acc.Balance)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 
@@ -11,10 +12,16 @@ import (
 
 // APIKeyAuth returns a Gin middleware that validates the API key
 // from the Authorization header (format: "Bearer sk-xxx") and
-// injects the authenticated User into the context.
+// injects the authenticated User and the key's scopes into the context.
 //
-// Lookup is delegated to auth.UserService.GetByAPIKey.
-func APIKeyAuth(userSvc auth.UserService) gin.HandlerFunc {
+// Lookup is delegated to auth.KeyService.Authenticate, which accepts both
+// named keys and the account key. Use RequireScope on route groups to
+// restrict what a key may call.
+//
+// If sessions is non-nil, login access tokens ("Bearer at-xxx") are
+// accepted too; they carry all user scopes and the session ID is stored
+// in the context.
+func APIKeyAuth(keys *auth.KeyService, sessions *auth.SessionService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		raw := extractBearerToken(c)
 		if raw == "" {
@@ -24,22 +31,92 @@ func APIKeyAuth(userSvc auth.UserService) gin.HandlerFunc {
 			return
 		}
 
-		user, err := userSvc.GetByAPIKey(c.Request.Context(), raw)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"error": "invalid api key",
-			})
+		var (
+			user   *auth.User
+			scopes auth.Scopes
+			ok     bool
+		)
+		if sessions != nil && auth.IsAccessToken(raw) {
+			var sessionID string
+			user, sessionID, ok = authenticateSession(c, sessions, raw)
+			scopes = auth.UserScopes
+			c.Set(appctx.CtxKeySession, sessionID)
+		} else {
+			user, scopes, ok = authenticateKey(c, keys, raw)
+		}
+		if !ok {
 			return
 		}
 
-		if user.Status != "active" {
+		c.Set(appctx.CtxKeyUser, user)
+		c.Set(appctx.CtxKeyScopes, scopes)
+		c.Next()
+	}
+}
+
+// authenticateSession resolves an access token and checks the account is
+// active, aborting the request if not.
+func authenticateSession(c *gin.Context, sessions *auth.SessionService, token string) (*auth.User, string, bool) {
+	user, sessionID, err := sessions.Authenticate(c.Request.Context(), token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired access token"})
+		return nil, "", false
+	}
+	if user.Status != "active" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": "account is " + user.Status,
+		})
+		return nil, "", false
+	}
+	return user, sessionID, true
+}
+
+// authenticateKey resolves raw and checks the account is active, aborting
+// the request if not.
+func authenticateKey(c *gin.Context, keys *auth.KeyService, raw string) (*auth.User, auth.Scopes, bool) {
+	user, scopes, err := keys.Authenticate(c.Request.Context(), raw, c.ClientIP())
+	switch {
+	case errors.Is(err, auth.ErrAPIKeyExpired):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "api key expired"})
+		return nil, nil, false
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid api key"})
+		return nil, nil, false
+	}
+
+	if user.Status != "active" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": "account is " + user.Status,
+		})
+		return nil, nil, false
+	}
+	return user, scopes, true
+}
+
+// RequireScope returns a Gin middleware that rejects requests whose API
+// key lacks scope with 403. Must run after APIKeyAuth.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !appctx.GetScopes(c).Has(scope) {
 			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
-				"error": "account is " + user.Status,
+				"error": "api key lacks scope " + scope,
 			})
 			return
 		}
+		c.Next()
+	}
+}
 
-		c.Set(appctx.CtxKeyUser, user)
+// RequireVerifiedEmail returns a Gin middleware that rejects users with
+// an unverified email with 403. Must run after APIKeyAuth.
+func RequireVerifiedEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !appctx.MustGetUser(c).EmailVerified() {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "email not verified",
+			})
+			return
+		}
 		c.Next()
 	}
 }
@@ -60,8 +137,18 @@ func extractBearerToken(c *gin.Context) string {
 // AdminTokenAuth returns a Gin middleware that validates the admin token
 // from the Authorization header (format: "Bearer <admin-token>").
 // This provides simple admin authentication without user database lookup.
-func AdminTokenAuth(adminToken string) gin.HandlerFunc {
+//
+// If keys is non-nil, API keys with the admin:read scope are also accepted
+// for GET requests.
+func AdminTokenAuth(adminToken string, keys *auth.KeyService) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if keys != nil && c.Request.Method == http.MethodGet {
+			if token := extractBearerToken(c); token != "" && (adminToken == "" || token != adminToken) {
+				adminReadKey(c, keys, token)
+				return
+			}
+		}
+
 		if adminToken == "" {
 			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
 				"error": "admin authentication not configured",
@@ -87,3 +174,21 @@ func AdminTokenAuth(adminToken string) gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// adminReadKey admits a GET request on the admin API made with an API key
+// carrying the admin:read scope.
+func adminReadKey(c *gin.Context, keys *auth.KeyService, raw string) {
+	user, scopes, ok := authenticateKey(c, keys, raw)
+	if !ok {
+		return
+	}
+	if !scopes.Has(auth.ScopeAdminRead) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": "api key lacks scope " + auth.ScopeAdminRead,
+		})
+		return
+	}
+	c.Set(appctx.CtxKeyUser, user)
+	c.Set(appctx.CtxKeyScopes, scopes)
+	c.Next()
+}
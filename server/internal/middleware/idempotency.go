@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/auth"
+	appctx "github.com/Archive-At-Home/archive-at-home/server/internal/context"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/idempotency"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header clients set to make a
+	// POST safe to retry.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on responses served from the store.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLen = 255
+)
+
+// Idempotency returns a Gin middleware that makes requests carrying an
+// Idempotency-Key header run at most once per key.
+//
+// Keys are scoped to the caller (API key user, or the admin token) and the
+// method and path. A repeated request gets the stored status and body back
+// with Idempotent-Replayed: true; one sent while the first is still running
+// gets 409, and reusing a key with a different body gets 422. 5xx and 429
+// responses are not stored, nor are JSON bodies with a top-level "error"
+// (a parse that timed out or failed still answers 200), so the request can
+// be retried with the same key.
+//
+// Must run after the authentication middleware. Requests without the
+// header are passed through.
+func Idempotency(st idempotency.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimSpace(c.GetHeader(IdempotencyKeyHeader))
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Idempotency-Key must be at most 255 characters",
+			})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(body)
+		fingerprint := hex.EncodeToString(sum[:])
+		scoped := idempotencyScope(c) + ":" + c.Request.Method + ":" + c.Request.URL.Path + ":" + key
+
+		ctx := context.WithoutCancel(c.Request.Context())
+		rec, claimed, err := st.Begin(ctx, scoped, fingerprint)
+		if err != nil {
+			log.Printf("[idempotency] begin error: %v", err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "idempotency store unavailable"})
+			return
+		}
+		if !claimed {
+			switch {
+			case rec.Fingerprint != fingerprint:
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+					"error": "Idempotency-Key was already used with a different request body",
+				})
+			case !rec.Done:
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+					"error": "a request with this Idempotency-Key is still in progress",
+				})
+			default:
+				c.Header(IdempotentReplayedHeader, "true")
+				c.Data(rec.Status, rec.ContentType, rec.Body)
+				c.Abort()
+			}
+			return
+		}
+
+		w := &captureWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+
+		// Deferred so a panicking handler releases the key too.
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			if err := st.Release(ctx, scoped); err != nil {
+				log.Printf("[idempotency] release error: %v", err)
+			}
+		}()
+
+		c.Next()
+
+		status := w.Status()
+		if !storable(status, w.body.Bytes()) {
+			return
+		}
+		err = st.Complete(ctx, scoped, &idempotency.Record{
+			Fingerprint: fingerprint,
+			Done:        true,
+			Status:      status,
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        w.body.Bytes(),
+		})
+		if err != nil {
+			log.Printf("[idempotency] store response error: %v", err)
+			return
+		}
+		completed = true
+	}
+}
+
+// storable reports whether a response is final: not a server error or a
+// rate limit, and not a failure reported in the body.
+func storable(status int, body []byte) bool {
+	if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+		return false
+	}
+	var failure struct {
+		Error string `json:"error"`
+	}
+	if status < http.StatusBadRequest && json.Unmarshal(body, &failure) == nil && failure.Error != "" {
+		return false
+	}
+	return true
+}
+
+// idempotencyScope identifies the caller: the API key's user, or the admin
+// token on admin routes.
+func idempotencyScope(c *gin.Context) string {
+	if v, ok := c.Get(appctx.CtxKeyUser); ok {
+		return "user:" + v.(*auth.User).ID
+	}
+	return "admin"
+}
+
+// captureWriter tees the response body so it can be stored.
+type captureWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	appctx "github.com/Archive-At-Home/archive-at-home/server/internal/context"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit returns a Gin middleware that counts every request against the
+// caller's per-minute limit. Must run after APIKeyAuth.
+//
+// Responses carry X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset (unix seconds); over the limit the request gets 429
+// with Retry-After. If the counter store is unavailable requests are let
+// through.
+func RateLimit(l *ratelimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := appctx.GetUserID(c)
+		d, err := l.AllowRequest(c.Request.Context(), userID)
+		if err != nil {
+			log.Printf("[ratelimit] user=%s: %v", userID, err)
+		}
+		if !rateLimitRespond(c, d) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// ParseLimit returns a Gin middleware that admits POST /parse against the
+// caller's in-flight and daily parse limits, holding the in-flight slot
+// until the handler returns. Must run after APIKeyAuth.
+func ParseLimit(l *ratelimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := appctx.GetUserID(c)
+		d, release, err := l.BeginParse(c.Request.Context(), userID)
+		if err != nil {
+			log.Printf("[ratelimit] user=%s: %v", userID, err)
+		}
+		defer release()
+		if !rateLimitRespond(c, d) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// rateLimitRespond sets the X-RateLimit-* headers for d, overriding those
+// of an earlier check, and aborts with 429 if d denies the request.
+// Returns whether the request may proceed.
+func rateLimitRespond(c *gin.Context, d ratelimit.Decision) bool {
+	if d.Limit > 0 {
+		c.Header("X-RateLimit-Limit", strconv.Itoa(d.Limit))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		if !d.Reset.IsZero() {
+			c.Header("X-RateLimit-Reset", strconv.FormatInt(d.Reset.Unix(), 10))
+		} else {
+			c.Writer.Header().Del("X-RateLimit-Reset")
+		}
+	}
+	if d.Allowed {
+		return true
+	}
+	retry := int(math.Ceil(d.RetryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(max(1, retry)))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"error":       "rate limit exceeded: " + d.Reason,
+		"limit":       d.Limit,
+		"retry_after": max(1, retry),
+	})
+	return false
+}
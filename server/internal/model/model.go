@@ -54,6 +54,10 @@ const (
 	// Server → Node (response to FETCH)
 	MsgTypeTaskAssigned MsgType = "TASK_ASSIGNED"
 	MsgTypeTaskGone     MsgType = "TASK_GONE" // already claimed by another node
+
+	// Server → Node → Server: gallery metadata lookup through the node's IP
+	MsgTypeMetadataRequest  MsgType = "METADATA_REQUEST"
+	MsgTypeMetadataResponse MsgType = "METADATA_RESPONSE"
 )
 
 // Envelope is the top-level WebSocket frame.
@@ -93,6 +97,27 @@ type TaskResult struct {
 	Error      string `json:"error,omitempty"`
 }
 
+// MetadataRequest asks a node to look up gallery metadata via the e-hentai API.
+type MetadataRequest struct {
+	RequestID  string `json:"request_id"`
+	GalleryID  string `json:"gallery_id"`
+	GalleryKey string `json:"gallery_key"`
+}
+
+// MetadataResponse is the node's reply to a MetadataRequest.
+//
+// GalleryError is set when the API answered but rejected the gallery
+// (e.g. wrong key); Error is set when the node could not complete the
+// lookup at all. Only the latter is worth retrying elsewhere.
+type MetadataResponse struct {
+	RequestID    string `json:"request_id"`
+	GalleryID    string `json:"gallery_id"`
+	Posted       int64  `json:"posted"`   // unix seconds
+	Filesize     int64  `json:"filesize"` // bytes
+	GalleryError string `json:"gallery_error,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
 // ─────────────────────────────────────────────
 // SQL Persistence Models (async write)
 // ─────────────────────────────────────────────
@@ -123,6 +148,7 @@ type ParseRequest struct {
 	GalleryID  string `json:"gallery_id" binding:"required"`
 	GalleryKey string `json:"gallery_key" binding:"required"` // e-hentai gallery token/key
 	Force      bool   `json:"force"`
+	MaxGP      *int   `json:"max_gp,omitempty" binding:"omitempty,min=0"` // refuse the task if estimated GP exceeds this ceiling
 }
 
 // ParseResponse is the outbound API response.
@@ -133,9 +159,41 @@ type ParseResponse struct {
 	Error      string `json:"error,omitempty"`
 }
 
+// GalleryRef identifies a single gallery (used by batch endpoints).
+type GalleryRef struct {
+	GalleryID  string `json:"gallery_id" form:"gallery_id" binding:"required"`
+	GalleryKey string `json:"gallery_key" form:"gallery_key" binding:"required"`
+}
+
+// QuoteResponse is the price estimate for a gallery, computed without creating a task.
+type QuoteResponse struct {
+	GalleryID   string `json:"gallery_id"`
+	EstimatedGP int    `json:"estimated_gp"`
+	FreeTier    bool   `json:"free_tier"`
+	Cached      bool   `json:"cached"`     // user already has a cached archive URL (non-force parse is free)
+	Affordable  bool   `json:"affordable"` // available balance covers the estimate (always true when cached)
+	Error       string `json:"error,omitempty"`
+}
+
+// BatchQuoteRequest asks for quotes on several galleries at once.
+type BatchQuoteRequest struct {
+	Galleries []GalleryRef `json:"galleries" binding:"required,min=1,max=25,dive"`
+}
+
+// BatchQuoteResponse aggregates per-gallery quotes.
+// TotalGP only counts galleries that resolved successfully and are not cached.
+type BatchQuoteResponse struct {
+	Quotes     []*QuoteResponse `json:"quotes"`
+	TotalGP    int              `json:"total_gp"`
+	Balance    int64            `json:"balance"`    // available balance
+	Affordable bool             `json:"affordable"` // available balance covers TotalGP
+}
+
 // UserProfile represents user profile with balance information.
 // Used by both /api/v1/me and /api/v1/admin/users/:id endpoints.
 type UserProfile struct {
 	User    interface{} `json:"user"`    // *auth.User
 	Balance int64       `json:"balance"` // Available balance (balance - frozen)
+	Frozen  int64       `json:"frozen"`  // Reserved for in-flight tasks
+	Plan    interface{} `json:"plan"`    // *plan.Status: plan and this month's usage
 }
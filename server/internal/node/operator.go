@@ -0,0 +1,140 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ─────────────────────────────────────────────
+// Node Operators
+//
+// A node is linked to the user account of the volunteer running it. The
+// settler credits that account a share of every task the node completes
+// (balance.TxNodeReward).
+// ─────────────────────────────────────────────
+
+var ErrNodeClaimed = errors.New("node is linked to another account")
+
+// Owner links a NodeID to its operator.
+type Owner struct {
+	NodeID    string    `json:"node_id" gorm:"primaryKey;size:128"`
+	UserID    string    `json:"user_id" gorm:"size:64;index"`
+	CreatedAt time.Time `json:"linked_at"`
+}
+
+func (Owner) TableName() string { return "node_owners" }
+
+// Earnings sums the rewards one operator received for one node.
+type Earnings struct {
+	NodeID   string    `json:"node_id"`
+	LinkedAt time.Time `json:"linked_at,omitzero"` // zero if the node has since been unlinked
+	Tasks    int64     `json:"tasks"`              // rewarded tasks
+	RewardGP int64     `json:"reward_gp"`
+}
+
+// OperatorService manages node ownership.
+type OperatorService struct {
+	db *gorm.DB
+}
+
+// NewOperatorService creates an OperatorService.
+func NewOperatorService(db *gorm.DB) *OperatorService {
+	return &OperatorService{db: db}
+}
+
+// Claim links nodeID to userID. Claiming a node the user already owns is a
+// no-op; a node owned by someone else returns ErrNodeClaimed.
+func (s *OperatorService) Claim(ctx context.Context, userID, nodeID string) error {
+	res := s.db.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&Owner{NodeID: nodeID, UserID: userID, CreatedAt: time.Now()})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 1 {
+		return nil
+	}
+	owner, err := s.OwnerOf(ctx, nodeID)
+	if err != nil {
+		return err
+	}
+	if owner != userID {
+		return ErrNodeClaimed
+	}
+	return nil
+}
+
+// SetOwner links nodeID to userID regardless of the current owner (admin).
+// An empty userID unlinks the node.
+func (s *OperatorService) SetOwner(ctx context.Context, nodeID, userID string) error {
+	db := s.db.WithContext(ctx)
+	if userID == "" {
+		return db.Delete(&Owner{}, "node_id = ?", nodeID).Error
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "node_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"user_id", "created_at"}),
+	}).Create(&Owner{NodeID: nodeID, UserID: userID, CreatedAt: time.Now()}).Error
+}
+
+// Release unlinks nodeID if userID owns it. Returns false if it did not.
+func (s *OperatorService) Release(ctx context.Context, userID, nodeID string) (bool, error) {
+	res := s.db.WithContext(ctx).Delete(&Owner{}, "node_id = ? AND user_id = ?", nodeID, userID)
+	return res.RowsAffected > 0, res.Error
+}
+
+// OwnerOf returns the user ID linked to nodeID, or "" if none.
+func (s *OperatorService) OwnerOf(ctx context.Context, nodeID string) (string, error) {
+	var o Owner
+	err := s.db.WithContext(ctx).Where("node_id = ?", nodeID).Take(&o).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	return o.UserID, err
+}
+
+// Earnings returns the user's rewards per node: every node currently
+// linked to the user plus any node it was rewarded for in the past.
+// Rewards are attributed through the node_id task_logs recorded for the
+// rewarded trace.
+func (s *OperatorService) Earnings(ctx context.Context, userID string) ([]Earnings, error) {
+	var owned []Owner
+	if err := s.db.WithContext(ctx).Where("user_id = ?", userID).Order("created_at").Find(&owned).Error; err != nil {
+		return nil, err
+	}
+
+	var rows []Earnings
+	err := s.db.WithContext(ctx).Table("transactions").
+		Select("task_logs.node_id AS node_id, COUNT(*) AS tasks, SUM(transactions.amount) AS reward_gp").
+		Joins("JOIN task_logs ON task_logs.trace_id = transactions.trace_id").
+		Where("transactions.user_id = ? AND transactions.type = ?", userID, balance.TxNodeReward).
+		Group("task_logs.node_id").
+		Order("task_logs.node_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	earned := make(map[string]Earnings, len(rows))
+	for _, r := range rows {
+		earned[r.NodeID] = r
+	}
+	out := make([]Earnings, 0, len(owned)+len(rows))
+	for _, o := range owned {
+		e := earned[o.NodeID]
+		e.NodeID, e.LinkedAt = o.NodeID, o.CreatedAt
+		out = append(out, e)
+		delete(earned, o.NodeID)
+	}
+	for _, r := range rows {
+		if _, ok := earned[r.NodeID]; ok {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
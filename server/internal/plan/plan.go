@@ -0,0 +1,224 @@
+package plan
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/pricing"
+)
+
+// ─────────────────────────────────────────────
+// Subscription Plans
+//
+// Plans (free, supporter, premium, ...) are defined in config. Each may
+// include a number of tasks and/or GP per calendar month, which are then
+// not billed, a discount on the estimated GP (the tiered pricing
+// multiplier), its own result cache lifetime and its own rate limits.
+// Admins assign plans to users with an optional expiry; everyone else is
+// on the default plan.
+// ─────────────────────────────────────────────
+
+// Plan is one configured subscription level.
+type Plan struct {
+	Name          string        `json:"name"`
+	MonthlyParses int           `json:"monthly_parses"` // tasks included per month (0 = none)
+	MonthlyGP     int64         `json:"monthly_gp"`     // GP of tasks included per month (0 = none)
+	Discount      float64       `json:"discount"`       // multiplier on estimated GP (1 = full price)
+	CacheTTL      time.Duration `json:"-"`              // result cache lifetime
+
+	// Rate limits (0 = unlimited), see package ratelimit.
+	RequestsPerMinute int `json:"requests_per_minute"`
+	MaxInFlight       int `json:"max_in_flight"`
+	DailyParses       int `json:"daily_parses"`
+}
+
+// includes reports whether the plan covers any tasks at all.
+func (p *Plan) includes() bool {
+	return p.MonthlyParses > 0 || p.MonthlyGP > 0
+}
+
+// Subscription assigns a plan to a user. A user without one (or whose
+// subscription has expired) is on the default plan.
+type Subscription struct {
+	UserID    string     `json:"user_id" gorm:"primaryKey;size:64"`
+	Plan      string     `json:"plan" gorm:"size:32"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // nil = never
+	Note      string     `json:"note,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// Active reports whether the subscription is in force at now.
+func (s *Subscription) Active(now time.Time) bool {
+	return s.ExpiresAt == nil || now.Before(*s.ExpiresAt)
+}
+
+// Usage counts the included tasks a user consumed in one month.
+type Usage struct {
+	UserID string `gorm:"primaryKey;size:64"`
+	Period string `gorm:"primaryKey;size:7"` // YYYY-MM, server local time
+	Parses int
+	GP     int64
+}
+
+func (Usage) TableName() string { return "plan_usage" }
+
+// IncludedTask is a task paid for by the plan allowance instead of GP.
+// It is removed again (and the usage decremented) if the task fails.
+type IncludedTask struct {
+	TraceID   string `gorm:"primaryKey;size:64"`
+	UserID    string `gorm:"size:64;index"`
+	Period    string `gorm:"size:7"`
+	GP        int64
+	CreatedAt time.Time
+}
+
+// Status is a user's plan and this month's usage, shown in /api/v1/me.
+type Status struct {
+	Plan           string     `json:"plan"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	Discount       float64    `json:"discount"`
+	Period         string     `json:"period"`
+	ResetsAt       time.Time  `json:"resets_at"`
+	ParsesUsed     int        `json:"parses_used"`
+	ParsesIncluded int        `json:"parses_included"`
+	GPUsed         int64      `json:"gp_used"`
+	GPIncluded     int64      `json:"gp_included"`
+}
+
+// ─────────────────────────────────────────────
+// Construction from config
+// ─────────────────────────────────────────────
+
+// Load builds the plan table from cfg:
+//
+//	PLANS                     plan names
+//	PLAN_MONTHLY_PARSES       e.g. "supporter=100,premium=1000"
+//	PLAN_MONTHLY_GP           e.g. "supporter=50000"
+//	PLAN_DISCOUNT             e.g. "supporter=0.8" (any pricing policy)
+//	PLAN_CACHE_TTL            e.g. "premium=720h" (others use CACHE_TTL)
+//	PRICING_TIER_MULTIPLIERS  further discount when PRICING_POLICY=tiered
+//	PLAN_RATE_LIMIT_RPM       e.g. "premium=600" (others use RATE_LIMIT_RPM)
+//	PLAN_MAX_IN_FLIGHT        (others use RATE_LIMIT_MAX_IN_FLIGHT)
+//	PLAN_DAILY_PARSES         (others use RATE_LIMIT_DAILY_PARSES)
+//
+// The default plan (PRICING_DEFAULT_TIER) always exists.
+func Load(cfg *config.Config) (map[string]Plan, error) {
+	plans := make(map[string]Plan)
+	for _, name := range strings.Split(cfg.Plans+","+cfg.PricingDefaultTier, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			plans[name] = Plan{
+				Name:              name,
+				Discount:          1,
+				CacheTTL:          cfg.CacheTTL,
+				RequestsPerMinute: cfg.RateLimitRPM,
+				MaxInFlight:       cfg.RateLimitMaxInFlight,
+				DailyParses:       cfg.RateLimitDailyParses,
+			}
+		}
+	}
+
+	parses, err := parsePerPlan(cfg.PlanMonthlyParses, plans, strconv.Atoi)
+	if err != nil {
+		return nil, fmt.Errorf("PLAN_MONTHLY_PARSES: %w", err)
+	}
+	gp, err := parsePerPlan(cfg.PlanMonthlyGP, plans, func(v string) (int64, error) {
+		return strconv.ParseInt(v, 10, 64)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("PLAN_MONTHLY_GP: %w", err)
+	}
+	ttls, err := parsePerPlan(cfg.PlanCacheTTL, plans, time.ParseDuration)
+	if err != nil {
+		return nil, fmt.Errorf("PLAN_CACHE_TTL: %w", err)
+	}
+	for name, ttl := range ttls {
+		// Redis expiries are whole seconds: anything shorter becomes EX 0,
+		// which Redis rejects when the task completes.
+		if ttl < time.Second {
+			return nil, fmt.Errorf("PLAN_CACHE_TTL: %s for plan %q is shorter than 1s", ttl, name)
+		}
+	}
+	discounts, err := parsePerPlan(cfg.PlanDiscount, plans, func(v string) (float64, error) {
+		d, err := strconv.ParseFloat(v, 64)
+		if err == nil && d < 0 {
+			err = fmt.Errorf("negative discount")
+		}
+		return d, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("PLAN_DISCOUNT: %w", err)
+	}
+	rpm, err := parsePerPlan(cfg.PlanRateLimitRPM, plans, strconv.Atoi)
+	if err != nil {
+		return nil, fmt.Errorf("PLAN_RATE_LIMIT_RPM: %w", err)
+	}
+	inFlight, err := parsePerPlan(cfg.PlanMaxInFlight, plans, strconv.Atoi)
+	if err != nil {
+		return nil, fmt.Errorf("PLAN_MAX_IN_FLIGHT: %w", err)
+	}
+	daily, err := parsePerPlan(cfg.PlanDailyParses, plans, strconv.Atoi)
+	if err != nil {
+		return nil, fmt.Errorf("PLAN_DAILY_PARSES: %w", err)
+	}
+	tiers := map[string]float64{}
+	if cfg.PricingPolicy == "tiered" {
+		if tiers, err = pricing.ParseMultipliers(cfg.PricingTierMultipliers); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, p := range plans {
+		p.MonthlyParses = max(0, parses[name])
+		p.MonthlyGP = max(0, gp[name])
+		if ttl, ok := ttls[name]; ok {
+			p.CacheTTL = ttl
+		}
+		// The effective discount: both multipliers apply to the price.
+		if d, ok := discounts[name]; ok {
+			p.Discount = d
+		}
+		if m, ok := tiers[name]; ok {
+			p.Discount *= m
+		}
+		if v, ok := rpm[name]; ok {
+			p.RequestsPerMinute = max(0, v)
+		}
+		if v, ok := inFlight[name]; ok {
+			p.MaxInFlight = max(0, v)
+		}
+		if v, ok := daily[name]; ok {
+			p.DailyParses = max(0, v)
+		}
+		plans[name] = p
+	}
+	return plans, nil
+}
+
+// parsePerPlan parses "name=value,..." where every name must be a plan.
+func parsePerPlan[T any](s string, plans map[string]Plan, parse func(string) (T, error)) (map[string]T, error) {
+	out := make(map[string]T)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q (expected plan=value)", part)
+		}
+		name = strings.TrimSpace(name)
+		if _, ok := plans[name]; !ok {
+			return nil, fmt.Errorf("unknown plan %q (add it to PLANS)", name)
+		}
+		v, err := parse(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %q: %w", part, err)
+		}
+		out[name] = v
+	}
+	return out, nil
+}
@@ -0,0 +1,93 @@
+package plan
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+)
+
+func testConfig() config.Config {
+	return config.Config{
+		Plans:                "supporter,premium",
+		PricingDefaultTier:   "free",
+		PricingPolicy:        "size",
+		CacheTTL:             time.Hour,
+		RateLimitRPM:         60,
+		RateLimitMaxInFlight: 2,
+		RateLimitDailyParses: 100,
+	}
+}
+
+func TestLoad(t *testing.T) {
+	cfg := testConfig()
+	cfg.PricingPolicy = "tiered"
+	cfg.PricingTierMultipliers = "premium=0.5"
+	cfg.PlanMonthlyParses = "supporter=100, premium=1000"
+	cfg.PlanMonthlyGP = "premium=50000"
+	cfg.PlanDiscount = "supporter=0.8,premium=0.9"
+	cfg.PlanCacheTTL = "premium=720h"
+	cfg.PlanRateLimitRPM = "premium=0"
+	cfg.PlanMaxInFlight = "supporter=4"
+	cfg.PlanDailyParses = "supporter=-1"
+
+	plans, err := Load(&cfg)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	want := map[string]Plan{
+		"free": {Name: "free", Discount: 1, CacheTTL: time.Hour,
+			RequestsPerMinute: 60, MaxInFlight: 2, DailyParses: 100},
+		"supporter": {Name: "supporter", MonthlyParses: 100, Discount: 0.8, CacheTTL: time.Hour,
+			RequestsPerMinute: 60, MaxInFlight: 4, DailyParses: 0},
+		"premium": {Name: "premium", MonthlyParses: 1000, MonthlyGP: 50000, Discount: 0.45, CacheTTL: 720 * time.Hour,
+			RequestsPerMinute: 0, MaxInFlight: 2, DailyParses: 100},
+	}
+	if len(plans) != len(want) {
+		t.Fatalf("plans = %v, want %d", plans, len(want))
+	}
+	for name, w := range want {
+		if p := plans[name]; p != w {
+			t.Errorf("plan %s = %+v, want %+v", name, p, w)
+		}
+	}
+}
+
+func TestLoadTierMultipliersOnlyWhenTiered(t *testing.T) {
+	cfg := testConfig()
+	cfg.PricingTierMultipliers = "premium=0.5"
+	cfg.PlanDiscount = "premium=0.9"
+	plans, err := Load(&cfg)
+	if err != nil || plans["premium"].Discount != 0.9 {
+		t.Fatalf("premium = %+v, %v; want discount 0.9", plans["premium"], err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(c *config.Config)
+		wantErr string
+	}{
+		{"unknown plan", func(c *config.Config) { c.PlanMonthlyParses = "gold=1" }, `PLAN_MONTHLY_PARSES: unknown plan "gold"`},
+		{"missing value", func(c *config.Config) { c.PlanMonthlyGP = "premium" }, "PLAN_MONTHLY_GP: invalid entry"},
+		{"bad number", func(c *config.Config) { c.PlanRateLimitRPM = "premium=fast" }, "PLAN_RATE_LIMIT_RPM: invalid entry"},
+		{"bad duration", func(c *config.Config) { c.PlanCacheTTL = "premium=forever" }, "PLAN_CACHE_TTL: invalid entry"},
+		{"cache ttl under 1s", func(c *config.Config) { c.PlanCacheTTL = "premium=500ms" }, "shorter than 1s"},
+		{"negative discount", func(c *config.Config) { c.PlanDiscount = "premium=-0.5" }, "PLAN_DISCOUNT: invalid entry"},
+		{"bad tier multiplier", func(c *config.Config) {
+			c.PricingPolicy = "tiered"
+			c.PricingTierMultipliers = "premium"
+		}, "invalid tier multiplier"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			tt.set(&cfg)
+			if _, err := Load(&cfg); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Load = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
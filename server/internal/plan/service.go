@@ -0,0 +1,195 @@
+package plan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrUnknownPlan = errors.New("unknown plan")
+
+// Service resolves users' plans and meters the monthly allowance.
+// It implements pricing.TierResolver, so the tiered pricing policy
+// discounts by plan.
+type Service struct {
+	db          *gorm.DB
+	plans       map[string]Plan
+	defaultPlan string
+	now         func() time.Time
+}
+
+// NewService creates a plan service for the plans returned by Load.
+// defaultPlan must be one of them.
+func NewService(db *gorm.DB, plans map[string]Plan, defaultPlan string) *Service {
+	return &Service{db: db, plans: plans, defaultPlan: defaultPlan, now: time.Now}
+}
+
+// Plans returns the configured plans sorted by name.
+func (s *Service) Plans() []Plan {
+	out := make([]Plan, 0, len(s.plans))
+	for _, p := range s.plans {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Current returns the user's plan and the subscription granting it, or
+// the default plan and nil when the user has no active subscription.
+func (s *Service) Current(ctx context.Context, userID string) (Plan, *Subscription, error) {
+	var sub Subscription
+	err := s.db.WithContext(ctx).Where("user_id = ?", userID).Take(&sub).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return s.plans[s.defaultPlan], nil, nil
+	case err != nil:
+		return Plan{}, nil, err
+	}
+	p, ok := s.plans[sub.Plan]
+	if !ok || !sub.Active(s.now()) {
+		// Expired, or the plan was removed from config.
+		return s.plans[s.defaultPlan], nil, nil
+	}
+	return p, &sub, nil
+}
+
+// Tier returns the name of the user's plan (pricing.TierResolver).
+func (s *Service) Tier(ctx context.Context, userID string) (string, error) {
+	p, _, err := s.Current(ctx, userID)
+	return p.Name, err
+}
+
+// Assign puts the user on plan until expiresAt (nil = no expiry),
+// replacing any current subscription.
+func (s *Service) Assign(ctx context.Context, userID, plan string, expiresAt *time.Time, note string) (*Subscription, error) {
+	if _, ok := s.plans[plan]; !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownPlan, plan)
+	}
+	now := s.now()
+	sub := &Subscription{UserID: userID, Plan: plan, ExpiresAt: expiresAt, Note: note, CreatedAt: now, UpdatedAt: now}
+	err := s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"plan", "expires_at", "note", "updated_at"}),
+	}).Create(sub).Error
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Cancel removes the user's subscription. Returns false if there was none.
+func (s *Service) Cancel(ctx context.Context, userID string) (bool, error) {
+	res := s.db.WithContext(ctx).Delete(&Subscription{}, "user_id = ?", userID)
+	return res.RowsAffected > 0, res.Error
+}
+
+// Cover charges a task of gp estimated GP to the user's monthly allowance
+// under plan p. It returns false, leaving the usage unchanged, when the
+// plan includes nothing or the task would exceed the allowance; the task
+// is then billed normally.
+//
+// The check and increment are one conditional UPDATE on the month's usage
+// row, so concurrent tasks cannot overdraw the allowance.
+func (s *Service) Cover(ctx context.Context, p Plan, userID, traceID string, gp int) (bool, error) {
+	if !p.includes() {
+		return false, nil
+	}
+	now := s.now()
+	period := periodOf(now)
+
+	covered := false
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&Usage{UserID: userID, Period: period}).Error; err != nil {
+			return err
+		}
+		q := tx.Model(&Usage{}).Where("user_id = ? AND period = ?", userID, period)
+		if p.MonthlyParses > 0 {
+			q = q.Where("parses < ?", p.MonthlyParses)
+		}
+		if p.MonthlyGP > 0 {
+			q = q.Where("gp + ? <= ?", gp, p.MonthlyGP)
+		}
+		res := q.Updates(map[string]any{
+			"parses": gorm.Expr("parses + 1"),
+			"gp":     gorm.Expr("gp + ?", gp),
+		})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		covered = true
+		return tx.Create(&IncludedTask{TraceID: traceID, UserID: userID, Period: period, GP: int64(gp), CreatedAt: now}).Error
+	})
+	if err != nil {
+		return false, err
+	}
+	return covered, nil
+}
+
+// Release gives a failed task's allowance back. Tasks that were not
+// covered, or were already released, are ignored.
+func (s *Service) Release(ctx context.Context, traceID string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var it IncludedTask
+		err := tx.Where("trace_id = ?", traceID).Take(&it).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		res := tx.Delete(&IncludedTask{}, "trace_id = ?", traceID)
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		return tx.Model(&Usage{}).Where("user_id = ? AND period = ?", it.UserID, it.Period).
+			Updates(map[string]any{
+				"parses": gorm.Expr("parses - 1"),
+				"gp":     gorm.Expr("gp - ?", it.GP),
+			}).Error
+	})
+}
+
+// Status returns the user's plan and this month's usage.
+func (s *Service) Status(ctx context.Context, userID string) (*Status, error) {
+	p, sub, err := s.Current(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	st := &Status{
+		Plan:           p.Name,
+		Discount:       p.Discount,
+		Period:         periodOf(now),
+		ResetsAt:       nextPeriod(now),
+		ParsesIncluded: p.MonthlyParses,
+		GPIncluded:     p.MonthlyGP,
+	}
+	if sub != nil {
+		st.ExpiresAt = sub.ExpiresAt
+	}
+
+	var u Usage
+	err = s.db.WithContext(ctx).Where("user_id = ? AND period = ?", userID, st.Period).Take(&u).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	st.ParsesUsed, st.GPUsed = u.Parses, u.GP
+	return st, nil
+}
+
+// periodOf returns the usage period (calendar month) containing t.
+func periodOf(t time.Time) string {
+	return t.Format("2006-01")
+}
+
+// nextPeriod returns the start of the month after t.
+func nextPeriod(t time.Time) time.Time {
+	y, m, _ := t.Date()
+	return time.Date(y, m+1, 1, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,165 @@
+package plan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/dbtest"
+)
+
+// newTestService returns a service whose clock is at noon on 2026-03-10
+// and moves with advance.
+func newTestService(t *testing.T, plans ...Plan) (s *Service, advance func(time.Duration)) {
+	t.Helper()
+	db := dbtest.Open(t, &Subscription{}, &Usage{}, &IncludedTask{})
+	table := map[string]Plan{"free": {Name: "free", Discount: 1}}
+	for _, p := range plans {
+		table[p.Name] = p
+	}
+	s = NewService(db, table, "free")
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.Local)
+	s.now = func() time.Time { return now }
+	return s, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestCurrent(t *testing.T) {
+	s, advance := newTestService(t, Plan{Name: "premium", Discount: 0.5})
+	ctx := context.Background()
+	tier := func() string {
+		t.Helper()
+		name, err := s.Tier(ctx, "u1")
+		if err != nil {
+			t.Fatalf("Tier: %v", err)
+		}
+		return name
+	}
+
+	if got := tier(); got != "free" {
+		t.Fatalf("tier without subscription = %q, want free", got)
+	}
+	if _, err := s.Assign(ctx, "u1", "gold", nil, ""); !errors.Is(err, ErrUnknownPlan) {
+		t.Fatalf("assign unknown plan = %v, want ErrUnknownPlan", err)
+	}
+	expires := s.now().Add(24 * time.Hour)
+	if _, err := s.Assign(ctx, "u1", "premium", &expires, "gift"); err != nil {
+		t.Fatalf("assign: %v", err)
+	}
+	if got := tier(); got != "premium" {
+		t.Fatalf("tier while subscribed = %q, want premium", got)
+	}
+	advance(24 * time.Hour)
+	if got := tier(); got != "free" {
+		t.Fatalf("tier after expiry = %q, want free", got)
+	}
+
+	// Assigning again replaces the subscription.
+	if _, err := s.Assign(ctx, "u1", "premium", nil, ""); err != nil || tier() != "premium" {
+		t.Fatalf("reassign: %v, tier %q", err, tier())
+	}
+	if ok, err := s.Cancel(ctx, "u1"); !ok || err != nil || tier() != "free" {
+		t.Fatalf("cancel = %v, %v; tier %q", ok, err, tier())
+	}
+	if ok, _ := s.Cancel(ctx, "u1"); ok {
+		t.Fatal("cancelled a missing subscription")
+	}
+}
+
+func TestCover(t *testing.T) {
+	tests := []struct {
+		name        string
+		plan        Plan
+		tasks       []int // estimated GP of consecutive tasks
+		wantCovered []bool
+	}{
+		{"nothing included", Plan{Name: "p"}, []int{10}, []bool{false}},
+		{"parses", Plan{Name: "p", MonthlyParses: 2}, []int{10, 1000, 1}, []bool{true, true, false}},
+		{"gp", Plan{Name: "p", MonthlyGP: 100}, []int{60, 50, 40, 1}, []bool{true, false, true, false}},
+		{"both", Plan{Name: "p", MonthlyParses: 2, MonthlyGP: 100}, []int{10, 200, 10, 10}, []bool{true, false, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestService(t, tt.plan)
+			for i, gp := range tt.tasks {
+				covered, err := s.Cover(context.Background(), tt.plan, "u1", fmt.Sprint("t", i), gp)
+				if err != nil || covered != tt.wantCovered[i] {
+					t.Fatalf("task %d (%d GP): covered = %v, %v; want %v", i, gp, covered, err, tt.wantCovered[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCoverConcurrent(t *testing.T) {
+	p := Plan{Name: "p", MonthlyParses: 3}
+	s, _ := newTestService(t, p)
+
+	const attempts = 10
+	var wg sync.WaitGroup
+	covered := make(chan bool, attempts)
+	for i := range attempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := s.Cover(context.Background(), p, "u1", fmt.Sprint("t", i), 1)
+			if err != nil {
+				t.Errorf("cover: %v", err)
+			}
+			covered <- ok
+		}()
+	}
+	wg.Wait()
+	close(covered)
+
+	n := 0
+	for ok := range covered {
+		if ok {
+			n++
+		}
+	}
+	if n != 3 {
+		t.Fatalf("%d concurrent tasks covered, want the allowance of 3", n)
+	}
+}
+
+func TestReleaseAndStatus(t *testing.T) {
+	p := Plan{Name: "p", MonthlyParses: 2, MonthlyGP: 100, Discount: 0.8}
+	s, advance := newTestService(t, p)
+	ctx := context.Background()
+	if _, err := s.Assign(ctx, "u1", "p", nil, ""); err != nil {
+		t.Fatalf("assign: %v", err)
+	}
+	status := func() *Status {
+		t.Helper()
+		st, err := s.Status(ctx, "u1")
+		if err != nil {
+			t.Fatalf("Status: %v", err)
+		}
+		return st
+	}
+
+	s.Cover(ctx, p, "u1", "a", 30)
+	s.Cover(ctx, p, "u1", "b", 40)
+	if st := status(); st.ParsesUsed != 2 || st.GPUsed != 70 || st.Period != "2026-03" || st.Discount != 0.8 {
+		t.Fatalf("status = %+v", st)
+	}
+
+	// Releasing twice, or a task that was never covered, gives back once.
+	for _, trace := range []string{"a", "a", "unknown"} {
+		if err := s.Release(ctx, trace); err != nil {
+			t.Fatalf("release %s: %v", trace, err)
+		}
+	}
+	if st := status(); st.ParsesUsed != 1 || st.GPUsed != 40 {
+		t.Fatalf("status after release = %+v", st)
+	}
+
+	// The allowance resets with the calendar month.
+	advance(24 * 24 * time.Hour)
+	if st := status(); st.Period != "2026-04" || st.ParsesUsed != 0 || !st.ResetsAt.Equal(time.Date(2026, 5, 1, 0, 0, 0, 0, time.Local)) {
+		t.Fatalf("status next month = %+v", st)
+	}
+}
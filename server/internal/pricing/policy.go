@@ -0,0 +1,220 @@
+package pricing
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+)
+
+const bytesPerMB = 1000000
+
+// ─────────────────────────────────────────────
+// SizePolicy: GP proportional to archive size
+// ─────────────────────────────────────────────
+
+// SizePolicy charges GPPerMB per megabyte (+1), multiplied by
+// OldMultiplier for galleries outside the new-gallery window.
+// This mirrors E-Hentai's own archive pricing.
+type SizePolicy struct {
+	GPPerMB       int
+	OldMultiplier int
+}
+
+func (p *SizePolicy) Estimate(_ context.Context, _ string, g *Gallery) (int, error) {
+	mbSize := float64(g.Filesize) / float64(bytesPerMB)
+	gp := int(mbSize*float64(p.GPPerMB)) + 1
+	if !g.IsNew {
+		gp *= p.OldMultiplier
+	}
+	return gp, nil
+}
+
+// Actual passes the node-reported GP through unchanged.
+func (p *SizePolicy) Actual(_ context.Context, _ string, actualGP int) (int, error) {
+	return actualGP, nil
+}
+
+// ─────────────────────────────────────────────
+// FixedPolicy: flat price per gallery
+// ─────────────────────────────────────────────
+
+// FixedPolicy charges the same GP for every gallery.
+type FixedPolicy struct {
+	GP int
+}
+
+func (p *FixedPolicy) Estimate(context.Context, string, *Gallery) (int, error) {
+	return p.GP, nil
+}
+
+func (p *FixedPolicy) Actual(context.Context, string, int) (int, error) {
+	return p.GP, nil
+}
+
+// ─────────────────────────────────────────────
+// PassThroughPolicy: actual GP plus a margin
+// ─────────────────────────────────────────────
+
+// PassThroughPolicy freezes the base estimate plus Margin and charges
+// the node-reported GP plus Margin (e.g. 0.1 = +10%).
+// Pair it with SettleActual or SettleMin.
+type PassThroughPolicy struct {
+	Base   Policy
+	Margin float64
+}
+
+func (p *PassThroughPolicy) Estimate(ctx context.Context, userID string, g *Gallery) (int, error) {
+	gp, err := p.Base.Estimate(ctx, userID, g)
+	if err != nil {
+		return 0, err
+	}
+	return scale(gp, 1+p.Margin), nil
+}
+
+func (p *PassThroughPolicy) Actual(_ context.Context, _ string, actualGP int) (int, error) {
+	return scale(actualGP, 1+p.Margin), nil
+}
+
+// ─────────────────────────────────────────────
+// TieredPolicy: per-plan multiplier on a base policy
+// ─────────────────────────────────────────────
+
+// TierResolver maps a user to a pricing tier name.
+type TierResolver interface {
+	Tier(ctx context.Context, userID string) (string, error)
+}
+
+// TierResolverFunc adapts a function to TierResolver.
+type TierResolverFunc func(ctx context.Context, userID string) (string, error)
+
+func (f TierResolverFunc) Tier(ctx context.Context, userID string) (string, error) {
+	return f(ctx, userID)
+}
+
+// TieredPolicy scales a base policy by the multiplier of the user's tier.
+// Users whose tier has no configured multiplier pay the base price.
+type TieredPolicy struct {
+	Base        Policy
+	Resolver    TierResolver
+	Multipliers map[string]float64
+}
+
+func (p *TieredPolicy) Estimate(ctx context.Context, userID string, g *Gallery) (int, error) {
+	gp, err := p.Base.Estimate(ctx, userID, g)
+	if err != nil {
+		return 0, err
+	}
+	m, err := p.multiplier(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	return scale(gp, m), nil
+}
+
+func (p *TieredPolicy) Actual(ctx context.Context, userID string, actualGP int) (int, error) {
+	gp, err := p.Base.Actual(ctx, userID, actualGP)
+	if err != nil {
+		return 0, err
+	}
+	m, err := p.multiplier(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	return scale(gp, m), nil
+}
+
+func (p *TieredPolicy) multiplier(ctx context.Context, userID string) (float64, error) {
+	tier, err := p.Resolver.Tier(ctx, userID)
+	if err != nil {
+		return 0, fmt.Errorf("resolve tier: %w", err)
+	}
+	if m, ok := p.Multipliers[tier]; ok {
+		return m, nil
+	}
+	return 1, nil
+}
+
+// ─────────────────────────────────────────────
+// Construction from config
+// ─────────────────────────────────────────────
+
+// New builds the pricing engine selected by cfg.PricingPolicy, scaled by
+// the per-plan cfg.PlanDiscount whatever the policy. tiers resolves user
+// tiers (plans) for the "tiered" policy and the plan discount; when nil
+// every user is placed in cfg.PricingDefaultTier.
+func New(cfg *config.Config, tiers TierResolver) (*Engine, error) {
+	mode, err := ParseSettlementMode(cfg.SettlementMode)
+	if err != nil {
+		return nil, err
+	}
+	if tiers == nil {
+		defaultTier := cfg.PricingDefaultTier
+		tiers = TierResolverFunc(func(context.Context, string) (string, error) {
+			return defaultTier, nil
+		})
+	}
+
+	size := &SizePolicy{
+		GPPerMB:       cfg.PricingGPPerMB,
+		OldMultiplier: cfg.PricingOldMultiplier,
+	}
+
+	var policy Policy
+	switch cfg.PricingPolicy {
+	case "size":
+		policy = size
+	case "fixed":
+		policy = &FixedPolicy{GP: cfg.PricingFixedGP}
+	case "passthrough":
+		policy = &PassThroughPolicy{Base: size, Margin: cfg.PricingMargin}
+	case "tiered":
+		multipliers, err := ParseMultipliers(cfg.PricingTierMultipliers)
+		if err != nil {
+			return nil, err
+		}
+		policy = &TieredPolicy{Base: size, Resolver: tiers, Multipliers: multipliers}
+	default:
+		return nil, fmt.Errorf("unknown pricing policy %q (expected size, fixed, passthrough or tiered)", cfg.PricingPolicy)
+	}
+
+	discounts, err := ParseMultipliers(cfg.PlanDiscount)
+	if err != nil {
+		return nil, fmt.Errorf("PLAN_DISCOUNT: %w", err)
+	}
+	if len(discounts) > 0 {
+		policy = &TieredPolicy{Base: policy, Resolver: tiers, Multipliers: discounts}
+	}
+
+	return NewEngine(policy, mode, cfg.PricingNewGalleryAge), nil
+}
+
+// ParseMultipliers parses "free=1,supporter=0.8,premium=0.5".
+func ParseMultipliers(s string) (map[string]float64, error) {
+	out := make(map[string]float64)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tier multiplier %q (expected name=value)", part)
+		}
+		m, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || m < 0 {
+			return nil, fmt.Errorf("invalid tier multiplier %q", part)
+		}
+		out[strings.TrimSpace(name)] = m
+	}
+	return out, nil
+}
+
+// scale multiplies gp by m, rounding up so fractional GP is never lost.
+// The epsilon absorbs float noise (100 * 1.1 = 110.00000000000001).
+func scale(gp int, m float64) int {
+	return int(math.Ceil(float64(gp)*m - 1e-9))
+}
@@ -0,0 +1,120 @@
+package pricing
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ─────────────────────────────────────────────
+// Pricing Engine
+//
+// Turns upstream gallery metadata into the GP frozen for a task
+// (Estimate) and the node-reported GP into the GP actually charged
+// (Actual). The settlement mode decides which of the two is deducted.
+// ─────────────────────────────────────────────
+
+// Gallery is the upstream metadata a price is computed from.
+type Gallery struct {
+	GalleryID string
+	Posted    time.Time
+	Filesize  int64 // bytes
+	IsNew     bool  // posted within the new-gallery window (set by Engine)
+}
+
+// Quote is the priced result for a single gallery.
+type Quote struct {
+	FreeTier bool // new gallery: nodes with free archive quota can take it at no cost
+	GP       int  // estimated GP to freeze
+}
+
+// Policy computes user-facing GP prices.
+type Policy interface {
+	// Estimate returns the GP to freeze before the task is dispatched.
+	Estimate(ctx context.Context, userID string, g *Gallery) (int, error)
+
+	// Actual converts the GP a node reports having spent into the
+	// price charged to the user (before the settlement mode is applied).
+	Actual(ctx context.Context, userID string, actualGP int) (int, error)
+}
+
+// SettlementMode selects how a completed task is charged.
+type SettlementMode string
+
+const (
+	SettleEstimate SettlementMode = "estimate" // always charge the frozen estimate
+	SettleActual   SettlementMode = "actual"   // charge the actual price
+	SettleMin      SettlementMode = "min"      // charge min(estimate, actual)
+)
+
+// ParseSettlementMode validates a settlement mode string.
+func ParseSettlementMode(s string) (SettlementMode, error) {
+	switch m := SettlementMode(s); m {
+	case SettleEstimate, SettleActual, SettleMin:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown settlement mode %q (expected estimate, actual or min)", s)
+	}
+}
+
+// Charge picks the amount to deduct. The result never exceeds the frozen
+// amount: users are never billed more than they agreed to at freeze time.
+func (m SettlementMode) Charge(frozen, actual int64) int64 {
+	charge := frozen
+	switch m {
+	case SettleActual:
+		charge = actual
+	case SettleMin:
+		charge = min(frozen, actual)
+	}
+	return max(0, min(charge, frozen))
+}
+
+// Engine combines a Policy with the settlement mode and new-gallery window.
+type Engine struct {
+	policy        Policy
+	mode          SettlementMode
+	newGalleryAge time.Duration
+}
+
+// NewEngine creates a pricing engine.
+func NewEngine(policy Policy, mode SettlementMode, newGalleryAge time.Duration) *Engine {
+	return &Engine{
+		policy:        policy,
+		mode:          mode,
+		newGalleryAge: newGalleryAge,
+	}
+}
+
+// Mode returns the configured settlement mode.
+func (e *Engine) Mode() SettlementMode {
+	return e.mode
+}
+
+// Quote prices a gallery for the given user.
+func (e *Engine) Quote(ctx context.Context, userID string, g *Gallery) (*Quote, error) {
+	priced := *g
+	priced.IsNew = time.Since(g.Posted) < e.newGalleryAge
+
+	gp, err := e.policy.Estimate(ctx, userID, &priced)
+	if err != nil {
+		return nil, fmt.Errorf("estimate: %w", err)
+	}
+	return &Quote{
+		FreeTier: priced.IsNew,
+		GP:       gp,
+	}, nil
+}
+
+// Charge returns the GP to deduct for a completed task whose estimate
+// was frozen and whose node reported actualGP.
+func (e *Engine) Charge(ctx context.Context, userID string, frozen int64, actualGP int) (int64, error) {
+	if e.mode == SettleEstimate {
+		return e.mode.Charge(frozen, frozen), nil
+	}
+	actual, err := e.policy.Actual(ctx, userID, actualGP)
+	if err != nil {
+		return frozen, fmt.Errorf("actual price: %w", err)
+	}
+	return e.mode.Charge(frozen, int64(actual)), nil
+}
@@ -0,0 +1,195 @@
+package pricing
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+)
+
+// tierOf places users in tiers by ID; unknown users are "free".
+func tierOf(tiers map[string]string) TierResolver {
+	return TierResolverFunc(func(_ context.Context, userID string) (string, error) {
+		if t, ok := tiers[userID]; ok {
+			return t, nil
+		}
+		return "free", nil
+	})
+}
+
+func TestPolicies(t *testing.T) {
+	ctx := context.Background()
+	size := &SizePolicy{GPPerMB: 10, OldMultiplier: 3}
+	tiered := &TieredPolicy{
+		Base:        size,
+		Resolver:    tierOf(map[string]string{"vip": "premium", "sup": "supporter"}),
+		Multipliers: map[string]float64{"premium": 0.5, "supporter": 0.8},
+	}
+
+	tests := []struct {
+		name         string
+		policy       Policy
+		user         string
+		gallery      Gallery
+		wantEstimate int
+		actual       int // node-reported GP
+		wantActual   int
+	}{
+		{"size new", size, "u", Gallery{Filesize: 2500000, IsNew: true}, 26, 40, 40},
+		{"size old", size, "u", Gallery{Filesize: 2500000}, 78, 40, 40},
+		{"size empty", size, "u", Gallery{IsNew: true}, 1, 0, 0},
+		{"fixed", &FixedPolicy{GP: 50}, "u", Gallery{Filesize: 9e8}, 50, 1234, 50},
+		{"passthrough rounds up", &PassThroughPolicy{Base: size, Margin: 0.1}, "u", Gallery{Filesize: 2500000, IsNew: true}, 29, 100, 110},
+		{"passthrough no margin", &PassThroughPolicy{Base: size}, "u", Gallery{Filesize: 2500000, IsNew: true}, 26, 7, 7},
+		{"tiered premium", tiered, "vip", Gallery{Filesize: 2500000, IsNew: true}, 13, 41, 21},
+		{"tiered supporter", tiered, "sup", Gallery{Filesize: 2500000}, 63, 10, 8},
+		{"tiered without multiplier", tiered, "u", Gallery{Filesize: 2500000}, 78, 40, 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := tt.gallery
+			if gp, err := tt.policy.Estimate(ctx, tt.user, &g); err != nil || gp != tt.wantEstimate {
+				t.Fatalf("Estimate = %d, %v; want %d", gp, err, tt.wantEstimate)
+			}
+			if gp, err := tt.policy.Actual(ctx, tt.user, tt.actual); err != nil || gp != tt.wantActual {
+				t.Fatalf("Actual(%d) = %d, %v; want %d", tt.actual, gp, err, tt.wantActual)
+			}
+		})
+	}
+}
+
+func TestTieredPolicyResolverError(t *testing.T) {
+	boom := errors.New("boom")
+	p := &TieredPolicy{
+		Base:     &FixedPolicy{GP: 10},
+		Resolver: TierResolverFunc(func(context.Context, string) (string, error) { return "", boom }),
+	}
+	if _, err := p.Estimate(context.Background(), "u", &Gallery{}); !errors.Is(err, boom) {
+		t.Fatalf("Estimate = %v, want resolver error", err)
+	}
+	if _, err := p.Actual(context.Background(), "u", 10); !errors.Is(err, boom) {
+		t.Fatalf("Actual = %v, want resolver error", err)
+	}
+}
+
+func TestSettlementModeCharge(t *testing.T) {
+	tests := []struct {
+		mode           SettlementMode
+		frozen, actual int64
+		want           int64
+	}{
+		{SettleEstimate, 100, 40, 100},
+		{SettleEstimate, 100, 400, 100},
+		{SettleActual, 100, 40, 40},
+		{SettleActual, 100, 400, 100}, // never more than frozen
+		{SettleActual, 100, -5, 0},
+		{SettleMin, 100, 40, 40},
+		{SettleMin, 100, 400, 100},
+	}
+	for _, tt := range tests {
+		if got := tt.mode.Charge(tt.frozen, tt.actual); got != tt.want {
+			t.Errorf("%s.Charge(%d, %d) = %d, want %d", tt.mode, tt.frozen, tt.actual, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{"estimate", "actual", "min"} {
+		if m, err := ParseSettlementMode(s); err != nil || string(m) != s {
+			t.Errorf("ParseSettlementMode(%q) = %q, %v", s, m, err)
+		}
+	}
+	if _, err := ParseSettlementMode("max"); err == nil {
+		t.Error("ParseSettlementMode(max) accepted")
+	}
+}
+
+func TestParseMultipliers(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{"", map[string]float64{}, false},
+		{"free=1, supporter = 0.8 ,premium=0.5,", map[string]float64{"free": 1, "supporter": 0.8, "premium": 0.5}, false},
+		{"free=0", map[string]float64{"free": 0}, false},
+		{"free", nil, true},
+		{"free=cheap", nil, true},
+		{"free=-1", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMultipliers(tt.in)
+		if (err != nil) != tt.wantErr || !maps.Equal(got, tt.want) {
+			t.Errorf("ParseMultipliers(%q) = %v, %v; want %v, err %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	ctx := context.Background()
+	base := config.Config{
+		SettlementMode:         "actual",
+		PricingGPPerMB:         10,
+		PricingOldMultiplier:   3,
+		PricingFixedGP:         50,
+		PricingTierMultipliers: "premium=0.5",
+		PricingDefaultTier:     "premium",
+		PricingNewGalleryAge:   24 * time.Hour,
+	}
+	resolver := tierOf(map[string]string{"vip": "premium"})
+	fresh := &Gallery{Filesize: 2500000, Posted: time.Now()}
+	old := &Gallery{Filesize: 2500000, Posted: time.Now().Add(-48 * time.Hour)}
+
+	tests := []struct {
+		name       string
+		policy     string
+		discount   string
+		tiers      TierResolver
+		user       string
+		gallery    *Gallery
+		wantGP     int
+		wantCharge int64 // for a node report of 20 GP against the quote
+	}{
+		{"size", "size", "", resolver, "u", fresh, 26, 20},
+		{"size old gallery", "size", "", resolver, "u", old, 78, 20},
+		{"fixed", "fixed", "", resolver, "u", fresh, 50, 50},
+		{"passthrough", "passthrough", "", resolver, "u", fresh, 26, 20},
+		{"tiered", "tiered", "", resolver, "vip", fresh, 13, 10},
+		{"tiered default tier", "tiered", "", nil, "u", fresh, 13, 10},
+		{"discount", "fixed", "premium=0.8", resolver, "vip", fresh, 40, 40},
+		{"discount other plan", "fixed", "premium=0.8", resolver, "u", fresh, 50, 50},
+		{"discount on tiered", "tiered", "premium=0.8", resolver, "vip", fresh, 11, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			cfg.PricingPolicy = tt.policy
+			cfg.PlanDiscount = tt.discount
+			e, err := New(&cfg, tt.tiers)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			q, err := e.Quote(ctx, tt.user, tt.gallery)
+			if err != nil || q.GP != tt.wantGP || q.FreeTier != (tt.gallery == fresh) {
+				t.Fatalf("Quote = %+v, %v; want %d GP", q, err, tt.wantGP)
+			}
+			if c, err := e.Charge(ctx, tt.user, int64(q.GP), 20); err != nil || c != tt.wantCharge {
+				t.Fatalf("Charge = %d, %v; want %d", c, err, tt.wantCharge)
+			}
+		})
+	}
+
+	for _, bad := range []func(*config.Config){
+		func(c *config.Config) { c.PricingPolicy = "auction" },
+		func(c *config.Config) { c.PricingPolicy = "size"; c.SettlementMode = "max" },
+		func(c *config.Config) { c.PricingPolicy = "tiered"; c.PricingTierMultipliers = "premium" },
+		func(c *config.Config) { c.PricingPolicy = "size"; c.PlanDiscount = "premium=-1" },
+	} {
+		cfg := base
+		bad(&cfg)
+		if _, err := New(&cfg, nil); err == nil {
+			t.Errorf("New(%+v) accepted", cfg)
+		}
+	}
+}
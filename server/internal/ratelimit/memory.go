@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryCounter is an in-process Counter for single-instance deployments
+// without Redis. Expired windows are dropped lazily.
+type MemoryCounter struct {
+	mu        sync.Mutex
+	hits      map[string]memoryWindow
+	slots     map[string]map[string]time.Time // key → token → acquired at
+	lastSweep time.Time
+}
+
+type memoryWindow struct {
+	count int
+	reset time.Time
+}
+
+// NewMemoryCounter creates an empty counter.
+func NewMemoryCounter() *MemoryCounter {
+	return &MemoryCounter{
+		hits:  make(map[string]memoryWindow),
+		slots: make(map[string]map[string]time.Time),
+	}
+}
+
+// Hit increments a fixed-window counter.
+func (c *MemoryCounter) Hit(_ context.Context, key string, reset time.Time) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.sweep(now)
+
+	w := c.hits[key]
+	if !now.Before(w.reset) {
+		w = memoryWindow{reset: reset}
+	}
+	w.count++
+	c.hits[key] = w
+	return w.count, nil
+}
+
+// Acquire takes a slot unless limit live slots are held.
+func (c *MemoryCounter) Acquire(_ context.Context, key, token string, limit int, ttl time.Duration) (bool, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	held := c.slots[key]
+	for t, at := range held {
+		if now.Sub(at) >= ttl {
+			delete(held, t)
+		}
+	}
+	if len(held) >= limit {
+		return false, len(held), nil
+	}
+	if held == nil {
+		held = make(map[string]time.Time)
+		c.slots[key] = held
+	}
+	held[token] = now
+	return true, len(held), nil
+}
+
+// Release frees the slot.
+func (c *MemoryCounter) Release(_ context.Context, key, token string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.slots[key], token)
+	if len(c.slots[key]) == 0 {
+		delete(c.slots, key)
+	}
+	return nil
+}
+
+// sweep removes expired windows at most once a minute. Caller holds mu.
+func (c *MemoryCounter) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+	for key, w := range c.hits {
+		if !now.Before(w.reset) {
+			delete(c.hits, key)
+		}
+	}
+}
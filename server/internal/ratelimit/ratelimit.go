@@ -0,0 +1,288 @@
+// Package ratelimit caps how hard one user can drive the API: requests per
+// minute on every authenticated endpoint, plus concurrent and daily parses
+// on POST /api/v1/parse.
+//
+// Limits come from the user's plan (config) unless an admin has set a
+// per-user override. Counters live in Redis so every instance enforces the
+// same budget; without Redis they are kept in process.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/plan"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Limits caps one user. Zero disables a limit.
+type Limits struct {
+	RequestsPerMinute int `json:"requests_per_minute"`
+	MaxInFlight       int `json:"max_in_flight"` // concurrent POST /parse requests
+	DailyParses       int `json:"daily_parses"`  // POST /parse requests per day (server local time)
+}
+
+// Override replaces some of a user's plan limits. Nil fields inherit from
+// the plan.
+type Override struct {
+	UserID            string    `json:"user_id" gorm:"primaryKey;size:64"`
+	RequestsPerMinute *int      `json:"requests_per_minute"`
+	MaxInFlight       *int      `json:"max_in_flight"`
+	DailyParses       *int      `json:"daily_parses"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+func (Override) TableName() string { return "rate_limit_overrides" }
+
+// apply returns lim with the override's fields replaced.
+func (o *Override) apply(lim Limits) Limits {
+	if o.RequestsPerMinute != nil {
+		lim.RequestsPerMinute = *o.RequestsPerMinute
+	}
+	if o.MaxInFlight != nil {
+		lim.MaxInFlight = *o.MaxInFlight
+	}
+	if o.DailyParses != nil {
+		lim.DailyParses = *o.DailyParses
+	}
+	return lim
+}
+
+// Decision is the outcome of a check against one limit, reported to the
+// client in X-RateLimit-* headers. Limit is 0 when nothing applied.
+type Decision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Time     // when the window resets (zero for in-flight)
+	RetryAfter time.Duration // set when !Allowed
+	Reason     string        // which limit was hit
+}
+
+// ─────────────────────────────────────────────
+// Counter backends
+// ─────────────────────────────────────────────
+
+// Counter stores the shared counts.
+type Counter interface {
+	// Hit counts one event under key, which expires at reset, and returns
+	// the count including this event.
+	Hit(ctx context.Context, key string, reset time.Time) (int, error)
+
+	// Acquire adds token to the slot set under key if fewer than limit
+	// slots are held. Slots older than ttl are dropped first, so a crashed
+	// instance cannot leak them. Returns whether the slot was taken and
+	// how many are held.
+	Acquire(ctx context.Context, key, token string, limit int, ttl time.Duration) (bool, int, error)
+
+	// Release frees a slot taken by Acquire.
+	Release(ctx context.Context, key, token string) error
+}
+
+// NewCounter returns a Redis counter shared by all instances, or an
+// in-process one when running without Redis.
+func NewCounter(cfg *config.Config, rdb *redis.Client) Counter {
+	if cfg.SchedulerBackend == "memory" || rdb == nil {
+		return NewMemoryCounter()
+	}
+	return NewRedisCounter(rdb)
+}
+
+// ─────────────────────────────────────────────
+// Limiter
+// ─────────────────────────────────────────────
+
+// limitsCacheTTL bounds how long another instance keeps using a user's
+// old limits after an admin changes their plan or override.
+const limitsCacheTTL = 30 * time.Second
+
+// Limiter resolves limits and checks them against a Counter.
+type Limiter struct {
+	db          *gorm.DB
+	plans       *plan.Service
+	counter     Counter
+	inFlightTTL time.Duration  // slot lifetime: the longest a parse can wait
+	day         *time.Location // zone whose calendar days the daily parse limit counts
+	now         func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cachedLimits
+}
+
+type cachedLimits struct {
+	limits  Limits
+	expires time.Time
+}
+
+// NewLimiter creates a limiter. inFlightTTL should exceed the longest a
+// parse request can run (TaskWaitTimeout); day is the zone whose midnight
+// resets the daily parse limit (the check-in zone, so both reset together).
+func NewLimiter(db *gorm.DB, plans *plan.Service, counter Counter, inFlightTTL time.Duration, day *time.Location) *Limiter {
+	return &Limiter{
+		db:          db,
+		plans:       plans,
+		counter:     counter,
+		inFlightTTL: inFlightTTL,
+		day:         day,
+		now:         time.Now,
+		cache:       make(map[string]cachedLimits),
+	}
+}
+
+// Limits returns the user's effective limits: the plan's, with any
+// override applied.
+func (l *Limiter) Limits(ctx context.Context, userID string) (Limits, error) {
+	now := l.now()
+	l.mu.Lock()
+	if c, ok := l.cache[userID]; ok && now.Before(c.expires) {
+		l.mu.Unlock()
+		return c.limits, nil
+	}
+	l.mu.Unlock()
+
+	p, _, err := l.plans.Current(ctx, userID)
+	if err != nil {
+		return Limits{}, err
+	}
+	lim := Limits{
+		RequestsPerMinute: p.RequestsPerMinute,
+		MaxInFlight:       p.MaxInFlight,
+		DailyParses:       p.DailyParses,
+	}
+	o, err := l.Override(ctx, userID)
+	if err != nil {
+		return Limits{}, err
+	}
+	if o != nil {
+		lim = o.apply(lim)
+	}
+
+	l.mu.Lock()
+	if len(l.cache) >= 10000 {
+		clear(l.cache)
+	}
+	l.cache[userID] = cachedLimits{limits: lim, expires: now.Add(limitsCacheTTL)}
+	l.mu.Unlock()
+	return lim, nil
+}
+
+// Invalidate drops the user's cached limits on this instance.
+func (l *Limiter) Invalidate(userID string) {
+	l.mu.Lock()
+	delete(l.cache, userID)
+	l.mu.Unlock()
+}
+
+// Override returns the user's override, or nil.
+func (l *Limiter) Override(ctx context.Context, userID string) (*Override, error) {
+	var o Override
+	err := l.db.WithContext(ctx).Where("user_id = ?", userID).Take(&o).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// SetOverride stores o, replacing the user's previous override.
+func (l *Limiter) SetOverride(ctx context.Context, o *Override) error {
+	o.UpdatedAt = l.now()
+	err := l.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"requests_per_minute", "max_in_flight", "daily_parses", "updated_at"}),
+	}).Create(o).Error
+	l.Invalidate(o.UserID)
+	return err
+}
+
+// ClearOverride removes the user's override. Returns false if there was
+// none.
+func (l *Limiter) ClearOverride(ctx context.Context, userID string) (bool, error) {
+	res := l.db.WithContext(ctx).Delete(&Override{}, "user_id = ?", userID)
+	l.Invalidate(userID)
+	return res.RowsAffected > 0, res.Error
+}
+
+// AllowRequest counts one API request against the per-minute limit
+// (fixed one-minute windows).
+func (l *Limiter) AllowRequest(ctx context.Context, userID string) (Decision, error) {
+	lim, err := l.Limits(ctx, userID)
+	if err != nil || lim.RequestsPerMinute <= 0 {
+		return Decision{Allowed: true}, err
+	}
+	now := l.now()
+	reset := now.Truncate(time.Minute).Add(time.Minute)
+	key := "rpm:" + userID + ":" + now.Format("200601021504")
+	return l.hit(ctx, key, lim.RequestsPerMinute, now, reset, "requests per minute")
+}
+
+// BeginParse admits a parse request against the in-flight and daily
+// limits. When allowed, the caller must call release once the request
+// has finished.
+func (l *Limiter) BeginParse(ctx context.Context, userID string) (d Decision, release func(), err error) {
+	release = func() {}
+	lim, err := l.Limits(ctx, userID)
+	if err != nil {
+		return Decision{Allowed: true}, release, err
+	}
+
+	d = Decision{Allowed: true}
+	if lim.MaxInFlight > 0 {
+		key, token := "inflight:"+userID, uuid.NewString()
+		ok, held, err := l.counter.Acquire(ctx, key, token, lim.MaxInFlight, l.inFlightTTL)
+		if err != nil {
+			return Decision{Allowed: true}, release, err
+		}
+		if !ok {
+			return Decision{
+				Limit:      lim.MaxInFlight,
+				RetryAfter: time.Second,
+				Reason:     "parse requests in flight",
+			}, release, nil
+		}
+		d = Decision{Allowed: true, Limit: lim.MaxInFlight, Remaining: lim.MaxInFlight - held}
+		release = func() {
+			// The request context may already be cancelled.
+			l.counter.Release(context.WithoutCancel(ctx), key, token)
+		}
+	}
+
+	if lim.DailyParses > 0 {
+		now := l.now().In(l.day)
+		y, m, day := now.Date()
+		reset := time.Date(y, m, day+1, 0, 0, 0, 0, now.Location())
+		daily, err := l.hit(ctx, "daily:"+userID+":"+now.Format(time.DateOnly), lim.DailyParses, now, reset, "parses per day")
+		if err != nil || !daily.Allowed {
+			release()
+			return daily, func() {}, err
+		}
+		d = daily
+	}
+	return d, release, nil
+}
+
+func (l *Limiter) hit(ctx context.Context, key string, limit int, now, reset time.Time, reason string) (Decision, error) {
+	n, err := l.counter.Hit(ctx, key, reset)
+	if err != nil {
+		return Decision{Allowed: true}, err
+	}
+	d := Decision{
+		Allowed:   n <= limit,
+		Limit:     limit,
+		Remaining: max(0, limit-n),
+		Reset:     reset,
+		Reason:    reason,
+	}
+	if !d.Allowed {
+		d.RetryAfter = reset.Sub(now)
+	}
+	return d, nil
+}
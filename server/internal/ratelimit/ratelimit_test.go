@@ -0,0 +1,175 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/dbtest"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/plan"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// The same cases run against every counter backend, with the limiter's
+// clock under test control so windows never depend on the wall clock.
+
+var counters = map[string]func(t *testing.T) Counter{
+	"redis": func(t *testing.T) Counter {
+		mr := miniredis.RunT(t)
+		rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { rdb.Close() })
+		return NewRedisCounter(rdb)
+	},
+	"memory": func(t *testing.T) Counter {
+		return NewMemoryCounter()
+	},
+}
+
+type testLimiter struct {
+	*Limiter
+	advance func(time.Duration)
+}
+
+func forEachCounter(t *testing.T, lim Limits, fn func(t *testing.T, l testLimiter)) {
+	for name, newCounter := range counters {
+		t.Run(name, func(t *testing.T) {
+			db := dbtest.Open(t, &plan.Subscription{}, &Override{})
+			plans := plan.NewService(db, map[string]plan.Plan{
+				"free": {
+					Name:              "free",
+					RequestsPerMinute: lim.RequestsPerMinute,
+					MaxInFlight:       lim.MaxInFlight,
+					DailyParses:       lim.DailyParses,
+				},
+			}, "free")
+			l := NewLimiter(db, plans, newCounter(t), time.Minute, time.Local)
+			// Start mid-minute, an hour ahead: counters expire windows on
+			// the real clock, so every window must still lie in the future.
+			now := time.Now().Add(time.Hour).Truncate(time.Minute).Add(30 * time.Second)
+			l.now = func() time.Time { return now }
+			fn(t, testLimiter{Limiter: l, advance: func(d time.Duration) { now = now.Add(d) }})
+		})
+	}
+}
+
+func TestAllowRequestWindows(t *testing.T) {
+	forEachCounter(t, Limits{RequestsPerMinute: 3}, func(t *testing.T, l testLimiter) {
+		ctx := context.Background()
+
+		for want := 2; want >= 0; want-- {
+			d, err := l.AllowRequest(ctx, "u1")
+			if err != nil || !d.Allowed || d.Limit != 3 || d.Remaining != want {
+				t.Fatalf("request within limit = %+v, %v; want remaining %d", d, err, want)
+			}
+		}
+		d, err := l.AllowRequest(ctx, "u1")
+		if err != nil || d.Allowed || d.Remaining != 0 || d.RetryAfter != 30*time.Second {
+			t.Fatalf("request over limit = %+v, %v; want denied, retry after 30s", d, err)
+		}
+		// Other users have their own budget.
+		if d, _ := l.AllowRequest(ctx, "u2"); !d.Allowed || d.Remaining != 2 {
+			t.Fatalf("other user = %+v", d)
+		}
+
+		// Windows are fixed minutes: the next one starts fresh.
+		l.advance(30 * time.Second)
+		if d, _ := l.AllowRequest(ctx, "u1"); !d.Allowed || d.Remaining != 2 {
+			t.Fatalf("request in next window = %+v", d)
+		}
+	})
+}
+
+func TestBeginParseLimits(t *testing.T) {
+	forEachCounter(t, Limits{MaxInFlight: 1, DailyParses: 2}, func(t *testing.T, l testLimiter) {
+		ctx := context.Background()
+
+		d, release, err := l.BeginParse(ctx, "u1")
+		if err != nil || !d.Allowed || d.Limit != 2 || d.Remaining != 1 {
+			t.Fatalf("first parse = %+v, %v", d, err)
+		}
+		// The slot is held: a concurrent parse is refused and not counted
+		// against the daily limit.
+		if d, _, _ := l.BeginParse(ctx, "u1"); d.Allowed || d.Limit != 1 {
+			t.Fatalf("concurrent parse = %+v, want in-flight denial", d)
+		}
+		release()
+
+		d, release, _ = l.BeginParse(ctx, "u1")
+		if !d.Allowed || d.Remaining != 0 {
+			t.Fatalf("second parse = %+v", d)
+		}
+		release()
+		d, _, _ = l.BeginParse(ctx, "u1")
+		if d.Allowed || d.Limit != 2 || d.RetryAfter <= 0 {
+			t.Fatalf("parse over daily limit = %+v", d)
+		}
+		// The refused parse gave its slot back.
+		if ok, held, _ := l.counter.Acquire(ctx, "inflight:u1", "probe", 1, time.Minute); !ok || held != 1 {
+			t.Fatalf("slot after daily denial: ok=%v held=%d, want free", ok, held)
+		}
+		l.counter.Release(ctx, "inflight:u1", "probe")
+
+		l.advance(24 * time.Hour)
+		if d, release, _ := l.BeginParse(ctx, "u1"); !d.Allowed {
+			t.Fatalf("parse next day = %+v", d)
+		} else {
+			release()
+		}
+	})
+}
+
+func TestDailyParsesFollowDayZone(t *testing.T) {
+	forEachCounter(t, Limits{DailyParses: 1}, func(t *testing.T, l testLimiter) {
+		ctx := context.Background()
+		l.day = time.FixedZone("UTC+8", 8*60*60)
+		now := l.now().In(l.day)
+		y, m, day := now.Date()
+		midnight := time.Date(y, m, day+1, 0, 0, 0, 0, l.day)
+
+		if d, release, _ := l.BeginParse(ctx, "u1"); !d.Allowed {
+			t.Fatalf("first parse = %+v", d)
+		} else {
+			release()
+		}
+		if d, _, _ := l.BeginParse(ctx, "u1"); d.Allowed || d.RetryAfter != midnight.Sub(now) {
+			t.Fatalf("parse over daily limit = %+v, want retry at %v", d, midnight)
+		}
+		l.advance(midnight.Sub(now))
+		if d, release, _ := l.BeginParse(ctx, "u1"); !d.Allowed {
+			t.Fatalf("parse after midnight in the day zone = %+v", d)
+		} else {
+			release()
+		}
+	})
+}
+
+func TestOverrides(t *testing.T) {
+	forEachCounter(t, Limits{RequestsPerMinute: 1, DailyParses: 5}, func(t *testing.T, l testLimiter) {
+		ctx := context.Background()
+
+		unlimited := 0
+		if err := l.SetOverride(ctx, &Override{UserID: "u1", RequestsPerMinute: &unlimited}); err != nil {
+			t.Fatalf("set override: %v", err)
+		}
+		lim, err := l.Limits(ctx, "u1")
+		if err != nil || lim != (Limits{RequestsPerMinute: 0, DailyParses: 5}) {
+			t.Fatalf("limits with override = %+v, %v", lim, err)
+		}
+		for range 3 {
+			if d, _ := l.AllowRequest(ctx, "u1"); !d.Allowed || d.Limit != 0 {
+				t.Fatalf("request without limit = %+v", d)
+			}
+		}
+
+		if ok, err := l.ClearOverride(ctx, "u1"); !ok || err != nil {
+			t.Fatalf("clear override = %v, %v", ok, err)
+		}
+		if lim, _ := l.Limits(ctx, "u1"); lim.RequestsPerMinute != 1 {
+			t.Fatalf("limits after clear = %+v", lim)
+		}
+		if ok, _ := l.ClearOverride(ctx, "u1"); ok {
+			t.Fatal("cleared a missing override")
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// luaAcquire takes an in-flight slot.
+//
+// KEYS[1] = rl:{key}       (sorted set: token → acquired at, ms)
+// ARGV[1] = now (ms)
+// ARGV[2] = slot ttl (ms)
+// ARGV[3] = limit
+// ARGV[4] = token
+//
+// Returns {1|0, slots held}.
+const luaAcquire = `
+local key   = KEYS[1]
+local now   = tonumber(ARGV[1])
+local ttl   = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+
+redis.call("ZREMRANGEBYSCORE", key, "-inf", now - ttl)
+local held = redis.call("ZCARD", key)
+if held >= limit then
+    return {0, held}
+end
+redis.call("ZADD", key, now, ARGV[4])
+redis.call("PEXPIRE", key, ttl)
+return {1, held + 1}
+`
+
+// RedisCounter keeps counters under "rl:{key}".
+type RedisCounter struct {
+	rdb     *redis.Client
+	acquire *redis.Script
+}
+
+// NewRedisCounter creates a Redis-backed counter.
+func NewRedisCounter(rdb *redis.Client) *RedisCounter {
+	return &RedisCounter{rdb: rdb, acquire: redis.NewScript(luaAcquire)}
+}
+
+// Hit increments a fixed-window counter.
+func (c *RedisCounter) Hit(ctx context.Context, key string, reset time.Time) (int, error) {
+	pipe := c.rdb.TxPipeline()
+	incr := pipe.Incr(ctx, "rl:"+key)
+	pipe.ExpireAt(ctx, "rl:"+key, reset)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("rate limit counter: %w", err)
+	}
+	return int(incr.Val()), nil
+}
+
+// Acquire takes a slot in a sorted set scored by acquisition time.
+func (c *RedisCounter) Acquire(ctx context.Context, key, token string, limit int, ttl time.Duration) (bool, int, error) {
+	res, err := c.acquire.Run(ctx, c.rdb, []string{"rl:" + key},
+		time.Now().UnixMilli(), ttl.Milliseconds(), limit, token).Int64Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("rate limit acquire: %w", err)
+	}
+	return res[0] == 1, int(res[1]), nil
+}
+
+// Release removes the slot.
+func (c *RedisCounter) Release(ctx context.Context, key, token string) error {
+	if err := c.rdb.ZRem(ctx, "rl:"+key, token).Err(); err != nil {
+		return fmt.Errorf("rate limit release: %w", err)
+	}
+	return nil
+}
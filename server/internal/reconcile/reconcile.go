@@ -0,0 +1,354 @@
+// Package reconcile cross-checks frozen GP against the ledger and task log.
+//
+// Every FREEZE entry should eventually be matched by an UNFREEZE and/or
+// REFUND for the same trace (settlement) whose amounts add up to the
+// frozen amount, and Account.Frozen should equal the sum of the freezes
+// that are still open. The reconciler reports where that does not hold and
+// repairs the one case it can decide on its own: freezes left open long
+// after their task should have finished.
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/settlement"
+	"gorm.io/gorm"
+)
+
+// Discrepancy kinds.
+const (
+	KindOrphanedFreeze       = "orphaned_freeze"        // FREEZE with no settlement, older than the orphan age
+	KindReleaseMismatch      = "release_mismatch"       // UNFREEZE+REFUND of a trace != its FREEZE
+	KindReleaseWithoutFreeze = "release_without_freeze" // UNFREEZE/REFUND for a trace that never froze
+	KindFrozenMismatch       = "frozen_mismatch"        // Account.Frozen != sum of open freezes
+)
+
+// Discrepancy is one finding. Expected/Actual are GP amounts whose meaning
+// depends on Kind (frozen vs released for traces, open freezes vs
+// Account.Frozen for accounts).
+type Discrepancy struct {
+	Kind       string           `json:"kind"`
+	UserID     string           `json:"user_id"`
+	TraceID    string           `json:"trace_id,omitempty"`
+	TaskStatus model.TaskStatus `json:"task_status,omitempty"`
+	Expected   int64            `json:"expected"`
+	Actual     int64            `json:"actual"`
+	Since      time.Time        `json:"since,omitzero"`
+}
+
+// Report summarises the ledger state.
+type Report struct {
+	GeneratedAt   time.Time     `json:"generated_at"`
+	OpenFreezes   int           `json:"open_freezes"`
+	OpenFrozenGP  int64         `json:"open_frozen_gp"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+}
+
+// Result is the outcome of one reconciliation pass.
+type Result struct {
+	Replayed int     `json:"replayed"` // finished tasks whose outcome was settled again
+	Released int     `json:"released"` // freezes released without a task outcome
+	Failed   int     `json:"failed"`
+	Report   *Report `json:"report"` // state after the repairs
+}
+
+// Reconciler checks and repairs frozen balances.
+type Reconciler struct {
+	db      *gorm.DB
+	balance balance.BalanceService
+	settler *settlement.Settler
+	cfg     *config.Config
+}
+
+// New creates a reconciler.
+func New(db *gorm.DB, balanceSvc balance.BalanceService, settler *settlement.Settler, cfg *config.Config) *Reconciler {
+	return &Reconciler{db: db, balance: balanceSvc, settler: settler, cfg: cfg}
+}
+
+// Run reconciles every RECONCILE_INTERVAL until ctx is cancelled.
+// A zero interval disables the job.
+func (r *Reconciler) Run(ctx context.Context) {
+	if r.cfg.ReconcileInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.cfg.ReconcileInterval)
+	defer ticker.Stop()
+
+	log.Println("[reconcile] job started")
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("[reconcile] job stopped")
+			return
+		case <-ticker.C:
+			res, err := r.Reconcile(ctx)
+			if err != nil {
+				log.Printf("[reconcile] error: %v", err)
+				continue
+			}
+			if res.Replayed+res.Released+res.Failed > 0 || len(res.Report.Discrepancies) > 0 {
+				log.Printf("[reconcile] replayed=%d released=%d failed=%d remaining discrepancies=%d",
+					res.Replayed, res.Released, res.Failed, len(res.Report.Discrepancies))
+			}
+		}
+	}
+}
+
+// ─────────────────────────────────────────────
+// Repair
+// ─────────────────────────────────────────────
+
+// Reconcile repairs orphaned freezes and returns the resulting report.
+//
+// A freeze is orphaned once it has been open for RECONCILE_ORPHAN_AGE.
+// If the task log shows the task finished, the settlement event was lost
+// and the outcome is replayed through the settler (charge or refund as
+// usual). Otherwise the task never finished and the GP is released with a
+// REFUND entry noting the reconciliation.
+func (r *Reconciler) Reconcile(ctx context.Context) (*Result, error) {
+	freezes, err := r.openFreezes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := r.taskLogs(ctx, freezes)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{}
+	cutoff := time.Now().Add(-r.cfg.ReconcileOrphanAge)
+	for _, f := range freezes {
+		if f.CreatedAt.After(cutoff) {
+			continue
+		}
+		task := tasks[f.TraceID]
+
+		if task != nil && (task.Status == model.TaskStatusCompleted || task.Status == model.TaskStatusFailed) {
+			err := r.settler.Handle(ctx, &model.TaskResult{
+				TraceID:  f.TraceID,
+				NodeID:   task.NodeID,
+				Success:  task.Status == model.TaskStatusCompleted,
+				ActualGP: task.ActualGP,
+			})
+			if err != nil {
+				log.Printf("[reconcile] replay trace=%s: %v", f.TraceID, err)
+				res.Failed++
+				continue
+			}
+			log.Printf("[reconcile] replayed %s outcome for trace=%s", task.Status, f.TraceID)
+			res.Replayed++
+			continue
+		}
+
+		status := model.TaskStatus("UNKNOWN")
+		if task != nil {
+			status = task.Status
+		}
+		remark := fmt.Sprintf("reconcile: orphaned freeze (task %s)", status)
+		if _, err := r.balance.ReleaseFrozen(ctx, f.UserID, f.TraceID, -f.Amount, remark); err != nil {
+			log.Printf("[reconcile] release trace=%s: %v", f.TraceID, err)
+			res.Failed++
+			continue
+		}
+		log.Printf("[reconcile] released %d GP orphaned by trace=%s user=%s (task %s)", -f.Amount, f.TraceID, f.UserID, status)
+		res.Released++
+	}
+
+	report, err := r.Report(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res.Report = report
+	return res, nil
+}
+
+// ─────────────────────────────────────────────
+// Report
+// ─────────────────────────────────────────────
+
+// Report checks the ledger without changing anything.
+func (r *Reconciler) Report(ctx context.Context) (*Report, error) {
+	report := &Report{GeneratedAt: time.Now(), Discrepancies: []Discrepancy{}}
+
+	// Open freezes: orphans, and the per-user sums Account.Frozen must match.
+	freezes, err := r.openFreezes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := r.taskLogs(ctx, freezes)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-r.cfg.ReconcileOrphanAge)
+	openByUser := make(map[string]int64)
+	for _, f := range freezes {
+		report.OpenFreezes++
+		report.OpenFrozenGP += -f.Amount
+		openByUser[f.UserID] += -f.Amount
+
+		if f.CreatedAt.After(cutoff) {
+			continue
+		}
+		d := Discrepancy{
+			Kind:     KindOrphanedFreeze,
+			UserID:   f.UserID,
+			TraceID:  f.TraceID,
+			Expected: -f.Amount,
+			Since:    f.CreatedAt,
+		}
+		if task := tasks[f.TraceID]; task != nil {
+			d.TaskStatus = task.Status
+		}
+		report.Discrepancies = append(report.Discrepancies, d)
+	}
+
+	// Settled traces within the lookback window.
+	mismatches, err := r.releaseMismatches(ctx, time.Now().Add(-r.cfg.ReconcileLookback))
+	if err != nil {
+		return nil, err
+	}
+	report.Discrepancies = append(report.Discrepancies, mismatches...)
+
+	// Account.Frozen vs open freezes.
+	var accounts []balance.Account
+	if err := r.db.WithContext(ctx).Where("frozen <> 0").Find(&accounts).Error; err != nil {
+		return nil, fmt.Errorf("load accounts: %w", err)
+	}
+	seen := make(map[string]bool, len(accounts))
+	for _, acc := range accounts {
+		seen[acc.UserID] = true
+		if acc.Frozen != openByUser[acc.UserID] {
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				Kind:     KindFrozenMismatch,
+				UserID:   acc.UserID,
+				Expected: openByUser[acc.UserID],
+				Actual:   acc.Frozen,
+			})
+		}
+	}
+	for userID, open := range openByUser {
+		if !seen[userID] && open != 0 {
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				Kind:     KindFrozenMismatch,
+				UserID:   userID,
+				Expected: open,
+				Actual:   0,
+			})
+		}
+	}
+
+	return report, nil
+}
+
+// ─────────────────────────────────────────────
+// Queries
+// ─────────────────────────────────────────────
+
+// openFreezes returns FREEZE entries with no UNFREEZE/REFUND for their trace.
+func (r *Reconciler) openFreezes(ctx context.Context) ([]balance.Transaction, error) {
+	settled := r.db.Table("transactions AS s").Select("1").
+		Where("s.trace_id = transactions.trace_id AND s.type IN ?",
+			[]balance.TransactionType{balance.TxUnfreeze, balance.TxRefund})
+
+	var freezes []balance.Transaction
+	err := r.db.WithContext(ctx).
+		Where("type = ? AND trace_id <> ''", balance.TxFreeze).
+		Where("NOT EXISTS (?)", settled).
+		Order("created_at").
+		Find(&freezes).Error
+	if err != nil {
+		return nil, fmt.Errorf("load open freezes: %w", err)
+	}
+	return freezes, nil
+}
+
+// taskLogs loads the task log rows for the given freezes.
+func (r *Reconciler) taskLogs(ctx context.Context, freezes []balance.Transaction) (map[string]*model.TaskLog, error) {
+	tasks := make(map[string]*model.TaskLog, len(freezes))
+	ids := make([]string, 0, len(freezes))
+	for _, f := range freezes {
+		ids = append(ids, f.TraceID)
+	}
+	for len(ids) > 0 {
+		batch := ids[:min(len(ids), 500)]
+		ids = ids[len(batch):]
+
+		var logs []model.TaskLog
+		if err := r.db.WithContext(ctx).Where("trace_id IN ?", batch).Find(&logs).Error; err != nil {
+			return nil, fmt.Errorf("load task logs: %w", err)
+		}
+		for i := range logs {
+			tasks[logs[i].TraceID] = &logs[i]
+		}
+	}
+	return tasks, nil
+}
+
+// releaseMismatches compares, per trace settled since the given time, the
+// UNFREEZE+REFUND total with the FREEZE amount.
+func (r *Reconciler) releaseMismatches(ctx context.Context, since time.Time) ([]Discrepancy, error) {
+	type row struct {
+		TraceID  string
+		UserID   string
+		Released int64
+	}
+	var released []row
+	err := r.db.WithContext(ctx).Model(&balance.Transaction{}).
+		Select("trace_id, MAX(user_id) AS user_id, SUM(amount) AS released").
+		Where("type IN ? AND trace_id <> '' AND created_at >= ?",
+			[]balance.TransactionType{balance.TxUnfreeze, balance.TxRefund}, since).
+		Group("trace_id").
+		Scan(&released).Error
+	if err != nil {
+		return nil, fmt.Errorf("load releases: %w", err)
+	}
+
+	frozen := make(map[string]int64, len(released))
+	ids := make([]string, 0, len(released))
+	for _, rel := range released {
+		ids = append(ids, rel.TraceID)
+	}
+	for len(ids) > 0 {
+		batch := ids[:min(len(ids), 500)]
+		ids = ids[len(batch):]
+
+		var freezes []balance.Transaction
+		if err := r.db.WithContext(ctx).
+			Where("type = ? AND trace_id IN ?", balance.TxFreeze, batch).
+			Find(&freezes).Error; err != nil {
+			return nil, fmt.Errorf("load freezes: %w", err)
+		}
+		for _, f := range freezes {
+			frozen[f.TraceID] += -f.Amount
+		}
+	}
+
+	var out []Discrepancy
+	for _, rel := range released {
+		amount, ok := frozen[rel.TraceID]
+		switch {
+		case !ok:
+			out = append(out, Discrepancy{
+				Kind:    KindReleaseWithoutFreeze,
+				UserID:  rel.UserID,
+				TraceID: rel.TraceID,
+				Actual:  rel.Released,
+			})
+		case amount != rel.Released:
+			out = append(out, Discrepancy{
+				Kind:     KindReleaseMismatch,
+				UserID:   rel.UserID,
+				TraceID:  rel.TraceID,
+				Expected: amount,
+				Actual:   rel.Released,
+			})
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,136 @@
+package reconcile
+
+import (
+	"cmp"
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/pricing"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/settlement"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/store"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const orphanAge = time.Hour
+
+type testEnv struct {
+	db       *gorm.DB
+	balances balance.BalanceService
+	r        *Reconciler
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	st, err := store.Open(sqlite.New(sqlite.Config{
+		DriverName: "sqlite",
+		DSN:        store.SQLiteDSN(filepath.Join(t.TempDir(), "test.db")),
+	}))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() {
+		if db, err := st.DB().DB(); err == nil {
+			db.Close()
+		}
+	})
+	db := st.DB()
+	balances := balance.NewBalanceService(db)
+	engine := pricing.NewEngine(&pricing.FixedPolicy{GP: 100}, pricing.SettleEstimate, 0)
+	settler := settlement.NewSettler(balances, engine, st, nil, 0, nil)
+	cfg := &config.Config{ReconcileOrphanAge: orphanAge, ReconcileLookback: 24 * time.Hour}
+	if _, err := balances.Deposit(context.Background(), "u1", balance.TxDeposit, 1000, "test"); err != nil {
+		t.Fatalf("deposit: %v", err)
+	}
+	return &testEnv{db: db, balances: balances, r: New(db, balances, settler, cfg)}
+}
+
+// freeze freezes gp for traceID, backdated by age, with a task log in
+// status (none when empty).
+func (e *testEnv) freeze(t *testing.T, traceID string, gp int64, age time.Duration, status model.TaskStatus) {
+	t.Helper()
+	if err := e.balances.FreezeGP(context.Background(), "u1", traceID, gp); err != nil {
+		t.Fatalf("freeze %s: %v", traceID, err)
+	}
+	e.db.Model(&balance.Transaction{}).Where("trace_id = ?", traceID).Update("created_at", time.Now().Add(-age))
+	if status != "" {
+		task := &model.TaskLog{TraceID: traceID, UserID: "u1", Status: status, ActualGP: int(gp), CreatedAt: time.Now().Add(-age)}
+		if err := e.db.Create(task).Error; err != nil {
+			t.Fatalf("task log %s: %v", traceID, err)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	old := 2 * orphanAge
+	e.freeze(t, "completed", 100, old, model.TaskStatusCompleted)
+	e.freeze(t, "failed", 50, old, model.TaskStatusFailed)
+	e.freeze(t, "stuck", 40, old, model.TaskStatusProcessing)
+	e.freeze(t, "lost", 30, old, "")
+	e.freeze(t, "young", 20, 0, model.TaskStatusProcessing)
+
+	res, err := e.r.Reconcile(ctx)
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if res.Replayed != 2 || res.Released != 2 || res.Failed != 0 {
+		t.Fatalf("result = %+v, want 2 replayed (completed, failed) and 2 released (stuck, lost)", res)
+	}
+	if r := res.Report; r.OpenFreezes != 1 || r.OpenFrozenGP != 20 || len(r.Discrepancies) != 0 {
+		t.Fatalf("report after repair = %+v", r)
+	}
+	acc, _ := e.balances.GetAccount(ctx, "u1")
+	if acc.Balance != 900 || acc.Frozen != 20 {
+		t.Fatalf("account = %+v, want only the completed task charged and young still frozen", acc)
+	}
+
+	// A second pass finds nothing to do.
+	if res, err := e.r.Reconcile(ctx); err != nil || res.Replayed+res.Released+res.Failed != 0 {
+		t.Fatalf("second pass = %+v, %v", res, err)
+	}
+}
+
+func TestReport(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	e.freeze(t, "orphan", 100, 2*orphanAge, model.TaskStatusProcessing)
+	e.freeze(t, "young", 20, 0, model.TaskStatusProcessing)
+	e.freeze(t, "short", 40, 0, model.TaskStatusCompleted)
+	e.db.Create(&balance.Transaction{UserID: "u1", Type: balance.TxUnfreeze, Amount: 30, TraceID: "short", CreatedAt: time.Now()})
+	e.db.Create(&balance.Transaction{UserID: "u2", Type: balance.TxRefund, Amount: 10, TraceID: "ghost", CreatedAt: time.Now()})
+	// "short" counts as settled, so only orphan and young are open, but
+	// the account still holds short's 40.
+
+	report, err := e.r.Report(ctx)
+	if err != nil {
+		t.Fatalf("report: %v", err)
+	}
+	if report.OpenFreezes != 2 || report.OpenFrozenGP != 120 {
+		t.Fatalf("open = %d freezes, %d GP; want 2, 120", report.OpenFreezes, report.OpenFrozenGP)
+	}
+
+	want := []Discrepancy{
+		{Kind: KindOrphanedFreeze, UserID: "u1", TraceID: "orphan", TaskStatus: model.TaskStatusProcessing, Expected: 100},
+		{Kind: KindReleaseMismatch, UserID: "u1", TraceID: "short", Expected: 40, Actual: 30},
+		{Kind: KindReleaseWithoutFreeze, UserID: "u2", TraceID: "ghost", Actual: 10},
+		{Kind: KindFrozenMismatch, UserID: "u1", Expected: 120, Actual: 160},
+	}
+	got := report.Discrepancies
+	for i := range got {
+		got[i].Since = time.Time{}
+	}
+	key := func(d Discrepancy) string { return d.Kind + "/" + d.TraceID }
+	slices.SortFunc(got, func(a, b Discrepancy) int { return cmp.Compare(key(a), key(b)) })
+	slices.SortFunc(want, func(a, b Discrepancy) int { return cmp.Compare(key(a), key(b)) })
+	if !slices.Equal(got, want) {
+		t.Fatalf("discrepancies:\n got %+v\nwant %+v", got, want)
+	}
+}
@@ -50,7 +50,7 @@ return {"OK", fields[1], fields[2]}
 //
 // KEYS[1] = task:{traceID}                (hash)
 // ARGV[1] = archive URL
-// ARGV[2] = cacheTTL (seconds)
+// ARGV[2] = cacheTTL (seconds), unless the task hash has cache_ttl
 // ARGV[3] = nodeID (requesting node)
 // ARGV[4] = traceID
 //
@@ -73,9 +73,12 @@ if assignedNode ~= nodeID then
 end
 
 -- Read stored keys from task metadata
-local keys = redis.call("HMGET", taskKey, "cache_key", "collapse_key")
+local keys = redis.call("HMGET", taskKey, "cache_key", "collapse_key", "cache_ttl")
 local cacheKey    = keys[1]
 local collapseKey = keys[2]
+if keys[3] then
+    cacheTTL = tonumber(keys[3])
+end
 
 -- 1. Mark task done
 redis.call("HSET", taskKey, "status", "COMPLETED")
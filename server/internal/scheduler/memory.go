@@ -0,0 +1,353 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
+)
+
+// ─────────────────────────────────────────────
+// In-memory backend
+//
+// MemoryScheduler mirrors the Redis Lua scripts operation for operation:
+// the same keys (task, collapse sentinel, per-user cache, pending queue)
+// with the same TTLs, guarded by one mutex instead of Lua atomicity.
+// Expired entries are dropped lazily on access, as Redis would report
+// them missing.
+// ─────────────────────────────────────────────
+
+// completedTaskTTL is how long COMPLETED/FAILED task hashes linger
+// (EXPIRE 300 in the Lua scripts).
+const completedTaskTTL = 300 * time.Second
+
+type memTask struct {
+	galleryID   string
+	galleryKey  string
+	collapseKey string
+	cacheKey    string
+	status      model.TaskStatus
+	nodeID      string
+	freeTier    bool
+	estimatedGP int
+	cacheTTL    time.Duration // 0 = cfg.CacheTTL
+	expiresAt   time.Time
+}
+
+type memValue struct {
+	value     string
+	expiresAt time.Time
+}
+
+// MemoryScheduler is a single-process TaskScheduler. State is lost on
+// restart and not shared between instances.
+type MemoryScheduler struct {
+	cfg *config.Config
+	now func() time.Time // overridable clock for tests
+
+	mu       sync.Mutex
+	tasks    map[string]*memTask  // traceID → task
+	collapse map[string]*memValue // collapse key → traceID
+	cache    map[string]*memValue // cache key → archive URL
+	queue    []string             // pending queue (traceIDs, may repeat)
+}
+
+// NewMemoryScheduler creates an empty in-memory scheduler.
+func NewMemoryScheduler(cfg *config.Config) *MemoryScheduler {
+	return &MemoryScheduler{
+		cfg:      cfg,
+		now:      time.Now,
+		tasks:    make(map[string]*memTask),
+		collapse: make(map[string]*memValue),
+		cache:    make(map[string]*memValue),
+	}
+}
+
+// ─────────────────────────────────────────────
+// Public API
+// ─────────────────────────────────────────────
+
+// PublishTask creates a new task or collapses into an existing one.
+func (s *MemoryScheduler) PublishTask(_ context.Context, traceID, userID, galleryID, galleryKey string, force bool) (PublishStatus, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	leaseTTL := s.leaseTTL()
+	collapseKey := model.CollapsingKey(userID, galleryID)
+	cacheKey := model.CacheKey(userID, galleryID)
+
+	if !force {
+		if cached := s.getLocked(s.cache, cacheKey, now); cached != nil {
+			return PublishCached, cached.value, nil
+		}
+	}
+
+	if existing := s.getLocked(s.collapse, collapseKey, now); existing != nil {
+		return PublishCollapsed, existing.value, nil
+	}
+
+	s.tasks[traceID] = &memTask{
+		galleryID:   galleryID,
+		galleryKey:  galleryKey,
+		collapseKey: collapseKey,
+		cacheKey:    cacheKey,
+		status:      model.TaskStatusPending,
+		expiresAt:   now.Add(leaseTTL * 3),
+	}
+	s.collapse[collapseKey] = &memValue{value: traceID, expiresAt: now.Add(leaseTTL * 2)}
+	s.queue = append(s.queue, traceID)
+
+	return PublishCreated, traceID, nil
+}
+
+// FetchTask lets a worker node attempt to claim a pending task.
+func (s *MemoryScheduler) FetchTask(_ context.Context, traceID, nodeID string) (*model.TaskAssignment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	task := s.taskLocked(traceID, now)
+	if task == nil || task.status != model.TaskStatusPending {
+		return nil, nil // task already claimed
+	}
+
+	leaseTTL := s.leaseTTL()
+	task.status = model.TaskStatusProcessing
+	task.nodeID = nodeID
+	task.expiresAt = now.Add(leaseTTL)
+
+	// Keep the collapse sentinel from outliving the task
+	if c := s.getLocked(s.collapse, task.collapseKey, now); c != nil {
+		c.expiresAt = now.Add(leaseTTL)
+	}
+
+	return &model.TaskAssignment{
+		TraceID:    traceID,
+		GalleryID:  task.galleryID,
+		GalleryKey: task.galleryKey,
+	}, nil
+}
+
+// CompleteTask stores the result and updates caches.
+func (s *MemoryScheduler) CompleteTask(_ context.Context, traceID, nodeID, archiveURL string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	task := s.taskLocked(traceID, now)
+	if task == nil || task.status != model.TaskStatusProcessing {
+		return fmt.Errorf("complete task: unexpected status INVALID")
+	}
+	if task.nodeID != nodeID {
+		return fmt.Errorf("task reassigned to another node (stale completion attempt)")
+	}
+
+	task.status = model.TaskStatusCompleted
+	task.expiresAt = now.Add(completedTaskTTL)
+	cacheTTL := s.cfg.CacheTTL
+	if task.cacheTTL > 0 {
+		cacheTTL = task.cacheTTL
+	}
+	s.cache[task.cacheKey] = &memValue{value: archiveURL, expiresAt: now.Add(cacheTTL)}
+	delete(s.collapse, task.collapseKey)
+	s.removeFromQueueLocked(traceID)
+	return nil
+}
+
+// FailTask marks a task as failed and removes collapse/pending state.
+func (s *MemoryScheduler) FailTask(ctx context.Context, traceID, nodeID string) error {
+	return s.finalizeTask(ctx, traceID, nodeID, false)
+}
+
+// RejectTask removes a task entirely.
+func (s *MemoryScheduler) RejectTask(ctx context.Context, traceID string) error {
+	return s.finalizeTask(ctx, traceID, "", true)
+}
+
+func (s *MemoryScheduler) finalizeTask(_ context.Context, traceID, nodeID string, reject bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	task := s.taskLocked(traceID, now)
+	if task == nil {
+		return fmt.Errorf("task not found")
+	}
+	switch task.status {
+	case model.TaskStatusCompleted, model.TaskStatusFailed:
+		return fmt.Errorf("finalize task: unexpected status INVALID")
+	case model.TaskStatusProcessing:
+		if nodeID == "" {
+			return fmt.Errorf("processing task failure requires node identity")
+		}
+		if task.nodeID != nodeID {
+			return fmt.Errorf("task reassigned to another node (stale failure attempt)")
+		}
+	}
+
+	delete(s.collapse, task.collapseKey)
+	s.removeFromQueueLocked(traceID)
+
+	if reject {
+		delete(s.tasks, traceID)
+	} else {
+		task.status = model.TaskStatusFailed
+		task.expiresAt = now.Add(completedTaskTTL)
+	}
+	return nil
+}
+
+// UpdateTaskCost sets task metadata used for node claim strategy and billing.
+func (s *MemoryScheduler) UpdateTaskCost(_ context.Context, traceID string, freeTier bool, estimatedGP int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if task := s.taskLocked(traceID, s.now()); task != nil {
+		task.freeTier = freeTier
+		task.estimatedGP = estimatedGP
+	}
+	return nil
+}
+
+// SetCacheTTL overrides the task's cache lifetime.
+func (s *MemoryScheduler) SetCacheTTL(_ context.Context, traceID string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if task := s.taskLocked(traceID, s.now()); task != nil {
+		task.cacheTTL = ttl
+	}
+	return nil
+}
+
+// IsCached reports whether the user already has a cached archive URL for the gallery.
+func (s *MemoryScheduler) IsCached(_ context.Context, userID, galleryID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.getLocked(s.cache, model.CacheKey(userID, galleryID), s.now()) != nil, nil
+}
+
+// TaskAnnouncement rebuilds the announcement for an existing PENDING task.
+func (s *MemoryScheduler) TaskAnnouncement(_ context.Context, traceID string) (*model.TaskAnnouncement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task := s.taskLocked(traceID, s.now())
+	if task == nil || task.status != model.TaskStatusPending {
+		return nil, nil
+	}
+	return &model.TaskAnnouncement{
+		TraceID:     traceID,
+		FreeTier:    task.freeTier,
+		EstimatedGP: task.estimatedGP,
+	}, nil
+}
+
+// PendingQueueLen returns the current length of the pending queue.
+func (s *MemoryScheduler) PendingQueueLen(_ context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.queue)), nil
+}
+
+// ─────────────────────────────────────────────
+// Lease Watchdog
+// ─────────────────────────────────────────────
+
+// StartLeaseWatchdog periodically reclaims stuck tasks until ctx is cancelled.
+func (s *MemoryScheduler) StartLeaseWatchdog(ctx context.Context, onReclaim, onExpire func(ctx context.Context, traceIDs []string)) {
+	runLeaseWatchdog(ctx, s.ReclaimExpiredTasks, onReclaim, onExpire)
+}
+
+// ReclaimExpiredTasks mirrors RedisScheduler.ReclaimExpiredTasks: it scans
+// the first 100 queue entries, drops expired tasks and resets PROCESSING
+// tasks with less than half a lease left.
+func (s *MemoryScheduler) ReclaimExpiredTasks(_ context.Context) (reclaimed, expired []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	leaseTTL := s.leaseTTL()
+	reclaimThreshold := time.Duration(int(s.cfg.TaskLeaseTTL.Seconds())/2) * time.Second
+
+	limit := min(len(s.queue), 100)
+	traceIDs := append([]string(nil), s.queue[:limit]...)
+
+	for _, traceID := range traceIDs {
+		task := s.taskLocked(traceID, now)
+		if task == nil {
+			if s.removeFromQueueLocked(traceID) > 0 {
+				log.Printf("[scheduler] removed expired task %s from queue", traceID)
+				expired = append(expired, traceID)
+			}
+			continue
+		}
+
+		ttl := task.expiresAt.Sub(now)
+		if task.status != model.TaskStatusProcessing || ttl >= reclaimThreshold {
+			continue
+		}
+
+		task.status = model.TaskStatusPending
+		task.nodeID = ""
+		task.expiresAt = now.Add(leaseTTL * 3)
+		s.queue = append(s.queue, traceID)
+		s.collapse[task.collapseKey] = &memValue{value: traceID, expiresAt: now.Add(leaseTTL * 2)}
+
+		log.Printf("[scheduler] reclaimed stuck task %s (TTL was %.0fs)", traceID, ttl.Seconds())
+		reclaimed = append(reclaimed, traceID)
+	}
+	return reclaimed, expired
+}
+
+// ─────────────────────────────────────────────
+// Helpers (caller holds s.mu)
+// ─────────────────────────────────────────────
+
+// leaseTTL is TaskLeaseTTL truncated to whole seconds, like the Lua ARGV.
+func (s *MemoryScheduler) leaseTTL() time.Duration {
+	return time.Duration(int(s.cfg.TaskLeaseTTL.Seconds())) * time.Second
+}
+
+func (s *MemoryScheduler) taskLocked(traceID string, now time.Time) *memTask {
+	task, ok := s.tasks[traceID]
+	if !ok {
+		return nil
+	}
+	if !now.Before(task.expiresAt) {
+		delete(s.tasks, traceID)
+		return nil
+	}
+	return task
+}
+
+func (s *MemoryScheduler) getLocked(m map[string]*memValue, key string, now time.Time) *memValue {
+	v, ok := m[key]
+	if !ok {
+		return nil
+	}
+	if !now.Before(v.expiresAt) {
+		delete(m, key)
+		return nil
+	}
+	return v
+}
+
+// removeFromQueueLocked drops every occurrence (LREM 0) and returns how
+// many there were.
+func (s *MemoryScheduler) removeFromQueueLocked(traceID string) int {
+	q := s.queue[:0]
+	for _, id := range s.queue {
+		if id != traceID {
+			q = append(q, id)
+		}
+	}
+	n := len(s.queue) - len(q)
+	s.queue = q
+	return n
+}
@@ -2,8 +2,10 @@ package scheduler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
@@ -19,8 +21,84 @@ const (
 	PublishCached
 )
 
-// Scheduler manages task lifecycle via Redis.
-type Scheduler struct {
+// TaskScheduler owns the task lifecycle: publishing with request collapsing
+// and per-user result caching, node claims under a lease, completion and
+// failure, and reclaiming tasks whose node went silent.
+//
+// RedisScheduler is the production backend; MemoryScheduler implements the
+// same semantics in-process for single-instance deployments and tests.
+type TaskScheduler interface {
+	// PublishTask creates a new task or collapses into an existing one.
+	// Returns status + payload:
+	//   - PublishCreated: payload is created traceID
+	//   - PublishCollapsed: payload is existing traceID
+	//   - PublishCached: payload is archiveURL
+	PublishTask(ctx context.Context, traceID, userID, galleryID, galleryKey string, force bool) (PublishStatus, string, error)
+
+	// FetchTask lets a worker node attempt to claim a pending task.
+	// Returns nil (and no error) if the task is already claimed or gone.
+	FetchTask(ctx context.Context, traceID, nodeID string) (*model.TaskAssignment, error)
+
+	// CompleteTask stores the result and updates caches.
+	// nodeID must match the node currently assigned to the task.
+	CompleteTask(ctx context.Context, traceID, nodeID, archiveURL string) error
+
+	// FailTask marks a task as failed and removes collapse/pending state.
+	// For PROCESSING tasks, nodeID must match the currently assigned node.
+	// For PENDING tasks, pass nodeID as an empty string.
+	FailTask(ctx context.Context, traceID, nodeID string) error
+
+	// RejectTask removes a task entirely (used for initialization/pre-flight rejections).
+	RejectTask(ctx context.Context, traceID string) error
+
+	// UpdateTaskCost sets task metadata used for node claim strategy and billing.
+	UpdateTaskCost(ctx context.Context, traceID string, freeTier bool, estimatedGP int) error
+
+	// SetCacheTTL overrides CacheTTL for the cached result of one task
+	// (the requesting user's plan decides how long results are kept).
+	SetCacheTTL(ctx context.Context, traceID string, ttl time.Duration) error
+
+	// IsCached reports whether the user already has a cached archive URL for the gallery.
+	IsCached(ctx context.Context, userID, galleryID string) (bool, error)
+
+	// TaskAnnouncement rebuilds the announcement for an existing PENDING task.
+	// Returns nil if the task no longer exists or is not PENDING.
+	TaskAnnouncement(ctx context.Context, traceID string) (*model.TaskAnnouncement, error)
+
+	// PendingQueueLen returns the current length of the pending queue.
+	PendingQueueLen(ctx context.Context) (int64, error)
+
+	// ReclaimExpiredTasks resets PROCESSING tasks whose lease has run below
+	// half of TaskLeaseTTL back to PENDING and drops expired tasks from the
+	// queue. Returns the trace IDs that were reset to PENDING and those of
+	// the expired tasks it dropped. Expired tasks will never report a
+	// result, so the caller must fail them for settlement.
+	ReclaimExpiredTasks(ctx context.Context) (reclaimed, expired []string)
+
+	// StartLeaseWatchdog runs ReclaimExpiredTasks periodically until ctx is
+	// cancelled. onReclaim (if set) receives the reclaimed trace IDs so they
+	// can be re-announced; onExpire (if set) receives the expired ones.
+	StartLeaseWatchdog(ctx context.Context, onReclaim, onExpire func(ctx context.Context, traceIDs []string))
+}
+
+// New returns the scheduler selected by cfg.SchedulerBackend. rdb is only
+// used (and may be nil) for the "memory" backend.
+func New(cfg *config.Config, rdb *redis.Client) (TaskScheduler, error) {
+	switch cfg.SchedulerBackend {
+	case "", "redis":
+		if rdb == nil {
+			return nil, fmt.Errorf("redis scheduler requires a redis client")
+		}
+		return NewRedisScheduler(rdb, cfg), nil
+	case "memory":
+		return NewMemoryScheduler(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown SCHEDULER_BACKEND %q (expected redis or memory)", cfg.SchedulerBackend)
+	}
+}
+
+// RedisScheduler manages task lifecycle via Redis.
+type RedisScheduler struct {
 	rdb *redis.Client
 	cfg *config.Config
 
@@ -32,9 +110,9 @@ type Scheduler struct {
 	reclaimScript  *redis.Script
 }
 
-// NewScheduler initialises the scheduler and loads Lua scripts.
-func NewScheduler(rdb *redis.Client, cfg *config.Config) *Scheduler {
-	return &Scheduler{
+// NewRedisScheduler initialises the scheduler and loads Lua scripts.
+func NewRedisScheduler(rdb *redis.Client, cfg *config.Config) *RedisScheduler {
+	return &RedisScheduler{
 		rdb:            rdb,
 		cfg:            cfg,
 		fetchScript:    redis.NewScript(LuaFetchTask),
@@ -61,7 +139,7 @@ func boolToFlag(b bool) string {
 //   - PublishCreated: payload is created traceID
 //   - PublishCollapsed: payload is existing traceID
 //   - PublishCached: payload is archiveURL
-func (s *Scheduler) PublishTask(ctx context.Context, traceID, userID, galleryID, galleryKey string, force bool) (PublishStatus, string, error) {
+func (s *RedisScheduler) PublishTask(ctx context.Context, traceID, userID, galleryID, galleryKey string, force bool) (PublishStatus, string, error) {
 	leaseTTL := int(s.cfg.TaskLeaseTTL.Seconds())
 
 	keys := []string{
@@ -93,7 +171,7 @@ func (s *Scheduler) PublishTask(ctx context.Context, traceID, userID, galleryID,
 
 // FetchTask lets a worker node attempt to claim a pending task.
 // Returns the assignment details or an indication that the task is gone.
-func (s *Scheduler) FetchTask(ctx context.Context, traceID, nodeID string) (*model.TaskAssignment, error) {
+func (s *RedisScheduler) FetchTask(ctx context.Context, traceID, nodeID string) (*model.TaskAssignment, error) {
 	leaseTTL := int(s.cfg.TaskLeaseTTL.Seconds())
 
 	keys := []string{model.TaskKey(traceID)}
@@ -118,7 +196,7 @@ func (s *Scheduler) FetchTask(ctx context.Context, traceID, nodeID string) (*mod
 
 // CompleteTask stores the result and updates caches.
 // nodeID must match the node currently assigned to the task.
-func (s *Scheduler) CompleteTask(ctx context.Context, traceID, nodeID, archiveURL string) error {
+func (s *RedisScheduler) CompleteTask(ctx context.Context, traceID, nodeID, archiveURL string) error {
 	keys := []string{model.TaskKey(traceID)}
 	args := []interface{}{archiveURL, int(s.cfg.CacheTTL.Seconds()), nodeID, traceID}
 
@@ -138,16 +216,16 @@ func (s *Scheduler) CompleteTask(ctx context.Context, traceID, nodeID, archiveUR
 // FailTask marks a task as failed and removes collapse/pending state.
 // For PROCESSING tasks, nodeID must match the currently assigned node.
 // For PENDING tasks, pass nodeID as an empty string.
-func (s *Scheduler) FailTask(ctx context.Context, traceID, nodeID string) error {
+func (s *RedisScheduler) FailTask(ctx context.Context, traceID, nodeID string) error {
 	return s.finalizeTask(ctx, traceID, nodeID, "FAIL")
 }
 
 // RejectTask removes a task entirely (used for initialization/pre-flight rejections).
-func (s *Scheduler) RejectTask(ctx context.Context, traceID string) error {
+func (s *RedisScheduler) RejectTask(ctx context.Context, traceID string) error {
 	return s.finalizeTask(ctx, traceID, "", "REJECT")
 }
 
-func (s *Scheduler) finalizeTask(ctx context.Context, traceID, nodeID, mode string) error {
+func (s *RedisScheduler) finalizeTask(ctx context.Context, traceID, nodeID, mode string) error {
 	keys := []string{model.TaskKey(traceID)}
 	args := []interface{}{nodeID, traceID, mode}
 
@@ -171,7 +249,7 @@ func (s *Scheduler) finalizeTask(ctx context.Context, traceID, nodeID, mode stri
 }
 
 // UpdateTaskCost sets task metadata used for node claim strategy and billing.
-func (s *Scheduler) UpdateTaskCost(ctx context.Context, traceID string, freeTier bool, estimatedGP int) error {
+func (s *RedisScheduler) UpdateTaskCost(ctx context.Context, traceID string, freeTier bool, estimatedGP int) error {
 	err := s.rdb.HSet(ctx, model.TaskKey(traceID), map[string]interface{}{
 		"free_tier":    boolToFlag(freeTier),
 		"estimated_gp": estimatedGP,
@@ -182,8 +260,46 @@ func (s *Scheduler) UpdateTaskCost(ctx context.Context, traceID string, freeTier
 	return nil
 }
 
+// SetCacheTTL stores the task's cache lifetime; LuaCompleteTask prefers
+// it over the configured CacheTTL.
+func (s *RedisScheduler) SetCacheTTL(ctx context.Context, traceID string, ttl time.Duration) error {
+	if err := s.rdb.HSet(ctx, model.TaskKey(traceID), "cache_ttl", int(ttl.Seconds())).Err(); err != nil {
+		return fmt.Errorf("set cache ttl: %w", err)
+	}
+	return nil
+}
+
+// IsCached reports whether the user already has a cached archive URL for the gallery.
+func (s *RedisScheduler) IsCached(ctx context.Context, userID, galleryID string) (bool, error) {
+	n, err := s.rdb.Exists(ctx, model.CacheKey(userID, galleryID)).Result()
+	if err != nil {
+		return false, fmt.Errorf("check cache: %w", err)
+	}
+	return n > 0, nil
+}
+
+// TaskAnnouncement rebuilds the announcement for an existing PENDING task.
+// Returns nil if the task no longer exists or is not PENDING.
+func (s *RedisScheduler) TaskAnnouncement(ctx context.Context, traceID string) (*model.TaskAnnouncement, error) {
+	vals, err := s.rdb.HMGet(ctx, model.TaskKey(traceID), "status", "free_tier", "estimated_gp").Result()
+	if err != nil {
+		return nil, fmt.Errorf("read task: %w", err)
+	}
+	if status, _ := vals[0].(string); status != "PENDING" {
+		return nil, nil
+	}
+	freeTier, _ := vals[1].(string)
+	estimatedGP, _ := vals[2].(string)
+	gp, _ := strconv.Atoi(estimatedGP)
+	return &model.TaskAnnouncement{
+		TraceID:     traceID,
+		FreeTier:    freeTier == "1",
+		EstimatedGP: gp,
+	}, nil
+}
+
 // PendingQueueLen returns the current length of the pending queue.
-func (s *Scheduler) PendingQueueLen(ctx context.Context) (int64, error) {
+func (s *RedisScheduler) PendingQueueLen(ctx context.Context) (int64, error) {
 	return s.rdb.LLen(ctx, model.PendingQueueKey).Result()
 }
 
@@ -192,9 +308,15 @@ func (s *Scheduler) PendingQueueLen(ctx context.Context) (int64, error) {
 // ─────────────────────────────────────────────
 
 // StartLeaseWatchdog periodically scans for expired task keys
-// whose lease TTL has passed and re-enqueues them.
+// whose lease TTL has passed and re-enqueues them. onReclaim (if set)
+// receives the trace IDs put back to PENDING so they can be re-announced,
+// onExpire (if set) those of tasks that expired and were dropped.
 // It runs until ctx is cancelled.
-func (s *Scheduler) StartLeaseWatchdog(ctx context.Context) {
+func (s *RedisScheduler) StartLeaseWatchdog(ctx context.Context, onReclaim, onExpire func(ctx context.Context, traceIDs []string)) {
+	runLeaseWatchdog(ctx, s.ReclaimExpiredTasks, onReclaim, onExpire)
+}
+
+func runLeaseWatchdog(ctx context.Context, reclaim func(ctx context.Context) ([]string, []string), onReclaim, onExpire func(ctx context.Context, traceIDs []string)) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
@@ -205,19 +327,28 @@ func (s *Scheduler) StartLeaseWatchdog(ctx context.Context) {
 			log.Println("[scheduler] lease watchdog stopped")
 			return
 		case <-ticker.C:
-			s.reclaimExpiredTasks(ctx)
+			reclaimed, expired := reclaim(ctx)
+			if len(reclaimed) > 0 && onReclaim != nil {
+				onReclaim(ctx, reclaimed)
+			}
+			if len(expired) > 0 && onExpire != nil {
+				onExpire(ctx, expired)
+			}
 		}
 	}
 }
 
-// reclaimExpiredTasks scans for stuck PROCESSING tasks and:
+// ReclaimExpiredTasks scans for stuck PROCESSING tasks and:
 // 1. Checks if task is still in PROCESSING state with low TTL
 // 2. Calls LuaReclaimTask to reset, clear collapseKey, and re-enqueue
 // 3. Removes truly expired tasks from queue
-func (s *Scheduler) reclaimExpiredTasks(ctx context.Context) {
+//
+// Returns the trace IDs that were reset to PENDING and those of the
+// expired tasks removed.
+func (s *RedisScheduler) ReclaimExpiredTasks(ctx context.Context) (reclaimed, expired []string) {
 	queueLen, err := s.rdb.LLen(ctx, model.PendingQueueKey).Result()
 	if err != nil || queueLen == 0 {
-		return
+		return nil, nil
 	}
 
 	// Scan up to 100 entries
@@ -248,10 +379,23 @@ func (s *Scheduler) reclaimExpiredTasks(ctx context.Context) {
 		ttlCmd := pipe.TTL(ctx, taskKey)
 		statusCmd := pipe.HGet(ctx, taskKey, "status")
 		_, err = pipe.Exec(ctx)
+		if errors.Is(statusCmd.Err(), redis.Nil) {
+			// Task doesn't exist – remove from queue (every entry: a
+			// reclaimed task is queued twice). Only the pass that removes
+			// it reports it, so the failure is settled once per instance.
+			n, err := s.rdb.LRem(ctx, model.PendingQueueKey, 0, traceID).Result()
+			if err != nil {
+				log.Printf("[scheduler] remove expired task %s error: %v", traceID, err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("[scheduler] removed expired task %s from queue", traceID)
+				expired = append(expired, traceID)
+			}
+			continue
+		}
 		if err != nil {
-			// Task doesn't exist – remove from queue
-			s.rdb.LRem(ctx, model.PendingQueueKey, 1, traceID)
-			log.Printf("[scheduler] removed expired task %s from queue", traceID)
+			log.Printf("[scheduler] inspect task %s error: %v", traceID, err)
 			continue
 		}
 
@@ -270,7 +414,9 @@ func (s *Scheduler) reclaimExpiredTasks(ctx context.Context) {
 			}
 			if result == "RECLAIMED" {
 				log.Printf("[scheduler] reclaimed stuck task %s (TTL was %.0fs)", traceID, ttl)
+				reclaimed = append(reclaimed, traceID)
 			}
 		}
 	}
+	return reclaimed, expired
 }
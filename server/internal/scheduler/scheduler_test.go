@@ -0,0 +1,275 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// The same cases run against every backend: MemoryScheduler must behave
+// exactly like the Lua scripts.
+
+type backend struct {
+	sched   TaskScheduler
+	advance func(time.Duration) // move the backend's clock forward
+}
+
+var backends = map[string]func(t *testing.T, cfg *config.Config) backend{
+	"redis": func(t *testing.T, cfg *config.Config) backend {
+		mr := miniredis.RunT(t)
+		rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { rdb.Close() })
+		return backend{sched: NewRedisScheduler(rdb, cfg), advance: mr.FastForward}
+	},
+	"memory": func(t *testing.T, cfg *config.Config) backend {
+		s := NewMemoryScheduler(cfg)
+		now := time.Now()
+		s.now = func() time.Time { return now }
+		return backend{sched: s, advance: func(d time.Duration) { now = now.Add(d) }}
+	},
+}
+
+func testConfig() *config.Config {
+	return &config.Config{
+		TaskLeaseTTL: 60 * time.Second,
+		CacheTTL:     time.Hour,
+	}
+}
+
+func forEachBackend(t *testing.T, fn func(t *testing.T, b backend)) {
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			fn(t, newBackend(t, testConfig()))
+		})
+	}
+}
+
+func mustPublish(t *testing.T, s TaskScheduler, traceID, userID, galleryID string, force bool, want PublishStatus) string {
+	t.Helper()
+	status, payload, err := s.PublishTask(context.Background(), traceID, userID, galleryID, "key", force)
+	if err != nil {
+		t.Fatalf("publish %s: %v", traceID, err)
+	}
+	if status != want {
+		t.Fatalf("publish %s: status = %d (%s), want %d", traceID, status, payload, want)
+	}
+	return payload
+}
+
+func mustFetch(t *testing.T, s TaskScheduler, traceID, nodeID string) {
+	t.Helper()
+	a, err := s.FetchTask(context.Background(), traceID, nodeID)
+	if err != nil || a == nil {
+		t.Fatalf("fetch %s by %s = %v, %v; want assignment", traceID, nodeID, a, err)
+	}
+	if a.GalleryID == "" || a.GalleryKey != "key" {
+		t.Fatalf("fetch %s: assignment = %+v", traceID, a)
+	}
+}
+
+func queueLen(t *testing.T, s TaskScheduler) int64 {
+	t.Helper()
+	n, err := s.PendingQueueLen(context.Background())
+	if err != nil {
+		t.Fatalf("queue len: %v", err)
+	}
+	return n
+}
+
+func TestPublishCollapseAndCache(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		ctx := context.Background()
+		s := b.sched
+
+		mustPublish(t, s, "t1", "u1", "100", false, PublishCreated)
+		if got := mustPublish(t, s, "t2", "u1", "100", false, PublishCollapsed); got != "t1" {
+			t.Fatalf("collapsed into %s, want t1", got)
+		}
+		// Different user: no collapsing across users.
+		mustPublish(t, s, "t3", "u2", "100", false, PublishCreated)
+		if n := queueLen(t, s); n != 2 {
+			t.Fatalf("queue len = %d, want 2", n)
+		}
+
+		mustFetch(t, s, "t1", "n1")
+		if err := s.CompleteTask(ctx, "t1", "n1", "https://archive/1"); err != nil {
+			t.Fatalf("complete: %v", err)
+		}
+		if n := queueLen(t, s); n != 1 {
+			t.Fatalf("queue len after complete = %d, want 1", n)
+		}
+
+		if got := mustPublish(t, s, "t4", "u1", "100", false, PublishCached); got != "https://archive/1" {
+			t.Fatalf("cached payload = %s", got)
+		}
+		if ok, _ := s.IsCached(ctx, "u1", "100"); !ok {
+			t.Fatal("IsCached = false after completion")
+		}
+		// force bypasses the cache.
+		mustPublish(t, s, "t5", "u1", "100", true, PublishCreated)
+
+		b.advance(time.Hour + time.Second)
+		if ok, _ := s.IsCached(ctx, "u1", "100"); ok {
+			t.Fatal("cache outlived CacheTTL")
+		}
+	})
+}
+
+func TestPerTaskCacheTTL(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		ctx := context.Background()
+		s := b.sched
+
+		mustPublish(t, s, "t1", "u1", "100", false, PublishCreated)
+		if err := s.SetCacheTTL(ctx, "t1", 3*time.Hour); err != nil {
+			t.Fatalf("set cache ttl: %v", err)
+		}
+		mustFetch(t, s, "t1", "n1")
+		if err := s.CompleteTask(ctx, "t1", "n1", "https://archive/1"); err != nil {
+			t.Fatalf("complete: %v", err)
+		}
+
+		b.advance(2 * time.Hour)
+		if ok, _ := s.IsCached(ctx, "u1", "100"); !ok {
+			t.Fatal("cache expired at CacheTTL despite per-task TTL")
+		}
+		b.advance(time.Hour + time.Second)
+		if ok, _ := s.IsCached(ctx, "u1", "100"); ok {
+			t.Fatal("cache outlived per-task TTL")
+		}
+	})
+}
+
+func TestFetchClaimsOnce(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		ctx := context.Background()
+		s := b.sched
+
+		mustPublish(t, s, "t1", "u1", "100", false, PublishCreated)
+		if err := s.UpdateTaskCost(ctx, "t1", true, 42); err != nil {
+			t.Fatalf("update cost: %v", err)
+		}
+		ann, err := s.TaskAnnouncement(ctx, "t1")
+		if err != nil || ann == nil || !ann.FreeTier || ann.EstimatedGP != 42 {
+			t.Fatalf("announcement = %+v, %v", ann, err)
+		}
+
+		mustFetch(t, s, "t1", "n1")
+		if a, err := s.FetchTask(ctx, "t1", "n2"); a != nil || err != nil {
+			t.Fatalf("second fetch = %+v, %v; want gone", a, err)
+		}
+		if a, err := s.FetchTask(ctx, "missing", "n2"); a != nil || err != nil {
+			t.Fatalf("fetch missing = %+v, %v; want gone", a, err)
+		}
+		if ann, _ := s.TaskAnnouncement(ctx, "t1"); ann != nil {
+			t.Fatalf("announcement for claimed task = %+v, want nil", ann)
+		}
+
+		if err := s.CompleteTask(ctx, "t1", "n2", "x"); err == nil {
+			t.Fatal("completion by another node succeeded")
+		}
+		if err := s.FailTask(ctx, "t1", ""); err == nil {
+			t.Fatal("failing a processing task without node succeeded")
+		}
+		if err := s.CompleteTask(ctx, "t1", "n1", "x"); err != nil {
+			t.Fatalf("complete: %v", err)
+		}
+		if err := s.CompleteTask(ctx, "t1", "n1", "x"); err == nil {
+			t.Fatal("second completion succeeded")
+		}
+	})
+}
+
+func TestFailAndReject(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		ctx := context.Background()
+		s := b.sched
+
+		mustPublish(t, s, "t1", "u1", "100", false, PublishCreated)
+		mustFetch(t, s, "t1", "n1")
+		if err := s.FailTask(ctx, "t1", "n1"); err != nil {
+			t.Fatalf("fail: %v", err)
+		}
+		if err := s.FailTask(ctx, "t1", "n1"); err == nil {
+			t.Fatal("failing a failed task succeeded")
+		}
+		// Failure clears the collapse sentinel and caches nothing.
+		mustPublish(t, s, "t2", "u1", "100", false, PublishCreated)
+
+		if err := s.RejectTask(ctx, "t2"); err != nil {
+			t.Fatalf("reject: %v", err)
+		}
+		if err := s.RejectTask(ctx, "t2"); err == nil {
+			t.Fatal("rejecting a removed task succeeded")
+		}
+		if n := queueLen(t, s); n != 0 {
+			t.Fatalf("queue len = %d, want 0", n)
+		}
+		mustPublish(t, s, "t3", "u1", "100", false, PublishCreated)
+	})
+}
+
+func TestLeaseReclaim(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		ctx := context.Background()
+		s := b.sched
+
+		mustPublish(t, s, "t1", "u1", "100", false, PublishCreated)
+		mustFetch(t, s, "t1", "n1")
+
+		if got, expired := s.ReclaimExpiredTasks(ctx); len(got) != 0 || len(expired) != 0 {
+			t.Fatalf("reclaimed %v, expired %v with a fresh lease", got, expired)
+		}
+
+		b.advance(40 * time.Second) // 20s of the 60s lease left
+		got, expired := s.ReclaimExpiredTasks(ctx)
+		if len(got) != 1 || got[0] != "t1" || len(expired) != 0 {
+			t.Fatalf("reclaimed %v, expired %v; want [t1], none", got, expired)
+		}
+		if ann, _ := s.TaskAnnouncement(ctx, "t1"); ann == nil {
+			t.Fatal("reclaimed task is not PENDING")
+		}
+		if err := s.CompleteTask(ctx, "t1", "n1", "x"); err == nil {
+			t.Fatal("stale node completed a reclaimed task")
+		}
+		// Still collapsing while re-queued.
+		mustPublish(t, s, "t2", "u1", "100", false, PublishCollapsed)
+
+		mustFetch(t, s, "t1", "n2")
+		if err := s.CompleteTask(ctx, "t1", "n2", "x"); err != nil {
+			t.Fatalf("complete after reclaim: %v", err)
+		}
+	})
+}
+
+func TestExpiredTaskLeavesQueue(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		ctx := context.Background()
+		s := b.sched
+
+		mustPublish(t, s, "t1", "u1", "100", false, PublishCreated)
+		mustFetch(t, s, "t1", "n1")
+
+		b.advance(61 * time.Second) // lease gone entirely
+		got, expired := s.ReclaimExpiredTasks(ctx)
+		if len(got) != 0 {
+			t.Fatalf("reclaimed expired task %v", got)
+		}
+		if len(expired) != 1 || expired[0] != "t1" {
+			t.Fatalf("expired %v, want [t1]", expired)
+		}
+		if n := queueLen(t, s); n != 0 {
+			t.Fatalf("queue len = %d, want 0", n)
+		}
+		// Reported once: the next pass finds nothing.
+		if got, expired := s.ReclaimExpiredTasks(ctx); len(got) != 0 || len(expired) != 0 {
+			t.Fatalf("second pass: reclaimed %v, expired %v", got, expired)
+		}
+		// The collapse sentinel expired with the lease.
+		mustPublish(t, s, "t2", "u1", "100", false, PublishCreated)
+	})
+}
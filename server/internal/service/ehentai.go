@@ -1,95 +1,65 @@
 package service
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"net/http"
+	"log"
 	"strconv"
 	"time"
 
 	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/ehapi"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/pricing"
 )
 
-const (
-	apiE         = "https://e-hentai.org/api.php"
-	oneYear      = 365 * 24 * time.Hour
-	gpPerMB      = 20
-	gpMultiplier = 3
-	bytesPerMB   = 1000000
-)
-
-var httpClient = &http.Client{Timeout: 15 * time.Second}
-
-// GalleryQuota holds the quota information for a gallery
-type GalleryQuota struct {
-	IsNew bool // true if published within the last year
-	GP    int  // GP (Gold Points) cost to download
+// NewEHAPIClient builds the direct api.php client from config.
+func NewEHAPIClient(cfg *config.Config) *ehapi.Client {
+	return ehapi.New(ehapi.Options{
+		Endpoint:         cfg.EHAPIURL,
+		Timeout:          cfg.EHAPITimeout,
+		Rate:             cfg.EHAPIRate,
+		Burst:            cfg.EHAPIBurst,
+		MaxRetries:       cfg.EHAPIMaxRetries,
+		RetryBaseDelay:   cfg.EHAPIRetryDelay,
+		BreakerThreshold: cfg.EHAPIBreakerThreshold,
+		BreakerCooldown:  cfg.EHAPIBreakerCooldown,
+		BatchWindow:      cfg.EHAPIBatchWindow,
+	})
 }
 
-func ResolveParseParams(ctx context.Context, cfg *config.Config, galleryID, galleryKey string) (*GalleryQuota, error) {
+// fetchMetadata resolves gallery metadata. When METADATA_VIA_NODES is
+// enabled a connected node is asked first, so the lookup uses the node's
+// IP (and cookie, for ExHentai-only galleries); the direct API call is
+// only a fallback for when no node could answer.
+func (s *GalleryService) fetchMetadata(ctx context.Context, galleryID, galleryKey string) (*pricing.Gallery, error) {
+	if s.cfg.MetadataViaNodes {
+		nodeCtx, cancel := context.WithTimeout(ctx, s.cfg.MetadataNodeTimeout)
+		res, err := s.hub.RequestMetadata(nodeCtx, galleryID, galleryKey)
+		cancel()
+		if err == nil {
+			if res.GalleryError != "" {
+				return nil, fmt.Errorf("api returned error: %s", res.GalleryError)
+			}
+			return &pricing.Gallery{
+				GalleryID: galleryID,
+				Posted:    time.Unix(res.Posted, 0),
+				Filesize:  res.Filesize,
+			}, nil
+		}
+		log.Printf("[service] node metadata lookup failed gallery=%s, falling back to direct API: %v", galleryID, err)
+	}
+
 	gid, err := strconv.Atoi(galleryID)
 	if err != nil {
 		return nil, fmt.Errorf("invalid gallery id: %w", err)
 	}
-
-	payload, _ := json.Marshal(map[string]any{
-		"method":    "gdata",
-		"gidlist":   [][]any{{gid, galleryKey}},
-		"namespace": 1,
-	})
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiE, bytes.NewReader(payload))
+	meta, err := s.ehapi.GalleryMetadata(ctx, gid, galleryKey)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("http request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("api status code: %d", resp.StatusCode)
-	}
-
-	var result struct {
-		Gmetadata []struct {
-			Posted   string `json:"posted"`
-			Filesize int64  `json:"filesize"`
-			Error    string `json:"error"`
-		} `json:"gmetadata"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("decode json failed: %w", err)
-	}
-
-	if len(result.Gmetadata) == 0 || result.Gmetadata[0].Error != "" {
-		if len(result.Gmetadata) == 0 {
-			return nil, fmt.Errorf("api returned error: empty metadata")
-		}
-		return nil, fmt.Errorf("api returned error: %s", result.Gmetadata[0].Error)
-	}
-
-	meta := result.Gmetadata[0]
-	postedUnix, err := strconv.ParseInt(meta.Posted, 10, 64)
-	if err != nil {
-		return nil, fmt.Errorf("invalid posted timestamp: %w", err)
-	}
-
-	isNew := time.Since(time.Unix(postedUnix, 0)) < oneYear
-	mbSize := float64(meta.Filesize) / float64(bytesPerMB)
-	gp := int(mbSize*float64(gpPerMB)) + 1
-	if !isNew {
-		gp *= gpMultiplier
-	}
-
-	return &GalleryQuota{
-		IsNew: isNew,
-		GP:    gp,
+	return &pricing.Gallery{
+		GalleryID: galleryID,
+		Posted:    meta.Posted,
+		Filesize:  meta.Filesize,
 	}, nil
 }
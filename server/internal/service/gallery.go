@@ -9,8 +9,12 @@ import (
 
 	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/ehapi"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/plan"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/pricing"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/scheduler"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/settlement"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/store"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/ws"
 	"github.com/google/uuid"
@@ -19,28 +23,38 @@ import (
 // Service errors
 var (
 	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrPriceExceedsLimit   = errors.New("estimated GP exceeds max_gp")
 )
 
 // GalleryService orchestrates the full request lifecycle:
 //
 //	publish/collapse (with atomic cache check) → setup created task → wait → return
 type GalleryService struct {
-	sched      *scheduler.Scheduler
+	sched      scheduler.TaskScheduler
 	hub        *ws.Hub
 	waiter     *ws.ResultWaiter
 	store      *store.Store
 	cfg        *config.Config
 	balanceSvc balance.BalanceService
+	pricing    *pricing.Engine
+	settler    *settlement.Settler
+	plans      *plan.Service
+	quotes     *quoteCache
+	ehapi      *ehapi.Client // direct api.php calls
 }
 
 // NewGalleryService creates the service.
 func NewGalleryService(
-	sched *scheduler.Scheduler,
+	sched scheduler.TaskScheduler,
 	hub *ws.Hub,
 	waiter *ws.ResultWaiter,
 	store *store.Store,
 	cfg *config.Config,
 	balanceSvc balance.BalanceService,
+	pricingEngine *pricing.Engine,
+	settler *settlement.Settler,
+	plans *plan.Service,
+	ehClient *ehapi.Client,
 ) *GalleryService {
 	return &GalleryService{
 		sched:      sched,
@@ -49,35 +63,69 @@ func NewGalleryService(
 		store:      store,
 		cfg:        cfg,
 		balanceSvc: balanceSvc,
+		pricing:    pricingEngine,
+		settler:    settler,
+		plans:      plans,
+		quotes:     newQuoteCache(cfg.QuoteCacheTTL),
+		ehapi:      ehClient,
 	}
 }
 
-// setupCreatedTask resolves e-hentai params, freezes balance, and broadcasts.
-// Returns (estimatedGP, error). On error the caller is responsible for cleanup.
+// setupCreatedTask resolves e-hentai params, charges the task to the
+// user's plan allowance or freezes balance, and broadcasts.
+// Returns (frozenGP, error); frozenGP is 0 when the plan covers the task.
+// On error the caller is responsible for cleanup.
 func (s *GalleryService) setupCreatedTask(ctx context.Context, userID string, req *model.ParseRequest, traceID string) (int, error) {
-	quota, err := ResolveParseParams(ctx, s.cfg, req.GalleryID, req.GalleryKey)
+	quota, err := s.ResolveParseParams(ctx, userID, req.GalleryID, req.GalleryKey)
 	if err != nil {
 		return 0, fmt.Errorf("resolve e-hentai params: %w", err)
 	}
 
-	freeTier := quota.IsNew
+	freeTier := quota.FreeTier
 	estimatedGP := quota.GP
 
-	if err := s.balanceSvc.FreezeGP(ctx, userID, traceID, int64(estimatedGP)); err != nil {
-		if errors.Is(err, balance.ErrInsufficientBalance) {
-			return estimatedGP, ErrInsufficientBalance
+	// Nothing is frozen yet, so report 0 to keep the caller from refunding.
+	if req.MaxGP != nil && estimatedGP > *req.MaxGP {
+		return 0, fmt.Errorf("%w (estimated %d, max %d)", ErrPriceExceedsLimit, estimatedGP, *req.MaxGP)
+	}
+
+	p, _, err := s.plans.Current(ctx, userID)
+	if err != nil {
+		return 0, fmt.Errorf("resolve plan: %w", err)
+	}
+	if p.CacheTTL != s.cfg.CacheTTL {
+		if err := s.sched.SetCacheTTL(ctx, traceID, p.CacheTTL); err != nil {
+			return 0, fmt.Errorf("update task metadata: %w", err)
 		}
-		return estimatedGP, fmt.Errorf("freeze balance: %w", err)
 	}
-	log.Printf("[service] froze %d GP for user=%s trace=%s", estimatedGP, userID, traceID)
+
+	// Tasks within the plan's monthly allowance are not billed; the caller
+	// releases the allowance again if setup fails.
+	included, err := s.plans.Cover(ctx, p, userID, traceID, estimatedGP)
+	if err != nil {
+		return 0, fmt.Errorf("plan allowance: %w", err)
+	}
+	frozenGP := 0
+	if included {
+		log.Printf("[service] task trace=%s included in plan %s of user=%s", traceID, p.Name, userID)
+	} else {
+		if err := s.balanceSvc.FreezeGP(ctx, userID, traceID, int64(estimatedGP)); err != nil {
+			if errors.Is(err, balance.ErrInsufficientBalance) {
+				return 0, ErrInsufficientBalance
+			}
+			return 0, fmt.Errorf("freeze balance: %w", err)
+		}
+		frozenGP = estimatedGP
+		log.Printf("[service] froze %d GP for user=%s trace=%s", estimatedGP, userID, traceID)
+	}
 
 	if err := s.sched.UpdateTaskCost(ctx, traceID, freeTier, estimatedGP); err != nil {
-		// Balance already frozen — caller must refund.
-		return estimatedGP, fmt.Errorf("update task metadata: %w", err)
+		// Balance or allowance already taken — caller must refund/release.
+		return frozenGP, fmt.Errorf("update task metadata: %w", err)
 	}
 
-	log.Printf("[service] NEW task trace=%s user=%s gallery=%s key=%s force=%v free=%v estGP=%d",
-		traceID, userID, req.GalleryID, req.GalleryKey, req.Force, freeTier, estimatedGP)
+	log.Printf("[service] NEW task trace=%s user=%s gallery=%s key=%s force=%v free=%v estGP=%d plan=%s included=%v",
+		traceID, userID, req.GalleryID, req.GalleryKey, req.Force, freeTier, estimatedGP, p.Name, included)
 
 	// Async SQL log
 	s.store.LogTaskCreated(traceID, userID, req.GalleryID, req.GalleryKey, req.Force, freeTier, estimatedGP)
@@ -91,16 +139,36 @@ func (s *GalleryService) setupCreatedTask(ctx context.Context, userID string, re
 		QueueLen:    int(queueLen),
 	})
 	if err != nil {
-		return estimatedGP, fmt.Errorf("broadcast announcement: %w", err)
+		return frozenGP, fmt.Errorf("broadcast announcement: %w", err)
 	}
 
-	return estimatedGP, nil
+	return frozenGP, nil
+}
+
+// ReannounceTasks broadcasts reclaimed tasks again so connected nodes
+// can claim them. Used as the lease watchdog's reclaim callback.
+func (s *GalleryService) ReannounceTasks(ctx context.Context, traceIDs []string) {
+	queueLen, _ := s.sched.PendingQueueLen(ctx)
+	for _, traceID := range traceIDs {
+		ann, err := s.sched.TaskAnnouncement(ctx, traceID)
+		if err != nil {
+			log.Printf("[service] reannounce trace=%s: %v", traceID, err)
+			continue
+		}
+		if ann == nil {
+			continue
+		}
+		ann.QueueLen = int(queueLen)
+		if err := s.hub.BroadcastTaskAnnouncement(ctx, ann); err != nil {
+			log.Printf("[service] reannounce trace=%s: %v", traceID, err)
+		}
+	}
 }
 
 // ParseGallery is the main business flow:
 //
 //  1. Publish/collapse atomically (also checks cache in Lua)
-//  2. If created: resolve params + freeze balance + broadcast
+//  2. If created: resolve params + plan allowance or freeze balance + broadcast
 //  3. Block (async→sync) until result arrives or timeout
 //
 // userID is injected by the API key middleware (not from the request body).
@@ -125,11 +193,11 @@ func (s *GalleryService) ParseGallery(ctx context.Context, userID string, req *m
 	resultCh := s.waiter.Register(actualTraceID)
 	defer s.waiter.Unregister(actualTraceID, resultCh)
 
-	estimatedGP := 0
+	frozenGP := 0
 
 	// ── Step 2: Setup created task (or log collapsed) ──
 	if created {
-		estimatedGP, err = s.setupCreatedTask(ctx, userID, req, actualTraceID)
+		frozenGP, err = s.setupCreatedTask(ctx, userID, req, actualTraceID)
 		if err != nil {
 			// Reject pre-flight/setup failures so they do not count as runtime FAILED tasks.
 			if rejectErr := s.sched.RejectTask(ctx, actualTraceID); rejectErr != nil {
@@ -142,11 +210,15 @@ func (s *GalleryService) ParseGallery(ctx context.Context, userID string, req *m
 				Error:   err.Error(),
 			})
 			// Refund if balance was frozen (FreezeGP succeeded but later step failed)
-			if !errors.Is(err, ErrInsufficientBalance) && estimatedGP > 0 {
-				if _, refundErr := s.balanceSvc.RefundTask(ctx, userID, actualTraceID, int64(estimatedGP)); refundErr != nil {
+			if !errors.Is(err, ErrInsufficientBalance) && frozenGP > 0 {
+				if _, refundErr := s.balanceSvc.RefundTask(ctx, userID, actualTraceID, int64(frozenGP)); refundErr != nil {
 					log.Printf("[service] refund balance error for setup failure: %v", refundErr)
 				}
 			}
+			// Give back the plan allowance if the task was included
+			if releaseErr := s.plans.Release(ctx, actualTraceID); releaseErr != nil {
+				log.Printf("[service] release plan allowance error for setup failure: %v", releaseErr)
+			}
 			// All failures: return ParseResponse with error (unified with collapsed path)
 			return &model.ParseResponse{Error: err.Error()}, nil
 		}
@@ -157,47 +229,21 @@ func (s *GalleryService) ParseGallery(ctx context.Context, userID string, req *m
 
 	// ── Step 3: Wait for result (async → sync bridge) ──
 	//
-	// Only created tasks have frozen GP to settle/refund.
-	refund := func(reason string) {
-		if !created || estimatedGP == 0 {
-			return
-		}
-		if _, err := s.balanceSvc.RefundTask(ctx, userID, actualTraceID, int64(estimatedGP)); err != nil {
-			log.Printf("[service] refund balance error %s: %v", reason, err)
-			return
-		}
-		log.Printf("[service] refunded %d GP %s trace=%s", estimatedGP, reason, actualTraceID)
-	}
-
+	// Billing is not done here: the settlement worker settles or refunds
+	// the frozen GP when the task finishes, whether or not this request is
+	// still waiting for it.
 	select {
 	case result := <-resultCh:
 		if result == nil {
-			refund("for nil result")
 			return &model.ParseResponse{Error: "task completed with nil result"}, nil
 		}
-
-		// Async SQL log
-		s.store.LogTaskCompleted(actualTraceID, result.NodeID, result.Success, result.ActualGP)
-
-		if created {
-			if result.Success {
-				if _, err := s.balanceSvc.SettleTask(ctx, userID, actualTraceID, int64(estimatedGP), int64(result.ActualGP)); err != nil {
-					log.Printf("[service] settle balance error: %v", err)
-				} else {
-					log.Printf("[service] settled task trace=%s frozen=%d actual=%d", actualTraceID, estimatedGP, result.ActualGP)
-				}
-			} else {
-				refund("for failed task")
-			}
-		}
-
 		if !result.Success {
 			return &model.ParseResponse{Error: result.Error}, nil
 		}
 
-		gpCost := estimatedGP
-		if !created {
-			gpCost = 0 // collapsed request was not charged
+		gpCost := 0 // collapsed and plan-included requests are not charged
+		if created && frozenGP > 0 {
+			gpCost = int(s.settler.Charge(ctx, userID, int64(frozenGP), result.ActualGP))
 		}
 		return &model.ParseResponse{
 			Cached:     false,
@@ -206,11 +252,9 @@ func (s *GalleryService) ParseGallery(ctx context.Context, userID string, req *m
 		}, nil
 
 	case <-time.After(s.cfg.TaskWaitTimeout):
-		refund("for timeout")
 		return &model.ParseResponse{Error: "timeout waiting for node result"}, nil
 
 	case <-ctx.Done():
-		refund("on cancellation")
 		return nil, ctx.Err()
 	}
 }
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/pricing"
+)
+
+// ─────────────────────────────────────────────
+// Quote cache: per-gallery metadata
+// ─────────────────────────────────────────────
+
+// quoteCache memoises gallery metadata per gallery so that repeated
+// quotes (and the parse that usually follows) do not hit the e-hentai
+// API every time. Prices are computed per user on top of it.
+type quoteCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]quoteEntry
+}
+
+type quoteEntry struct {
+	gallery   *pricing.Gallery
+	expiresAt time.Time
+}
+
+func newQuoteCache(ttl time.Duration) *quoteCache {
+	return &quoteCache{
+		ttl:     ttl,
+		entries: make(map[string]quoteEntry),
+	}
+}
+
+func quoteCacheKey(galleryID, galleryKey string) string {
+	return galleryID + ":" + galleryKey
+}
+
+func (qc *quoteCache) get(galleryID, galleryKey string) (*pricing.Gallery, bool) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	key := quoteCacheKey(galleryID, galleryKey)
+	e, ok := qc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expiresAt) {
+		delete(qc.entries, key)
+		return nil, false
+	}
+	return e.gallery, true
+}
+
+func (qc *quoteCache) set(galleryID, galleryKey string, gallery *pricing.Gallery) {
+	if qc.ttl <= 0 {
+		return
+	}
+
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	now := time.Now()
+	// Opportunistically drop expired entries so the map cannot grow unbounded.
+	if len(qc.entries) >= 1024 {
+		for k, e := range qc.entries {
+			if now.After(e.expiresAt) {
+				delete(qc.entries, k)
+			}
+		}
+	}
+	qc.entries[quoteCacheKey(galleryID, galleryKey)] = quoteEntry{
+		gallery:   gallery,
+		expiresAt: now.Add(qc.ttl),
+	}
+}
+
+// ResolveParseParams prices a gallery for the user. Metadata comes from
+// the quote cache when possible; the price always reflects the current
+// pricing policy for this user.
+func (s *GalleryService) ResolveParseParams(ctx context.Context, userID, galleryID, galleryKey string) (*pricing.Quote, error) {
+	gallery, ok := s.quotes.get(galleryID, galleryKey)
+	if !ok {
+		var err error
+		gallery, err = s.fetchMetadata(ctx, galleryID, galleryKey)
+		if err != nil {
+			return nil, err
+		}
+		s.quotes.set(galleryID, galleryKey, gallery)
+	}
+	return s.pricing.Quote(ctx, userID, gallery)
+}
+
+// ─────────────────────────────────────────────
+// Quote API
+// ─────────────────────────────────────────────
+
+// QuoteGallery estimates the GP cost of parsing a gallery without creating a task.
+// Gallery resolution failures are reported in QuoteResponse.Error.
+func (s *GalleryService) QuoteGallery(ctx context.Context, userID string, ref model.GalleryRef) (*model.QuoteResponse, error) {
+	acc, err := s.balanceSvc.GetAccount(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("get account: %w", err)
+	}
+	return s.quote(ctx, userID, ref, acc.Available()), nil
+}
+
+// QuoteGalleries estimates the GP cost of several galleries concurrently.
+func (s *GalleryService) QuoteGalleries(ctx context.Context, userID string, refs []model.GalleryRef) (*model.BatchQuoteResponse, error) {
+	acc, err := s.balanceSvc.GetAccount(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("get account: %w", err)
+	}
+	available := acc.Available()
+
+	quotes := make([]*model.QuoteResponse, len(refs))
+	var wg sync.WaitGroup
+	for i, ref := range refs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			quotes[i] = s.quote(ctx, userID, ref, available)
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for _, q := range quotes {
+		if q.Error == "" && !q.Cached {
+			total += q.EstimatedGP
+		}
+	}
+
+	return &model.BatchQuoteResponse{
+		Quotes:     quotes,
+		TotalGP:    total,
+		Balance:    available,
+		Affordable: available >= int64(total),
+	}, nil
+}
+
+func (s *GalleryService) quote(ctx context.Context, userID string, ref model.GalleryRef, available int64) *model.QuoteResponse {
+	resp := &model.QuoteResponse{GalleryID: ref.GalleryID}
+
+	cached, err := s.sched.IsCached(ctx, userID, ref.GalleryID)
+	if err != nil {
+		log.Printf("[service] quote cache lookup error user=%s gallery=%s: %v", userID, ref.GalleryID, err)
+	}
+	resp.Cached = cached
+
+	quota, err := s.ResolveParseParams(ctx, userID, ref.GalleryID, ref.GalleryKey)
+	if err != nil {
+		resp.Error = fmt.Sprintf("resolve e-hentai params: %v", err)
+		return resp
+	}
+
+	resp.EstimatedGP = quota.GP
+	resp.FreeTier = quota.FreeTier
+	resp.Affordable = cached || available >= int64(quota.GP)
+	return resp
+}
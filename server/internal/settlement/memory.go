@@ -0,0 +1,76 @@
+package settlement
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
+)
+
+// MemoryQueue is an in-process Queue for single-instance deployments
+// without Redis. It survives HTTP timeouts and cancellations but not a
+// restart (neither do the in-memory scheduler's tasks).
+type MemoryQueue struct {
+	retryDelay time.Duration
+
+	mu      sync.Mutex
+	pending []*model.TaskResult
+	wake    chan struct{}
+}
+
+// NewMemoryQueue creates an empty queue. Failed results are retried after
+// retryDelay.
+func NewMemoryQueue(retryDelay time.Duration) *MemoryQueue {
+	return &MemoryQueue{
+		retryDelay: retryDelay,
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// Publish enqueues a result. It never blocks.
+func (q *MemoryQueue) Publish(_ context.Context, result *model.TaskResult) error {
+	q.mu.Lock()
+	q.pending = append(q.pending, result)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Consume delivers queued results until ctx is cancelled.
+func (q *MemoryQueue) Consume(ctx context.Context, handle func(ctx context.Context, result *model.TaskResult) error) {
+	for {
+		q.mu.Lock()
+		batch := q.pending
+		q.pending = nil
+		q.mu.Unlock()
+
+		var failed []*model.TaskResult
+		for _, result := range batch {
+			if err := handle(ctx, result); err != nil {
+				log.Printf("[settlement] trace=%s failed, will retry: %v", result.TraceID, err)
+				failed = append(failed, result)
+			}
+		}
+
+		var retry <-chan time.Time
+		if len(failed) > 0 {
+			q.mu.Lock()
+			q.pending = append(failed, q.pending...)
+			q.mu.Unlock()
+			retry = time.After(q.retryDelay)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-retry:
+		}
+	}
+}
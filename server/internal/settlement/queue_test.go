@@ -0,0 +1,141 @@
+package settlement
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+var queues = map[string]func(t *testing.T) (publish, consume Queue){
+	"redis": func(t *testing.T) (Queue, Queue) {
+		mr := miniredis.RunT(t)
+		rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { rdb.Close() })
+		// Publish and consume through different instances, as in a cluster.
+		return NewRedisQueue(rdb, "a", 50*time.Millisecond), NewRedisQueue(rdb, "b", 50*time.Millisecond)
+	},
+	"memory": func(t *testing.T) (Queue, Queue) {
+		q := NewMemoryQueue(50 * time.Millisecond)
+		return q, q
+	},
+}
+
+// recorder fails the first failures deliveries of every trace.
+type recorder struct {
+	mu       sync.Mutex
+	failures int
+	attempts map[string]int
+	handled  map[string]int
+}
+
+func (r *recorder) handle(_ context.Context, result *model.TaskResult) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts[result.TraceID]++
+	if r.attempts[result.TraceID] <= r.failures {
+		return errors.New("transient")
+	}
+	r.handled[result.TraceID]++
+	return nil
+}
+
+func (r *recorder) handledCount(traceID string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.handled[traceID]
+}
+
+func TestQueueRedeliversUntilHandled(t *testing.T) {
+	for name, newQueues := range queues {
+		t.Run(name, func(t *testing.T) {
+			pub, sub := newQueues(t)
+			rec := &recorder{failures: 2, attempts: map[string]int{}, handled: map[string]int{}}
+
+			// Published before anyone consumes: must not be lost.
+			ctx := context.Background()
+			for _, id := range []string{"t1", "t2"} {
+				if err := pub.Publish(ctx, &model.TaskResult{TraceID: id, Success: true}); err != nil {
+					t.Fatalf("publish: %v", err)
+				}
+			}
+
+			runCtx, cancel := context.WithCancel(ctx)
+			done := make(chan struct{})
+			go func() { sub.Consume(runCtx, rec.handle); close(done) }()
+			t.Cleanup(func() { cancel(); <-done })
+
+			deadline := time.Now().Add(5 * time.Second)
+			for rec.handledCount("t1") == 0 || rec.handledCount("t2") == 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("results not handled: %+v", rec.attempts)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			// Acknowledged entries are not delivered again.
+			time.Sleep(200 * time.Millisecond)
+			if a, b := rec.handledCount("t1"), rec.handledCount("t2"); a != 1 || b != 1 {
+				t.Fatalf("handled t1=%d t2=%d, want exactly once each", a, b)
+			}
+		})
+	}
+}
+
+func TestRedisQueueTrimKeepsUnsettled(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	ctx := context.Background()
+	q := NewRedisQueue(rdb, "a", time.Minute)
+	if err := q.ensureGroup(ctx); err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	length := func() int64 {
+		t.Helper()
+		n, err := rdb.XLen(ctx, streamKey).Result()
+		if err != nil {
+			t.Fatalf("xlen: %v", err)
+		}
+		return n
+	}
+
+	for i := range 5 {
+		q.Publish(ctx, &model.TaskResult{TraceID: fmt.Sprint("t", i), Success: true})
+	}
+	if err := q.trim(ctx); err != nil || length() != 5 {
+		t.Fatalf("trim before delivery: %v, %d entries left, want 5", err, length())
+	}
+
+	// Deliver three; settle the first and third, the second stays pending.
+	streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: streamGroup, Consumer: "a", Streams: []string{streamKey, ">"}, Count: 3,
+	}).Result()
+	if err != nil || len(streams[0].Messages) != 3 {
+		t.Fatalf("read = %v, %v", streams, err)
+	}
+	msgs := streams[0].Messages
+	rdb.XAck(ctx, streamKey, streamGroup, msgs[0].ID, msgs[2].ID)
+
+	tests := []struct {
+		ack  []string
+		want int64
+	}{
+		{nil, 4},                  // from the pending second entry on
+		{[]string{msgs[1].ID}, 3}, // from the last delivered entry on
+	}
+	for _, tt := range tests {
+		if len(tt.ack) > 0 {
+			rdb.XAck(ctx, streamKey, streamGroup, tt.ack...)
+		}
+		if err := q.trim(ctx); err != nil || length() != tt.want {
+			t.Fatalf("trim: %v, %d entries left, want %d", err, length(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package settlement
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
+	"github.com/redis/go-redis/v9"
+)
+
+// ─────────────────────────────────────────────
+// Redis Stream queue
+//
+// Results are XADDed to stream:settlement and read through the
+// "settlement" consumer group, so each event goes to one instance.
+// Entries are XACKed only after the handler succeeds; anything left
+// pending longer than claimIdle (handler error, or the consumer died) is
+// taken over with XAUTOCLAIM by whichever instance polls next. Settled
+// entries are trimmed periodically (see trim); the stream is never capped
+// by length, which would drop unsettled results.
+// ─────────────────────────────────────────────
+
+const (
+	streamKey   = "stream:settlement"
+	streamGroup = "settlement"
+	streamField = "result"
+
+	readCount    = 16
+	readBlock    = 5 * time.Second
+	trimInterval = time.Minute // how often settled entries are trimmed
+)
+
+// RedisQueue is a durable Queue backed by a Redis Stream.
+type RedisQueue struct {
+	rdb       *redis.Client
+	consumer  string
+	claimIdle time.Duration
+	lastTrim  time.Time // only touched by Consume's goroutine
+}
+
+// NewRedisQueue creates a stream queue. consumer must be unique per
+// instance; claimIdle is how long an unacknowledged entry waits before
+// another consumer retries it.
+func NewRedisQueue(rdb *redis.Client, consumer string, claimIdle time.Duration) *RedisQueue {
+	return &RedisQueue{rdb: rdb, consumer: consumer, claimIdle: claimIdle}
+}
+
+// Publish appends a result to the stream.
+func (q *RedisQueue) Publish(ctx context.Context, result *model.TaskResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("marshal result: %w", err)
+	}
+	err = q.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamKey,
+		Values: map[string]any{streamField: data},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("xadd settlement: %w", err)
+	}
+	return nil
+}
+
+// Consume reads the stream through the consumer group until ctx is cancelled.
+func (q *RedisQueue) Consume(ctx context.Context, handle func(ctx context.Context, result *model.TaskResult) error) {
+	for ctx.Err() == nil {
+		if err := q.ensureGroup(ctx); err != nil {
+			q.backoff(ctx, "create group", err)
+			continue
+		}
+		if err := q.poll(ctx, handle); err != nil {
+			q.backoff(ctx, "poll", err)
+		}
+		if time.Since(q.lastTrim) >= trimInterval {
+			q.lastTrim = time.Now()
+			if err := q.trim(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("[settlement] trim error: %v", err)
+			}
+		}
+	}
+}
+
+// trim drops acknowledged entries: everything below the oldest entry still
+// pending in the group, or, with nothing pending, below the last entry
+// delivered to it. Entries not yet delivered are always kept.
+func (q *RedisQueue) trim(ctx context.Context) error {
+	groups, err := q.rdb.XInfoGroups(ctx, streamKey).Result()
+	if err != nil {
+		return fmt.Errorf("xinfo groups: %w", err)
+	}
+	minID := ""
+	for _, g := range groups {
+		if g.Name == streamGroup {
+			minID = g.LastDeliveredID
+		}
+	}
+	if minID == "" || minID == "0-0" {
+		return nil
+	}
+	pending, err := q.rdb.XPending(ctx, streamKey, streamGroup).Result()
+	if err != nil {
+		return fmt.Errorf("xpending: %w", err)
+	}
+	if pending.Count > 0 {
+		minID = pending.Lower
+	}
+	if err := q.rdb.XTrimMinID(ctx, streamKey, minID).Err(); err != nil {
+		return fmt.Errorf("xtrim: %w", err)
+	}
+	return nil
+}
+
+// ensureGroup creates the consumer group (and stream) if missing. Starting
+// at 0 picks up results published before the first consumer ever ran.
+func (q *RedisQueue) ensureGroup(ctx context.Context) error {
+	err := q.rdb.XGroupCreateMkStream(ctx, streamKey, streamGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// poll retries stale pending entries, then blocks for new ones.
+func (q *RedisQueue) poll(ctx context.Context, handle func(ctx context.Context, result *model.TaskResult) error) error {
+	claimed, _, err := q.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   streamKey,
+		Group:    streamGroup,
+		Consumer: q.consumer,
+		MinIdle:  q.claimIdle,
+		Start:    "0-0",
+		Count:    readCount,
+	}).Result()
+	if err != nil {
+		return fmt.Errorf("xautoclaim: %w", err)
+	}
+	q.process(ctx, claimed, handle)
+
+	streams, err := q.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    streamGroup,
+		Consumer: q.consumer,
+		Streams:  []string{streamKey, ">"},
+		Count:    readCount,
+		Block:    min(readBlock, q.claimIdle),
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("xreadgroup: %w", err)
+	}
+	for _, s := range streams {
+		q.process(ctx, s.Messages, handle)
+	}
+	return nil
+}
+
+func (q *RedisQueue) process(ctx context.Context, msgs []redis.XMessage, handle func(ctx context.Context, result *model.TaskResult) error) {
+	for _, msg := range msgs {
+		raw, _ := msg.Values[streamField].(string)
+		var result model.TaskResult
+		if err := json.Unmarshal([]byte(raw), &result); err != nil {
+			// Poison entry: acknowledge so it does not block the group.
+			log.Printf("[settlement] dropping malformed entry %s: %v", msg.ID, err)
+			q.rdb.XAck(ctx, streamKey, streamGroup, msg.ID)
+			continue
+		}
+		if err := handle(ctx, &result); err != nil {
+			log.Printf("[settlement] entry %s trace=%s failed, will retry: %v", msg.ID, result.TraceID, err)
+			continue
+		}
+		if err := q.rdb.XAck(ctx, streamKey, streamGroup, msg.ID).Err(); err != nil {
+			log.Printf("[settlement] xack %s: %v", msg.ID, err)
+		}
+	}
+}
+
+func (q *RedisQueue) backoff(ctx context.Context, op string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	log.Printf("[settlement] %s error: %v", op, err)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+	}
+}
@@ -0,0 +1,186 @@
+// Package settlement bills finished tasks from durable result events.
+//
+// The WebSocket hub publishes one event per task outcome, right after the
+// scheduler has accepted it (CompleteTask / FailTask). A Settler consumes
+// the events and settles or refunds the GP frozen for the trace. Billing
+// therefore no longer depends on the HTTP request that created the task
+// still waiting: timeouts, client cancellations and server restarts only
+// delay it.
+package settlement
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/node"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/plan"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/pricing"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/store"
+	"github.com/redis/go-redis/v9"
+)
+
+// Queue carries task results from the hub to the settlement worker.
+// Delivery is at-least-once; handlers must be idempotent.
+type Queue interface {
+	// Publish enqueues a finished task's result.
+	Publish(ctx context.Context, result *model.TaskResult) error
+
+	// Consume delivers results to handle until ctx is cancelled. A result
+	// whose handler returns an error is redelivered later.
+	Consume(ctx context.Context, handle func(ctx context.Context, result *model.TaskResult) error)
+}
+
+// NewQueue returns the queue matching the scheduler backend: a Redis
+// Stream when tasks live in Redis, an in-process queue otherwise.
+func NewQueue(cfg *config.Config, rdb *redis.Client, consumer string) Queue {
+	if cfg.SchedulerBackend == "memory" || rdb == nil {
+		return NewMemoryQueue(cfg.SettlementRetryDelay)
+	}
+	return NewRedisQueue(rdb, consumer, cfg.SettlementClaimIdle)
+}
+
+// ─────────────────────────────────────────────
+// Settler
+// ─────────────────────────────────────────────
+
+// Settler applies task results to balances.
+type Settler struct {
+	balance     balance.BalanceService
+	pricing     *pricing.Engine
+	store       *store.Store
+	operators   *node.OperatorService
+	rewardShare float64
+	plans       *plan.Service
+}
+
+// NewSettler creates a settler. rewardShare of each completed task's
+// ActualGP (capped at what the user was charged) goes to the operator of
+// the node that ran it; 0 disables rewards. Failed tasks that were
+// included in the user's plan get their allowance back from plans.
+func NewSettler(balanceSvc balance.BalanceService, pricingEngine *pricing.Engine, st *store.Store, operators *node.OperatorService, rewardShare float64, plans *plan.Service) *Settler {
+	return &Settler{
+		balance:     balanceSvc,
+		pricing:     pricingEngine,
+		store:       st,
+		operators:   operators,
+		rewardShare: rewardShare,
+		plans:       plans,
+	}
+}
+
+// Run consumes q until ctx is cancelled.
+func (s *Settler) Run(ctx context.Context, q Queue) {
+	log.Println("[settlement] worker started")
+	q.Consume(ctx, s.Handle)
+	log.Println("[settlement] worker stopped")
+}
+
+// Handle settles (success) or refunds (failure) the GP frozen for the
+// result's trace. Results for traces without a FREEZE entry (collapsed
+// and plan-included requests never freeze) and results already settled
+// are no-ops apart from returning a failed task's plan allowance, so
+// redelivery is safe.
+func (s *Settler) Handle(ctx context.Context, result *model.TaskResult) error {
+	s.store.LogTaskCompleted(result.TraceID, result.NodeID, result.Success, result.ActualGP)
+
+	freeze, err := s.balance.GetFreeze(ctx, result.TraceID)
+	if err != nil {
+		return fmt.Errorf("load freeze trace=%s: %w", result.TraceID, err)
+	}
+	if freeze == nil {
+		if !result.Success && s.plans != nil {
+			if err := s.plans.Release(ctx, result.TraceID); err != nil {
+				return fmt.Errorf("release plan allowance trace=%s: %w", result.TraceID, err)
+			}
+		}
+		return nil
+	}
+	userID := freeze.UserID
+	frozen := -freeze.Amount
+
+	if !result.Success {
+		_, err = s.balance.RefundTask(ctx, userID, result.TraceID, frozen)
+		if err == nil {
+			log.Printf("[settlement] refunded %d GP for failed task trace=%s user=%s", frozen, result.TraceID, userID)
+		}
+	} else {
+		charge := s.Charge(ctx, userID, frozen, result.ActualGP)
+		reward, err := s.nodeReward(ctx, result, charge)
+		if err != nil {
+			return fmt.Errorf("node reward trace=%s: %w", result.TraceID, err)
+		}
+		_, err = s.balance.SettleTask(ctx, userID, result.TraceID, frozen, charge, reward)
+		if err == nil {
+			log.Printf("[settlement] settled task trace=%s user=%s frozen=%d actual=%d charged=%d mode=%s",
+				result.TraceID, userID, frozen, result.ActualGP, charge, s.pricing.Mode())
+			if reward != nil && reward.UserID != userID {
+				log.Printf("[settlement] rewarded %d GP to operator=%s node=%s trace=%s",
+					reward.Amount, reward.UserID, reward.NodeID, result.TraceID)
+			}
+		}
+	}
+
+	if errors.Is(err, balance.ErrAlreadySettled) {
+		if result.Success {
+			s.checkLateCompletion(ctx, userID, result.TraceID, frozen)
+		}
+		log.Printf("[settlement] trace=%s already settled, skipping", result.TraceID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("settle trace=%s: %w", result.TraceID, err)
+	}
+	return nil
+}
+
+// checkLateCompletion raises an alert when a task completed after its
+// freeze was released without a charge (the watchdog expired it, or
+// reconciliation took it for an orphan): the user got the archive for
+// free. A redelivered completion finds the DEDUCT entry and stays quiet.
+func (s *Settler) checkLateCompletion(ctx context.Context, userID, traceID string, frozen int64) {
+	charged, _, err := s.balance.ListTransactions(ctx, balance.TransactionFilter{
+		UserID:  userID,
+		TraceID: traceID,
+		Types:   []balance.TransactionType{balance.TxDeduct},
+		Limit:   1,
+	})
+	if err != nil {
+		log.Printf("[settlement] check late completion trace=%s: %v", traceID, err)
+		return
+	}
+	if len(charged) == 0 {
+		log.Printf("[settlement] ALERT: trace=%s user=%s completed after its %d GP were released; delivered without charge",
+			traceID, userID, frozen)
+	}
+}
+
+// nodeReward returns the operator's share of a completed task, or nil
+// when rewards are off, nothing was charged or the node has no operator.
+func (s *Settler) nodeReward(ctx context.Context, result *model.TaskResult, charge int64) (*balance.NodeReward, error) {
+	if s.operators == nil || s.rewardShare <= 0 || result.NodeID == "" || result.ActualGP <= 0 || charge <= 0 {
+		return nil, nil
+	}
+	operator, err := s.operators.OwnerOf(ctx, result.NodeID)
+	if err != nil || operator == "" {
+		return nil, err
+	}
+	amount := int64(float64(result.ActualGP) * s.rewardShare)
+	return &balance.NodeReward{UserID: operator, NodeID: result.NodeID, Amount: min(amount, charge)}, nil
+}
+
+// Charge returns the GP to charge for a completed task under the current
+// settlement mode, clamped to [0, frozen]. Pricing errors fall back to the
+// frozen estimate.
+func (s *Settler) Charge(ctx context.Context, userID string, frozen int64, actualGP int) int64 {
+	charge, err := s.pricing.Charge(ctx, userID, frozen, actualGP)
+	if err != nil {
+		log.Printf("[settlement] pricing error user=%s, charging estimate: %v", userID, err)
+		charge = frozen
+	}
+	return max(0, min(charge, frozen))
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	_ "modernc.org/sqlite" // pure-Go SQLite driver, registered as "sqlite"
+)
+
+// ─────────────────────────────────────────────
+// Database driver selection (DB_DRIVER)
+// ─────────────────────────────────────────────
+
+// Dialector builds the GORM dialector for cfg.DBDriver. The returned
+// description is safe to log (no password).
+func Dialector(cfg *config.Config) (gorm.Dialector, string, error) {
+	switch cfg.DBDriver {
+	case "", "postgres":
+		port := portOr(cfg.DBPort, "5432")
+		dsn := cfg.DBDSN
+		if dsn == "" {
+			dsn = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+				cfg.DBHost, port, cfg.DBUser, cfg.DBPassword, cfg.DBName, cfg.DBSSLMode)
+		}
+		return postgres.Open(dsn), fmt.Sprintf("postgres %s@%s:%s/%s", cfg.DBUser, cfg.DBHost, port, cfg.DBName), nil
+
+	case "mysql":
+		port := portOr(cfg.DBPort, "3306")
+		dsn := cfg.DBDSN
+		if dsn == "" {
+			dsn = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=UTC",
+				cfg.DBUser, cfg.DBPassword, cfg.DBHost, port, cfg.DBName)
+		}
+		return mysql.Open(dsn), fmt.Sprintf("mysql %s@%s:%s/%s", cfg.DBUser, cfg.DBHost, port, cfg.DBName), nil
+
+	case "sqlite":
+		dsn := cfg.DBDSN
+		if dsn == "" {
+			if dir := filepath.Dir(cfg.DBPath); dir != "." {
+				if err := os.MkdirAll(dir, 0o755); err != nil {
+					return nil, "", fmt.Errorf("create sqlite directory: %w", err)
+				}
+			}
+			dsn = SQLiteDSN(cfg.DBPath)
+		}
+		return sqlite.New(sqlite.Config{DriverName: "sqlite", DSN: dsn}), "sqlite " + cfg.DBPath, nil
+
+	default:
+		return nil, "", fmt.Errorf("unknown DB_DRIVER %q (expected postgres, mysql or sqlite)", cfg.DBDriver)
+	}
+}
+
+// SQLiteDSN returns the DSN used for a SQLite file. WAL lets readers run
+// alongside the single writer, and immediate transactions take the write
+// lock up front so concurrent writers wait (busy_timeout) instead of
+// failing with SQLITE_BUSY on lock upgrade.
+func SQLiteDSN(path string) string {
+	return "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_txlock=immediate"
+}
+
+func portOr(port, def string) string {
+	if port == "" {
+		return def
+	}
+	return port
+}
@@ -1,12 +1,18 @@
 package store
 
 import (
+	"fmt"
 	"log"
 	"time"
 
 	"github.com/Archive-At-Home/archive-at-home/server/internal/auth"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/checkin"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/node"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/plan"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/ratelimit"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/voucher"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -18,36 +24,72 @@ type Store struct {
 	logCh chan func() // buffered channel for async writes
 }
 
-// NewStore opens the database, auto-migrates schemas, and
+// NewStore opens the PostgreSQL database, auto-migrates schemas, and
 // starts background write workers.
 func NewStore(dsn string) (*Store, error) {
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Warn),
+	return Open(postgres.Open(dsn))
+}
+
+// Open is NewStore for an arbitrary GORM dialector (see Dialector).
+func Open(dialector gorm.Dialector) (*Store, error) {
+	db, err := gorm.Open(dialector, &gorm.Config{
+		Logger:         logger.Default.LogMode(logger.Warn),
+		TranslateError: true, // unique violations surface as gorm.ErrDuplicatedKey
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	// Configure connection pool for PostgreSQL
+	// Configure connection pool
 	sqlDB, err := db.DB()
 	if err != nil {
 		return nil, err
 	}
 
-	// PostgreSQL works well with multiple connections
+	// PostgreSQL and MySQL work well with multiple connections; SQLite
+	// serialises writers itself (see SQLiteDSN)
 	sqlDB.SetMaxOpenConns(25)
 	sqlDB.SetMaxIdleConns(5)
 	sqlDB.SetConnMaxLifetime(time.Hour)
 
+	if err := migrateLedger(db); err != nil {
+		return nil, err
+	}
+	// Checked before AutoMigrate adds the column; see verifyExistingEmails.
+	emailsPredateVerification := db.Migrator().HasTable(&auth.User{}) &&
+		!db.Migrator().HasColumn(&auth.User{}, "email_verified_at")
+
 	// Auto-migrate
 	if err := db.AutoMigrate(
 		&model.TaskLog{},
 		&auth.User{},
+		&auth.APIKey{},
+		&auth.Session{},
+		&auth.EmailToken{},
 		&balance.Account{},
 		&balance.Transaction{},
+		&voucher.Voucher{},
+		&voucher.Redemption{},
+		&node.Owner{},
+		&plan.Subscription{},
+		&plan.Usage{},
+		&plan.IncludedTask{},
+		&checkin.Checkin{},
+		&ratelimit.Override{},
 	); err != nil {
+		if db.Migrator().HasTable(&balance.Transaction{}) && !db.Migrator().HasIndex(&balance.Transaction{}, "idx_tx_trace_type") {
+			return nil, fmt.Errorf("%w (if transactions has duplicate (trace_id, type) rows, remove them and check GET /api/v1/admin/reconcile)", err)
+		}
 		return nil, err
 	}
+	if err := auth.MigrateLegacyAPIKeys(db); err != nil {
+		return nil, fmt.Errorf("hash legacy api keys: %w", err)
+	}
+	if emailsPredateVerification {
+		if err := verifyExistingEmails(db); err != nil {
+			return nil, fmt.Errorf("verify existing emails: %w", err)
+		}
+	}
 
 	s := &Store{
 		db:    db,
@@ -60,6 +102,42 @@ func NewStore(dsn string) (*Store, error) {
 	return s, nil
 }
 
+// migrateLedger upgrades ledgers written by older versions:
+//
+//   - entries without a task used to store an empty trace ID, which would
+//     collide in the (trace_id, type) unique index, so they become NULL
+//   - daily check-in rewards used to be recorded as DEPOSIT entries with
+//     the check-in remark; they become CHECKIN so the totals in
+//     /api/v1/me/balance count them separately
+func migrateLedger(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&balance.Transaction{}) {
+		return nil
+	}
+	err := db.Model(&balance.Transaction{}).
+		Where("trace_id = ?", "").
+		Update("trace_id", nil).Error
+	if err != nil {
+		return fmt.Errorf("migrate ledger trace ids: %w", err)
+	}
+	err = db.Model(&balance.Transaction{}).
+		Where("type = ? AND remark = ?", balance.TxDeposit, "每日签到").
+		Update("type", balance.TxCheckin).Error
+	if err != nil {
+		return fmt.Errorf("migrate check-in entries: %w", err)
+	}
+	return nil
+}
+
+// verifyExistingEmails marks the addresses of accounts registered before
+// email verification existed as verified, as of their registration, so
+// REQUIRE_EMAIL_VERIFIED does not lock them out. It runs once, when the
+// email_verified_at column is added.
+func verifyExistingEmails(db *gorm.DB) error {
+	return db.Model(&auth.User{}).
+		Where("email IS NOT NULL AND email_verified_at IS NULL").
+		UpdateColumn("email_verified_at", gorm.Expr("created_at")).Error
+}
+
 func (s *Store) writeWorker() {
 	for fn := range s.logCh {
 		fn()
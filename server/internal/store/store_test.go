@@ -0,0 +1,68 @@
+package store
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/auth"
+	"gorm.io/driver/sqlite"
+	_ "modernc.org/sqlite"
+)
+
+func TestOpenVerifiesExistingEmails(t *testing.T) {
+	dsn := SQLiteDSN(filepath.Join(t.TempDir(), "test.db"))
+
+	// A users table from before email verification existed.
+	registered := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	raw, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		"CREATE TABLE users (id TEXT PRIMARY KEY, email TEXT, provider TEXT, status TEXT, created_at DATETIME, updated_at DATETIME)",
+		"INSERT INTO users VALUES ('mail', 'old@example.com', 'email', 'active', ?, ?)",
+		"INSERT INTO users VALUES ('tg', NULL, 'telegram', 'active', ?, ?)",
+	} {
+		if _, err := raw.Exec(q, registered, registered); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	raw.Close()
+
+	open := func() *Store {
+		s, err := Open(sqlite.New(sqlite.Config{DriverName: "sqlite", DSN: dsn}))
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		t.Cleanup(func() {
+			if db, err := s.DB().DB(); err == nil {
+				db.Close()
+			}
+		})
+		return s
+	}
+	verifiedAt := func(s *Store, id string) *time.Time {
+		var u auth.User
+		if err := s.DB().Where("id = ?", id).Take(&u).Error; err != nil {
+			t.Fatalf("load %s: %v", id, err)
+		}
+		return u.EmailVerifiedAt
+	}
+
+	s := open()
+	if at := verifiedAt(s, "mail"); at == nil || !at.Equal(registered) {
+		t.Fatalf("existing email verified at %v, want %v", at, registered)
+	}
+	if at := verifiedAt(s, "tg"); at != nil {
+		t.Fatalf("account without email verified at %v", at)
+	}
+
+	// Later starts leave new, unverified accounts alone.
+	s.DB().Exec("INSERT INTO users (id, email, provider, status, created_at, updated_at) VALUES ('new', 'new@example.com', 'email', 'active', ?, ?)",
+		time.Now(), time.Now())
+	if at := verifiedAt(open(), "new"); at != nil {
+		t.Fatalf("account registered after the upgrade verified at %v", at)
+	}
+}
@@ -0,0 +1,300 @@
+package voucher
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ─────────────────────────────────────────────
+// Errors
+// ─────────────────────────────────────────────
+
+var (
+	ErrNotFound      = errors.New("voucher not found")
+	ErrUnavailable   = errors.New("voucher is expired, revoked or fully redeemed")
+	ErrUserLimit     = errors.New("voucher already redeemed by this user")
+	ErrInvalidAmount = errors.New("voucher amount must be positive")
+)
+
+// MaxMintCount caps one mint request.
+const MaxMintCount = 1000
+
+// ─────────────────────────────────────────────
+// service implements Service
+// ─────────────────────────────────────────────
+
+type service struct {
+	db *gorm.DB
+}
+
+// NewService creates a voucher service. Redemptions are credited as
+// VOUCHER entries in the same transaction that records them.
+func NewService(db *gorm.DB) Service {
+	return &service{db: db}
+}
+
+// Mint creates req.Count vouchers under a new batch ID.
+func (s *service) Mint(ctx context.Context, req MintRequest) (*Batch, error) {
+	if req.Amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	if req.Count <= 0 || req.Count > MaxMintCount {
+		return nil, fmt.Errorf("count must be between 1 and %d", MaxMintCount)
+	}
+	if req.MaxRedemptions <= 0 {
+		req.MaxRedemptions = 1
+	}
+	if req.PerUserLimit < 0 {
+		req.PerUserLimit = 0
+	}
+
+	batch := &Batch{ID: "batch-" + uuid.NewString(), Codes: make([]string, 0, req.Count)}
+	now := time.Now()
+	vouchers := make([]Voucher, req.Count)
+	for i := range vouchers {
+		code, err := generateCode()
+		if err != nil {
+			return nil, err
+		}
+		vouchers[i] = Voucher{
+			Code:           code,
+			BatchID:        batch.ID,
+			Amount:         req.Amount,
+			MaxRedemptions: req.MaxRedemptions,
+			PerUserLimit:   req.PerUserLimit,
+			Note:           req.Note,
+			ExpiresAt:      req.ExpiresAt,
+			CreatedAt:      now,
+		}
+		batch.Codes = append(batch.Codes, code)
+	}
+	// About 79 random bits per code: a collision fails the whole batch,
+	// which the admin can simply retry.
+	if err := s.db.WithContext(ctx).CreateInBatches(&vouchers, 200).Error; err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// Redeem claims one redemption and deposits its amount in one transaction.
+//
+// The claim is a conditional UPDATE on the voucher row (still active and
+// below MaxRedemptions) followed by the per-user count, so concurrent
+// redemptions of the same code serialise on that row. Under snapshot
+// isolation (MySQL's REPEATABLE READ) the count can miss a redemption
+// committed meanwhile; the redemption's UserSeq then collides in the
+// unique index and the claim fails with ErrUserLimit.
+func (s *service) Redeem(ctx context.Context, userID, code string) (*Voucher, int64, error) {
+	code = NormalizeCode(code)
+
+	var v Voucher
+	var acc *balance.Account
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("code = ?", code).First(&v).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		now := time.Now()
+		res := tx.Model(&Voucher{}).
+			Where("id = ? AND revoked_at IS NULL AND redeemed < max_redemptions", v.ID).
+			Where("expires_at IS NULL OR expires_at > ?", now).
+			Update("redeemed", gorm.Expr("redeemed + 1"))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrUnavailable
+		}
+
+		redemption := Redemption{VoucherID: v.ID, UserID: userID, Amount: v.Amount, CreatedAt: now}
+		if v.PerUserLimit > 0 {
+			var prior struct {
+				N   int64
+				Seq int
+			}
+			if err := tx.Model(&Redemption{}).
+				Select("COUNT(*) AS n, COALESCE(MAX(user_seq), 0) AS seq").
+				Where("voucher_id = ? AND user_id = ?", v.ID, userID).
+				Scan(&prior).Error; err != nil {
+				return err
+			}
+			if prior.N >= int64(v.PerUserLimit) {
+				return ErrUserLimit
+			}
+			seq := prior.Seq + 1
+			redemption.UserSeq = &seq
+		}
+
+		if err := tx.Create(&redemption).Error; err != nil {
+			// modernc SQLite errors are not translated by the GORM driver.
+			if errors.Is(err, gorm.ErrDuplicatedKey) || strings.Contains(err.Error(), "UNIQUE constraint failed") {
+				return ErrUserLimit
+			}
+			return err
+		}
+
+		var err error
+		acc, err = balance.DepositTx(tx, userID, balance.TxVoucher, v.Amount, "voucher "+v.Code)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	v.Redeemed++
+
+	log.Printf("[voucher] user=%s redeemed %s for %d GP", userID, v.Code, v.Amount)
+	return &v, acc.Available(), nil
+}
+
+// List pages through vouchers by descending ID.
+func (s *service) List(ctx context.Context, f ListFilter) ([]Voucher, uint, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	limit = min(limit, 500)
+
+	now := time.Now()
+	q := s.db.WithContext(ctx).Model(&Voucher{})
+	if f.BatchID != "" {
+		q = q.Where("batch_id = ?", f.BatchID)
+	}
+	switch f.Status {
+	case "":
+	case "revoked":
+		q = q.Where("revoked_at IS NOT NULL")
+	case "expired":
+		q = q.Where("revoked_at IS NULL AND expires_at <= ?", now)
+	case "exhausted":
+		q = q.Where("revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?) AND redeemed >= max_redemptions", now)
+	case "active":
+		q = q.Where("revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?) AND redeemed < max_redemptions", now)
+	default:
+		return nil, 0, fmt.Errorf("unknown status %q", f.Status)
+	}
+	if f.Cursor > 0 {
+		q = q.Where("id < ?", f.Cursor)
+	}
+
+	var vouchers []Voucher
+	if err := q.Order("id DESC").Limit(limit + 1).Find(&vouchers).Error; err != nil {
+		return nil, 0, err
+	}
+	if len(vouchers) <= limit {
+		return vouchers, 0, nil
+	}
+	vouchers = vouchers[:limit]
+	return vouchers, vouchers[limit-1].ID, nil
+}
+
+// Batches aggregates vouchers and redemptions per batch.
+func (s *service) Batches(ctx context.Context) ([]BatchStats, error) {
+	var stats []BatchStats
+	err := s.db.WithContext(ctx).Model(&Voucher{}).
+		Select(`batch_id, MAX(amount) AS amount, MAX(note) AS note,
+			COUNT(*) AS vouchers, SUM(redeemed) AS redeemed,
+			SUM(redeemed * amount) AS redeemed_gp,
+			SUM(CASE WHEN revoked_at IS NULL THEN 0 ELSE 1 END) AS revoked`).
+		Group("batch_id").
+		Order("MIN(id) DESC").
+		Scan(&stats).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var users []struct {
+		BatchID string
+		Users   int
+	}
+	err = s.db.WithContext(ctx).Table("redemptions").
+		Select("vouchers.batch_id, COUNT(DISTINCT redemptions.user_id) AS users").
+		Joins("JOIN vouchers ON vouchers.id = redemptions.voucher_id").
+		Group("vouchers.batch_id").
+		Scan(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	byBatch := make(map[string]int, len(users))
+	for _, u := range users {
+		byBatch[u.BatchID] = u.Users
+	}
+	for i := range stats {
+		stats[i].Users = byBatch[stats[i].BatchID]
+	}
+	return stats, nil
+}
+
+// Revoke marks vouchers revoked. Already redeemed GP is not clawed back.
+func (s *service) Revoke(ctx context.Context, code, batchID string) (int64, error) {
+	q := s.db.WithContext(ctx).Model(&Voucher{}).Where("revoked_at IS NULL")
+	switch {
+	case code != "":
+		q = q.Where("code = ?", NormalizeCode(code))
+	case batchID != "":
+		q = q.Where("batch_id = ?", batchID)
+	default:
+		return 0, errors.New("code or batch_id required")
+	}
+	res := q.Update("revoked_at", time.Now())
+	return res.RowsAffected, res.Error
+}
+
+// ─────────────────────────────────────────────
+// Codes
+// ─────────────────────────────────────────────
+
+// codeAlphabet leaves out 0/O and 1/I/L, which are easy to mistype.
+const codeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// generateCode returns 16 random characters as XXXX-XXXX-XXXX-XXXX.
+// Bytes past the largest multiple of the alphabet size are skipped so
+// every character is equally likely.
+func generateCode() (string, error) {
+	const n = len(codeAlphabet)
+	var b strings.Builder
+	buf := make([]byte, 32)
+	for count := 0; count < 16; {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, c := range buf {
+			if int(c) >= 256/n*n || count == 16 {
+				continue
+			}
+			if count > 0 && count%4 == 0 {
+				b.WriteByte('-')
+			}
+			b.WriteByte(codeAlphabet[int(c)%n])
+			count++
+		}
+	}
+	return b.String(), nil
+}
+
+// NormalizeCode upper-cases a user-typed code and restores the dashes, so
+// "abcd efgh-jkmn pqrs" matches ABCD-EFGH-JKMN-PQRS.
+func NormalizeCode(code string) string {
+	var raw []rune
+	for _, c := range strings.ToUpper(code) {
+		if c == '-' || c == ' ' {
+			continue
+		}
+		raw = append(raw, c)
+	}
+	if len(raw) != 16 {
+		return strings.ToUpper(strings.TrimSpace(code))
+	}
+	return string(raw[0:4]) + "-" + string(raw[4:8]) + "-" + string(raw[8:12]) + "-" + string(raw[12:16])
+}
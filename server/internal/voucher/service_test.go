@@ -0,0 +1,176 @@
+package voucher
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/dbtest"
+	"gorm.io/gorm"
+)
+
+func newTestService(t *testing.T) (*service, *gorm.DB) {
+	t.Helper()
+	db := dbtest.Open(t, &Voucher{}, &Redemption{}, &balance.Account{}, &balance.Transaction{})
+	return NewService(db).(*service), db
+}
+
+func mint(t *testing.T, s Service, req MintRequest) string {
+	t.Helper()
+	batch, err := s.Mint(context.Background(), req)
+	if err != nil || len(batch.Codes) != req.Count {
+		t.Fatalf("mint = %+v, %v", batch, err)
+	}
+	return batch.Codes[0]
+}
+
+func TestRedeemPerUserLimitConcurrent(t *testing.T) {
+	s, _ := newTestService(t)
+	code := mint(t, s, MintRequest{Count: 1, Amount: 10, MaxRedemptions: 100, PerUserLimit: 2})
+
+	const attempts = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, attempts)
+	for range attempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := s.Redeem(context.Background(), "u1", code)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var ok int
+	for err := range errs {
+		switch {
+		case err == nil:
+			ok++
+		case !errors.Is(err, ErrUserLimit):
+			t.Fatalf("redeem error = %v, want ErrUserLimit", err)
+		}
+	}
+	if ok != 2 {
+		t.Fatalf("%d concurrent redemptions succeeded, want the per-user limit of 2", ok)
+	}
+	// Another user still has their own allowance.
+	if _, available, err := s.Redeem(context.Background(), "u2", code); err != nil || available != 10 {
+		t.Fatalf("redeem by other user = %d, %v", available, err)
+	}
+}
+
+func TestRedemptionSeqIsUnique(t *testing.T) {
+	_, db := newTestService(t)
+	seq := 1
+	create := func(seq *int) error {
+		return db.Create(&Redemption{VoucherID: 1, UserID: "u1", UserSeq: seq}).Error
+	}
+
+	if err := create(&seq); err != nil {
+		t.Fatalf("first redemption: %v", err)
+	}
+	// What a redemption counting from a stale snapshot would insert.
+	if err := create(&seq); err == nil {
+		t.Fatal("duplicate UserSeq accepted")
+	}
+	// Vouchers without a per-user limit (and old rows) leave it NULL.
+	for range 2 {
+		if err := create(nil); err != nil {
+			t.Fatalf("redemption without seq: %v", err)
+		}
+	}
+}
+
+func TestRedeemUnavailable(t *testing.T) {
+	s, _ := newTestService(t)
+	ctx := context.Background()
+	code := mint(t, s, MintRequest{Count: 1, Amount: 10, MaxRedemptions: 1})
+
+	if _, _, err := s.Redeem(ctx, "u1", "NOPE-NOPE-NOPE-NOPE"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("redeem unknown code = %v, want ErrNotFound", err)
+	}
+	// Codes are accepted in any case and grouping.
+	v, available, err := s.Redeem(ctx, "u1", strings.ToLower(strings.ReplaceAll(code, "-", " ")))
+	if err != nil || v.Redeemed != 1 || available != 10 {
+		t.Fatalf("redeem = %+v, %d, %v", v, available, err)
+	}
+	if _, _, err := s.Redeem(ctx, "u2", code); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("redeem exhausted = %v, want ErrUnavailable", err)
+	}
+}
+
+func TestRedeemRollsBackWithDeposit(t *testing.T) {
+	s, db := newTestService(t)
+	ctx := context.Background()
+	code := mint(t, s, MintRequest{Count: 1, Amount: 10, MaxRedemptions: 1})
+
+	// The deposit fails after the redemption has been recorded.
+	if err := db.Migrator().DropTable(&balance.Transaction{}); err != nil {
+		t.Fatalf("drop transactions: %v", err)
+	}
+	if _, _, err := s.Redeem(ctx, "u1", code); err == nil {
+		t.Fatal("redeem succeeded without a ledger")
+	}
+	var redemptions int64
+	db.Model(&Redemption{}).Count(&redemptions)
+	var v Voucher
+	db.Where("code = ?", code).Take(&v)
+	if redemptions != 0 || v.Redeemed != 0 {
+		t.Fatalf("after failed deposit: %d redemptions, voucher redeemed %d; want none", redemptions, v.Redeemed)
+	}
+
+	// The code is still good once the ledger is back.
+	if err := db.AutoMigrate(&balance.Transaction{}); err != nil {
+		t.Fatalf("migrate transactions: %v", err)
+	}
+	if _, available, err := s.Redeem(ctx, "u1", code); err != nil || available != 10 {
+		t.Fatalf("redeem = %d, %v", available, err)
+	}
+}
+
+func TestNormalizeCode(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"ABCD-EFGH-JKMN-PQRS", "ABCD-EFGH-JKMN-PQRS"},
+		{"abcd efgh-jkmn pqrs", "ABCD-EFGH-JKMN-PQRS"},
+		{"abcdefghjkmnpqrs", "ABCD-EFGH-JKMN-PQRS"},
+		{" ab-cd-ef-gh-jk-mn-pq-rs ", "ABCD-EFGH-JKMN-PQRS"},
+		// Anything but 16 characters is left for the lookup to reject.
+		{" short-code ", "SHORT-CODE"},
+		{"abcd-efgh-jkmn-pqrst", "ABCD-EFGH-JKMN-PQRST"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeCode(tt.in); got != tt.want {
+			t.Errorf("NormalizeCode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateCode(t *testing.T) {
+	seen := make(map[string]bool)
+	for range 1000 {
+		code, err := generateCode()
+		if err != nil {
+			t.Fatalf("generateCode: %v", err)
+		}
+		if len(code) != 19 || NormalizeCode(code) != code {
+			t.Fatalf("code %q is not XXXX-XXXX-XXXX-XXXX", code)
+		}
+		for i, c := range code {
+			if i%5 == 4 {
+				if c != '-' {
+					t.Fatalf("code %q: %q at %d, want a dash", code, c, i)
+				}
+			} else if !strings.ContainsRune(codeAlphabet, c) {
+				t.Fatalf("code %q: %q is not in the code alphabet", code, c)
+			}
+		}
+		if seen[code] {
+			t.Fatalf("duplicate code %q", code)
+		}
+		seen[code] = true
+	}
+}
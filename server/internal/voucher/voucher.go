@@ -0,0 +1,118 @@
+package voucher
+
+import (
+	"context"
+	"time"
+)
+
+// ─────────────────────────────────────────────
+// Voucher / Gift Code System
+//
+// Admins mint batches of codes worth a fixed amount of GP; users redeem
+// them for a VOUCHER ledger entry.
+// ─────────────────────────────────────────────
+
+// Voucher is one redeemable code.
+type Voucher struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	Code           string     `json:"code" gorm:"size:32;uniqueIndex"` // XXXX-XXXX-XXXX-XXXX
+	BatchID        string     `json:"batch_id" gorm:"size:64;index"`
+	Amount         int64      `json:"amount"`          // GP per redemption
+	MaxRedemptions int        `json:"max_redemptions"` // across all users
+	PerUserLimit   int        `json:"per_user_limit"`  // redemptions per user (0 = no limit)
+	Redeemed       int        `json:"redeemed"`
+	Note           string     `json:"note,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// Status is the voucher's state at now: active, revoked, expired or
+// exhausted.
+func (v *Voucher) Status(now time.Time) string {
+	switch {
+	case v.RevokedAt != nil:
+		return "revoked"
+	case v.ExpiresAt != nil && !now.Before(*v.ExpiresAt):
+		return "expired"
+	case v.Redeemed >= v.MaxRedemptions:
+		return "exhausted"
+	default:
+		return "active"
+	}
+}
+
+// Redemption records one user redeeming a voucher.
+//
+// UserSeq numbers a user's redemptions of a voucher with a per-user limit
+// (nil otherwise, and for redemptions made before it existed). Its unique
+// index rejects two concurrent redemptions that both counted the same
+// earlier ones, whatever the database's isolation level.
+type Redemption struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	VoucherID uint      `json:"voucher_id" gorm:"index:idx_redemption_voucher_user;uniqueIndex:idx_redemption_user_seq"`
+	UserID    string    `json:"user_id" gorm:"size:64;index:idx_redemption_voucher_user;uniqueIndex:idx_redemption_user_seq"`
+	UserSeq   *int      `json:"-" gorm:"uniqueIndex:idx_redemption_user_seq"`
+	Amount    int64     `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MintRequest describes a batch of identical vouchers.
+type MintRequest struct {
+	Count          int
+	Amount         int64
+	MaxRedemptions int
+	PerUserLimit   int
+	ExpiresAt      *time.Time
+	Note           string
+}
+
+// Batch is the result of a mint.
+type Batch struct {
+	ID    string   `json:"batch_id"`
+	Codes []string `json:"codes"`
+}
+
+// ListFilter selects vouchers for the admin listing.
+type ListFilter struct {
+	BatchID string
+	Status  string // active | revoked | expired | exhausted, empty for all
+	Cursor  uint   // only vouchers with ID below this
+	Limit   int
+}
+
+// BatchStats summarises a batch.
+type BatchStats struct {
+	BatchID    string `json:"batch_id"`
+	Amount     int64  `json:"amount"` // GP per redemption
+	Note       string `json:"note,omitempty"`
+	Vouchers   int    `json:"vouchers"`
+	Redeemed   int    `json:"redeemed"`    // redemptions across the batch
+	RedeemedGP int64  `json:"redeemed_gp"` // GP handed out
+	Users      int    `json:"users"`       // distinct redeeming users
+	Revoked    int    `json:"revoked"`
+}
+
+// ─────────────────────────────────────────────
+// Service
+// ─────────────────────────────────────────────
+
+type Service interface {
+	// Mint creates a batch of vouchers with random codes.
+	Mint(ctx context.Context, req MintRequest) (*Batch, error)
+
+	// Redeem credits the voucher's amount to the user. Returns the
+	// voucher as redeemed and the user's available balance afterwards.
+	Redeem(ctx context.Context, userID, code string) (*Voucher, int64, error)
+
+	// List returns vouchers matching filter, newest first, and the cursor
+	// for the next page (0 when there is none).
+	List(ctx context.Context, filter ListFilter) ([]Voucher, uint, error)
+
+	// Batches returns redemption statistics per batch, newest first.
+	Batches(ctx context.Context) ([]BatchStats, error)
+
+	// Revoke disables a single code, or every code in a batch when code is
+	// empty. Returns how many vouchers were revoked.
+	Revoke(ctx context.Context, code, batchID string) (int64, error)
+}
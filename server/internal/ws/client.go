@@ -116,6 +116,14 @@ func (c *Client) handleMessage(ctx context.Context, raw []byte) {
 		res.NodeID = c.NodeID
 		c.hub.HandleTaskResult(ctx, c, &res)
 
+	case model.MsgTypeMetadataResponse:
+		var res model.MetadataResponse
+		if err := json.Unmarshal(env.Payload, &res); err != nil {
+			log.Printf("[ws] node %s: bad METADATA_RESPONSE payload: %v", c.NodeID, err)
+			return
+		}
+		c.hub.HandleMetadataResponse(c, &res)
+
 	default:
 		log.Printf("[ws] node %s: unknown message type: %s", c.NodeID, env.Type)
 	}
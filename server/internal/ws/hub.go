@@ -5,10 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"sync"
 
+	"github.com/Archive-At-Home/archive-at-home/server/internal/cluster"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/model"
 	"github.com/Archive-At-Home/archive-at-home/server/internal/scheduler"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/settlement"
+	"github.com/google/uuid"
 )
 
 // ─────────────────────────────────────────────
@@ -57,6 +61,19 @@ func (rw *ResultWaiter) Unregister(traceID string, ch <-chan *model.TaskResult)
 	}
 }
 
+// Waiting returns the number of requests waiting for a result, across
+// all traces.
+func (rw *ResultWaiter) Waiting() int {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	n := 0
+	for _, chs := range rw.waiters {
+		n += len(chs)
+	}
+	return n
+}
+
 // Notify delivers a result to all waiters for the given traceID.
 func (rw *ResultWaiter) Notify(traceID string, result *model.TaskResult) {
 	rw.mu.Lock()
@@ -78,22 +95,57 @@ func (rw *ResultWaiter) Notify(traceID string, result *model.TaskResult) {
 
 // Hub maintains the set of active WebSocket clients and
 // broadcasts task announcements to all of them.
+//
+// With a cluster attached (EnableCluster), announcements and results are
+// also fanned out to the other server instances and node registration is
+// checked cluster-wide.
 type Hub struct {
 	mu      sync.RWMutex
 	clients map[string]*Client // nodeID → Client
-	sched   *scheduler.Scheduler
+	sched   scheduler.TaskScheduler
 	waiter  *ResultWaiter
+	results settlement.Queue // finished tasks, consumed by the settlement worker
+	cluster *cluster.Cluster // nil in single-instance mode
+
+	// In-flight METADATA_REQUESTs: requestID → waiter
+	metaMu      sync.Mutex
+	metaPending map[string]*metadataWaiter
 }
 
-// NewHub creates a new Hub.
-func NewHub(sched *scheduler.Scheduler, waiter *ResultWaiter) *Hub {
+type metadataWaiter struct {
+	nodeID string
+	ch     chan *model.MetadataResponse
+}
+
+// NewHub creates a new Hub. Every result the scheduler accepts is
+// published to results for billing.
+func NewHub(sched scheduler.TaskScheduler, waiter *ResultWaiter, results settlement.Queue) *Hub {
 	return &Hub{
-		clients: make(map[string]*Client),
-		sched:   sched,
-		waiter:  waiter,
+		clients:     make(map[string]*Client),
+		sched:       sched,
+		waiter:      waiter,
+		results:     results,
+		metaPending: make(map[string]*metadataWaiter),
 	}
 }
 
+// EnableCluster attaches the hub to a cluster: messages published by other
+// instances are delivered to local nodes and waiters. Call before the
+// cluster is started and before any node connects.
+func (h *Hub) EnableCluster(c *cluster.Cluster) {
+	h.cluster = c
+	c.SetHandlers(cluster.Handlers{
+		Announcement: func(ann *model.TaskAnnouncement) {
+			if _, err := h.broadcastLocal(ann); err != nil {
+				log.Printf("[hub] relay announcement trace=%s: %v", ann.TraceID, err)
+			}
+		},
+		Result: func(result *model.TaskResult) {
+			h.waiter.Notify(result.TraceID, result)
+		},
+	})
+}
+
 // Register adds a client to the hub. Returns an error if the node is already connected.
 func (h *Hub) Register(c *Client) error {
 	h.mu.Lock()
@@ -102,6 +154,11 @@ func (h *Hub) Register(c *Client) error {
 	if _, ok := h.clients[c.NodeID]; ok {
 		return fmt.Errorf("node %s already connected", c.NodeID)
 	}
+	if h.cluster != nil {
+		if err := h.cluster.RegisterNode(context.Background(), c.NodeID); err != nil {
+			return err
+		}
+	}
 	h.clients[c.NodeID] = c
 	log.Printf("[hub] node %s connected (total: %d)", c.NodeID, len(h.clients))
 	return nil
@@ -112,18 +169,35 @@ func (h *Hub) Unregister(c *Client) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	delete(h.clients, c.NodeID)
+	if h.cluster != nil {
+		if err := h.cluster.UnregisterNode(context.Background(), c.NodeID); err != nil {
+			log.Printf("[hub] %v", err)
+		}
+	}
 	log.Printf("[hub] node %s disconnected (total: %d)", c.NodeID, len(h.clients))
 }
 
-// NodeCount returns the number of connected nodes.
+// NodeCount returns the number of connected nodes (cluster-wide when
+// clustered).
 func (h *Hub) NodeCount() int {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	return len(h.clients)
+	return len(h.NodeIDs())
 }
 
-// NodeIDs returns the IDs of all currently connected nodes.
+// NodeIDs returns the IDs of all currently connected nodes (cluster-wide
+// when clustered).
 func (h *Hub) NodeIDs() []string {
+	if h.cluster != nil {
+		nodes, err := h.cluster.Nodes(context.Background())
+		if err == nil {
+			ids := make([]string, 0, len(nodes))
+			for id := range nodes {
+				ids = append(ids, id)
+			}
+			return ids
+		}
+		log.Printf("[hub] cluster node list: %v; reporting local nodes only", err)
+	}
+
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 	ids := make([]string, 0, len(h.clients))
@@ -134,7 +208,37 @@ func (h *Hub) NodeIDs() []string {
 }
 
 // BroadcastTaskAnnouncement sends a task announcement to all connected nodes.
+// When clustered it is also relayed to the other instances, and only fails
+// if no node is connected anywhere in the cluster.
 func (h *Hub) BroadcastTaskAnnouncement(ctx context.Context, ann *model.TaskAnnouncement) error {
+	sent, err := h.broadcastLocal(ann)
+	if err != nil {
+		return err
+	}
+	if h.cluster == nil {
+		if sent == 0 {
+			return fmt.Errorf("no nodes available")
+		}
+		return nil
+	}
+
+	if err := h.cluster.PublishAnnouncement(ctx, ann); err != nil {
+		log.Printf("[hub] %v", err)
+		if sent == 0 {
+			return fmt.Errorf("no nodes available")
+		}
+		return nil
+	}
+	if sent == 0 && h.NodeCount() == 0 {
+		log.Printf("[hub] no nodes in cluster for announcement trace=%s", ann.TraceID)
+		return fmt.Errorf("no nodes available")
+	}
+	return nil
+}
+
+// broadcastLocal sends an announcement to the nodes connected to this
+// instance and returns how many received it.
+func (h *Hub) broadcastLocal(ann *model.TaskAnnouncement) (int, error) {
 	env := model.Envelope{
 		Type:    model.MsgTypeTaskAnnouncement,
 		Payload: ann,
@@ -142,7 +246,7 @@ func (h *Hub) BroadcastTaskAnnouncement(ctx context.Context, ann *model.TaskAnno
 	data, err := json.Marshal(env)
 	if err != nil {
 		log.Printf("[hub] marshal announcement error: %v", err)
-		return fmt.Errorf("marshal announcement: %w", err)
+		return 0, fmt.Errorf("marshal announcement: %w", err)
 	}
 
 	h.mu.RLock()
@@ -159,11 +263,11 @@ func (h *Hub) BroadcastTaskAnnouncement(ctx context.Context, ann *model.TaskAnno
 	}
 
 	if sent == 0 {
-		log.Printf("[hub] no nodes received announcement trace=%s (online=%d)", ann.TraceID, len(h.clients))
-		return fmt.Errorf("no nodes available")
+		log.Printf("[hub] no local nodes received announcement trace=%s (online=%d)", ann.TraceID, len(h.clients))
+		return 0, nil
 	}
 	log.Printf("[hub] broadcast TASK_ANNOUNCEMENT trace=%s to %d/%d nodes", ann.TraceID, sent, len(h.clients))
-	return nil
+	return sent, nil
 }
 
 // HandleFetchTask processes a FETCH_TASK request from a worker node.
@@ -204,6 +308,7 @@ func (h *Hub) HandleFetchTask(ctx context.Context, c *Client, req *model.FetchTa
 func (h *Hub) HandleTaskResult(ctx context.Context, c *Client, result *model.TaskResult) {
 	log.Printf("[hub] received result for trace=%s from node=%s success=%v",
 		result.TraceID, c.NodeID, result.Success)
+	result.NodeID = c.NodeID // authenticated identity, not the payload's claim
 
 	if result.Success && result.ArchiveURL == "" {
 		result.Success = false
@@ -212,6 +317,10 @@ func (h *Hub) HandleTaskResult(ctx context.Context, c *Client, result *model.Tas
 		}
 	}
 
+	// accepted: the scheduler finalized the task with this outcome. Stale
+	// results (task reclaimed and reassigned, already finished) are not
+	// billed; the current owner's result will be.
+	accepted := true
 	if result.Success {
 		if err := h.sched.CompleteTask(ctx, result.TraceID, c.NodeID, result.ArchiveURL); err != nil {
 			log.Printf("[hub] complete task error: %v", err)
@@ -221,14 +330,125 @@ func (h *Hub) HandleTaskResult(ctx context.Context, c *Client, result *model.Tas
 			}
 			if failErr := h.sched.FailTask(ctx, result.TraceID, c.NodeID); failErr != nil {
 				log.Printf("[hub] fail task after complete error: %v", failErr)
+				accepted = false
 			}
 		}
 	} else {
 		if err := h.sched.FailTask(ctx, result.TraceID, c.NodeID); err != nil {
 			log.Printf("[hub] fail task error: %v", err)
+			accepted = false
 		}
 	}
 
-	// Notify HTTP waiters regardless of success
+	if accepted {
+		h.publishResult(ctx, result)
+	}
+	h.notifyResult(ctx, result)
+}
+
+// ExpireTasks fails tasks the scheduler dropped because their lease and
+// task hash expired without a result (the node died or went silent). No
+// node will ever report them, so the failure is published for settlement
+// here: otherwise the GP frozen for them would stay frozen.
+func (h *Hub) ExpireTasks(ctx context.Context, traceIDs []string) {
+	for _, traceID := range traceIDs {
+		log.Printf("[hub] task trace=%s expired without a result", traceID)
+		result := &model.TaskResult{TraceID: traceID, Success: false, Error: "task expired"}
+		h.publishResult(ctx, result)
+		h.notifyResult(ctx, result)
+	}
+}
+
+func (h *Hub) publishResult(ctx context.Context, result *model.TaskResult) {
+	if err := h.results.Publish(ctx, result); err != nil {
+		log.Printf("[hub] CRITICAL: publish result for settlement trace=%s: %v", result.TraceID, err)
+	}
+}
+
+// notifyResult wakes HTTP waiters regardless of success; when clustered
+// the waiter may live on another instance.
+func (h *Hub) notifyResult(ctx context.Context, result *model.TaskResult) {
 	h.waiter.Notify(result.TraceID, result)
+	if h.cluster != nil {
+		if err := h.cluster.PublishResult(ctx, result); err != nil {
+			log.Printf("[hub] %v", err)
+		}
+	}
+}
+
+// ─────────────────────────────────────────────
+// Metadata lookups through the node pool
+// ─────────────────────────────────────────────
+
+// RequestMetadata asks a randomly chosen connected node to resolve
+// gallery metadata and blocks until it replies or ctx is done.
+// A reply carrying Error (not GalleryError) is returned as an error.
+func (h *Hub) RequestMetadata(ctx context.Context, galleryID, galleryKey string) (*model.MetadataResponse, error) {
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for _, c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.RUnlock()
+
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("no nodes available")
+	}
+	c := clients[rand.IntN(len(clients))]
+
+	req := &model.MetadataRequest{
+		RequestID:  uuid.NewString(),
+		GalleryID:  galleryID,
+		GalleryKey: galleryKey,
+	}
+	data, err := json.Marshal(model.Envelope{
+		Type:    model.MsgTypeMetadataRequest,
+		Payload: req,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal metadata request: %w", err)
+	}
+
+	w := &metadataWaiter{nodeID: c.NodeID, ch: make(chan *model.MetadataResponse, 1)}
+	h.metaMu.Lock()
+	h.metaPending[req.RequestID] = w
+	h.metaMu.Unlock()
+	defer func() {
+		h.metaMu.Lock()
+		delete(h.metaPending, req.RequestID)
+		h.metaMu.Unlock()
+	}()
+
+	select {
+	case c.send <- data:
+	default:
+		return nil, fmt.Errorf("send buffer full for node %s", c.NodeID)
+	}
+
+	select {
+	case res := <-w.ch:
+		if res.Error != "" {
+			return nil, fmt.Errorf("node %s: %s", c.NodeID, res.Error)
+		}
+		return res, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("node %s: %w", c.NodeID, ctx.Err())
+	}
+}
+
+// HandleMetadataResponse delivers a METADATA_RESPONSE to its waiter.
+// Replies from a node other than the one asked are ignored.
+func (h *Hub) HandleMetadataResponse(c *Client, res *model.MetadataResponse) {
+	h.metaMu.Lock()
+	w, ok := h.metaPending[res.RequestID]
+	h.metaMu.Unlock()
+
+	if !ok || w.nodeID != c.NodeID {
+		log.Printf("[hub] unexpected metadata response request=%s from node=%s", res.RequestID, c.NodeID)
+		return
+	}
+	select {
+	case w.ch <- res:
+	default:
+	}
 }
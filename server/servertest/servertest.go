@@ -0,0 +1,364 @@
+// Package servertest boots the complete server stack in-process for
+// integration tests: Gin router, WebSocket hub, scheduler (against
+// miniredis) and GORM store (against a throwaway SQLite file). Outgoing
+// mail is recorded rather than sent (see Server.Mails).
+//
+// Configuration uses the same environment variables as production; pass
+// overrides in Options.Env. They are applied with t.Setenv, so tests using
+// this package cannot call t.Parallel.
+package servertest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Archive-At-Home/archive-at-home/server/internal/app"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/balance"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/config"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/mail"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/service"
+	"github.com/Archive-At-Home/archive-at-home/server/internal/store"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// AdminToken is the admin bearer token configured for every test server.
+const AdminToken = "servertest-admin"
+
+// Options customises a test server.
+type Options struct {
+	// Env overrides configuration variables (e.g. "SETTLEMENT_MODE").
+	// EH_API_URL should point at a fake upstream.
+	Env map[string]string
+
+	// Join starts another replica of an existing server: same Redis,
+	// database and node signing key. Set CLUSTER_MODE=true on both for the
+	// replicas to share nodes and results.
+	Join *Server
+}
+
+// Server is a running in-process server.
+type Server struct {
+	URL   string // HTTP base URL
+	WSURL string // node WebSocket endpoint
+
+	Redis *miniredis.Miniredis
+
+	app    *app.App
+	signer ed25519.PrivateKey
+	dbPath string
+	outbox *outbox
+}
+
+var userSeq atomic.Int64
+
+// Start boots a server and registers cleanup on t.
+func Start(t testing.TB, opts Options) *Server {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate node key: %v", err)
+	}
+	if opts.Join != nil {
+		priv = opts.Join.signer
+		pub = priv.Public().(ed25519.PublicKey)
+	}
+
+	env := map[string]string{
+		"NODE_VERIFY_KEY":     base64.StdEncoding.EncodeToString(pub),
+		"ADMIN_TOKEN":         AdminToken,
+		"TASK_WAIT_TIMEOUT":   "10s",
+		"EH_API_MAX_RETRIES":  "0",
+		"EH_API_BATCH_WINDOW": "0",
+		"EH_API_RATE":         "0",
+	}
+	for k, v := range opts.Env {
+		env[k] = v
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg := config.Load()
+
+	var mr *miniredis.Miniredis
+	dbPath := filepath.Join(t.TempDir(), "server.db")
+	if opts.Join != nil {
+		mr, dbPath = opts.Join.Redis, opts.Join.dbPath
+	} else {
+		mr = miniredis.RunT(t)
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	cfg.DBDriver = "sqlite"
+	cfg.DBPath = dbPath
+	dialector, _, err := store.Dialector(cfg)
+	if err != nil {
+		t.Fatalf("store dialector: %v", err)
+	}
+	st, err := store.Open(dialector)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+
+	box := &outbox{}
+	if opts.Join != nil {
+		box = opts.Join.outbox
+	}
+
+	gin.SetMode(gin.TestMode)
+	a, err := app.New(cfg, rdb, st, service.NewEHAPIClient(cfg), box)
+	if err != nil {
+		t.Fatalf("init app: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := a.StartWorkers(ctx); err != nil {
+		t.Fatalf("start workers: %v", err)
+	}
+
+	hs := httptest.NewServer(a.Router)
+	t.Cleanup(hs.Close)
+
+	return &Server{
+		URL:    hs.URL,
+		WSURL:  "ws" + strings.TrimPrefix(hs.URL, "http") + "/ws",
+		Redis:  mr,
+		app:    a,
+		signer: priv,
+		dbPath: dbPath,
+		outbox: box,
+	}
+}
+
+// SignNode returns the signature a node must present for nodeID.
+func (s *Server) SignNode(nodeID string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(s.signer, []byte(nodeID)))
+}
+
+// NodeCount returns the number of nodes connected to the hub (across all
+// replicas in cluster mode).
+func (s *Server) NodeCount() int {
+	return s.app.Hub.NodeCount()
+}
+
+// Waiting returns the number of parse requests on this server waiting for
+// a task result, whether they created the task or collapsed into it.
+func (s *Server) Waiting() int {
+	return s.app.Waiter.Waiting()
+}
+
+// WaitForNodes blocks until n nodes are connected to the hub.
+func (s *Server) WaitForNodes(t testing.TB, n int) {
+	t.Helper()
+	Eventually(t, 5*time.Second, func() bool { return s.app.Hub.NodeCount() >= n },
+		"waiting for %d connected nodes", n)
+}
+
+// ─────────────────────────────────────────────
+// Users & balance
+// ─────────────────────────────────────────────
+
+// User is a registered test user.
+type User struct {
+	ID     string
+	APIKey string
+}
+
+// Admin authenticates Do calls with the admin token.
+var Admin = &User{APIKey: AdminToken}
+
+// CreateUser registers a user and deposits initial GP.
+func (s *Server) CreateUser(t testing.TB, initial int64) *User {
+	t.Helper()
+	ctx := context.Background()
+
+	n := userSeq.Add(1)
+	u, err := s.app.Users.Register(ctx, fmt.Sprintf("user%d@example.com", n), "password", fmt.Sprintf("user%d", n))
+	if err != nil {
+		t.Fatalf("register user: %v", err)
+	}
+	if initial > 0 {
+		if _, err := s.app.Balance.Deposit(ctx, u.ID, balance.TxDeposit, initial, "servertest"); err != nil {
+			t.Fatalf("deposit: %v", err)
+		}
+	}
+	return &User{ID: u.ID, APIKey: u.APIKey}
+}
+
+// Balance returns the user's balance and frozen GP.
+func (s *Server) Balance(t testing.TB, userID string) (balance, frozen int64) {
+	t.Helper()
+	acc, err := s.app.Balance.GetAccount(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("get account: %v", err)
+	}
+	return acc.Balance, acc.Frozen
+}
+
+// Exec runs a SQL statement against the server's database, for fixtures
+// the API cannot create (such as records dated in the past).
+func (s *Server) Exec(t testing.TB, query string, args ...any) {
+	t.Helper()
+	if err := s.app.Store.DB().Exec(query, args...).Error; err != nil {
+		t.Fatalf("exec %q: %v", query, err)
+	}
+}
+
+// ─────────────────────────────────────────────
+// HTTP helpers
+// ─────────────────────────────────────────────
+
+// ParseResult is the JSON body of POST /api/v1/parse.
+type ParseResult struct {
+	Cached     bool   `json:"cached"`
+	GPCost     int    `json:"gp_cost"`
+	ArchiveURL string `json:"archive_url"`
+	Error      string `json:"error"`
+}
+
+// Parse calls POST /api/v1/parse as the user.
+func (s *Server) Parse(t testing.TB, u *User, galleryID, galleryKey string) *ParseResult {
+	t.Helper()
+	var res ParseResult
+	s.Do(t, u, http.MethodPost, "/api/v1/parse", map[string]any{
+		"gallery_id":  galleryID,
+		"gallery_key": galleryKey,
+	}, &res)
+	return &res
+}
+
+// Do sends a JSON request authenticated as u (nil for anonymous) and
+// decodes the response into out (may be nil). It returns the status code.
+func (s *Server) Do(t testing.TB, u *User, method, path string, body, out any) int {
+	t.Helper()
+	return s.DoHeader(t, u, method, path, nil, body, out).StatusCode
+}
+
+// DoHeader is Do with extra request headers. It returns the response, whose
+// body has already been consumed.
+func (s *Server) DoHeader(t testing.TB, u *User, method, path string, header http.Header, body, out any) *http.Response {
+	t.Helper()
+
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("marshal body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if u != nil {
+		req.Header.Set("Authorization", "Bearer "+u.APIKey)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("decode %s %s (status %d): %v", method, path, resp.StatusCode, err)
+		}
+	}
+	return resp
+}
+
+// ─────────────────────────────────────────────
+// Mail
+// ─────────────────────────────────────────────
+
+// Mail is a message sent by the server.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// outbox records mail instead of delivering it. Replicas share the outbox
+// of the server they joined.
+type outbox struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+func (o *outbox) Send(_ context.Context, msg mail.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sent = append(o.sent, Mail{To: msg.To, Subject: msg.Subject, Body: msg.Body})
+	return nil
+}
+
+// Mails returns the messages sent to the address, oldest first.
+func (s *Server) Mails(to string) []Mail {
+	s.outbox.mu.Lock()
+	defer s.outbox.mu.Unlock()
+	var mails []Mail
+	for _, m := range s.outbox.sent {
+		if m.To == to {
+			mails = append(mails, m)
+		}
+	}
+	return mails
+}
+
+// ─────────────────────────────────────────────
+// Time & lease control
+// ─────────────────────────────────────────────
+
+// FastForward advances miniredis time, expiring keys and shrinking TTLs.
+func (s *Server) FastForward(d time.Duration) {
+	s.Redis.FastForward(d)
+}
+
+// ReclaimExpiredTasks runs one lease watchdog pass and returns the
+// reclaimed trace IDs (which are re-announced to connected nodes).
+func (s *Server) ReclaimExpiredTasks() []string {
+	return s.app.ReclaimExpiredTasks(context.Background())
+}
+
+// LeaseTTL returns the configured task lease.
+func (s *Server) LeaseTTL() time.Duration {
+	return s.app.Config.TaskLeaseTTL
+}
+
+// Eventually polls cond every 20ms until it holds or timeout elapses.
+func Eventually(t testing.TB, timeout time.Duration, cond func() bool, format string, args ...any) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out: "+format, args...)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}